@@ -2,7 +2,6 @@ package authorize_script
 
 import (
 	"bytes"
-	"fmt"
 	"io"
 
 	"github.com/tokenized/bitcoin_interpreter"
@@ -10,7 +9,6 @@ import (
 	"github.com/tokenized/channels"
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
 	"github.com/tokenized/pkg/bitcoin"
-	"github.com/tokenized/pkg/bsor"
 
 	"github.com/pkg/errors"
 )
@@ -31,6 +29,8 @@ const (
 var (
 	ProtocolID = envelope.ProtocolID("A") // Protocol ID for signed messages
 
+	codec = channels.NewCodec(ProtocolID, AuthorizeScriptVersion, "authorize", &Authorize{})
+
 	ErrPayloadMissing = errors.New("Payload Missing")
 )
 
@@ -88,6 +88,19 @@ func NewAuthorizeP2PK(key bitcoin.Key) (*Authorize, error) {
 	}, nil
 }
 
+// NewAuthorizeP2PKWithSigner creates an authorize script using the standard OP_CHECKSIG script for
+// a single key that is held by the signer.
+func NewAuthorizeP2PKWithSigner(signer channels.Signer,
+	publicKey bitcoin.PublicKey) (*Authorize, error) {
+
+	return &Authorize{
+		LockingScript: p2pk.CreateScript(publicKey, false),
+		unlocker:      NewSignerUnlocker(signer, publicKey),
+	}, nil
+}
+
+func (*Authorize) IsSignatureType() {}
+
 func (*Authorize) ProtocolID() envelope.ProtocolID {
 	return ProtocolID
 }
@@ -99,20 +112,7 @@ func (m *Authorize) Wrap(payload envelope.Data) (envelope.Data, error) {
 		}
 	}
 
-	// Version
-	scriptItems := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(AuthorizeScriptVersion))}
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return payload, errors.Wrap(err, "marshal")
-	}
-	scriptItems = append(scriptItems, msgScriptItems...)
-
-	payload.ProtocolIDs = append(envelope.ProtocolIDs{ProtocolID}, payload.ProtocolIDs...)
-	payload.Payload = append(scriptItems, payload.Payload...)
-
-	return payload, nil
+	return codec.Wrap(m, payload)
 }
 
 func (m *Authorize) authorize(payload envelope.Data) error {
@@ -172,6 +172,15 @@ func AuthorizeP2PK(payload envelope.Data, key bitcoin.Key) (*Authorize, error) {
 	return result, nil
 }
 
+// AuthorizeP2PKWithSigner adds the AuthorizeMessage protocol to the provided bitcoin script with
+// the standard OP_CHECKSIG script for a single key that is held by the signer.
+func AuthorizeP2PKWithSigner(payload envelope.Data, signer channels.Signer,
+	publicKey bitcoin.PublicKey) (*Authorize, error) {
+
+	return AuthorizePayload(payload, p2pk.CreateScript(publicKey, false),
+		NewSignerUnlocker(signer, publicKey))
+}
+
 func WrapAuthorize(payload envelope.Data, lockingScript bitcoin.Script,
 	unlocker bitcoin_interpreter.Unlocker) (envelope.Data, error) {
 
@@ -194,33 +203,26 @@ func WrapAuthorizeP2PK(payload envelope.Data, key bitcoin.Key) (envelope.Data, e
 	return wrapper.Wrap(payload)
 }
 
-// ParseAuthorize parses the signature and public key (if provided).
-func ParseAuthorize(payload envelope.Data) (*Authorize, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 || !bytes.Equal(payload.ProtocolIDs[0], ProtocolID) {
-		return nil, payload, nil
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
+// WrapAuthorizeP2PKWithSigner authorizes the payload with the signer and wraps the payload with the
+// authorization and returns the new payload containing the authorization.
+func WrapAuthorizeP2PKWithSigner(payload envelope.Data, signer channels.Signer,
+	publicKey bitcoin.PublicKey) (envelope.Data, error) {
 
-	if len(payload.Payload) < 2 {
-		return nil, payload, errors.Wrapf(channels.ErrInvalidMessage,
-			"not enough signature push ops: %d", len(payload.Payload))
-	}
-
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
+	wrapper, err := AuthorizeP2PKWithSigner(payload, signer, publicKey)
 	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(channels.ErrUnsupportedVersion,
-			fmt.Sprintf("signed: %d", version))
+		return payload, errors.Wrap(err, "authorize")
 	}
-	payload.Payload = payload.Payload[1:]
 
-	result := &Authorize{}
-	payload.Payload, err = bsor.Unmarshal(payload.Payload, result)
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "unmarshal")
+	return wrapper.Wrap(payload)
+}
+
+// ParseAuthorize parses the signature and public key (if provided).
+func ParseAuthorize(payload envelope.Data) (*Authorize, envelope.Data, error) {
+	msg, payload, err := codec.Parse(payload)
+	if msg == nil || err != nil {
+		return nil, payload, err
 	}
+	result := msg.(*Authorize)
 
 	if err := result.SetPayload(payload); err != nil {
 		return nil, payload, errors.Wrap(err, "set payload")
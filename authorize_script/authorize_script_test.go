@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/json"
+	"fmt"
 	"testing"
 
+	"github.com/tokenized/channels"
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
 	envelopeV1 "github.com/tokenized/envelope/pkg/golang/envelope/v1"
 	"github.com/tokenized/pkg/bitcoin"
@@ -98,3 +100,91 @@ func Test_Basic(t *testing.T) {
 			testData)
 	}
 }
+
+func Test_Signer(t *testing.T) {
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+
+	testProtocolID := []byte("TEST")
+	testData := make([]byte, 25)
+	rand.Read(testData)
+	authPayload := envelope.Data{
+		ProtocolIDs: envelope.ProtocolIDs{testProtocolID},
+		Payload:     bitcoin.ScriptItems{bitcoin.NewPushDataScriptItem(testData)},
+	}
+
+	payload, err := WrapAuthorizeP2PKWithSigner(authPayload, channels.NewKeySigner(key),
+		key.PublicKey())
+	if err != nil {
+		t.Fatalf("Failed to authorize payload : %s", err)
+	}
+
+	authorized, _, err := ParseAuthorize(payload)
+	if err != nil {
+		t.Fatalf("Failed to parse authorize : %s", err)
+	}
+
+	if authorized == nil {
+		t.Fatalf("Authorize message missing")
+	}
+
+	if err := authorized.Verify(); err != nil {
+		t.Fatalf("Failed to verify authorize : %s", err)
+	}
+
+	otherKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	if _, err := WrapAuthorizeP2PKWithSigner(authPayload, channels.NewKeySigner(otherKey),
+		key.PublicKey()); err == nil {
+		t.Fatalf("Authorize with wrong signer should fail")
+	}
+}
+
+func Test_WireFormat(t *testing.T) {
+	authorize := &Authorize{
+		LockingScript:   bitcoin.Script{bitcoin.OP_1},
+		UnlockingScript: bitcoin.Script{bitcoin.OP_2, bitcoin.OP_3},
+	}
+
+	payload := envelope.Data{
+		ProtocolIDs: envelope.ProtocolIDs{channels.ProtocolIDNote},
+		Payload:     bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(0)},
+	}
+
+	wrapped, err := authorize.Wrap(payload)
+	if err != nil {
+		t.Fatalf("Failed to wrap authorize : %s", err)
+	}
+
+	script, err := envelopeV1.Wrap(wrapped).Script()
+	if err != nil {
+		t.Fatalf("Failed to create script : %s", err)
+	}
+
+	want := "006a02bd01520141044e4f54455700525101515202525300"
+	if got := fmt.Sprintf("%x", []byte(script)); got != want {
+		t.Fatalf("Wrong script : \ngot  %s\nwant %s", got, want)
+	}
+
+	parsedPayload, err := channels.ParseEnvelope(script)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope : %s", err)
+	}
+
+	parsed, remaining, err := ParseAuthorize(parsedPayload)
+	if err != nil {
+		t.Fatalf("Failed to parse authorize : %s", err)
+	}
+
+	rewrapped, err := parsed.Wrap(remaining)
+	if err != nil {
+		t.Fatalf("Failed to wrap parsed authorize : %s", err)
+	}
+
+	reScript, err := envelopeV1.Wrap(rewrapped).Script()
+	if err != nil {
+		t.Fatalf("Failed to create script : %s", err)
+	}
+
+	if !bytes.Equal(reScript, script) {
+		t.Fatalf("Wrong wrapped script : \ngot  %x\nwant %x", []byte(reScript), []byte(script))
+	}
+}
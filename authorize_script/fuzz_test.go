@@ -0,0 +1,39 @@
+package authorize_script
+
+import (
+	"testing"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/google/uuid"
+)
+
+func Fuzz_ParseAuthorize(f *testing.F) {
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+
+	authorize, err := NewAuthorizeP2PK(key)
+	if err != nil {
+		f.Fatalf("Failed to create authorize : %s", err)
+	}
+
+	id := channels.UUID(uuid.New())
+	script, err := channels.Wrap(&id, authorize)
+	if err != nil {
+		f.Fatalf("Failed to wrap message : %s", err)
+	}
+	f.Add([]byte(script))
+
+	// An empty push data (OP_PUSHDATA1 0) for the version.
+	f.Add([]byte{0x00, 0x6a, 0x02, 0xbd, 0x01, 0x51, 0x01, 0x41, 0x52, 0x4c, 0x00, 0x00})
+
+	protocols := channels.NewProtocols(NewProtocol(), channels.NewUUIDProtocol())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		script := bitcoin.Script(b)
+		if payload, err := channels.ParseEnvelope(script); err == nil {
+			ParseAuthorize(payload)
+		}
+
+		protocols.Parse(script)
+	})
+}
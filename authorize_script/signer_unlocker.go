@@ -0,0 +1,96 @@
+package authorize_script
+
+import (
+	"github.com/tokenized/bitcoin_interpreter"
+	"github.com/tokenized/bitcoin_interpreter/p2pk"
+	"github.com/tokenized/channels"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+// SignerUnlocker unlocks P2PK locking scripts with a channels.Signer so the key doesn't have to be
+// held in process memory. The public key must be provided because it is needed to create and match
+// locking scripts before anything is signed.
+type SignerUnlocker struct {
+	Signer               channels.Signer
+	PublicKey            bitcoin.PublicKey
+	SigHashType          bitcoin_interpreter.SigHashType
+	OpCodeSeparatorIndex int
+}
+
+func NewSignerUnlocker(signer channels.Signer, publicKey bitcoin.PublicKey) *SignerUnlocker {
+	return &SignerUnlocker{
+		Signer:               signer,
+		PublicKey:            publicKey,
+		SigHashType:          bitcoin_interpreter.SigHashDefault,
+		OpCodeSeparatorIndex: -1,
+	}
+}
+
+func (u *SignerUnlocker) Unlock(writeSigPreimage bitcoin_interpreter.WriteSignaturePreimage,
+	lockingScript bitcoin.Script) (bitcoin.Script, error) {
+	return u.SubUnlock(writeSigPreimage, lockingScript, 0)
+}
+
+func (u *SignerUnlocker) SubUnlock(writeSigPreimage bitcoin_interpreter.WriteSignaturePreimage,
+	lockingScript bitcoin.Script, lockingScriptOffset int) (bitcoin.Script, error) {
+
+	publicKey, err := p2pk.MatchScript(lockingScript[lockingScriptOffset:], false)
+	if err != nil && errors.Cause(err) != bitcoin_interpreter.RemainingScript {
+		return nil, err
+	}
+
+	if !publicKey.Equal(u.PublicKey) {
+		return nil, errors.Wrap(bitcoin_interpreter.CantUnlock, "wrong public key")
+	}
+
+	sigHash, err := bitcoin_interpreter.CalculateSignatureHash(writeSigPreimage, u.SigHashType,
+		lockingScript, u.OpCodeSeparatorIndex)
+	if err != nil {
+		return nil, errors.Wrap(err, "sig hash")
+	}
+
+	signature, signerPublicKey, err := u.Signer.Sign(sigHash, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "signature")
+	}
+
+	if !signerPublicKey.Equal(u.PublicKey) {
+		return nil, errors.Wrap(bitcoin_interpreter.CantUnlock, "wrong signer public key")
+	}
+
+	return bitcoin.ConcatScript(
+		bitcoin.PushData(append(signature.Bytes(), byte(u.SigHashType))),
+	), nil
+}
+
+func (u *SignerUnlocker) UnlockingSize(lockingScript bitcoin.Script) (int, error) {
+	if !u.CanUnlock(lockingScript) {
+		return 0, bitcoin_interpreter.ScriptNotMatching
+	}
+
+	return p2pk.UnlockingSize, nil
+}
+
+func (u *SignerUnlocker) CanUnlock(lockingScript bitcoin.Script) bool {
+	publicKey, err := p2pk.MatchScript(lockingScript, false)
+	if err != nil {
+		return false
+	}
+
+	return publicKey.Equal(u.PublicKey)
+}
+
+func (u *SignerUnlocker) CanPartiallyUnlock(lockingScript bitcoin.Script) bool {
+	return u.CanUnlock(lockingScript)
+}
+
+func (u *SignerUnlocker) Copy() bitcoin_interpreter.Unlocker {
+	return &SignerUnlocker{
+		Signer:               u.Signer,
+		PublicKey:            u.PublicKey.Copy(),
+		SigHashType:          u.SigHashType,
+		OpCodeSeparatorIndex: u.OpCodeSeparatorIndex,
+	}
+}
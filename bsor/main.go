@@ -14,6 +14,9 @@ func main() {
 		reflect.TypeOf(channels.ReplyTo{}),
 		reflect.TypeOf(channels.Response{}),
 		reflect.TypeOf(channels.Signature{}),
+		reflect.TypeOf(channels.Encrypted{}),
+		reflect.TypeOf(channels.MultiSignature{}),
+		reflect.TypeOf(channels.ReplayProtection{}),
 	)
 	if err != nil {
 		fmt.Printf("Failed to create definitions : %s\n", err)
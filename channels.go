@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"sync"
 
+	"github.com/tokenized/channels/metrics"
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
 	envelopeV1 "github.com/tokenized/envelope/pkg/golang/envelope/v1"
 	"github.com/tokenized/pkg/bitcoin"
@@ -64,11 +65,20 @@ type Protocol interface {
 type Protocols struct {
 	Protocols []Protocol
 
+	unsignedWrapperPolicy UnsignedWrapperPolicy
+	securityProtocolIDs   envelope.ProtocolIDs
+	lenient               bool
+	limits                ParseLimits
+	metrics               metrics.Metrics
+
 	lock sync.RWMutex
 }
 
 func NewProtocols(protocols ...Protocol) *Protocols {
-	result := &Protocols{}
+	result := &Protocols{
+		limits:  DefaultParseLimits(),
+		metrics: metrics.NoOp{},
+	}
 
 	for _, protocol := range protocols {
 		result.Protocols = append(result.Protocols, protocol)
@@ -116,37 +126,191 @@ func (ps *Protocols) ResponseCodeToString(protocolID envelope.ProtocolID, code u
 	return protocolID.String() + fmt.Sprintf(":unknown(%d)", code)
 }
 
+// Parse parses the message and wrappers from the script. Wrappers are returned outermost first.
 func (ps *Protocols) Parse(script bitcoin.Script) (Message, []Wrapper, error) {
-	payload, err := envelopeV1.Parse(bytes.NewReader(script))
+	msg, wrappers, _, err := ps.ParseWithCoverage(script)
+	return msg, wrappers, err
+}
+
+// ParseWithCoverage parses the message and wrappers from the script and also returns which of the
+// wrappers are covered by a signature. The coverage contains one entry for each wrapper in the
+// same order.
+func (ps *Protocols) ParseWithCoverage(script bitcoin.Script) (Message, []Wrapper,
+	WrapperCoverages, error) {
+
+	parsed, err := ps.ParseLayers(script)
+	if err != nil {
+		if parsed != nil {
+			return nil, parsed.Wrappers(), nil, err
+		}
+		return nil, nil, nil, err
+	}
+
+	return parsed.Message(), parsed.Wrappers(), parsed.Coverage(), nil
+}
+
+// ParseLayers parses each protocol layer of the script. The layers retain the exact bytes they
+// were parsed from so they can be archived, verified again later, or serialized unchanged.
+func (ps *Protocols) ParseLayers(script bitcoin.Script) (*ParsedMessage, error) {
+	var protocolID envelope.ProtocolID
+	parsed, err := ps.parseLayers(script, &protocolID)
+	if err != nil {
+		ps.reportParseFailure(protocolID, err)
+		return parsed, err
+	}
+
+	ps.lock.RLock()
+	policy := ps.unsignedWrapperPolicy
+	securityProtocolIDs := ps.securityProtocolIDs
+	ps.lock.RUnlock()
+
+	if policy == UnsignedWrappersRejected {
+		if err := parsed.Coverage().CheckSecurityWrappers(securityProtocolIDs); err != nil {
+			ps.reportParseFailure(protocolID, err)
+			return parsed, err
+		}
+	}
+
+	ps.reportParsed(parsed)
+	return parsed, nil
+}
+
+func (ps *Protocols) parseLayers(script bitcoin.Script,
+	protocolID *envelope.ProtocolID) (*ParsedMessage, error) {
+
+	limits := ps.parseLimits()
+	searches := limits.MaxUnknownWrapperSearch
+	return ps.parseLayersWithLimits(script, limits, &searches, protocolID)
+}
+
+// parseLayersWithLimits parses the layers of the script. searches is the number of unknown wrapper
+// splits remaining for the whole message so nested unknown wrappers can't multiply the work. If
+// current isn't nil it is set to the protocol ID of each layer as it is parsed so it contains the
+// protocol ID of the layer that failed when an error is returned.
+func (ps *Protocols) parseLayersWithLimits(script bitcoin.Script, limits ParseLimits,
+	searches *int, current *envelope.ProtocolID) (*ParsedMessage, error) {
+
+	if err := limits.checkScript(script); err != nil {
+		return nil, err
+	}
+
+	payload, headerSize, offsets, err := parseEnvelope(script)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "envelope")
+		return nil, errors.Wrap(err, "envelope")
+	}
+
+	if err := limits.checkPayload(payload); err != nil {
+		return nil, err
 	}
 
-	var wrappers []Wrapper
+	result := &ParsedMessage{
+		header: script[:headerSize],
+	}
+	return ps.parsePayload(result, payload, script, offsets, false, limits, searches, current)
+}
+
+// parsePayload parses the layers of the payload and appends them to the result. source is the
+// script the payload was parsed from and offsets are the offsets in source of the push ops of the
+// payload. signed is true when the payload is covered by a signature layer outside of it.
+func (ps *Protocols) parsePayload(result *ParsedMessage, payload envelope.Data,
+	source bitcoin.Script, offsets []int, signed bool, limits ParseLimits, searches *int,
+	current *envelope.ProtocolID) (*ParsedMessage, error) {
+
+	var err error
 	for {
-		protocol := ps.GetProtocol(payload.ProtocolIDs[0])
-		if protocol == nil {
-			return nil, wrappers, errors.Wrap(ErrUnsupportedProtocol,
-				payload.ProtocolIDs[0].String())
+		if err := limits.checkDepth(len(result.Layers) + 1); err != nil {
+			return nil, err
 		}
 
-		msg, newPayload, err := protocol.Parse(payload)
-		if err != nil {
-			return nil, nil, errors.Wrapf(err, "parse: %s", protocol.ProtocolID())
+		protocolID := payload.ProtocolIDs[0]
+		if current != nil {
+			*current = protocolID
 		}
 
-		if len(newPayload.ProtocolIDs) == 0 {
-			return msg, wrappers, nil
+		var msg Message
+		var newPayload envelope.Data
+		if protocol := ps.GetProtocol(protocolID); protocol != nil {
+			msg, newPayload, err = protocol.Parse(payload)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse: %s", protocolID)
+			}
+		} else if ps.isLenient() && len(payload.ProtocolIDs) > 1 {
+			// The contained layers are parsed while separating the unknown wrapper.
+			parsed, err := ps.parseUnknownWrapper(result, payload, source, offsets, signed,
+				limits, searches)
+			if err != nil {
+				return result, errors.Wrapf(err, "unknown: %s", protocolID)
+			}
+			return parsed, nil
+		} else {
+			return result, errors.Wrap(ErrUnsupportedProtocol, protocolID.String())
 		}
 
-		if wrapper, ok := msg.(Wrapper); ok {
-			wrappers = append(wrappers, wrapper)
+		if err := CheckCollectionLengths(msg, limits.MaxCollectionLength); err != nil {
+			return nil, errors.Wrapf(err, "parse: %s", protocolID)
+		}
+
+		layer := newLayer(protocolID, msg, signed, payload, source, offsets)
+		result.Layers = append(result.Layers, layer)
+
+		consumed, replaced := consumedCount(payload, newPayload)
+		if replaced {
+			layer.Bytes = layer.CoveredBytes
 		} else {
-			return nil, nil, errors.Wrapf(ErrRemainingProtocols, "%s", newPayload.ProtocolIDs)
+			layer.Bytes = source[offsets[0]:offsets[consumed]:offsets[consumed]]
+		}
+
+		if len(newPayload.ProtocolIDs) == 0 {
+			result.complete = true
+			return result, nil
+		}
+
+		if _, ok := msg.(Wrapper); !ok {
+			return nil, errors.Wrapf(ErrRemainingProtocols, "%s", newPayload.ProtocolIDs)
 		}
 
+		// Encryption replaces the payload rather than just removing its own protocol ID so the
+		// protocol count can stay the same. Every other protocol must consume its protocol ID.
 		if len(payload.ProtocolIDs) == len(newPayload.ProtocolIDs) {
-			return nil, nil, errors.Wrapf(ErrParseDidntConsumeProtocol, "%s", newPayload.ProtocolIDs)
+			_, isEncrypted := msg.(*Encrypted)
+			if !isEncrypted || (bytes.Equal(payload.ProtocolIDs[0], newPayload.ProtocolIDs[0]) &&
+				len(payload.Payload) == len(newPayload.Payload)) {
+				return nil, errors.Wrapf(ErrParseDidntConsumeProtocol, "%s",
+					newPayload.ProtocolIDs)
+			}
+		}
+
+		if replaced {
+			// The contained payload didn't come from the script so it is serialized to provide
+			// the bytes of the inner layers.
+			source, err = envelopeV1.Wrap(newPayload).Script()
+			if err != nil {
+				return nil, errors.Wrapf(err, "script: %s", protocolID)
+			}
+
+			if err := limits.checkScript(source); err != nil {
+				return nil, errors.Wrapf(err, "contained: %s", protocolID)
+			}
+
+			var headerSize int
+			newPayload, headerSize, offsets, err = parseEnvelope(source)
+			if err != nil {
+				return nil, errors.Wrapf(err, "envelope: %s", protocolID)
+			}
+			source = source[headerSize:]
+
+			if err := limits.checkPayload(newPayload); err != nil {
+				return nil, errors.Wrapf(err, "contained: %s", protocolID)
+			}
+			for i := range offsets {
+				offsets[i] -= headerSize
+			}
+		} else {
+			offsets = offsets[consumed:]
+		}
+
+		if _, ok := msg.(SignatureWrapper); ok {
+			signed = true
 		}
 
 		payload = newPayload
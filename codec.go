@@ -0,0 +1,462 @@
+package channels
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/bsor"
+
+	"github.com/pkg/errors"
+)
+
+// ScriptItemsMarshaler is implemented by messages that are encoded directly as push ops instead of
+// BSOR.
+type ScriptItemsMarshaler interface {
+	MarshalScriptItems() (bitcoin.ScriptItems, error)
+}
+
+// ScriptItemsUnmarshaler is implemented by messages that are decoded directly from push ops
+// instead of BSOR. It returns the push ops that remain after the message.
+type ScriptItemsUnmarshaler interface {
+	UnmarshalScriptItems(scriptItems bitcoin.ScriptItems) (bitcoin.ScriptItems, error)
+}
+
+// CodecMessageType defines one message type of a protocol.
+type CodecMessageType struct {
+	// Type is the value of the message type push op.
+	Type uint64
+
+	// Name is the name of the message type used in JSON.
+	Name string
+
+	// Message is an example of the message used to determine the Go type.
+	Message Message
+}
+
+type CodecMessageTypes []*CodecMessageType
+
+// CodecVersion defines an older version of a protocol that is still supported. Messages parsed in
+// an older version are upgraded into the Go type of the current version.
+type CodecVersion struct {
+	Version uint8
+
+	// Unmarshal decodes the push ops of the message, after the version and message type, into
+	// message, which is a new empty message of the current version. It returns the push ops that
+	// remain after the message.
+	Unmarshal func(message Message, scriptItems bitcoin.ScriptItems) (bitcoin.ScriptItems, error)
+
+	// Marshal encodes the message, after the version and message type, in this version. It is nil
+	// when the version can be parsed, but not written.
+	Marshal func(message Message) (bitcoin.ScriptItems, error)
+}
+
+// Codec writes and parses the messages of a protocol. The protocol's messages are encoded as a
+// version push op, then a message type push op if the protocol has more than one message type,
+// then the message in BSOR or, if it implements ScriptItemsMarshaler, its own push ops. Older
+// versions added with AddVersion are parsed and upgraded to the current version.
+type Codec struct {
+	protocolID envelope.ProtocolID
+	version    uint8
+	name       string // used in error messages
+
+	// typed is true when the message type push op is included.
+	typed bool
+
+	// cantWrap is true when parsing fails if other protocols follow this protocol.
+	cantWrap bool
+
+	// errUnsupported is returned when the message type isn't known.
+	errUnsupported error
+
+	// errUnsupportedVersion is returned when the version isn't known.
+	errUnsupportedVersion error
+
+	// versions are the older versions that are supported.
+	versions map[uint8]*CodecVersion
+
+	single   *codecMessageType // the message type when not typed
+	byType   map[uint64]*codecMessageType
+	byGoType map[reflect.Type]*codecMessageType
+	byName   map[string]*codecMessageType
+}
+
+type codecMessageType struct {
+	CodecMessageType
+	goType reflect.Type
+}
+
+// NewCodec creates a codec for a protocol with one message type.
+func NewCodec(protocolID envelope.ProtocolID, version uint8, name string,
+	message Message) *Codec {
+
+	result := newCodec(protocolID, version, name)
+	result.add(&CodecMessageType{Message: message})
+	return result
+}
+
+// NewTypedCodec creates a codec for a protocol with several message types. errUnsupported is
+// returned from Parse when the message type isn't in messageTypes.
+func NewTypedCodec(protocolID envelope.ProtocolID, version uint8, name string,
+	errUnsupported error, messageTypes CodecMessageTypes) *Codec {
+
+	result := newCodec(protocolID, version, name)
+	result.typed = true
+	result.errUnsupported = errUnsupported
+	for _, messageType := range messageTypes {
+		result.add(messageType)
+	}
+	return result
+}
+
+func newCodec(protocolID envelope.ProtocolID, version uint8, name string) *Codec {
+	return &Codec{
+		protocolID:            protocolID,
+		version:               version,
+		name:                  name,
+		errUnsupportedVersion: ErrUnsupportedVersion,
+		versions:              make(map[uint8]*CodecVersion),
+		byType:                make(map[uint64]*codecMessageType),
+		byGoType:              make(map[reflect.Type]*codecMessageType),
+		byName:                make(map[string]*codecMessageType),
+	}
+}
+
+func (c *Codec) add(messageType *CodecMessageType) {
+	goType := reflect.TypeOf(messageType.Message)
+	if goType.Kind() == reflect.Ptr {
+		goType = goType.Elem()
+	}
+
+	mt := &codecMessageType{
+		CodecMessageType: *messageType,
+		goType:           goType,
+	}
+
+	c.single = mt
+	c.byType[mt.Type] = mt
+	c.byGoType[goType] = mt
+	if len(mt.Name) > 0 {
+		c.byName[mt.Name] = mt
+	}
+}
+
+// SetCantWrap makes Parse return ErrInvalidMessage when other protocols follow this protocol.
+// Otherwise the remaining protocols are returned with the payload.
+func (c *Codec) SetCantWrap() *Codec {
+	c.cantWrap = true
+	return c
+}
+
+// SetErrUnsupportedVersion sets the error returned from Parse when the version isn't known. It
+// defaults to ErrUnsupportedVersion.
+func (c *Codec) SetErrUnsupportedVersion(err error) *Codec {
+	c.errUnsupportedVersion = err
+	return c
+}
+
+// AddVersion adds support for an older version of the protocol.
+func (c *Codec) AddVersion(version *CodecVersion) *Codec {
+	c.versions[version.Version] = version
+	return c
+}
+
+func (c *Codec) ProtocolID() envelope.ProtocolID {
+	return c.protocolID
+}
+
+func (c *Codec) Version() uint8 {
+	return c.version
+}
+
+// VersionedProtocolID returns the ID that is included in supported protocols to advertise that a
+// version of a protocol is supported. It is the protocol ID followed by a zero byte and the
+// version.
+func VersionedProtocolID(protocolID envelope.ProtocolID, version uint8) envelope.ProtocolID {
+	result := make(envelope.ProtocolID, 0, len(protocolID)+2)
+	result = append(result, protocolID...)
+	return append(result, 0, version)
+}
+
+// SupportedProtocols returns the protocol ID followed by the versioned protocol IDs of the
+// versions that can be parsed, newest first, so they can be advertised to a counterparty.
+func (c *Codec) SupportedProtocols() envelope.ProtocolIDs {
+	versions := []uint8{c.version}
+	for version := range c.versions {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i] > versions[j]
+	})
+
+	result := envelope.ProtocolIDs{c.protocolID}
+	for _, version := range versions {
+		result = append(result, VersionedProtocolID(c.protocolID, version))
+	}
+
+	return result
+}
+
+// SelectVersion returns the highest version that can be written and that the counterparty
+// advertised in its supported protocols. When the counterparty doesn't advertise any versions of
+// the protocol the current version is used.
+func (c *Codec) SelectVersion(supportedProtocols envelope.ProtocolIDs) (uint8, error) {
+	advertised := false
+	found := false
+	var result uint8
+	for _, protocolID := range supportedProtocols {
+		version, ok := c.advertisedVersion(protocolID)
+		if !ok {
+			continue
+		}
+		advertised = true
+
+		if !c.canWriteVersion(version) {
+			continue
+		}
+
+		if !found || version > result {
+			result = version
+			found = true
+		}
+	}
+
+	if found {
+		return result, nil
+	}
+
+	if advertised {
+		return 0, errors.Wrapf(c.errUnsupportedVersion, "%s: none advertised", c.name)
+	}
+
+	return c.version, nil
+}
+
+// advertisedVersion returns the version of the protocol advertised by a versioned protocol ID.
+func (c *Codec) advertisedVersion(protocolID envelope.ProtocolID) (uint8, bool) {
+	if len(protocolID) != len(c.protocolID)+2 || !bytes.HasPrefix(protocolID, c.protocolID) ||
+		protocolID[len(c.protocolID)] != 0 {
+		return 0, false
+	}
+
+	return protocolID[len(protocolID)-1], true
+}
+
+func (c *Codec) canWriteVersion(version uint8) bool {
+	if version == c.version {
+		return true
+	}
+
+	v, exists := c.versions[version]
+	return exists && v.Marshal != nil
+}
+
+// MessageForType returns a new empty message for the message type, or nil if the message type is
+// not known.
+func (c *Codec) MessageForType(messageType uint64) Message {
+	mt, exists := c.byType[messageType]
+	if !exists {
+		return nil
+	}
+
+	return reflect.New(mt.goType).Interface().(Message)
+}
+
+// MessageTypeFor returns the message type of the message. It returns false if the message is not
+// part of this protocol.
+func (c *Codec) MessageTypeFor(message Message) (uint64, bool) {
+	goType := reflect.TypeOf(message)
+	if goType == nil {
+		return 0, false
+	}
+	if goType.Kind() == reflect.Ptr {
+		goType = goType.Elem()
+	}
+
+	mt, exists := c.byGoType[goType]
+	if !exists {
+		return 0, false
+	}
+
+	return mt.Type, true
+}
+
+// MessageTypeName returns the JSON name of the message type, or an empty string if it is not
+// known.
+func (c *Codec) MessageTypeName(messageType uint64) string {
+	mt, exists := c.byType[messageType]
+	if !exists {
+		return ""
+	}
+
+	return mt.Name
+}
+
+// MessageTypeForName returns the message type with the JSON name. It returns false if the name is
+// not known.
+func (c *Codec) MessageTypeForName(name string) (uint64, bool) {
+	mt, exists := c.byName[name]
+	if !exists {
+		return 0, false
+	}
+
+	return mt.Type, true
+}
+
+// Write returns the payload containing only the message.
+func (c *Codec) Write(message Message) (envelope.Data, error) {
+	return c.WriteVersion(message, c.version)
+}
+
+// WriteVersion returns the payload containing only the message written in the specified version.
+func (c *Codec) WriteVersion(message Message, version uint8) (envelope.Data, error) {
+	scriptItems, err := c.marshal(message, version)
+	if err != nil {
+		return envelope.Data{}, err
+	}
+
+	return envelope.Data{
+		ProtocolIDs: envelope.ProtocolIDs{c.protocolID},
+		Payload:     scriptItems,
+	}, nil
+}
+
+// Wrap returns the payload wrapped in the message.
+func (c *Codec) Wrap(message Message, payload envelope.Data) (envelope.Data, error) {
+	return c.WrapVersion(message, c.version, payload)
+}
+
+// WrapVersion returns the payload wrapped in the message written in the specified version.
+func (c *Codec) WrapVersion(message Message, version uint8,
+	payload envelope.Data) (envelope.Data, error) {
+
+	scriptItems, err := c.marshal(message, version)
+	if err != nil {
+		return payload, err
+	}
+
+	payload.ProtocolIDs = append(envelope.ProtocolIDs{c.protocolID}, payload.ProtocolIDs...)
+	payload.Payload = append(scriptItems, payload.Payload...)
+
+	return payload, nil
+}
+
+func (c *Codec) marshal(message Message, version uint8) (bitcoin.ScriptItems, error) {
+	var marshal func(message Message) (bitcoin.ScriptItems, error)
+	if version != c.version {
+		if !c.canWriteVersion(version) {
+			return nil, errors.Wrapf(c.errUnsupportedVersion, "%s: %d", c.name, version)
+		}
+		marshal = c.versions[version].Marshal
+	}
+
+	// Version
+	scriptItems := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(version))}
+
+	// Message type
+	if c.typed {
+		messageType, ok := c.MessageTypeFor(message)
+		if !ok {
+			return nil, errors.Wrapf(c.errUnsupported, "%T", message)
+		}
+		scriptItems = append(scriptItems, bitcoin.PushNumberScriptItem(int64(messageType)))
+	}
+
+	// Message
+	if marshal != nil {
+		msgScriptItems, err := marshal(message)
+		if err != nil {
+			return nil, errors.Wrapf(err, "marshal version %d", version)
+		}
+		return append(scriptItems, msgScriptItems...), nil
+	}
+
+	if marshaler, ok := message.(ScriptItemsMarshaler); ok {
+		msgScriptItems, err := marshaler.MarshalScriptItems()
+		if err != nil {
+			return nil, errors.Wrap(err, "marshal")
+		}
+		return append(scriptItems, msgScriptItems...), nil
+	}
+
+	msgScriptItems, err := bsor.Marshal(message)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal")
+	}
+
+	return append(scriptItems, msgScriptItems...), nil
+}
+
+// Parse parses the message from the beginning of the payload and returns the remaining payload.
+// It returns a nil message and no error when the payload doesn't start with this protocol.
+func (c *Codec) Parse(payload envelope.Data) (Message, envelope.Data, error) {
+	if len(payload.ProtocolIDs) == 0 || !bytes.Equal(payload.ProtocolIDs[0], c.protocolID) {
+		return nil, payload, nil
+	}
+
+	if c.cantWrap && len(payload.ProtocolIDs) != 1 {
+		return nil, payload, errors.Wrapf(ErrInvalidMessage, "%s can't wrap", c.name)
+	}
+	payload.ProtocolIDs = payload.ProtocolIDs[1:]
+
+	headerCount := 1
+	if c.typed {
+		headerCount = 2
+	}
+
+	if len(payload.Payload) < headerCount+1 {
+		return nil, payload, errors.Wrapf(ErrInvalidMessage, "not enough %s push ops: %d", c.name,
+			len(payload.Payload))
+	}
+
+	version, err := ScriptNumberValue(payload.Payload[0])
+	if err != nil {
+		return nil, payload, errors.Wrap(err, "version")
+	}
+	var olderVersion *CodecVersion
+	if version != int64(c.version) {
+		if version >= 0 && version <= math.MaxUint8 {
+			olderVersion = c.versions[uint8(version)]
+		}
+		if olderVersion == nil {
+			return nil, payload, errors.Wrap(c.errUnsupportedVersion,
+				fmt.Sprintf("%s: %d", c.name, version))
+		}
+	}
+
+	var result Message
+	if c.typed {
+		messageType, err := ScriptNumberValue(payload.Payload[1])
+		if err != nil {
+			return nil, payload, errors.Wrap(err, "message type")
+		}
+
+		if messageType >= 0 {
+			result = c.MessageForType(uint64(messageType))
+		}
+		if result == nil {
+			return nil, payload, errors.Wrap(c.errUnsupported, fmt.Sprintf("%d", messageType))
+		}
+	} else {
+		result = reflect.New(c.single.goType).Interface().(Message)
+	}
+
+	var remaining bitcoin.ScriptItems
+	if olderVersion != nil {
+		remaining, err = olderVersion.Unmarshal(result, payload.Payload[headerCount:])
+	} else if unmarshaler, ok := result.(ScriptItemsUnmarshaler); ok {
+		remaining, err = unmarshaler.UnmarshalScriptItems(payload.Payload[headerCount:])
+	} else {
+		remaining, err = UnmarshalBSOR(payload.Payload[headerCount:], result)
+	}
+	if err != nil {
+		return nil, payload, errors.Wrap(err, "unmarshal")
+	}
+	payload.Payload = remaining
+
+	return result, payload, nil
+}
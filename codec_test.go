@@ -0,0 +1,219 @@
+package channels
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/bsor"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+var (
+	testCodecProtocolID = envelope.ProtocolID("TC")
+
+	errTestUnsupported = errors.New("Test Unsupported")
+)
+
+type testCodecFirst struct {
+	Value string `bsor:"1"`
+}
+
+func (*testCodecFirst) ProtocolID() envelope.ProtocolID {
+	return testCodecProtocolID
+}
+
+type testCodecSecond struct {
+	Value uint64 `bsor:"1"`
+}
+
+func (*testCodecSecond) ProtocolID() envelope.ProtocolID {
+	return testCodecProtocolID
+}
+
+func testCodec() *Codec {
+	return NewTypedCodec(testCodecProtocolID, 0, "test", errTestUnsupported, CodecMessageTypes{
+		{Type: 1, Name: "first", Message: &testCodecFirst{}},
+		{Type: 200, Name: "second", Message: &testCodecSecond{}},
+	})
+}
+
+func Test_Codec_Typed(t *testing.T) {
+	codec := testCodec()
+
+	for _, msg := range []Message{&testCodecFirst{Value: "abc"}, &testCodecSecond{Value: 12}} {
+		payload, err := codec.Write(msg)
+		if err != nil {
+			t.Fatalf("Failed to write message : %s", err)
+		}
+
+		// Verify the wire format is the same as the hand-written encoding.
+		messageType, _ := codec.MessageTypeFor(msg)
+		want := bitcoin.ScriptItems{
+			bitcoin.PushNumberScriptItem(0),
+			bitcoin.PushNumberScriptItem(int64(messageType)),
+		}
+		msgScriptItems, err := bsor.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Failed to marshal message : %s", err)
+		}
+		want = append(want, msgScriptItems...)
+
+		gotScript, _ := payload.Payload.Script()
+		wantScript, _ := want.Script()
+		if !bytes.Equal(gotScript, wantScript) {
+			t.Fatalf("Wrong payload : \ngot  %s\nwant %s", gotScript, wantScript)
+		}
+
+		read, remaining, err := codec.Parse(payload)
+		if err != nil {
+			t.Fatalf("Failed to parse message : %s", err)
+		}
+
+		if len(remaining.ProtocolIDs) != 0 || len(remaining.Payload) != 0 {
+			t.Errorf("Payload should be empty")
+		}
+
+		js, _ := json.Marshal(read)
+		t.Logf("Message (%T) : %s", read, js)
+
+		switch m := read.(type) {
+		case *testCodecFirst:
+			if m.Value != "abc" {
+				t.Errorf("Wrong value : got %s, want %s", m.Value, "abc")
+			}
+		case *testCodecSecond:
+			if m.Value != 12 {
+				t.Errorf("Wrong value : got %d, want %d", m.Value, 12)
+			}
+		}
+	}
+
+	if name := codec.MessageTypeName(200); name != "second" {
+		t.Errorf("Wrong name : got %s, want %s", name, "second")
+	}
+
+	if messageType, ok := codec.MessageTypeForName("first"); !ok || messageType != 1 {
+		t.Errorf("Wrong message type for name : got %d %t, want %d", messageType, ok, 1)
+	}
+
+	if _, ok := codec.MessageTypeForName("third"); ok {
+		t.Errorf("Name should not be found")
+	}
+
+	if msg := codec.MessageForType(3); msg != nil {
+		t.Errorf("Message should be nil for unknown type")
+	}
+
+	if _, err := codec.Write(&ReplyTo{}); errors.Cause(err) != errTestUnsupported {
+		t.Errorf("Wrong write error : got %v, want %s", err, errTestUnsupported)
+	}
+}
+
+func Test_Codec_ParseErrors(t *testing.T) {
+	codec := testCodec()
+
+	payload := envelope.Data{
+		ProtocolIDs: envelope.ProtocolIDs{testCodecProtocolID},
+		Payload: bitcoin.ScriptItems{
+			bitcoin.PushNumberScriptItem(1),
+			bitcoin.PushNumberScriptItem(1),
+			bitcoin.PushNumberScriptItem(0),
+		},
+	}
+	if _, _, err := codec.Parse(payload); errors.Cause(err) != ErrUnsupportedVersion {
+		t.Errorf("Wrong version error : got %v, want %s", err, ErrUnsupportedVersion)
+	}
+
+	payload.Payload[0] = bitcoin.PushNumberScriptItem(0)
+	payload.Payload[1] = bitcoin.PushNumberScriptItem(3)
+	if _, _, err := codec.Parse(payload); errors.Cause(err) != errTestUnsupported {
+		t.Errorf("Wrong message type error : got %v, want %s", err, errTestUnsupported)
+	}
+
+	payload.Payload[1] = bitcoin.PushNumberScriptItem(-1)
+	if _, _, err := codec.Parse(payload); errors.Cause(err) != errTestUnsupported {
+		t.Errorf("Wrong negative message type error : got %v, want %s", err, errTestUnsupported)
+	}
+
+	payload.Payload = payload.Payload[:2]
+	if _, _, err := codec.Parse(payload); errors.Cause(err) != ErrInvalidMessage {
+		t.Errorf("Wrong push op count error : got %v, want %s", err, ErrInvalidMessage)
+	}
+
+	wrapped, err := codec.Write(&testCodecFirst{Value: "abc"})
+	if err != nil {
+		t.Fatalf("Failed to write message : %s", err)
+	}
+	wrapped.ProtocolIDs = append(wrapped.ProtocolIDs, ProtocolIDUUID)
+
+	// Remaining protocols are returned unless the codec can't wrap.
+	_, remaining, err := codec.Parse(wrapped)
+	if err != nil {
+		t.Errorf("Failed to parse wrapped : %s", err)
+	} else if len(remaining.ProtocolIDs) != 1 {
+		t.Errorf("Wrong remaining protocol count : got %d, want %d", len(remaining.ProtocolIDs),
+			1)
+	}
+
+	cantWrap := testCodec().SetCantWrap()
+	if _, _, err := cantWrap.Parse(wrapped); errors.Cause(err) != ErrInvalidMessage {
+		t.Errorf("Wrong wrap error : got %v, want %s", err, ErrInvalidMessage)
+	}
+
+	// A different protocol is not parsed.
+	other := envelope.Data{ProtocolIDs: envelope.ProtocolIDs{ProtocolIDUUID}}
+	msg, _, err := codec.Parse(other)
+	if msg != nil || err != nil {
+		t.Errorf("Different protocol should not parse : %v", err)
+	}
+}
+
+func Test_Codec_Custom(t *testing.T) {
+	id := UUID(uuid.New())
+	payload, err := NewStringID("thread").Wrap(envelope.Data{})
+	if err != nil {
+		t.Fatalf("Failed to wrap string id : %s", err)
+	}
+
+	payload, err = id.Wrap(payload)
+	if err != nil {
+		t.Fatalf("Failed to wrap uuid : %s", err)
+	}
+
+	// Hand-written encoding of a UUID wrapping a string ID.
+	want := bitcoin.ScriptItems{
+		bitcoin.PushNumberScriptItem(int64(UUIDVersion)),
+		bitcoin.NewPushDataScriptItem(id[:]),
+		bitcoin.PushNumberScriptItem(int64(StringIDVersion)),
+		bitcoin.NewPushDataScriptItem([]byte("thread")),
+	}
+
+	gotScript, _ := payload.Payload.Script()
+	wantScript, _ := want.Script()
+	if !bytes.Equal(gotScript, wantScript) {
+		t.Fatalf("Wrong payload : \ngot  %s\nwant %s", gotScript, wantScript)
+	}
+
+	readID, payload, err := ParseUUID(payload)
+	if err != nil {
+		t.Fatalf("Failed to parse uuid : %s", err)
+	}
+
+	if readID == nil || *readID != id {
+		t.Fatalf("Wrong uuid : got %v, want %s", readID, id)
+	}
+
+	readStringID, _, err := ParseStringID(payload)
+	if err != nil {
+		t.Fatalf("Failed to parse string id : %s", err)
+	}
+
+	if readStringID == nil || readStringID.StringID != "thread" {
+		t.Fatalf("Wrong string id : got %v, want %s", readStringID, "thread")
+	}
+}
@@ -1,13 +1,11 @@
 package contract_operator
 
 import (
-	"bytes"
 	"fmt"
 
 	"github.com/tokenized/channels"
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
 	"github.com/tokenized/pkg/bitcoin"
-	"github.com/tokenized/pkg/bsor"
 	"github.com/tokenized/pkg/expanded_tx"
 	"github.com/tokenized/pkg/peer_channels"
 
@@ -35,6 +33,14 @@ var (
 
 	ErrUnsupportedVersion                 = errors.New("Unsupported Operator Version")
 	ErrUnsupportedContractOperatorMessage = errors.New("Unsupported Operator Message")
+
+	codec = channels.NewTypedCodec(ProtocolID, Version, "contract operator",
+		ErrUnsupportedContractOperatorMessage, channels.CodecMessageTypes{
+			{Type: uint64(MessageTypeCreateAgent), Name: "create_agent", Message: &CreateAgent{}},
+			{Type: uint64(MessageTypeAgent), Name: "agent", Message: &Agent{}},
+			{Type: uint64(MessageTypeSignTx), Name: "sign_tx", Message: &SignTx{}},
+			{Type: uint64(MessageTypeSignedTx), Name: "signed_tx", Message: &SignedTx{}},
+		}).SetErrUnsupportedVersion(ErrUnsupportedVersion).SetCantWrap()
 )
 
 type MessageType uint8
@@ -97,20 +103,7 @@ func (*CreateAgent) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *CreateAgent) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload, bitcoin.PushNumberScriptItem(int64(MessageTypeCreateAgent)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 type Agent struct {
@@ -125,20 +118,7 @@ func (*Agent) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *Agent) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload, bitcoin.PushNumberScriptItem(int64(MessageTypeAgent)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 type SignTx struct {
@@ -150,20 +130,7 @@ func (*SignTx) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *SignTx) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload, bitcoin.PushNumberScriptItem(int64(MessageTypeSignTx)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 type SignedTx struct {
@@ -175,99 +142,20 @@ func (*SignedTx) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *SignedTx) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload, bitcoin.PushNumberScriptItem(int64(MessageTypeSignedTx)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 func Parse(payload envelope.Data) (channels.Message, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 {
-		return nil, payload, nil
-	}
-
-	if !bytes.Equal(payload.ProtocolIDs[0], ProtocolID) {
-		return nil, payload, nil
-	}
-
-	if len(payload.ProtocolIDs) != 1 {
-		return nil, payload, errors.Wrapf(channels.ErrInvalidMessage,
-			"contract operator can't wrap")
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
-
-	if len(payload.Payload) == 0 {
-		return nil, payload, errors.Wrapf(channels.ErrInvalidMessage, "payload empty")
-	}
-
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(ErrUnsupportedVersion, fmt.Sprintf("%d", version))
-	}
-
-	messageType, err := bitcoin.ScriptNumberValue(payload.Payload[1])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "message type")
-	}
-
-	result := MessageForType(MessageType(messageType))
-	if result == nil {
-		return nil, payload, errors.Wrap(ErrUnsupportedContractOperatorMessage,
-			fmt.Sprintf("%d", MessageType(messageType)))
-	}
-
-	payloads, err := bsor.Unmarshal(payload.Payload[2:], result)
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "unmarshal")
-	}
-	payload.Payload = payloads
-
-	return result, payload, nil
+	return codec.Parse(payload)
 }
 
 func MessageForType(messageType MessageType) channels.Message {
-	switch messageType {
-	case MessageTypeCreateAgent:
-		return &CreateAgent{}
-	case MessageTypeAgent:
-		return &Agent{}
-	case MessageTypeSignTx:
-		return &SignTx{}
-	case MessageTypeSignedTx:
-		return &SignedTx{}
-	case MessageTypeInvalid:
-		return nil
-	default:
-		return nil
-	}
+	return codec.MessageForType(uint64(messageType))
 }
 
 func MessageTypeFor(message channels.Message) MessageType {
-	switch message.(type) {
-	case *CreateAgent:
-		return MessageTypeCreateAgent
-	case *Agent:
-		return MessageTypeAgent
-	case *SignTx:
-		return MessageTypeSignTx
-	case *SignedTx:
-		return MessageTypeSignedTx
-	default:
-		return MessageTypeInvalid
-	}
+	messageType, _ := codec.MessageTypeFor(message)
+	return MessageType(messageType)
 }
 
 func (v *MessageType) UnmarshalJSON(data []byte) error {
@@ -301,34 +189,16 @@ func (v *MessageType) UnmarshalText(text []byte) error {
 }
 
 func (v *MessageType) SetString(s string) error {
-	switch s {
-	case "create_agent":
-		*v = MessageTypeCreateAgent
-	case "agent":
-		*v = MessageTypeAgent
-	case "sign_tx":
-		*v = MessageTypeSignTx
-	case "signed_tx":
-		*v = MessageTypeSignedTx
-	default:
+	messageType, ok := codec.MessageTypeForName(s)
+	if !ok {
 		*v = MessageTypeInvalid
 		return fmt.Errorf("Unknown MessageType value \"%s\"", s)
 	}
 
+	*v = MessageType(messageType)
 	return nil
 }
 
 func (v MessageType) String() string {
-	switch v {
-	case MessageTypeCreateAgent:
-		return "create_agent"
-	case MessageTypeAgent:
-		return "agent"
-	case MessageTypeSignTx:
-		return "sign_tx"
-	case MessageTypeSignedTx:
-		return "signed_tx"
-	default:
-		return ""
-	}
+	return codec.MessageTypeName(uint64(v))
 }
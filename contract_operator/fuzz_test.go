@@ -0,0 +1,33 @@
+package contract_operator
+
+import (
+	"testing"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/pkg/bitcoin"
+)
+
+func Fuzz_Parse(f *testing.F) {
+	for _, msg := range []channels.Writer{
+		&CreateAgent{},
+		&Agent{},
+		&SignTx{},
+		&SignedTx{},
+	} {
+		script, err := channels.Wrap(msg)
+		if err != nil {
+			f.Fatalf("Failed to wrap %T : %s", msg, err)
+		}
+		f.Add([]byte(script))
+	}
+
+	protocols := channels.NewProtocols(NewProtocol())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		script := bitcoin.Script(b)
+		if payload, err := channels.ParseEnvelope(script); err == nil {
+			Parse(payload)
+		}
+
+		protocols.Parse(script)
+	})
+}
@@ -0,0 +1,185 @@
+package channels
+
+import (
+	"bytes"
+
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// UnsignedWrappersAllowed means wrappers outside of a signature are returned without error.
+	UnsignedWrappersAllowed = UnsignedWrapperPolicy(0)
+
+	// UnsignedWrappersRejected means parsing fails with ErrUnsignedWrapper when a security
+	// relevant wrapper is not inside the innermost signature of the message.
+	UnsignedWrappersRejected = UnsignedWrapperPolicy(1)
+)
+
+var (
+	// SecurityProtocolIDs are the protocols of wrappers that change how a message is handled, so
+	// they could be used to attack the recipient if they are injected outside of a signature. For
+	// example a reply to could be added by the peer channel host to redirect replies.
+	SecurityProtocolIDs = envelope.ProtocolIDs{
+		ProtocolIDReplyTo,
+		ProtocolIDFeeRequirements,
+		ProtocolIDExpiry,
+	}
+
+	ErrUnsignedWrapper = errors.New("Unsigned Wrapper")
+)
+
+type UnsignedWrapperPolicy uint8
+
+// SignatureWrapper is implemented by wrappers that sign the data they contain.
+type SignatureWrapper interface {
+	Wrapper
+	IsSignatureType()
+}
+
+// WrapperCoverage specifies whether a wrapper is covered by a signature. A wrapper is covered
+// when a signature wrapper is outside of it.
+type WrapperCoverage struct {
+	Wrapper Wrapper
+	Signed  bool
+
+	// Signature is the innermost signature outside of the wrapper. It is nil when the wrapper is
+	// not signed.
+	Signature SignatureWrapper
+}
+
+type WrapperCoverages []*WrapperCoverage
+
+// SetUnsignedWrapperPolicy sets how wrappers outside of a signature are handled when parsing. If
+// no protocol IDs are provided then SecurityProtocolIDs are used.
+func (ps *Protocols) SetUnsignedWrapperPolicy(policy UnsignedWrapperPolicy,
+	protocolIDs ...envelope.ProtocolID) {
+
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.unsignedWrapperPolicy = policy
+	if len(protocolIDs) > 0 {
+		ps.securityProtocolIDs = protocolIDs
+	} else {
+		ps.securityProtocolIDs = SecurityProtocolIDs
+	}
+}
+
+// CalculateWrapperCoverage returns the signature coverage of wrappers that are in the order
+// returned by Protocols.Parse, outermost first.
+func CalculateWrapperCoverage(wrappers []Wrapper) WrapperCoverages {
+	result := make(WrapperCoverages, len(wrappers))
+	var signature SignatureWrapper
+	for i, wrapper := range wrappers {
+		result[i] = &WrapperCoverage{
+			Wrapper:   wrapper,
+			Signed:    signature != nil,
+			Signature: signature,
+		}
+
+		if s, ok := wrapper.(SignatureWrapper); ok {
+			signature = s
+		}
+	}
+
+	return result
+}
+
+// IsSigned returns true if the message is covered by at least one signature.
+func (cs WrapperCoverages) IsSigned() bool {
+	return cs.InnermostSignature() != nil
+}
+
+// InnermostSignature returns the signature that is inside all other signatures, or nil if there
+// are no signatures. It is the only signature that covers all of the signed wrappers.
+func (cs WrapperCoverages) InnermostSignature() SignatureWrapper {
+	var result SignatureWrapper
+	for _, c := range cs {
+		if signature, ok := c.Wrapper.(SignatureWrapper); ok {
+			result = signature
+		}
+	}
+
+	return result
+}
+
+// Unsigned returns the wrappers that are not covered by a signature.
+func (cs WrapperCoverages) Unsigned() []Wrapper {
+	var result []Wrapper
+	for _, c := range cs {
+		if !c.Signed {
+			result = append(result, c.Wrapper)
+		}
+	}
+
+	return result
+}
+
+// SignedBy returns the wrappers that are inside the signature, which must be one of the wrappers.
+func (cs WrapperCoverages) SignedBy(signature SignatureWrapper) []Wrapper {
+	var result []Wrapper
+	covered := false
+	for _, c := range cs {
+		if covered {
+			result = append(result, c.Wrapper)
+		} else if signature != nil && c.Wrapper == Wrapper(signature) {
+			covered = true
+		}
+	}
+
+	return result
+}
+
+// CheckSecurityWrappers returns ErrUnsignedWrapper if a wrapper with one of the protocol IDs is not
+// inside the innermost signature. Parsing doesn't verify signatures, so the innermost signature
+// must be verified before the wrappers are trusted. Wrappers between an outer signature and the
+// innermost one could have been added by anyone holding the outer message so they are rejected,
+// as are the wrappers of unsigned messages.
+func (cs WrapperCoverages) CheckSecurityWrappers(protocolIDs envelope.ProtocolIDs) error {
+	return cs.CheckSecurityWrappersSignedBy(cs.InnermostSignature(), protocolIDs)
+}
+
+// CheckSecurityWrappersSignedBy returns ErrUnsignedWrapper if a wrapper with one of the protocol
+// IDs is not inside the signature. The signature should be the one that the caller verified. If
+// it is nil then any wrapper with one of the protocol IDs is rejected.
+func (cs WrapperCoverages) CheckSecurityWrappersSignedBy(signature SignatureWrapper,
+	protocolIDs envelope.ProtocolIDs) error {
+
+	covered := false
+	for _, c := range cs {
+		if covered {
+			continue
+		}
+
+		if signature != nil && c.Wrapper == Wrapper(signature) {
+			covered = true
+			continue
+		}
+
+		protocolID := c.Wrapper.ProtocolID()
+		for _, securityProtocolID := range protocolIDs {
+			if bytes.Equal(protocolID, securityProtocolID) {
+				return errors.Wrap(ErrUnsignedWrapper, protocolID.String())
+			}
+		}
+	}
+
+	return nil
+}
+
+// UnsignedWrapperResponse returns an unauthorized response for an ErrUnsignedWrapper error. It
+// returns nil for other errors.
+func UnsignedWrapperResponse(err error) *Response {
+	if errors.Cause(err) != ErrUnsignedWrapper {
+		return nil
+	}
+
+	return &Response{
+		Status:         StatusUnauthorized,
+		CodeProtocolID: ProtocolIDSignedMessages,
+		Code:           SignedStatusUnsignedWrapper,
+		Note:           err.Error(),
+	}
+}
@@ -0,0 +1,150 @@
+package channels
+
+import (
+	"testing"
+
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+func Test_WrapperCoverage(t *testing.T) {
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+
+	id := UUID(uuid.New())
+	signedReplyTo := &ReplyTo{Handle: stringPtr("signed@test.com")}
+	injectedReplyTo := &ReplyTo{Handle: stringPtr("injected@test.com")}
+
+	signedScript, err := Wrap(&id, signedReplyTo, NewSignature(key, nil, true))
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+
+	injectedScript, err := Wrap(&id, signedReplyTo, NewSignature(key, nil, true),
+		injectedReplyTo)
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+
+	protocols := NewProtocols(NewSignedProtocol(), NewReplyToProtocol(), NewUUIDProtocol())
+
+	_, wrappers, coverage, err := protocols.ParseWithCoverage(injectedScript)
+	if err != nil {
+		t.Fatalf("Failed to parse : %s", err)
+	}
+
+	if len(coverage) != len(wrappers) {
+		t.Fatalf("Wrong coverage count : got %d, want %d", len(coverage), len(wrappers))
+	}
+
+	wantSigned := []bool{false, false, true}
+	for i, c := range coverage {
+		t.Logf("Wrapper %s signed %t", c.Wrapper.ProtocolID(), c.Signed)
+		if c.Signed != wantSigned[i] {
+			t.Errorf("Wrong coverage for wrapper %d : got %t, want %t", i, c.Signed, wantSigned[i])
+		}
+	}
+
+	err = coverage.CheckSecurityWrappers(SecurityProtocolIDs)
+	if errors.Cause(err) != ErrUnsignedWrapper {
+		t.Errorf("Wrong check error : got %v, want %s", err, ErrUnsignedWrapper)
+	}
+
+	protocols.SetUnsignedWrapperPolicy(UnsignedWrappersRejected)
+
+	if _, _, err := protocols.Parse(signedScript); err != nil {
+		t.Fatalf("Failed to parse signed script : %s", err)
+	}
+
+	_, _, err = protocols.Parse(injectedScript)
+	if errors.Cause(err) != ErrUnsignedWrapper {
+		t.Fatalf("Wrong parse error : got %v, want %s", err, ErrUnsignedWrapper)
+	}
+
+	response := UnsignedWrapperResponse(err)
+	if response == nil {
+		t.Fatalf("Missing response")
+	}
+
+	if response.Status != StatusUnauthorized {
+		t.Errorf("Wrong response status : got %s, want %s", response.Status, StatusUnauthorized)
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func Test_WrapperCoverage_InnermostSignature(t *testing.T) {
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	otherKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+
+	id := UUID(uuid.New())
+	replyTo := &ReplyTo{Handle: stringPtr("injected@test.com")}
+
+	// An outer signature doesn't cover wrappers that are outside of the inner signature.
+	script, err := Wrap(&id, NewSignature(key, nil, true), replyTo,
+		NewSignature(otherKey, nil, true))
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+
+	protocols := NewProtocols(NewSignedProtocol(), NewReplyToProtocol(), NewUUIDProtocol())
+
+	_, wrappers, coverage, err := protocols.ParseWithCoverage(script)
+	if err != nil {
+		t.Fatalf("Failed to parse : %s", err)
+	}
+
+	if len(wrappers) != 3 {
+		t.Fatalf("Wrong wrapper count : got %d, want %d", len(wrappers), 3)
+	}
+
+	if coverage[1].Signature != wrappers[0] {
+		t.Errorf("Wrong reply to signature : got %v, want %v", coverage[1].Signature, wrappers[0])
+	}
+
+	if coverage[2].Signature != wrappers[0] {
+		t.Errorf("Wrong inner signature : got %v, want %v", coverage[2].Signature, wrappers[0])
+	}
+
+	if coverage.InnermostSignature() != wrappers[2] {
+		t.Errorf("Wrong innermost signature : got %v, want %v", coverage.InnermostSignature(),
+			wrappers[2])
+	}
+
+	err = coverage.CheckSecurityWrappers(SecurityProtocolIDs)
+	if errors.Cause(err) != ErrUnsignedWrapper {
+		t.Errorf("Wrong check error : got %v, want %s", err, ErrUnsignedWrapper)
+	}
+
+	outerSignature := wrappers[0].(SignatureWrapper)
+	if err := coverage.CheckSecurityWrappersSignedBy(outerSignature,
+		SecurityProtocolIDs); err != nil {
+		t.Errorf("Failed to check wrappers signed by outer signature : %s", err)
+	}
+
+	if len(coverage.SignedBy(outerSignature)) != 2 {
+		t.Errorf("Wrong signed by count : got %d, want %d",
+			len(coverage.SignedBy(outerSignature)), 2)
+	}
+
+	// Security wrappers on unsigned messages are rejected.
+	unsignedScript, err := Wrap(&id, replyTo)
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+
+	protocols.SetUnsignedWrapperPolicy(UnsignedWrappersRejected)
+
+	_, _, err = protocols.Parse(unsignedScript)
+	if errors.Cause(err) != ErrUnsignedWrapper {
+		t.Errorf("Wrong unsigned parse error : got %v, want %s", err, ErrUnsignedWrapper)
+	}
+
+	_, _, err = protocols.Parse(script)
+	if errors.Cause(err) != ErrUnsignedWrapper {
+		t.Errorf("Wrong parse error : got %v, want %s", err, ErrUnsignedWrapper)
+	}
+}
@@ -0,0 +1,321 @@
+package channels
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	envelopeV1 "github.com/tokenized/envelope/pkg/golang/envelope/v1"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	EncryptedMessagesVersion = uint8(0)
+
+	// EncryptedStatusEncryptionRequired is a code specific to the encryption protocol that is
+	// placed in a Reject message to signify that a message is considered invalid if it is not
+	// encrypted.
+	EncryptedStatusEncryptionRequired = uint32(1)
+
+	// EncryptedStatusDecryptFailed is a code specific to the encryption protocol that is placed in
+	// a Reject message to signify that a message could not be decrypted. Either the wrong keys were
+	// used or the encrypted data is invalid.
+	EncryptedStatusDecryptFailed = uint32(2)
+)
+
+var (
+	ProtocolIDEncryptedMessages = envelope.ProtocolID("ENC") // Protocol ID for encrypted messages
+
+	encryptedCodec = NewCodec(ProtocolIDEncryptedMessages, EncryptedMessagesVersion, "encrypted",
+		&Encrypted{}).SetCantWrap()
+
+	ErrEncryptKeyMissing = errors.New("Encrypt Key Missing")
+
+	// ErrDecryptFailed is returned when the encrypted data wasn't encrypted with the shared key or
+	// was modified after it was encrypted.
+	ErrDecryptFailed = errors.New("Decrypt Failed")
+)
+
+// EncryptedProtocol parses encrypted messages. When it is given the local relationship key it
+// decrypts the payload so the contained protocols can be parsed. Otherwise the encrypted message is
+// returned as is.
+type EncryptedProtocol struct {
+	key       *bitcoin.Key
+	publicKey *bitcoin.PublicKey
+}
+
+// NewEncryptedProtocol creates an encryption protocol that can decrypt messages with the local
+// key and the counterparty's public key. The counterparty's public key is only used when the
+// message doesn't include the sender's public key.
+func NewEncryptedProtocol(key *bitcoin.Key, publicKey *bitcoin.PublicKey) *EncryptedProtocol {
+	return &EncryptedProtocol{
+		key:       key,
+		publicKey: publicKey,
+	}
+}
+
+func (*EncryptedProtocol) ProtocolID() envelope.ProtocolID {
+	return ProtocolIDEncryptedMessages
+}
+
+func (p *EncryptedProtocol) Parse(payload envelope.Data) (Message, envelope.Data, error) {
+	encrypted, payload, err := ParseEncrypted(payload)
+	if err != nil {
+		return nil, payload, err
+	}
+	if encrypted == nil || p.key == nil {
+		return encrypted, payload, nil
+	}
+
+	publicKey := encrypted.SenderPublicKey
+	if publicKey == nil {
+		publicKey = p.publicKey
+	}
+	if publicKey == nil {
+		return nil, payload, errors.Wrap(ErrPublicKeyMissing, "sender")
+	}
+
+	decrypted, err := encrypted.Decrypt(*p.key, *publicKey)
+	if err != nil {
+		return nil, payload, errors.Wrap(err, "decrypt")
+	}
+
+	// Retain the decrypted payload so the message can be wrapped again without the keys.
+	encrypted.decrypted = &decrypted
+
+	return encrypted, decrypted, nil
+}
+
+func (*EncryptedProtocol) ResponseCodeToString(code uint32) string {
+	return EncryptedResponseCodeToString(code)
+}
+
+// Encrypted is a message containing an encrypted payload. The encryption key is derived with ECDH
+// from the two relationship keys after each is derived with the derivation hash, so only the two
+// parties of the relationship can decrypt it. The payload is encrypted with AES-GCM so changes to
+// the encrypted data are detected. The encrypted data is the nonce followed by the ciphertext.
+type Encrypted struct {
+	SenderPublicKey *bitcoin.PublicKey `bsor:"1" json:"sender_public_key,omitempty"`
+	DerivationHash  bitcoin.Hash32     `bsor:"2" json:"derivation_hash"`
+	EncryptedData   bitcoin.Hex        `bsor:"3" json:"encrypted_data"`
+
+	key       *bitcoin.Key
+	publicKey *bitcoin.PublicKey
+
+	// decrypted is the payload that was decrypted when the message was parsed.
+	decrypted *envelope.Data
+}
+
+// NewEncrypted creates an encryption wrapper that will encrypt the payload for the owner of the
+// public key. If the derivation hash is nil then a random one is used.
+func NewEncrypted(key bitcoin.Key, publicKey bitcoin.PublicKey, derivationHash *bitcoin.Hash32,
+	includeKey bool) *Encrypted {
+
+	result := &Encrypted{
+		key:       &key,
+		publicKey: &publicKey,
+	}
+
+	if derivationHash != nil {
+		result.DerivationHash = *derivationHash
+	} else {
+		result.DerivationHash = RandomHash()
+	}
+
+	if includeKey {
+		pk := key.PublicKey()
+		result.SenderPublicKey = &pk
+	}
+
+	return result
+}
+
+func (*Encrypted) ProtocolID() envelope.ProtocolID {
+	return ProtocolIDEncryptedMessages
+}
+
+// Wrap encrypts the payload and returns the encrypted message. A parsed message can't encrypt
+// without the keys so it returns the original encrypted data when the payload is the one that
+// was decrypted and ErrEncryptKeyMissing when it has changed.
+func (m *Encrypted) Wrap(payload envelope.Data) (envelope.Data, error) {
+	if m.key != nil {
+		if err := m.encrypt(payload); err != nil {
+			return payload, errors.Wrap(err, "encrypt")
+		}
+	} else if len(payload.ProtocolIDs) != 0 {
+		if m.decrypted == nil {
+			return payload, ErrEncryptKeyMissing
+		}
+
+		unchanged, err := equalPayloads(payload, *m.decrypted)
+		if err != nil {
+			return payload, errors.Wrap(err, "compare")
+		}
+		if !unchanged {
+			return payload, errors.Wrap(ErrEncryptKeyMissing, "payload changed")
+		}
+	}
+
+	// The contained protocol IDs and payload are hidden in the encrypted data.
+	return encryptedCodec.Write(m)
+}
+
+func (m *Encrypted) encrypt(payload envelope.Data) error {
+	secret, err := m.secret(*m.key, *m.publicKey)
+	if err != nil {
+		return errors.Wrap(err, "secret")
+	}
+
+	script, err := envelopeV1.Wrap(payload).Script()
+	if err != nil {
+		return errors.Wrap(err, "script")
+	}
+
+	aead, err := newAEAD(secret)
+	if err != nil {
+		return errors.Wrap(err, "aead")
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return errors.Wrap(err, "nonce")
+	}
+
+	encryptedData := aead.Seal(nonce, nonce, script, nil)
+
+	m.EncryptedData = encryptedData
+	return nil
+}
+
+// equalPayloads returns true if the payloads serialize to the same script.
+func equalPayloads(l, r envelope.Data) (bool, error) {
+	lScript, err := envelopeV1.Wrap(l).Script()
+	if err != nil {
+		return false, err
+	}
+
+	rScript, err := envelopeV1.Wrap(r).Script()
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(lScript, rScript), nil
+}
+
+// Encrypt encrypts the payload for the owner of the public key and returns the encryption message
+// that can be used to wrap it.
+func Encrypt(payload envelope.Data, key bitcoin.Key, publicKey bitcoin.PublicKey,
+	derivationHash *bitcoin.Hash32, includeKey bool) (*Encrypted, error) {
+
+	result := NewEncrypted(key, publicKey, derivationHash, includeKey)
+	if err := result.encrypt(payload); err != nil {
+		return nil, err
+	}
+
+	result.key = nil
+	result.publicKey = nil
+	return result, nil
+}
+
+// WrapEncrypted encrypts the payload and returns the new payload containing only the encrypted
+// message.
+func WrapEncrypted(payload envelope.Data, key bitcoin.Key, publicKey bitcoin.PublicKey,
+	derivationHash *bitcoin.Hash32, includeKey bool) (envelope.Data, error) {
+
+	return NewEncrypted(key, publicKey, derivationHash, includeKey).Wrap(payload)
+}
+
+// Decrypt decrypts the contained payload using the local key and the public key of the other
+// party.
+func (m Encrypted) Decrypt(key bitcoin.Key, publicKey bitcoin.PublicKey) (envelope.Data, error) {
+	secret, err := m.secret(key, publicKey)
+	if err != nil {
+		return envelope.Data{}, errors.Wrap(err, "secret")
+	}
+
+	aead, err := newAEAD(secret)
+	if err != nil {
+		return envelope.Data{}, errors.Wrap(err, "aead")
+	}
+
+	if len(m.EncryptedData) < aead.NonceSize() {
+		return envelope.Data{}, errors.Wrap(ErrDecryptFailed, "missing nonce")
+	}
+
+	nonce := m.EncryptedData[:aead.NonceSize()]
+	script, err := aead.Open(nil, nonce, m.EncryptedData[aead.NonceSize():], nil)
+	if err != nil {
+		return envelope.Data{}, errors.Wrap(ErrDecryptFailed, err.Error())
+	}
+
+	payload, err := ParseEnvelope(script)
+	if err != nil {
+		return envelope.Data{}, errors.Wrap(err, "envelope")
+	}
+
+	return payload, nil
+}
+
+// newAEAD returns the AES-GCM cipher for the shared secret.
+func newAEAD(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, errors.Wrap(err, "aes")
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "gcm")
+	}
+
+	return aead, nil
+}
+
+// secret calculates the shared encryption key from ECDH of the keys derived with the derivation
+// hash.
+func (m Encrypted) secret(key bitcoin.Key, publicKey bitcoin.PublicKey) ([]byte, error) {
+	derivedKey, err := key.AddHash(m.DerivationHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "derive key")
+	}
+
+	derivedPublicKey, err := publicKey.AddHash(m.DerivationHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "derive public key")
+	}
+
+	secret, err := bitcoin.ECDHSecret(derivedKey, derivedPublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "ecdh")
+	}
+
+	hash := sha256.Sum256(secret)
+	return hash[:], nil
+}
+
+// ParseEncrypted parses the encrypted message. The returned payload is empty because the contained
+// protocols are encrypted.
+func ParseEncrypted(payload envelope.Data) (*Encrypted, envelope.Data, error) {
+	msg, payload, err := encryptedCodec.Parse(payload)
+	if msg == nil || err != nil {
+		return nil, payload, err
+	}
+
+	return msg.(*Encrypted), payload, nil
+}
+
+func EncryptedResponseCodeToString(code uint32) string {
+	switch code {
+	case EncryptedStatusEncryptionRequired:
+		return "encryption_required"
+	case EncryptedStatusDecryptFailed:
+		return "decrypt_failed"
+	default:
+		return "parse_error"
+	}
+}
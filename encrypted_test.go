@@ -0,0 +1,214 @@
+package channels
+
+import (
+	"bytes"
+	"testing"
+
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	envelopeV1 "github.com/tokenized/envelope/pkg/golang/envelope/v1"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+func Test_Encrypted(t *testing.T) {
+	senderKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	receiverKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	otherKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+
+	id := UUID(uuid.New())
+	note := NewNote("Secret note")
+	encrypted := NewEncrypted(senderKey, receiverKey.PublicKey(), nil, true)
+
+	script, err := Wrap(&id, note, encrypted)
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+	t.Logf("Script : %s", script)
+
+	if bytes.Contains(script, []byte(note.Note)) {
+		t.Fatalf("Script contains unencrypted note")
+	}
+
+	// Without the key the encrypted message is returned.
+	protocols := NewProtocols(NewEncryptedProtocol(nil, nil), NewNoteProtocol(),
+		NewUUIDProtocol())
+	msg, wrappers, err := protocols.Parse(script)
+	if err != nil {
+		t.Fatalf("Failed to parse without key : %s", err)
+	}
+
+	if _, ok := msg.(*Encrypted); !ok {
+		t.Fatalf("Message should be encrypted : %T", msg)
+	}
+
+	if len(wrappers) != 0 {
+		t.Fatalf("Wrong wrapper count : got %d, want %d", len(wrappers), 0)
+	}
+
+	// With the wrong key decrypt fails.
+	protocols = NewProtocols(NewEncryptedProtocol(&otherKey, nil), NewNoteProtocol(),
+		NewUUIDProtocol())
+	if _, _, err := protocols.Parse(script); errors.Cause(err) != ErrDecryptFailed {
+		t.Fatalf("Wrong wrong key error : got %v, want %s", err, ErrDecryptFailed)
+	}
+
+	// Modified encrypted data fails to decrypt.
+	tampered := *msg.(*Encrypted)
+	tampered.EncryptedData = make(bitcoin.Hex, len(encrypted.EncryptedData))
+	copy(tampered.EncryptedData, encrypted.EncryptedData)
+	tampered.EncryptedData[len(tampered.EncryptedData)/2] ^= 0x01
+	if _, err := tampered.Decrypt(receiverKey,
+		senderKey.PublicKey()); errors.Cause(err) != ErrDecryptFailed {
+		t.Fatalf("Wrong tampered error : got %v, want %s", err, ErrDecryptFailed)
+	}
+
+	protocols = NewProtocols(NewEncryptedProtocol(&receiverKey, nil), NewNoteProtocol(),
+		NewUUIDProtocol())
+	msg, wrappers, err = protocols.Parse(script)
+	if err != nil {
+		t.Fatalf("Failed to parse : %s", err)
+	}
+
+	readID, ok := msg.(*UUID)
+	if !ok {
+		t.Fatalf("Message should be a UUID : %T", msg)
+	}
+
+	if !bytes.Equal(readID[:], id[:]) {
+		t.Errorf("Wrong UUID : got %s, want %s", uuid.UUID(*readID), uuid.UUID(id))
+	}
+
+	if len(wrappers) != 2 {
+		t.Fatalf("Wrong wrapper count : got %d, want %d", len(wrappers), 2)
+	}
+
+	if _, ok := wrappers[0].(*Encrypted); !ok {
+		t.Errorf("First wrapper should be encrypted : %T", wrappers[0])
+	}
+
+	readNote, ok := wrappers[1].(*Note)
+	if !ok {
+		t.Fatalf("Second wrapper should be a note : %T", wrappers[1])
+	}
+
+	if readNote.Note != note.Note {
+		t.Errorf("Wrong note : got %s, want %s", readNote.Note, note.Note)
+	}
+
+	// The parsed message can be wrapped again without the keys.
+	rewrapped, err := Wrap(readID, readNote, wrappers[0])
+	if err != nil {
+		t.Fatalf("Failed to wrap again : %s", err)
+	}
+
+	if !bytes.Equal(rewrapped, script) {
+		t.Fatalf("Wrong rewrapped script : \n  got  %s\n  want %s", rewrapped, script)
+	}
+
+	// Changed contents can't be encrypted without the keys.
+	if _, err := Wrap(readID, NewNote("Changed note"),
+		wrappers[0]); errors.Cause(err) != ErrEncryptKeyMissing {
+		t.Fatalf("Wrong changed wrap error : got %v, want %s", err, ErrEncryptKeyMissing)
+	}
+}
+
+// testReplacer is a wrapper protocol that replaces the payload without consuming its protocol
+// ID, like encryption does.
+type testReplacer struct{}
+
+func (*testReplacer) ProtocolID() envelope.ProtocolID {
+	return envelope.ProtocolID("RPL")
+}
+
+func (r *testReplacer) Wrap(payload envelope.Data) (envelope.Data, error) {
+	return payload, nil
+}
+
+func (r *testReplacer) Parse(payload envelope.Data) (Message, envelope.Data, error) {
+	return r, envelope.Data{
+		ProtocolIDs: envelope.ProtocolIDs{ProtocolIDUUID, ProtocolIDNote},
+		Payload:     payload.Payload,
+	}, nil
+}
+
+func (*testReplacer) ResponseCodeToString(code uint32) string {
+	return "parse_error"
+}
+
+func Test_ParseDidntConsumeProtocol(t *testing.T) {
+	id := UUID(uuid.New())
+	script, err := Wrap(&id, NewNote("note"))
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+
+	payload, err := ParseEnvelope(script)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope : %s", err)
+	}
+	payload.ProtocolIDs[0] = (&testReplacer{}).ProtocolID()
+
+	replaced, err := envelopeV1.Wrap(payload).Script()
+	if err != nil {
+		t.Fatalf("Failed to create script : %s", err)
+	}
+
+	// Only encryption is allowed to keep the protocol count the same.
+	protocols := NewProtocols(&testReplacer{}, NewNoteProtocol(), NewUUIDProtocol())
+	if _, _, err := protocols.Parse(replaced); errors.Cause(err) != ErrParseDidntConsumeProtocol {
+		t.Fatalf("Wrong parse error : got %v, want %s", err, ErrParseDidntConsumeProtocol)
+	}
+}
+
+func Test_Encrypted_WithoutKey(t *testing.T) {
+	senderKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	receiverKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	senderPublicKey := senderKey.PublicKey()
+
+	id := UUID(uuid.New())
+	encrypted := NewEncrypted(senderKey, receiverKey.PublicKey(), nil, false)
+
+	script, err := Wrap(&id, encrypted)
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+
+	protocols := NewProtocols(NewEncryptedProtocol(&receiverKey, nil), NewUUIDProtocol())
+	if _, _, err := protocols.Parse(script); errors.Cause(err) != ErrPublicKeyMissing {
+		t.Fatalf("Wrong parse error : got %v, want %s", err, ErrPublicKeyMissing)
+	}
+
+	protocols = NewProtocols(NewEncryptedProtocol(&receiverKey, &senderPublicKey),
+		NewUUIDProtocol())
+	msg, _, err := protocols.Parse(script)
+	if err != nil {
+		t.Fatalf("Failed to parse : %s", err)
+	}
+
+	if _, ok := msg.(*UUID); !ok {
+		t.Fatalf("Message should be a UUID : %T", msg)
+	}
+}
+
+func Test_Encrypted_WireFormat(t *testing.T) {
+	_, publicKey, hash, _ := testWireValues(t)
+
+	encrypted := &Encrypted{
+		SenderPublicKey: &publicKey,
+		DerivationHash:  hash,
+		EncryptedData:   bitcoin.Hex{0x01, 0x02, 0x03, 0x04},
+	}
+
+	payload, err := encrypted.Wrap(envelope.Data{})
+	if err != nil {
+		t.Fatalf("Failed to wrap encrypted : %s", err)
+	}
+
+	testWireFormat(t, payload, "006a02bd015103454e435800535121"+testWirePublicKey+
+		"5220000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f530401020304",
+		func(payload envelope.Data) (Wrapper, envelope.Data, error) {
+			return ParseEncrypted(payload)
+		})
+}
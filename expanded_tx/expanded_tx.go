@@ -1,16 +1,9 @@
 package expanded_tx
 
 import (
-	"bytes"
-	"fmt"
-
 	"github.com/tokenized/channels"
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
-	"github.com/tokenized/pkg/bitcoin"
-	"github.com/tokenized/pkg/bsor"
 	"github.com/tokenized/pkg/expanded_tx"
-
-	"github.com/pkg/errors"
 )
 
 const (
@@ -34,6 +27,9 @@ const (
 
 var (
 	ProtocolID = envelope.ProtocolID("ETX") // Protocol ID for expanded tx
+
+	codec = channels.NewCodec(ProtocolID, Version, "expanded tx", &ExpandedTxMessage{}).
+		SetCantWrap()
 )
 
 type Protocol struct{}
@@ -73,54 +69,11 @@ func (*ExpandedTxMessage) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *ExpandedTxMessage) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 func Parse(payload envelope.Data) (channels.Message, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 {
-		return nil, payload, nil
-	}
-
-	if !bytes.Equal(payload.ProtocolIDs[0], ProtocolID) {
-		return nil, payload, nil
-	}
-
-	if len(payload.ProtocolIDs) != 1 {
-		return nil, payload, errors.Wrapf(channels.ErrInvalidMessage, "expanded tx messages can't wrap")
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
-
-	if len(payload.Payload) == 0 {
-		return nil, payload, errors.Wrapf(channels.ErrInvalidMessage, "payload empty")
-	}
-
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(channels.ErrUnsupportedVersion,
-			fmt.Sprintf("expanded tx %d", version))
-	}
-
-	result := &ExpandedTxMessage{}
-	payloads, err := bsor.Unmarshal(payload.Payload[1:], result)
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "unmarshal")
-	}
-	payload.Payload = payloads
-
-	return result, payload, nil
+	return codec.Parse(payload)
 }
 
 func ResponseCodeToString(code uint32) string {
@@ -0,0 +1,31 @@
+package expanded_tx
+
+import (
+	"testing"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/wire"
+)
+
+func Fuzz_Parse(f *testing.F) {
+	for _, msg := range []channels.Writer{
+		&ExpandedTxMessage{Tx: wire.NewMsgTx(1)},
+	} {
+		script, err := channels.Wrap(msg)
+		if err != nil {
+			f.Fatalf("Failed to wrap %T : %s", msg, err)
+		}
+		f.Add([]byte(script))
+	}
+
+	protocols := channels.NewProtocols(NewProtocol())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		script := bitcoin.Script(b)
+		if payload, err := channels.ParseEnvelope(script); err == nil {
+			Parse(payload)
+		}
+
+		protocols.Parse(script)
+	})
+}
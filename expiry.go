@@ -1,20 +1,24 @@
 package channels
 
 import (
-	"bytes"
-	"fmt"
-
-	"github.com/pkg/errors"
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
 	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
 )
 
 const (
 	ExpiryVersion = uint8(0)
+
+	// ExpiryStatusExpired is a code specific to the expiry protocol that is placed in a Reject
+	// message to signify that a message was received after it expired.
+	ExpiryStatusExpired = uint32(1)
 )
 
 var (
 	ProtocolIDExpiry = envelope.ProtocolID("EXP") // Protocol ID for channel expirys
+
+	expiryCodec = NewCodec(ProtocolIDExpiry, ExpiryVersion, "expiry", new(ExpiryMessage))
 )
 
 type ExpiryProtocol struct{}
@@ -54,64 +58,46 @@ func (*ExpiryMessage) ProtocolID() envelope.ProtocolID {
 }
 
 func (r *ExpiryMessage) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(ExpiryVersion))}
-
-	// Message
-	item := bitcoin.PushNumberScriptItemUnsigned(uint64(*r))
-	payload = append(payload, item)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolIDExpiry}, payload}, nil
+	return expiryCodec.Write(r)
 }
 
 func (r *ExpiryMessage) Wrap(payload envelope.Data) (envelope.Data, error) {
-	// Version
-	scriptItems := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(ExpiryVersion))}
-
-	// Message
-	item := bitcoin.PushNumberScriptItemUnsigned(uint64(*r))
-	scriptItems = append(scriptItems, item)
-
-	payload.ProtocolIDs = append(envelope.ProtocolIDs{ProtocolIDExpiry}, payload.ProtocolIDs...)
-	payload.Payload = append(scriptItems, payload.Payload...)
+	return expiryCodec.Wrap(r, payload)
+}
 
-	return payload, nil
+func (r *ExpiryMessage) MarshalScriptItems() (bitcoin.ScriptItems, error) {
+	return bitcoin.ScriptItems{bitcoin.PushNumberScriptItemUnsigned(uint64(*r))}, nil
 }
 
-func ParseExpiry(payload envelope.Data) (*ExpiryMessage, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 ||
-		!bytes.Equal(payload.ProtocolIDs[0], ProtocolIDExpiry) {
-		return nil, payload, nil
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
+func (r *ExpiryMessage) UnmarshalScriptItems(scriptItems bitcoin.ScriptItems) (bitcoin.ScriptItems,
+	error) {
 
-	if len(payload.Payload) < 2 {
-		return nil, payload, errors.Wrapf(ErrInvalidMessage,
-			"not enough fee requirements push ops: %d", len(payload.Payload))
+	if len(scriptItems) == 0 {
+		return nil, errors.Wrap(ErrInvalidMessage, "missing expiry")
 	}
 
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
+	value, err := ScriptNumberValueUnsigned(scriptItems[0])
 	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(ErrUnsupportedVersion,
-			fmt.Sprintf("fee requirements: %d", version))
+		return nil, errors.Wrap(err, "value")
 	}
+	*r = ExpiryMessage(value)
 
-	value, err := bitcoin.ScriptNumberValueUnsigned(payload.Payload[1])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "value")
-	}
-	result := ExpiryMessage(value)
+	return scriptItems[1:], nil
+}
 
-	payload.Payload = payload.Payload[2:]
+func ParseExpiry(payload envelope.Data) (*ExpiryMessage, envelope.Data, error) {
+	msg, payload, err := expiryCodec.Parse(payload)
+	if msg == nil {
+		return nil, payload, err
+	}
 
-	return &result, payload, nil
+	return msg.(*ExpiryMessage), payload, nil
 }
 
 func ExpiryResponseCodeToString(code uint32) string {
 	switch code {
+	case ExpiryStatusExpired:
+		return "expired"
 	default:
 		return "parse_error"
 	}
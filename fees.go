@@ -1,15 +1,8 @@
 package channels
 
 import (
-	"bytes"
-	"fmt"
-
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
-	"github.com/tokenized/pkg/bitcoin"
-	"github.com/tokenized/pkg/bsor"
 	"github.com/tokenized/pkg/fees"
-
-	"github.com/pkg/errors"
 )
 
 const (
@@ -18,6 +11,9 @@ const (
 
 var (
 	ProtocolIDFeeRequirements = envelope.ProtocolID("FEES") // Protocol ID for channel fee requirements
+
+	feeRequirementsCodec = NewCodec(ProtocolIDFeeRequirements, FeeRequirementsVersion,
+		"fee requirements", &FeeRequirementsMessage{})
 )
 
 type FeeRequirementsProtocol struct{}
@@ -58,65 +54,20 @@ func (*FeeRequirementsMessage) ProtocolID() envelope.ProtocolID {
 }
 
 func (r *FeeRequirementsMessage) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(FeeRequirementsVersion))}
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(r)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolIDFeeRequirements}, payload}, nil
+	return feeRequirementsCodec.Write(r)
 }
 
 func (r *FeeRequirementsMessage) Wrap(payload envelope.Data) (envelope.Data, error) {
-	// Version
-	scriptItems := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(FeeRequirementsVersion))}
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(r)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	scriptItems = append(scriptItems, msgScriptItems...)
-
-	payload.ProtocolIDs = append(envelope.ProtocolIDs{ProtocolIDFeeRequirements}, payload.ProtocolIDs...)
-	payload.Payload = append(scriptItems, payload.Payload...)
-
-	return payload, nil
+	return feeRequirementsCodec.Wrap(r, payload)
 }
 
 func ParseFeeRequirements(payload envelope.Data) (*FeeRequirementsMessage, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 ||
-		!bytes.Equal(payload.ProtocolIDs[0], ProtocolIDFeeRequirements) {
-		return nil, payload, nil
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
-
-	if len(payload.Payload) < 2 {
-		return nil, payload, errors.Wrapf(ErrInvalidMessage,
-			"not enough fee requirements push ops: %d", len(payload.Payload))
-	}
-
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(ErrUnsupportedVersion,
-			fmt.Sprintf("fee requirements: %d", version))
-	}
-
-	result := &FeeRequirementsMessage{}
-	payloads, err := bsor.Unmarshal(payload.Payload[1:], result)
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "unmarshal")
+	msg, payload, err := feeRequirementsCodec.Parse(payload)
+	if msg == nil {
+		return nil, payload, err
 	}
-	payload.Payload = payloads
 
-	return result, payload, nil
+	return msg.(*FeeRequirementsMessage), payload, nil
 }
 
 func FeeRequirementsResponseCodeToString(code uint32) string {
@@ -0,0 +1,140 @@
+package channels
+
+import (
+	"testing"
+
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/fees"
+	"github.com/tokenized/pkg/merchant_api"
+
+	"github.com/google/uuid"
+)
+
+var fuzzKey, _ = bitcoin.GenerateKey(bitcoin.MainNet)
+
+// fuzzSeeds returns valid scripts containing every protocol in this package.
+func fuzzSeeds(f *testing.F) []bitcoin.Script {
+	key2, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	handle := "test@tokenized.id"
+	txid := TxID(RandomHash())
+	msg := UUID(uuid.New())
+
+	wrappers := []Wrapper{
+		NewSignature(fuzzKey, nil, true),
+		NewMultiSignature([]bitcoin.Key{fuzzKey, key2}, nil, true),
+		NewEncrypted(key2, fuzzKey.PublicKey(), nil, true),
+		&ReplyTo{Handle: &handle},
+		&Response{Status: StatusReject, CodeProtocolID: ProtocolIDUUID, Code: 1, Note: "note"},
+		NewFeeRequirementsMessage(fees.FeeRequirements{
+			{FeeType: merchant_api.FeeTypeStandard, Satoshis: 500, Bytes: 1000},
+		}),
+		NewExpiryMessage(Now()),
+		NewTimeMessage(Now()),
+		&msg,
+		&MessageID{MessageID: 12},
+		NewStringID("thread"),
+		&txid,
+		NewNote("note"),
+		NewReplayProtection(uuid.New().String()),
+	}
+
+	var result []bitcoin.Script
+	for _, wrapper := range wrappers {
+		script, err := Wrap(&msg, wrapper)
+		if err != nil {
+			f.Fatalf("Failed to wrap %s : %s", wrapper.ProtocolID(), err)
+		}
+		result = append(result, script)
+	}
+
+	script, err := Wrap(&msg, wrappers...)
+	if err != nil {
+		f.Fatalf("Failed to wrap all : %s", err)
+	}
+	result = append(result, script)
+
+	return result
+}
+
+func fuzzProtocols() *Protocols {
+	result := NewProtocols(NewSignedProtocol(), NewMultiSignedProtocol(),
+		NewEncryptedProtocol(&fuzzKey, nil), NewReplyToProtocol(), NewResponseProtocol(),
+		NewFeeRequirementsProtocol(), NewExpiryProtocol(), NewTimeProtocol(), NewUUIDProtocol(),
+		NewMessageIDProtocol(), NewStringIDProtocol(), NewTxIDProtocol(), NewNoteProtocol(),
+		NewReplayProtectionProtocol())
+	result.SetLenient(true)
+	return result
+}
+
+// fuzzProtocol verifies that the protocol and a full parse don't panic on any script.
+func fuzzProtocol(f *testing.F, protocol Protocol) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add([]byte(seed))
+	}
+
+	protocols := fuzzProtocols()
+	f.Fuzz(func(t *testing.T, b []byte) {
+		script := bitcoin.Script(b)
+		if payload, err := ParseEnvelope(script); err == nil {
+			protocol.Parse(payload)
+		}
+
+		protocols.Parse(script)
+	})
+}
+
+func Fuzz_Signed(f *testing.F) {
+	fuzzProtocol(f, NewSignedProtocol())
+}
+
+func Fuzz_MultiSigned(f *testing.F) {
+	fuzzProtocol(f, NewMultiSignedProtocol())
+}
+
+func Fuzz_Encrypted(f *testing.F) {
+	fuzzProtocol(f, NewEncryptedProtocol(&fuzzKey, nil))
+}
+
+func Fuzz_ReplyTo(f *testing.F) {
+	fuzzProtocol(f, NewReplyToProtocol())
+}
+
+func Fuzz_Response(f *testing.F) {
+	fuzzProtocol(f, NewResponseProtocol())
+}
+
+func Fuzz_FeeRequirements(f *testing.F) {
+	fuzzProtocol(f, NewFeeRequirementsProtocol())
+}
+
+func Fuzz_Expiry(f *testing.F) {
+	fuzzProtocol(f, NewExpiryProtocol())
+}
+
+func Fuzz_Time(f *testing.F) {
+	fuzzProtocol(f, NewTimeProtocol())
+}
+
+func Fuzz_UUID(f *testing.F) {
+	fuzzProtocol(f, NewUUIDProtocol())
+}
+
+func Fuzz_MessageID(f *testing.F) {
+	fuzzProtocol(f, NewMessageIDProtocol())
+}
+
+func Fuzz_StringID(f *testing.F) {
+	fuzzProtocol(f, NewStringIDProtocol())
+}
+
+func Fuzz_TxID(f *testing.F) {
+	fuzzProtocol(f, NewTxIDProtocol())
+}
+
+func Fuzz_Note(f *testing.F) {
+	fuzzProtocol(f, NewNoteProtocol())
+}
+
+func Fuzz_ReplayProtection(f *testing.F) {
+	fuzzProtocol(f, NewReplayProtectionProtocol())
+}
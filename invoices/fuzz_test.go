@@ -0,0 +1,36 @@
+package invoices
+
+import (
+	"testing"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/pkg/bitcoin"
+)
+
+func Fuzz_Parse(f *testing.F) {
+	for _, msg := range []channels.Writer{
+		&RequestMenu{},
+		&Menu{},
+		&PurchaseOrder{},
+		&Invoice{},
+		&TransferRequest{},
+		&Transfer{},
+		&TransferAccept{},
+	} {
+		script, err := channels.Wrap(msg)
+		if err != nil {
+			f.Fatalf("Failed to wrap %T : %s", msg, err)
+		}
+		f.Add([]byte(script))
+	}
+
+	protocols := channels.NewProtocols(NewProtocol())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		script := bitcoin.Script(b)
+		if payload, err := channels.ParseEnvelope(script); err == nil {
+			Parse(payload)
+		}
+
+		protocols.Parse(script)
+	})
+}
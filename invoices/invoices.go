@@ -6,9 +6,7 @@ import (
 
 	"github.com/tokenized/channels"
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
-	envelopeV1 "github.com/tokenized/envelope/pkg/golang/envelope/v1"
 	"github.com/tokenized/pkg/bitcoin"
-	"github.com/tokenized/pkg/bsor"
 	"github.com/tokenized/pkg/expanded_tx"
 	"github.com/tokenized/pkg/fees"
 	"github.com/tokenized/pkg/wire"
@@ -79,6 +77,18 @@ var (
 
 	ErrUnsupportedInvoicesMessage = errors.New("Unsupported Invoices Message")
 	ErrInvoiceMissing             = errors.New("Invoice Missing")
+
+	codec = channels.NewTypedCodec(ProtocolID, Version, "invoices",
+		ErrUnsupportedInvoicesMessage, channels.CodecMessageTypes{
+			{Type: uint64(MessageTypeRequestMenu), Name: "request_menu", Message: &RequestMenu{}},
+			{Type: uint64(MessageTypeMenu), Name: "menu", Message: &Menu{}},
+			{Type: uint64(MessageTypePurchaseOrder), Name: "purchase_order", Message: &PurchaseOrder{}},
+			{Type: uint64(MessageTypeInvoice), Name: "invoice", Message: &Invoice{}},
+			{Type: uint64(MessageTypeTransferRequest), Name: "transfer_request",
+				Message: &TransferRequest{}},
+			{Type: uint64(MessageTypeTransfer), Name: "transfer", Message: &Transfer{}},
+			{Type: uint64(MessageTypeTransferAccept), Name: "accept", Message: &TransferAccept{}},
+		}).SetCantWrap()
 )
 
 type MessageType uint8
@@ -139,20 +149,7 @@ func (*RequestMenu) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *RequestMenu) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload, bitcoin.PushNumberScriptItem(int64(MessageTypeRequestMenu)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 // Menu represents a set of items available to include in an invoice.
@@ -165,20 +162,7 @@ func (*Menu) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *Menu) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload, bitcoin.PushNumberScriptItem(int64(MessageTypeMenu)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 // PurchaseOrder contains items the buyer wishes to purchase.
@@ -193,20 +177,7 @@ func (*PurchaseOrder) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *PurchaseOrder) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload, bitcoin.PushNumberScriptItem(int64(MessageTypePurchaseOrder)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 // Invoice is a message created by the vendor representing an approved set of items to buy. This is
@@ -229,20 +200,7 @@ func (*Invoice) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *Invoice) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload, bitcoin.PushNumberScriptItem(int64(MessageTypeInvoice)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 // TransferRequest is an incomplete tx that includes an output containing the Invoice message and
@@ -257,21 +215,7 @@ func (*TransferRequest) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *TransferRequest) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload,
-		bitcoin.PushNumberScriptItem(int64(MessageTypeTransferRequest)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 // Transfer is a payment transaction that embeds the approved invoice.
@@ -284,20 +228,7 @@ func (*Transfer) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *Transfer) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload, bitcoin.PushNumberScriptItem(int64(MessageTypeTransfer)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 // Fulfills verifies that all inputs and outputs in the transfer request are in the transfer.
@@ -349,20 +280,7 @@ func (*TransferAccept) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *TransferAccept) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload, bitcoin.PushNumberScriptItem(int64(MessageTypeTransferAccept)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 // Item is something that can be included in an invoice. Commonly a product or service.
@@ -452,58 +370,13 @@ type InvoiceItem struct {
 type InvoiceItems []*InvoiceItem
 
 func Parse(payload envelope.Data) (channels.Message, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 {
-		return nil, payload, nil
-	}
-
-	if !bytes.Equal(payload.ProtocolIDs[0], ProtocolID) {
-		return nil, payload, nil
-	}
-
-	if len(payload.ProtocolIDs) != 1 {
-		return nil, envelope.Data{}, errors.Wrapf(channels.ErrInvalidMessage, "invoices can't wrap")
-	}
-
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
-
-	if len(payload.Payload) == 0 {
-		return nil, payload, errors.Wrapf(channels.ErrInvalidMessage, "payload empty")
-	}
-
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(channels.ErrUnsupportedVersion,
-			fmt.Sprintf("invoices %d", version))
-	}
-
-	messageType, err := bitcoin.ScriptNumberValue(payload.Payload[1])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "message type")
-	}
-
-	result := MessageForType(MessageType(messageType))
-	if result == nil {
-		return nil, payload, errors.Wrap(ErrUnsupportedInvoicesMessage,
-			fmt.Sprintf("%d", MessageType(messageType)))
-	}
-
-	payloads, err := bsor.Unmarshal(payload.Payload[2:], result)
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "unmarshal")
-	}
-
-	payload.Payload = payloads
-
-	return result, payload, nil
+	return codec.Parse(payload)
 }
 
 // Extract finds the Invoice message embedded in the tx.
 func Extract(tx *wire.MsgTx) (*Invoice, error) {
 	for _, txout := range tx.TxOut {
-		payload, err := envelopeV1.Parse(bytes.NewReader(txout.LockingScript))
+		payload, err := channels.ParseEnvelope(txout.LockingScript)
 		if err != nil {
 			continue
 		}
@@ -530,47 +403,12 @@ func Extract(tx *wire.MsgTx) (*Invoice, error) {
 }
 
 func MessageForType(messageType MessageType) channels.Message {
-	switch MessageType(messageType) {
-	case MessageTypeRequestMenu:
-		return &RequestMenu{}
-	case MessageTypeMenu:
-		return &Menu{}
-	case MessageTypePurchaseOrder:
-		return &PurchaseOrder{}
-	case MessageTypeInvoice:
-		return &Invoice{}
-	case MessageTypeTransferRequest:
-		return &TransferRequest{}
-	case MessageTypeTransfer:
-		return &Transfer{}
-	case MessageTypeTransferAccept:
-		return &TransferAccept{}
-	case MessageTypeInvalid:
-		return nil
-	default:
-		return nil
-	}
+	return codec.MessageForType(uint64(messageType))
 }
 
 func MessageTypeFor(message channels.Message) MessageType {
-	switch message.(type) {
-	case *RequestMenu:
-		return MessageTypeRequestMenu
-	case *Menu:
-		return MessageTypeMenu
-	case *PurchaseOrder:
-		return MessageTypePurchaseOrder
-	case *Invoice:
-		return MessageTypeInvoice
-	case *TransferRequest:
-		return MessageTypeTransferRequest
-	case *Transfer:
-		return MessageTypeTransfer
-	case *TransferAccept:
-		return MessageTypeTransferAccept
-	default:
-		return MessageTypeInvalid
-	}
+	messageType, _ := codec.MessageTypeFor(message)
+	return MessageType(messageType)
 }
 
 func (v *MessageType) UnmarshalJSON(data []byte) error {
@@ -604,48 +442,18 @@ func (v *MessageType) UnmarshalText(text []byte) error {
 }
 
 func (v *MessageType) SetString(s string) error {
-	switch s {
-	case "request_menu":
-		*v = MessageTypeRequestMenu
-	case "menu":
-		*v = MessageTypeMenu
-	case "purchase_order":
-		*v = MessageTypePurchaseOrder
-	case "invoice":
-		*v = MessageTypeInvoice
-	case "transfer_request":
-		*v = MessageTypeTransferRequest
-	case "transfer":
-		*v = MessageTypeTransfer
-	case "accept":
-		*v = MessageTypeTransferAccept
-	default:
+	messageType, ok := codec.MessageTypeForName(s)
+	if !ok {
 		*v = MessageTypeInvalid
 		return fmt.Errorf("Unknown MessageType value \"%s\"", s)
 	}
 
+	*v = MessageType(messageType)
 	return nil
 }
 
 func (v MessageType) String() string {
-	switch v {
-	case MessageTypeRequestMenu:
-		return "request_menu"
-	case MessageTypeMenu:
-		return "menu"
-	case MessageTypePurchaseOrder:
-		return "purchase_order"
-	case MessageTypeInvoice:
-		return "invoice"
-	case MessageTypeTransferRequest:
-		return "transfer_request"
-	case MessageTypeTransfer:
-		return "transfer"
-	case MessageTypeTransferAccept:
-		return "accept"
-	default:
-		return ""
-	}
+	return codec.MessageTypeName(uint64(v))
 }
 
 func ResponseCodeToString(code uint32) string {
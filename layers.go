@@ -0,0 +1,240 @@
+package channels
+
+import (
+	"bytes"
+
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	envelopeV1 "github.com/tokenized/envelope/pkg/golang/envelope/v1"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+// Layer is one protocol of a parsed message. The last layer is the message and the others are
+// wrappers, outermost first.
+type Layer struct {
+	ProtocolID envelope.ProtocolID
+	Version    uint8
+	Message    Message
+
+	// Signed is true when the layer is covered by a signature layer outside of it.
+	Signed bool
+
+	// Data is the envelope data the layer was parsed from. It contains the protocol IDs and push
+	// ops of this layer and all of the layers inside of it.
+	Data envelope.Data
+
+	// Bytes is the exact script of the push ops of this layer.
+	Bytes bitcoin.Script
+
+	// CoveredBytes is the exact script of the push ops of this layer and all of the layers inside
+	// of it.
+	CoveredBytes bitcoin.Script
+}
+
+// ParsedMessage is the result of parsing each layer of a message. The bytes of layers inside a
+// layer that replaces the payload, like encryption, are the serialization of the replaced payload
+// since they don't exist in the original script.
+type ParsedMessage struct {
+	Layers []*Layer
+
+	header   bitcoin.Script // envelope header and protocol IDs
+	complete bool
+}
+
+// Message returns the message of the innermost layer. It is nil if parsing didn't complete.
+func (m ParsedMessage) Message() Message {
+	if !m.complete || len(m.Layers) == 0 {
+		return nil
+	}
+
+	return m.Layers[len(m.Layers)-1].Message
+}
+
+// Wrappers returns the wrappers outermost first, the same as Protocols.Parse.
+func (m ParsedMessage) Wrappers() []Wrapper {
+	var result []Wrapper
+	for _, layer := range m.wrapperLayers() {
+		if wrapper, ok := layer.Message.(Wrapper); ok {
+			result = append(result, wrapper)
+		}
+	}
+
+	return result
+}
+
+// Coverage returns the signature coverage of the wrappers.
+func (m ParsedMessage) Coverage() WrapperCoverages {
+	return CalculateWrapperCoverage(m.Wrappers())
+}
+
+func (m ParsedMessage) wrapperLayers() []*Layer {
+	if m.complete && len(m.Layers) > 0 {
+		return m.Layers[:len(m.Layers)-1]
+	}
+
+	return m.Layers
+}
+
+// Script returns the original script that was parsed byte for byte.
+func (m ParsedMessage) Script() bitcoin.Script {
+	result := make(bitcoin.Script, len(m.header))
+	copy(result, m.header)
+
+	if len(m.Layers) > 0 {
+		result = append(result, m.Layers[0].CoveredBytes...)
+	}
+
+	return result
+}
+
+// newLayer returns the layer for the message parsed from the payload. Bytes must be set after the
+// number of push ops the layer consumed is known.
+func newLayer(protocolID envelope.ProtocolID, msg Message, signed bool, payload envelope.Data,
+	source bitcoin.Script, offsets []int) *Layer {
+
+	result := &Layer{
+		ProtocolID:   protocolID,
+		Message:      msg,
+		Signed:       signed,
+		Data:         payload,
+		CoveredBytes: source[offsets[0]:offsets[len(offsets)-1]:offsets[len(offsets)-1]],
+	}
+	if len(payload.Payload) > 0 {
+		if version, err := ScriptNumberValue(payload.Payload[0]); err == nil {
+			result.Version = uint8(version)
+		}
+	}
+
+	return result
+}
+
+// ParseEnvelope parses an envelope v1 script. It is the same as envelopeV1.Parse except that counts
+// are verified against the size of the script before anything is allocated since the script is
+// untrusted.
+func ParseEnvelope(script bitcoin.Script) (envelope.Data, error) {
+	payload, _, _, err := parseEnvelope(script)
+	return payload, err
+}
+
+// parseEnvelope parses an envelope and returns the offset of the start of each push op in the
+// payload. The last offset is the end of the last push op.
+func parseEnvelope(script bitcoin.Script) (envelope.Data, int, []int, error) {
+	buf := bytes.NewReader(script)
+
+	if err := envelopeV1.ParseHeader(buf); err != nil {
+		return envelope.Data{}, 0, nil, errors.Wrap(err, "header")
+	}
+
+	protocolIDCountItem, err := bitcoin.ParseScript(buf)
+	if err != nil {
+		return envelope.Data{}, 0, nil, errors.Wrap(envelope.ErrInvalidEnvelope,
+			errors.Wrap(err, "protocol id count").Error())
+	}
+
+	protocolIDCount, err := ScriptNumberValue(protocolIDCountItem)
+	if err != nil {
+		return envelope.Data{}, 0, nil, errors.Wrap(envelope.ErrInvalidEnvelope,
+			errors.Wrap(err, "protocol id count value").Error())
+	}
+	if protocolIDCount <= 0 || protocolIDCount > int64(buf.Len()) {
+		return envelope.Data{}, 0, nil, errors.Wrapf(envelope.ErrInvalidEnvelope,
+			"invalid protocol id count %d", protocolIDCount)
+	}
+
+	protocolIDs := make(envelope.ProtocolIDs, 0, protocolIDCount)
+	for i := int64(0); i < protocolIDCount; i++ {
+		item, err := bitcoin.ParseScript(buf)
+		if err != nil {
+			return envelope.Data{}, 0, nil, errors.Wrap(envelope.ErrInvalidEnvelope,
+				errors.Wrapf(err, "protocol id %d", i).Error())
+		}
+
+		switch item.Type {
+		case bitcoin.ScriptItemTypeOpCode:
+			protocolIDs = append(protocolIDs, envelope.ProtocolID{item.OpCode})
+		case bitcoin.ScriptItemTypePushData:
+			protocolIDs = append(protocolIDs, envelope.ProtocolID(item.Data))
+		default:
+			return envelope.Data{}, 0, nil, errors.Wrap(envelope.ErrInvalidEnvelope,
+				"unknown script item type")
+		}
+	}
+
+	payloadCountItem, err := bitcoin.ParseScript(buf)
+	if err != nil {
+		return envelope.Data{}, 0, nil, errors.Wrap(envelope.ErrInvalidEnvelope,
+			errors.Wrap(err, "payload count").Error())
+	}
+
+	payloadCount, err := ScriptNumberValue(payloadCountItem)
+	if err != nil {
+		return envelope.Data{}, 0, nil, errors.Wrap(envelope.ErrInvalidEnvelope,
+			errors.Wrap(err, "payload count value").Error())
+	}
+	if payloadCount < 0 || payloadCount > int64(buf.Len()) {
+		return envelope.Data{}, 0, nil, errors.Wrapf(envelope.ErrInvalidEnvelope,
+			"invalid payload count %d", payloadCount)
+	}
+
+	headerSize := len(script) - buf.Len()
+	offsets := make([]int, 0, payloadCount+1)
+	offsets = append(offsets, headerSize)
+	payload := make(bitcoin.ScriptItems, 0, payloadCount)
+	for i := int64(0); i < payloadCount; i++ {
+		item, err := bitcoin.ParseScript(buf)
+		if err != nil {
+			return envelope.Data{}, 0, nil, errors.Wrapf(err, "payload %d", i)
+		}
+
+		payload = append(payload, item)
+		offsets = append(offsets, len(script)-buf.Len())
+	}
+
+	return envelope.Data{
+		ProtocolIDs: protocolIDs,
+		Payload:     payload,
+	}, headerSize, offsets, nil
+}
+
+// normalizeScriptItem converts empty push data to OP_FALSE. They push the same value, but
+// bitcoin.ScriptNumberValue panics on empty push data. Only the value is normalized, payload items
+// are left as they are in the script so they still hash to the same signature hash.
+func normalizeScriptItem(item *bitcoin.ScriptItem) *bitcoin.ScriptItem {
+	if item.Type != bitcoin.ScriptItemTypePushData || len(item.Data) != 0 {
+		return item
+	}
+
+	return bitcoin.NewOpCodeScriptItem(bitcoin.OP_FALSE)
+}
+
+// ScriptNumberValue is bitcoin.ScriptNumberValue, but returns zero for empty push data. Protocols
+// should use it to decode numbers from untrusted scripts.
+func ScriptNumberValue(item *bitcoin.ScriptItem) (int64, error) {
+	return bitcoin.ScriptNumberValue(normalizeScriptItem(item))
+}
+
+// ScriptNumberValueUnsigned is bitcoin.ScriptNumberValueUnsigned, but returns zero for empty push
+// data.
+func ScriptNumberValueUnsigned(item *bitcoin.ScriptItem) (uint64, error) {
+	return bitcoin.ScriptNumberValueUnsigned(normalizeScriptItem(item))
+}
+
+// consumedCount returns the number of push ops consumed by a protocol's parse, or true if the
+// new payload is not the end of the previous payload. Items are compared by value at their index
+// so a protocol that copies the remaining items is still counted by what it consumed.
+func consumedCount(payload, newPayload envelope.Data) (int, bool) {
+	consumed := len(payload.Payload) - len(newPayload.Payload)
+	if consumed < 0 {
+		return 0, true
+	}
+
+	for i, item := range newPayload.Payload {
+		if item == nil || payload.Payload[consumed+i] == nil ||
+			!item.Equal(*payload.Payload[consumed+i]) {
+			return 0, true
+		}
+	}
+
+	return consumed, false
+}
@@ -0,0 +1,190 @@
+package channels
+
+import (
+	"bytes"
+	"testing"
+
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/google/uuid"
+)
+
+func Test_ParseLayers(t *testing.T) {
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+
+	id := UUID(uuid.New())
+	replyTo := &ReplyTo{Handle: stringPtr("test@test.com")}
+
+	script, err := Wrap(&id, replyTo, NewSignature(key, RandomHashPtr(), true))
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+	t.Logf("Script : %s", script)
+
+	protocols := NewProtocols(NewSignedProtocol(), NewReplyToProtocol(), NewUUIDProtocol())
+	parsed, err := protocols.ParseLayers(script)
+	if err != nil {
+		t.Fatalf("Failed to parse : %s", err)
+	}
+
+	if len(parsed.Layers) != 3 {
+		t.Fatalf("Wrong layer count : got %d, want %d", len(parsed.Layers), 3)
+	}
+
+	if !bytes.Equal(parsed.Script(), script) {
+		t.Fatalf("Wrong script : \n  got  %s\n  want %s", parsed.Script(), script)
+	}
+
+	if _, ok := parsed.Message().(*UUID); !ok {
+		t.Fatalf("Message should be a UUID : %T", parsed.Message())
+	}
+
+	if len(parsed.Wrappers()) != 2 {
+		t.Fatalf("Wrong wrapper count : got %d, want %d", len(parsed.Wrappers()), 2)
+	}
+
+	wantProtocolIDs := [][]byte{ProtocolIDSignedMessages, ProtocolIDReplyTo, ProtocolIDUUID}
+	var layerBytes []byte
+	for i, layer := range parsed.Layers {
+		t.Logf("Layer %s version %d signed %t : %s", layer.ProtocolID, layer.Version, layer.Signed,
+			layer.Bytes)
+
+		if !bytes.Equal(layer.ProtocolID, wantProtocolIDs[i]) {
+			t.Errorf("Wrong layer %d protocol id : got %s, want %s", i, layer.ProtocolID,
+				wantProtocolIDs[i])
+		}
+
+		if layer.Signed != (i > 0) {
+			t.Errorf("Wrong layer %d signed : got %t, want %t", i, layer.Signed, i > 0)
+		}
+
+		if !bytes.HasSuffix(script, layer.CoveredBytes) {
+			t.Errorf("Layer %d covered bytes are not the end of the script", i)
+		}
+
+		layerBytes = append(layerBytes, layer.Bytes...)
+	}
+
+	if !bytes.Equal(layerBytes, parsed.Layers[0].CoveredBytes) {
+		t.Errorf("Layer bytes don't match covered bytes")
+	}
+
+	// Verify the signature again from the retained data of the signed layer.
+	signature := parsed.Layers[0].Message.(*Signature)
+	hash, err := SignatureHash(parsed.Layers[1].Data)
+	if err != nil {
+		t.Fatalf("Failed to calculate signature hash : %s", err)
+	}
+
+	publicKey, err := signature.GetPublicKey()
+	if err != nil {
+		t.Fatalf("Failed to get public key : %s", err)
+	}
+
+	if !signature.Signature.Verify(*hash, *publicKey) {
+		t.Fatalf("Signature verify failed from layer data")
+	}
+}
+
+func Test_ParseLayers_Encrypted(t *testing.T) {
+	senderKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	receiverKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+
+	id := UUID(uuid.New())
+	script, err := Wrap(&id, NewSignature(senderKey, nil, true),
+		NewEncrypted(senderKey, receiverKey.PublicKey(), nil, true))
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+
+	protocols := NewProtocols(NewEncryptedProtocol(&receiverKey, nil), NewSignedProtocol(),
+		NewUUIDProtocol())
+	parsed, err := protocols.ParseLayers(script)
+	if err != nil {
+		t.Fatalf("Failed to parse : %s", err)
+	}
+
+	if len(parsed.Layers) != 3 {
+		t.Fatalf("Wrong layer count : got %d, want %d", len(parsed.Layers), 3)
+	}
+
+	if !bytes.Equal(parsed.Script(), script) {
+		t.Fatalf("Wrong script : \n  got  %s\n  want %s", parsed.Script(), script)
+	}
+
+	if err := parsed.Layers[1].Message.(*Signature).Verify(); err != nil {
+		t.Fatalf("Failed to verify signature : %s", err)
+	}
+
+	if !bytes.Equal(parsed.Layers[1].CoveredBytes,
+		append(parsed.Layers[1].Bytes, parsed.Layers[2].CoveredBytes...)) {
+		t.Errorf("Inner layer bytes don't match covered bytes")
+	}
+}
+
+func Test_ParseLayers_EmptyPush(t *testing.T) {
+	id := UUID(uuid.New())
+
+	// The version is an empty push data instead of OP_0.
+	script := bitcoin.Script(append([]byte{bitcoin.OP_FALSE, bitcoin.OP_RETURN, 0x02, 0xbd, 0x01,
+		bitcoin.OP_1, 0x04, 'U', 'U', 'I', 'D', bitcoin.OP_2, bitcoin.OP_PUSH_DATA_1, 0x00, 0x10},
+		id[:]...))
+
+	protocols := NewProtocols(NewUUIDProtocol())
+	parsed, err := protocols.ParseLayers(script)
+	if err != nil {
+		t.Fatalf("Failed to parse : %s", err)
+	}
+
+	if !bytes.Equal(parsed.Script(), script) {
+		t.Fatalf("Wrong script : \n  got  %s\n  want %s", parsed.Script(), script)
+	}
+
+	item := parsed.Layers[0].Data.Payload[0]
+	if item.Type != bitcoin.ScriptItemTypePushData || len(item.Data) != 0 {
+		t.Errorf("Wrong version item : got %s, want empty push data", item)
+	}
+
+	if msg, ok := parsed.Message().(*UUID); !ok || *msg != id {
+		t.Errorf("Wrong message : got %v, want %s", parsed.Message(), id)
+	}
+}
+
+func Test_ConsumedCount_Copied(t *testing.T) {
+	payload := envelope.Data{
+		Payload: bitcoin.ScriptItems{
+			bitcoin.NewOpCodeScriptItem(bitcoin.OP_0),
+			bitcoin.NewPushDataScriptItem([]byte{1, 2, 3}),
+			bitcoin.NewPushDataScriptItem([]byte{4, 5, 6}),
+		},
+	}
+
+	// Copies of the remaining items are still counted as consumed from the same payload.
+	copied := envelope.Data{
+		Payload: bitcoin.ScriptItems{
+			bitcoin.NewPushDataScriptItem([]byte{1, 2, 3}),
+			bitcoin.NewPushDataScriptItem([]byte{4, 5, 6}),
+		},
+	}
+
+	consumed, replaced := consumedCount(payload, copied)
+	if replaced {
+		t.Fatalf("Copied payload should not be replaced")
+	}
+
+	if consumed != 1 {
+		t.Errorf("Wrong consumed count : got %d, want %d", consumed, 1)
+	}
+
+	different := envelope.Data{
+		Payload: bitcoin.ScriptItems{
+			bitcoin.NewPushDataScriptItem([]byte{4, 5, 6}),
+			bitcoin.NewPushDataScriptItem([]byte{1, 2, 3}),
+		},
+	}
+
+	if _, replaced := consumedCount(payload, different); !replaced {
+		t.Errorf("Different payload should be replaced")
+	}
+}
@@ -0,0 +1,401 @@
+package channels
+
+import (
+	"encoding"
+	"reflect"
+
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/bsor"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxCollectionCheckDepth is how deep into a message collection lengths are checked.
+	maxCollectionCheckDepth = 64
+)
+
+var (
+	ErrLimitExceeded = errors.New("Limit Exceeded")
+)
+
+// ParseLimits limits the resources used to parse messages since they are received from untrusted
+// sources. A zero value means there is no limit.
+type ParseLimits struct {
+	// MaxScriptSize is the maximum number of bytes in the envelope script.
+	MaxScriptSize int
+
+	// MaxWrapperDepth is the maximum number of protocol layers, including the message.
+	MaxWrapperDepth int
+
+	// MaxPushCount is the maximum number of push ops in the envelope payload. Since each item of a
+	// collection is at least one push op this also limits collection lengths.
+	MaxPushCount int
+
+	// MaxPushSize is the maximum number of bytes in one push op. This limits the size of strings
+	// and binary data.
+	MaxPushSize int
+
+	// MaxCollectionLength is the maximum number of items in any collection in a message.
+	MaxCollectionLength int
+
+	// MaxUnknownWrapperSearch is the maximum number of push op splits tried when separating an
+	// unknown wrapper from the protocols it contains in lenient mode.
+	MaxUnknownWrapperSearch int
+}
+
+func DefaultParseLimits() ParseLimits {
+	return ParseLimits{
+		MaxScriptSize:           32 * 1024 * 1024,
+		MaxWrapperDepth:         32,
+		MaxPushCount:            64 * 1024,
+		MaxPushSize:             16 * 1024 * 1024,
+		MaxCollectionLength:     10000,
+		MaxUnknownWrapperSearch: 1024,
+	}
+}
+
+// SetParseLimits sets the limits applied when parsing.
+func (ps *Protocols) SetParseLimits(limits ParseLimits) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.limits = limits
+}
+
+func (ps *Protocols) parseLimits() ParseLimits {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return ps.limits
+}
+
+func (l ParseLimits) checkScript(script bitcoin.Script) error {
+	if l.MaxScriptSize > 0 && len(script) > l.MaxScriptSize {
+		return errors.Wrapf(ErrLimitExceeded, "script size %d over %d", len(script),
+			l.MaxScriptSize)
+	}
+
+	return nil
+}
+
+func (l ParseLimits) checkPayload(payload envelope.Data) error {
+	if l.MaxPushCount > 0 && len(payload.Payload) > l.MaxPushCount {
+		return errors.Wrapf(ErrLimitExceeded, "push count %d over %d", len(payload.Payload),
+			l.MaxPushCount)
+	}
+
+	if l.MaxPushSize > 0 {
+		for i, item := range payload.Payload {
+			if len(item.Data) > l.MaxPushSize {
+				return errors.Wrapf(ErrLimitExceeded, "push %d size %d over %d", i, len(item.Data),
+					l.MaxPushSize)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (l ParseLimits) checkDepth(depth int) error {
+	if l.MaxWrapperDepth > 0 && depth > l.MaxWrapperDepth {
+		return errors.Wrapf(ErrLimitExceeded, "wrapper depth over %d", l.MaxWrapperDepth)
+	}
+
+	return nil
+}
+
+// CheckCollectionLengths returns ErrLimitExceeded if any collection in the message has more than
+// the maximum number of items. Binary data is not checked since it is limited by push op size.
+func CheckCollectionLengths(msg interface{}, max int) error {
+	if max <= 0 || msg == nil {
+		return nil
+	}
+
+	return checkCollectionLengths(reflect.ValueOf(msg), max, 0)
+}
+
+func checkCollectionLengths(value reflect.Value, max, depth int) error {
+	if depth > maxCollectionCheckDepth {
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+		return checkCollectionLengths(value.Elem(), max, depth+1)
+
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if err := checkCollectionLengths(value.Field(i), max, depth+1); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice, reflect.Array, reflect.Map:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			return nil // binary data
+		}
+
+		if value.Kind() != reflect.Array && value.Len() > max {
+			return errors.Wrapf(ErrLimitExceeded, "collection length %d over %d", value.Len(),
+				max)
+		}
+
+		if value.Kind() == reflect.Map {
+			iter := value.MapRange()
+			for iter.Next() {
+				if err := checkCollectionLengths(iter.Value(), max, depth+1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		for i := 0; i < value.Len(); i++ {
+			if err := checkCollectionLengths(value.Index(i), max, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// LimitExceededResponse returns an invalid response for an ErrLimitExceeded error. It returns nil
+// for other errors.
+func LimitExceededResponse(err error) *Response {
+	if errors.Cause(err) != ErrLimitExceeded {
+		return nil
+	}
+
+	return &Response{
+		Status: StatusInvalid,
+		Note:   err.Error(),
+	}
+}
+
+// UnmarshalBSOR is the same as bsor.Unmarshal except that every collection count is verified to be
+// possible with the remaining push ops before the collection is allocated. Otherwise untrusted
+// data can specify a huge collection count that is allocated before the data is found to be
+// missing. Structs and collections are walked here, using the field indexes from bsor, so counts
+// are checked as they are read. Every other value is decoded from its push op by bsor.Unmarshal.
+func UnmarshalBSOR(scriptItems bitcoin.ScriptItems,
+	object interface{}) (bitcoin.ScriptItems, error) {
+
+	value := reflect.ValueOf(object)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return nil, errors.New("Unmarshal object is not a ptr")
+	}
+
+	if err := unmarshalBSORObject(&scriptItems, value.Elem(), 0, false); err != nil {
+		return nil, errors.Wrap(err, "object")
+	}
+
+	return scriptItems, nil
+}
+
+// unmarshalBSORObject decodes a value the same way as bsor. Pointers in collections are preceded
+// by a number that is zero when the pointer is nil.
+func unmarshalBSORObject(scriptItems *bitcoin.ScriptItems, value reflect.Value, fixedSize uint,
+	inArray bool) error {
+
+	if value.Kind() != reflect.Ptr {
+		_, err := unmarshalBSORValue(scriptItems, value, fixedSize)
+		return err
+	}
+
+	if inArray {
+		item, err := nextBSORItem(scriptItems)
+		if err != nil {
+			return errors.Wrap(err, "not nil")
+		}
+
+		notNil, err := ScriptNumberValueUnsigned(item)
+		if err != nil {
+			return errors.Wrap(err, "not nil")
+		}
+
+		if notNil == 0 {
+			return nil
+		}
+	}
+
+	ptr := reflect.New(value.Type().Elem())
+	empty, err := unmarshalBSORValue(scriptItems, ptr.Elem(), fixedSize)
+	if err != nil {
+		return err
+	}
+
+	// bsor leaves pointers to structs with no fields nil when they are in a collection.
+	if !empty || !inArray {
+		value.Set(ptr)
+	}
+
+	return nil
+}
+
+// unmarshalBSORValue decodes a value that is not a pointer. It returns true if the value is a
+// struct with no fields.
+func unmarshalBSORValue(scriptItems *bitcoin.ScriptItems, value reflect.Value,
+	fixedSize uint) (bool, error) {
+
+	typ := value.Type()
+	if reflect.PtrTo(typ).Implements(binaryUnmarshalerType) {
+		return false, unmarshalBSORItem(scriptItems, value, fixedSize)
+	}
+
+	switch typ.Kind() {
+	case reflect.Struct:
+		fieldCount, err := readBSORCount(scriptItems, 2)
+		if err != nil {
+			return false, errors.Wrap(err, "field count")
+		}
+
+		if fieldCount == 0 {
+			return true, nil
+		}
+
+		fields, err := bsor.NewFieldIndexes(typ, value)
+		if err != nil {
+			return false, errors.Wrap(err, "field indexes")
+		}
+
+		for i := 0; i < fieldCount; i++ {
+			id, err := readBSORNumber(scriptItems)
+			if err != nil {
+				return false, errors.Wrap(err, "field id")
+			}
+
+			field, exists := fields[uint64(id)]
+			if !exists {
+				return false, errors.Wrapf(ErrInvalidMessage, "field %d not found in %s", id,
+					typ.Name())
+			}
+
+			if err := unmarshalBSORObject(scriptItems, value.Field(field.Index), field.FixedSize,
+				false); err != nil {
+				return false, errors.Wrap(err, typ.Field(field.Index).Name)
+			}
+		}
+
+		return false, nil
+
+	case reflect.Slice:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return false, unmarshalBSORItem(scriptItems, value, fixedSize)
+		}
+
+		// Each item requires at least one push op.
+		count, err := readBSORCount(scriptItems, 1)
+		if err != nil {
+			return false, errors.Wrap(err, "count")
+		}
+
+		slice := reflect.MakeSlice(typ, count, count)
+		for i := 0; i < count; i++ {
+			if err := unmarshalBSORObject(scriptItems, slice.Index(i), 0, true); err != nil {
+				return false, errors.Wrapf(err, "item %d", i)
+			}
+		}
+
+		value.Set(slice)
+		return false, nil
+
+	case reflect.Array:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return false, unmarshalBSORItem(scriptItems, value, fixedSize)
+		}
+
+		for i := 0; i < value.Len(); i++ {
+			if err := unmarshalBSORObject(scriptItems, value.Index(i), 0, true); err != nil {
+				return false, errors.Wrapf(err, "item %d", i)
+			}
+		}
+
+		return false, nil
+
+	case reflect.Map:
+		return false, errors.Wrapf(ErrInvalidMessage, "unsupported type: %s", typ.Name())
+
+	default:
+		return false, unmarshalBSORItem(scriptItems, value, fixedSize)
+	}
+}
+
+// unmarshalBSORItem decodes a value that is contained in one push op with bsor.
+func unmarshalBSORItem(scriptItems *bitcoin.ScriptItems, value reflect.Value,
+	fixedSize uint) error {
+
+	item, err := nextBSORItem(scriptItems)
+	if err != nil {
+		return err
+	}
+
+	// bsor panics on numbers that are empty push data.
+	if !reflect.PtrTo(value.Type()).Implements(binaryUnmarshalerType) {
+		switch value.Kind() {
+		case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			item = normalizeScriptItem(item)
+		}
+	}
+
+	ptr := reflect.New(value.Type())
+	if _, err := bsor.Unmarshal(bitcoin.ScriptItems{item}, ptr.Interface()); err != nil {
+		return err
+	}
+
+	if fixedSize > 0 {
+		switch value.Kind() {
+		case reflect.String, reflect.Slice:
+			if uint(ptr.Elem().Len()) != fixedSize {
+				return errors.Wrapf(ErrInvalidMessage, "fixed size %d, got %d", fixedSize,
+					ptr.Elem().Len())
+			}
+		}
+	}
+
+	value.Set(ptr.Elem())
+	return nil
+}
+
+var binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+
+func nextBSORItem(scriptItems *bitcoin.ScriptItems) (*bitcoin.ScriptItem, error) {
+	if len(*scriptItems) == 0 {
+		return nil, errors.Wrap(ErrInvalidMessage, "missing push op")
+	}
+
+	result := (*scriptItems)[0]
+	*scriptItems = (*scriptItems)[1:]
+	return result, nil
+}
+
+func readBSORNumber(scriptItems *bitcoin.ScriptItems) (int64, error) {
+	item, err := nextBSORItem(scriptItems)
+	if err != nil {
+		return 0, err
+	}
+
+	return ScriptNumberValue(item)
+}
+
+// readBSORCount reads a count of things that each require at least the specified number of push
+// ops and returns ErrLimitExceeded if there aren't enough remaining push ops.
+func readBSORCount(scriptItems *bitcoin.ScriptItems, pushOps int) (int, error) {
+	count, err := readBSORNumber(scriptItems)
+	if err != nil {
+		return 0, err
+	}
+
+	if count < 0 || count > int64(len(*scriptItems)/pushOps) {
+		return 0, errors.Wrapf(ErrLimitExceeded, "count %d with %d push ops", count,
+			len(*scriptItems))
+	}
+
+	return int(count), nil
+}
@@ -0,0 +1,227 @@
+package channels
+
+import (
+	"reflect"
+	"testing"
+
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	envelopeV1 "github.com/tokenized/envelope/pkg/golang/envelope/v1"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/bsor"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+func Test_ParseLimits(t *testing.T) {
+	id := UUID(uuid.New())
+	script, err := Wrap(&id, NewNote("note"), NewStringID("thread"), NewTimeMessage(Now()))
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+	t.Logf("Script : %s", script)
+
+	protocols := NewProtocols(NewNoteProtocol(), NewStringIDProtocol(), NewTimeProtocol(),
+		NewUUIDProtocol())
+	if _, _, err := protocols.Parse(script); err != nil {
+		t.Fatalf("Failed to parse with default limits : %s", err)
+	}
+
+	limits := DefaultParseLimits()
+	limits.MaxWrapperDepth = 3
+	protocols.SetParseLimits(limits)
+	_, _, err = protocols.Parse(script)
+	if errors.Cause(err) != ErrLimitExceeded {
+		t.Fatalf("Wrong depth error : got %v, want %s", err, ErrLimitExceeded)
+	}
+
+	response := LimitExceededResponse(err)
+	if response == nil {
+		t.Fatalf("Missing limit exceeded response")
+	}
+	if response.Status != StatusInvalid {
+		t.Errorf("Wrong response status : got %s, want %s", response.Status, StatusInvalid)
+	}
+
+	limits = DefaultParseLimits()
+	limits.MaxScriptSize = len(script) - 1
+	protocols.SetParseLimits(limits)
+	if _, _, err := protocols.Parse(script); errors.Cause(err) != ErrLimitExceeded {
+		t.Fatalf("Wrong script size error : got %v, want %s", err, ErrLimitExceeded)
+	}
+
+	limits = DefaultParseLimits()
+	limits.MaxPushSize = 3
+	protocols.SetParseLimits(limits)
+	if _, _, err := protocols.Parse(script); errors.Cause(err) != ErrLimitExceeded {
+		t.Fatalf("Wrong push size error : got %v, want %s", err, ErrLimitExceeded)
+	}
+
+	// No limits
+	protocols.SetParseLimits(ParseLimits{})
+	if _, _, err := protocols.Parse(script); err != nil {
+		t.Fatalf("Failed to parse without limits : %s", err)
+	}
+
+	if LimitExceededResponse(ErrInvalidMessage) != nil {
+		t.Errorf("Response should be nil for other errors")
+	}
+}
+
+func Test_ParseLimits_CollectionCount(t *testing.T) {
+	id := UUID(uuid.New())
+	payload, err := id.Write()
+	if err != nil {
+		t.Fatalf("Failed to write message : %s", err)
+	}
+
+	// A multi-signature claiming a billion signatures.
+	payload.ProtocolIDs = append(envelope.ProtocolIDs{ProtocolIDMultiSignedMessages},
+		payload.ProtocolIDs...)
+	payload.Payload = append(bitcoin.ScriptItems{
+		bitcoin.PushNumberScriptItem(0),          // version
+		bitcoin.PushNumberScriptItem(1),          // field count
+		bitcoin.PushNumberScriptItem(1),          // field id
+		bitcoin.PushNumberScriptItem(1000000000), // signature count
+	}, payload.Payload...)
+
+	script, err := envelopeV1.Wrap(payload).Script()
+	if err != nil {
+		t.Fatalf("Failed to create script : %s", err)
+	}
+
+	protocols := NewProtocols(NewMultiSignedProtocol(), NewUUIDProtocol())
+	if _, _, err := protocols.Parse(script); errors.Cause(err) != ErrLimitExceeded {
+		t.Fatalf("Wrong collection count error : got %v, want %s", err, ErrLimitExceeded)
+	}
+}
+
+func Test_ParseLimits_EmptyPush(t *testing.T) {
+	// Protocol id count is a push data with no data, found by fuzzing.
+	script := bitcoin.Script{0x00, 0x6a, 0x02, 0xbd, 0x01, bitcoin.OP_PUSH_DATA_1, 0x00}
+
+	if _, err := ParseEnvelope(script); errors.Cause(err) != envelope.ErrInvalidEnvelope {
+		t.Fatalf("Wrong envelope error : got %v, want %s", err, envelope.ErrInvalidEnvelope)
+	}
+}
+
+func Test_ParseLimits_UnknownWrapperSearch(t *testing.T) {
+	// Adjacent unknown wrappers around data that doesn't parse are searched once since their push
+	// ops all belong to the innermost of them.
+	var protocolIDs envelope.ProtocolIDs
+	for i := 0; i < 16; i++ {
+		protocolIDs = append(protocolIDs, envelope.ProtocolID{byte('a' + i), 'x'})
+	}
+	protocolIDs = append(protocolIDs, ProtocolIDUUID)
+
+	var payload bitcoin.ScriptItems
+	for i := 0; i < 20; i++ {
+		payload = append(payload, bitcoin.PushNumberScriptItem(int64(i)))
+	}
+
+	script, err := envelopeV1.Wrap(envelope.Data{
+		ProtocolIDs: protocolIDs,
+		Payload:     payload,
+	}).Script()
+	if err != nil {
+		t.Fatalf("Failed to create script : %s", err)
+	}
+
+	protocols := NewProtocols(NewUUIDProtocol())
+	protocols.SetLenient(true)
+	if _, _, err := protocols.Parse(script); errors.Cause(err) != ErrUnsupportedProtocol {
+		t.Fatalf("Wrong search error : got %v, want %s", err, ErrUnsupportedProtocol)
+	}
+
+	// The splits tried are limited.
+	limits := DefaultParseLimits()
+	limits.MaxUnknownWrapperSearch = 5
+	protocols.SetParseLimits(limits)
+	if _, _, err := protocols.Parse(script); errors.Cause(err) != ErrLimitExceeded {
+		t.Fatalf("Wrong limited search error : got %v, want %s", err, ErrLimitExceeded)
+	}
+}
+
+type testBSORItem struct {
+	Name  string  `bsor:"1"`
+	Value *uint64 `bsor:"2"`
+}
+
+type testBSORMessage struct {
+	ID       UUID              `bsor:"1"`
+	Items    []testBSORItem    `bsor:"2"`
+	Pointers []*testBSORItem   `bsor:"3"`
+	Fixed    [2]*testBSORItem  `bsor:"4"`
+	Item     *testBSORItem     `bsor:"5"`
+	Empty    *testBSORItem     `bsor:"6"`
+	Data     []byte            `bsor:"7"`
+	Keys     []bitcoin.Hash32  `bsor:"8"`
+	Flag     bool              `bsor:"9"`
+	Price    float64           `bsor:"10"`
+	Code     string            `bsor:"11" bsor_fixed_size:"3"`
+	Strings  []string          `bsor:"12"`
+	Numbers  []int32           `bsor:"13"`
+	Nested   [][]*testBSORItem `bsor:"14"`
+	Optional *string           `bsor:"15"`
+}
+
+func Test_UnmarshalBSOR(t *testing.T) {
+	value := uint64(1234)
+	name := "optional"
+	message := &testBSORMessage{
+		ID: UUID(uuid.New()),
+		Items: []testBSORItem{
+			{Name: "first", Value: &value},
+			{},
+		},
+		Pointers: []*testBSORItem{nil, {Name: "second"}, {}},
+		Fixed:    [2]*testBSORItem{{Value: &value}, nil},
+		Item:     &testBSORItem{Name: "item"},
+		Empty:    &testBSORItem{},
+		Data:     []byte{1, 2, 3},
+		Keys:     []bitcoin.Hash32{RandomHash(), RandomHash()},
+		Flag:     true,
+		Price:    1.5,
+		Code:     "USD",
+		Strings:  []string{"a", "", "c"},
+		Numbers:  []int32{-1, 0, 100000},
+		Nested:   [][]*testBSORItem{{nil, {Name: "nested"}}, nil},
+		Optional: &name,
+	}
+
+	scriptItems, err := bsor.Marshal(message)
+	if err != nil {
+		t.Fatalf("Failed to marshal : %s", err)
+	}
+
+	want := &testBSORMessage{}
+	if _, err := bsor.Unmarshal(scriptItems, want); err != nil {
+		t.Fatalf("Failed to unmarshal with bsor : %s", err)
+	}
+
+	got := &testBSORMessage{}
+	remaining, err := UnmarshalBSOR(append(scriptItems, bitcoin.NewOpCodeScriptItem(bitcoin.OP_1)),
+		got)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal : %s", err)
+	}
+
+	if len(remaining) != 1 {
+		t.Errorf("Wrong remaining count : got %d, want %d", len(remaining), 1)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong unmarshal : \n  got  %+v\n  want %+v", got, want)
+	}
+
+	// Fixed size values are checked.
+	for i, item := range scriptItems {
+		if string(item.Data) == "USD" {
+			scriptItems[i] = bitcoin.NewPushDataScriptItem([]byte("US"))
+		}
+	}
+
+	if _, err := UnmarshalBSOR(scriptItems, &testBSORMessage{}); err == nil {
+		t.Errorf("Fixed size should fail")
+	}
+}
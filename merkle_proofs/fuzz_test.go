@@ -0,0 +1,38 @@
+package merkle_proofs
+
+import (
+	"testing"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/merkle_proof"
+)
+
+func Fuzz_Parse(f *testing.F) {
+	txid := channels.RandomHash()
+	blockHash := channels.RandomHash()
+
+	for _, msg := range []channels.Writer{
+		&MerkleProof{MerkleProof: &merkle_proof.MerkleProof{
+			TxID:      &txid,
+			Path:      []bitcoin.Hash32{channels.RandomHash()},
+			BlockHash: &blockHash,
+		}},
+	} {
+		script, err := channels.Wrap(msg)
+		if err != nil {
+			f.Fatalf("Failed to wrap %T : %s", msg, err)
+		}
+		f.Add([]byte(script))
+	}
+
+	protocols := channels.NewProtocols(NewProtocol())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		script := bitcoin.Script(b)
+		if payload, err := channels.ParseEnvelope(script); err == nil {
+			Parse(payload)
+		}
+
+		protocols.Parse(script)
+	})
+}
@@ -1,9 +1,6 @@
 package merkle_proofs
 
 import (
-	"bytes"
-	"fmt"
-
 	"github.com/tokenized/channels"
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
 	"github.com/tokenized/pkg/bitcoin"
@@ -19,6 +16,8 @@ const (
 var (
 	ProtocolID = envelope.ProtocolID("MP") // Protocol ID for merkle proofs
 
+	codec = channels.NewCodec(ProtocolID, Version, "merkle proof", &MerkleProof{})
+
 	ErrInvalidMerkleProof = errors.New("Invalid MerkleProof")
 )
 
@@ -49,53 +48,40 @@ func (MerkleProof) ProtocolID() envelope.ProtocolID {
 }
 
 func (m MerkleProof) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
+	return codec.Write(m)
+}
 
-	// Message
+func (m MerkleProof) MarshalScriptItems() (bitcoin.ScriptItems, error) {
 	b, err := m.MerkleProof.MarshalBinary()
 	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal binary")
+		return nil, errors.Wrap(err, "marshal binary")
 	}
-	payload = append(payload, bitcoin.NewPushDataScriptItem(b))
 
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return bitcoin.ScriptItems{bitcoin.NewPushDataScriptItem(b)}, nil
 }
 
-func Parse(payload envelope.Data) (*MerkleProof, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 ||
-		!bytes.Equal(payload.ProtocolIDs[0], ProtocolID) {
-		return nil, payload, nil
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
+func (m *MerkleProof) UnmarshalScriptItems(scriptItems bitcoin.ScriptItems) (bitcoin.ScriptItems,
+	error) {
 
-	if len(payload.Payload) < 2 {
-		return nil, payload, errors.Wrapf(ErrInvalidMerkleProof,
-			"not enough merkle proof push ops: %d", len(payload.Payload))
+	if len(scriptItems) == 0 || scriptItems[0].Type != bitcoin.ScriptItemTypePushData {
+		return nil, errors.Wrapf(ErrInvalidMerkleProof, "not push data")
 	}
 
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(channels.ErrUnsupportedVersion,
-			fmt.Sprintf("merkle proof: %d", version))
+	m.MerkleProof = &merkle_proof.MerkleProof{}
+	if err := m.MerkleProof.UnmarshalBinary(scriptItems[0].Data); err != nil {
+		return nil, errors.Wrap(err, "unmarshal binary")
 	}
 
-	result := &MerkleProof{}
-	if payload.Payload[1].Type != bitcoin.ScriptItemTypePushData {
-		return nil, payload, errors.Wrapf(ErrInvalidMerkleProof, "not push data")
-	}
+	return scriptItems[1:], nil
+}
 
-	result.MerkleProof = &merkle_proof.MerkleProof{}
-	if err := result.MerkleProof.UnmarshalBinary(payload.Payload[1].Data); err != nil {
-		return nil, payload, errors.Wrap(err, "unmarshal binary")
+func Parse(payload envelope.Data) (*MerkleProof, envelope.Data, error) {
+	msg, payload, err := codec.Parse(payload)
+	if msg == nil {
+		return nil, payload, err
 	}
 
-	payload.Payload = payload.Payload[2:]
-
-	return result, payload, nil
+	return msg.(*MerkleProof), payload, nil
 }
 
 func ResponseCodeToString(code uint32) string {
@@ -1,9 +1,6 @@
 package channels
 
 import (
-	"bytes"
-	"fmt"
-
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
 	"github.com/tokenized/pkg/bitcoin"
 
@@ -12,11 +9,17 @@ import (
 
 const (
 	MessageIDVersion = uint8(0)
+
+	// MessageIDStatusDuplicate is a code specific to the message id protocol that is placed in a
+	// Reject message to signify that a message with the same id was already received.
+	MessageIDStatusDuplicate = uint32(1)
 )
 
 var (
 	ProtocolIDMessageID = envelope.ProtocolID("ID") // Protocol ID for message id
 
+	messageIDCodec = NewCodec(ProtocolIDMessageID, MessageIDVersion, "message id", &MessageID{})
+
 	ErrInvalidMessageID = errors.New("Invalid MessageID")
 )
 
@@ -35,7 +38,7 @@ func (*MessageIDProtocol) Parse(payload envelope.Data) (Message, envelope.Data,
 }
 
 func (*MessageIDProtocol) ResponseCodeToString(code uint32) string {
-	return "parse"
+	return MessageIDResponseCodeToString(code)
 }
 
 type MessageID struct {
@@ -59,46 +62,43 @@ func WrapMessageID(payload envelope.Data, messageID uint64) (envelope.Data, erro
 }
 
 func (m *MessageID) Wrap(payload envelope.Data) (envelope.Data, error) {
-	// Version
-	scriptItems := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(MessageIDVersion))}
-
-	// Message
-	scriptItems = append(scriptItems, bitcoin.PushNumberScriptItemUnsigned(m.MessageID))
-
-	payload.ProtocolIDs = append(envelope.ProtocolIDs{ProtocolIDMessageID}, payload.ProtocolIDs...)
-	payload.Payload = append(scriptItems, payload.Payload...)
+	return messageIDCodec.Wrap(m, payload)
+}
 
-	return payload, nil
+func (m *MessageID) MarshalScriptItems() (bitcoin.ScriptItems, error) {
+	return bitcoin.ScriptItems{bitcoin.PushNumberScriptItemUnsigned(m.MessageID)}, nil
 }
 
-func ParseMessageID(payload envelope.Data) (*MessageID, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 || !bytes.Equal(payload.ProtocolIDs[0], ProtocolIDMessageID) {
-		return nil, payload, nil
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
+func (m *MessageID) UnmarshalScriptItems(scriptItems bitcoin.ScriptItems) (bitcoin.ScriptItems,
+	error) {
 
-	if len(payload.Payload) < 3 {
-		return nil, payload, errors.Wrapf(ErrInvalidMessage, "not enough message id push ops: %d",
-			len(payload.Payload))
+	if len(scriptItems) == 0 {
+		return nil, errors.Wrap(ErrInvalidMessage, "missing message id")
 	}
 
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
+	value, err := ScriptNumberValueUnsigned(scriptItems[0])
 	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(ErrUnsupportedVersion,
-			fmt.Sprintf("message id: %d", version))
+		return nil, errors.Wrap(err, "value")
 	}
+	m.MessageID = value
 
-	value, err := bitcoin.ScriptNumberValueUnsigned(payload.Payload[1])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "value")
-	}
-	result := &MessageID{
-		MessageID: value,
+	return scriptItems[1:], nil
+}
+
+func ParseMessageID(payload envelope.Data) (*MessageID, envelope.Data, error) {
+	msg, payload, err := messageIDCodec.Parse(payload)
+	if msg == nil {
+		return nil, payload, err
 	}
 
-	payload.Payload = payload.Payload[2:]
-	return result, payload, nil
+	return msg.(*MessageID), payload, nil
+}
+
+func MessageIDResponseCodeToString(code uint32) string {
+	switch code {
+	case MessageIDStatusDuplicate:
+		return "duplicate"
+	default:
+		return "parse"
+	}
 }
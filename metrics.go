@@ -0,0 +1,75 @@
+package channels
+
+import (
+	"github.com/tokenized/channels/metrics"
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MetricParsed counts messages parsed successfully. It is labeled with the protocol of the
+	// message.
+	MetricParsed = "channels_parsed"
+
+	// MetricParseFailures counts messages that failed to parse. It is labeled with the protocol of
+	// the layer that failed and the reason.
+	MetricParseFailures = "channels_parse_failures"
+)
+
+// SetMetrics sets where parse counts are reported.
+func (ps *Protocols) SetMetrics(m metrics.Metrics) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.metrics = m
+}
+
+func (ps *Protocols) getMetrics() metrics.Metrics {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	if ps.metrics == nil {
+		return metrics.NoOp{}
+	}
+	return ps.metrics
+}
+
+func (ps *Protocols) reportParsed(parsed *ParsedMessage) {
+	protocol := "none"
+	if msg := parsed.Message(); msg != nil {
+		protocol = msg.ProtocolID().String()
+	}
+
+	ps.getMetrics().AddCounter(MetricParsed, metrics.Labels{"protocol": protocol}, 1)
+}
+
+func (ps *Protocols) reportParseFailure(protocolID envelope.ProtocolID, err error) {
+	protocol := "none"
+	if len(protocolID) > 0 {
+		protocol = protocolID.String()
+	}
+
+	ps.getMetrics().AddCounter(MetricParseFailures, metrics.Labels{
+		"protocol": protocol,
+		"reason":   parseFailureReason(err),
+	}, 1)
+}
+
+// parseFailureReason returns a short label for the cause of a parse error.
+func parseFailureReason(err error) string {
+	switch errors.Cause(err) {
+	case ErrUnsupportedProtocol:
+		return "unsupported_protocol"
+	case ErrUnsupportedVersion:
+		return "unsupported_version"
+	case ErrLimitExceeded:
+		return "limit_exceeded"
+	case ErrUnsignedWrapper:
+		return "unsigned_wrapper"
+	case ErrNotChannels:
+		return "not_channels"
+	default:
+		return "invalid"
+	}
+}
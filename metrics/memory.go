@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Memory retains measurements in memory so they can be checked in tests.
+type Memory struct {
+	counters   map[string]float64
+	gauges     map[string]float64
+	histograms map[string][]float64
+
+	lock sync.Mutex
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		counters:   make(map[string]float64),
+		gauges:     make(map[string]float64),
+		histograms: make(map[string][]float64),
+	}
+}
+
+func (m *Memory) AddCounter(name string, labels Labels, value float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.counters[seriesKey(name, labels)] += value
+}
+
+func (m *Memory) SetGauge(name string, labels Labels, value float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.gauges[seriesKey(name, labels)] = value
+}
+
+func (m *Memory) ObserveHistogram(name string, labels Labels, value float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := seriesKey(name, labels)
+	m.histograms[key] = append(m.histograms[key], value)
+}
+
+// Counter returns the value of the counter with exactly the specified labels.
+func (m *Memory) Counter(name string, labels Labels) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.counters[seriesKey(name, labels)]
+}
+
+// CounterTotal returns the sum of the counter over all labels.
+func (m *Memory) CounterTotal(name string) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	total := 0.0
+	for key, value := range m.counters {
+		if seriesName(key) == name {
+			total += value
+		}
+	}
+
+	return total
+}
+
+// Gauge returns the last value set for the gauge with exactly the specified labels and whether it
+// was set.
+func (m *Memory) Gauge(name string, labels Labels) (float64, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	value, exists := m.gauges[seriesKey(name, labels)]
+	return value, exists
+}
+
+// Histogram returns the observations of the histogram with exactly the specified labels in the
+// order they were recorded.
+func (m *Memory) Histogram(name string, labels Labels) []float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	values := m.histograms[seriesKey(name, labels)]
+	result := make([]float64, len(values))
+	copy(result, values)
+	return result
+}
+
+// seriesKey returns a key that identifies the series with the name and labels, for example
+// "name{a=1,b=2}". Labels are sorted so the order they were specified in doesn't matter.
+func seriesKey(name string, labels Labels) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	var pairs []string
+	for label, value := range labels {
+		pairs = append(pairs, label+"="+value)
+	}
+	sort.Strings(pairs)
+
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func seriesName(key string) string {
+	if i := strings.IndexByte(key, '{'); i != -1 {
+		return key[:i]
+	}
+	return key
+}
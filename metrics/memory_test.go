@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func Test_Memory(t *testing.T) {
+	m := NewMemory()
+
+	m.AddCounter("count", nil, 1)
+	m.AddCounter("count", Labels{"a": "1", "b": "2"}, 2)
+	m.AddCounter("count", Labels{"b": "2", "a": "1"}, 3)
+	m.AddCounter("other", nil, 10)
+
+	if value := m.Counter("count", nil); value != 1 {
+		t.Errorf("Wrong counter : got %f, want %f", value, 1.0)
+	}
+
+	if value := m.Counter("count", Labels{"a": "1", "b": "2"}); value != 5 {
+		t.Errorf("Wrong labeled counter : got %f, want %f", value, 5.0)
+	}
+
+	if value := m.CounterTotal("count"); value != 6 {
+		t.Errorf("Wrong counter total : got %f, want %f", value, 6.0)
+	}
+
+	if _, exists := m.Gauge("gauge", nil); exists {
+		t.Errorf("Gauge should not exist")
+	}
+
+	m.SetGauge("gauge", nil, 3)
+	m.SetGauge("gauge", nil, 2)
+	if value, exists := m.Gauge("gauge", nil); !exists || value != 2 {
+		t.Errorf("Wrong gauge : got %f, want %f", value, 2.0)
+	}
+
+	m.ObserveHistogram("histogram", Labels{"a": "1"}, 0.5)
+	m.ObserveHistogram("histogram", Labels{"a": "1"}, 1.5)
+	values := m.Histogram("histogram", Labels{"a": "1"})
+	if len(values) != 2 || values[0] != 0.5 || values[1] != 1.5 {
+		t.Errorf("Wrong histogram : got %v, want %v", values, []float64{0.5, 1.5})
+	}
+}
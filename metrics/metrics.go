@@ -0,0 +1,27 @@
+package metrics
+
+// Labels are name/value pairs that identify one series of a metric, for example the protocol of a
+// parse failure. Keep the number of distinct values small.
+type Labels map[string]string
+
+// Metrics receives measurements from the listener, the protocol parser, and the response handler.
+// Implementations must be safe for concurrent use and should not block.
+type Metrics interface {
+	// AddCounter adds to a value that only increases, like a count of events.
+	AddCounter(name string, labels Labels, value float64)
+
+	// SetGauge sets a value that can go up and down, like a queue depth.
+	SetGauge(name string, labels Labels, value float64)
+
+	// ObserveHistogram records one observation of a distribution, like a latency in seconds.
+	ObserveHistogram(name string, labels Labels, value float64)
+}
+
+// NoOp discards all measurements. It is the default wherever metrics are reported.
+type NoOp struct{}
+
+func (NoOp) AddCounter(name string, labels Labels, value float64) {}
+
+func (NoOp) SetGauge(name string, labels Labels, value float64) {}
+
+func (NoOp) ObserveHistogram(name string, labels Labels, value float64) {}
@@ -0,0 +1,57 @@
+package channels
+
+import (
+	"testing"
+
+	"github.com/tokenized/channels/metrics"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/google/uuid"
+)
+
+func Test_Protocols_Metrics(t *testing.T) {
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+
+	id := UUID(uuid.New())
+	script, err := Wrap(&id, NewSignature(key, RandomHashPtr(), true))
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+
+	m := metrics.NewMemory()
+	protocols := NewProtocols(NewSignedProtocol(), NewUUIDProtocol())
+	protocols.SetMetrics(m)
+
+	if _, _, err := protocols.Parse(script); err != nil {
+		t.Fatalf("Failed to parse : %s", err)
+	}
+
+	labels := metrics.Labels{"protocol": ProtocolIDUUID.String()}
+	if count := m.Counter(MetricParsed, labels); count != 1 {
+		t.Errorf("Wrong parsed count : got %f, want %f", count, 1.0)
+	}
+
+	// The UUID layer isn't supported.
+	protocols = NewProtocols(NewSignedProtocol())
+	protocols.SetMetrics(m)
+
+	if _, _, err := protocols.Parse(script); err == nil {
+		t.Fatalf("Parse should fail")
+	}
+
+	labels = metrics.Labels{
+		"protocol": ProtocolIDUUID.String(),
+		"reason":   "unsupported_protocol",
+	}
+	if count := m.Counter(MetricParseFailures, labels); count != 1 {
+		t.Errorf("Wrong parse failure count : got %f, want %f", count, 1.0)
+	}
+
+	if _, _, err := protocols.Parse(bitcoin.Script{bitcoin.OP_TRUE}); err == nil {
+		t.Fatalf("Parse should fail")
+	}
+
+	if count := m.CounterTotal(MetricParseFailures); count != 2 {
+		t.Errorf("Wrong parse failure total : got %f, want %f", count, 2.0)
+	}
+}
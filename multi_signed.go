@@ -0,0 +1,374 @@
+package channels
+
+import (
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	MultiSignedMessagesVersion = uint8(0)
+
+	// MultiSignedStatusSignaturesRequired is a code specific to the multi-signature protocol that
+	// is placed in a Reject message to signify that a message is considered invalid if it is not
+	// signed by multiple keys.
+	MultiSignedStatusSignaturesRequired = uint32(1)
+
+	// MultiSignedStatusInvalidSignature is a code specific to the multi-signature protocol that is
+	// placed in a Reject message to signify that a message has an invalid signature. Either the
+	// wrong key was used or the signature is just invalid.
+	MultiSignedStatusInvalidSignature = uint32(2)
+
+	// MultiSignedStatusWrongPublicKey is a code specific to the multi-signature protocol that is
+	// placed in a Reject message to signify that a message includes the wrong public key for
+	// context.
+	MultiSignedStatusWrongPublicKey = uint32(3)
+
+	// MultiSignedStatusThresholdNotMet is a code specific to the multi-signature protocol that is
+	// placed in a Reject message to signify that a message does not have enough valid signatures.
+	MultiSignedStatusThresholdNotMet = uint32(4)
+)
+
+var (
+	ProtocolIDMultiSignedMessages = envelope.ProtocolID("MS") // Protocol ID for multi-signed messages
+
+	multiSignedCodec = NewCodec(ProtocolIDMultiSignedMessages, MultiSignedMessagesVersion,
+		"multi-signed", &MultiSignature{})
+
+	ErrThresholdNotMet       = errors.New("Threshold Not Met")
+	ErrInvalidThreshold      = errors.New("Invalid Threshold")
+	ErrUnauthorizedPublicKey = errors.New("Unauthorized Public Key")
+)
+
+type MultiSignedProtocol struct{}
+
+func NewMultiSignedProtocol() *MultiSignedProtocol {
+	return &MultiSignedProtocol{}
+}
+
+func (*MultiSignedProtocol) ProtocolID() envelope.ProtocolID {
+	return ProtocolIDMultiSignedMessages
+}
+
+func (*MultiSignedProtocol) Parse(payload envelope.Data) (Message, envelope.Data, error) {
+	return ParseMultiSigned(payload)
+}
+
+func (*MultiSignedProtocol) ResponseCodeToString(code uint32) string {
+	return MultiSignedResponseCodeToString(code)
+}
+
+// MultiSignature is a message signed by several keys. Every signature is of the same hash of the
+// remaining protocol ids and push ops.
+type MultiSignature struct {
+	Signatures SignerSignatures `bsor:"1" json:"signatures"`
+
+	signers []*multiSigner
+	hash    *bitcoin.Hash32
+}
+
+// SignerSignature is the signature of one signer of a MultiSignature. The public key is optional
+// when it is known from context.
+type SignerSignature struct {
+	Signature      bitcoin.Signature  `bsor:"1" json:"signature"`
+	PublicKey      *bitcoin.PublicKey `bsor:"2" json:"public_key,omitempty"`
+	DerivationHash *bitcoin.Hash32    `bsor:"3" json:"derivation_hash,omitempty"`
+}
+
+type SignerSignatures []*SignerSignature
+
+// MultiSignatureVerification is the result of verifying a MultiSignature. Errors contains one
+// entry for each signature in the same order. The entry is nil when the signature is valid.
+type MultiSignatureVerification struct {
+	Errors       []error
+	ValidCount   int
+	ThresholdMet bool
+}
+
+type multiSigner struct {
+	signer         Signer
+	derivationHash *bitcoin.Hash32
+	includeKey     bool
+}
+
+// NewMultiSignature creates a multi-signature wrapper that will sign the payload with each key when
+// it is wrapped. derivationHashes, when not empty, must contain one entry for each key.
+func NewMultiSignature(keys []bitcoin.Key, derivationHashes []*bitcoin.Hash32,
+	includeKeys bool) *MultiSignature {
+
+	var signers []Signer
+	for _, key := range keys {
+		signers = append(signers, NewKeySigner(key))
+	}
+
+	return NewMultiSignatureWithSigners(signers, derivationHashes, includeKeys)
+}
+
+// NewMultiSignatureWithSigners creates a multi-signature wrapper that will sign the payload with
+// each signer when it is wrapped. derivationHashes, when not empty, must contain one entry for each
+// signer.
+func NewMultiSignatureWithSigners(signers []Signer, derivationHashes []*bitcoin.Hash32,
+	includeKeys bool) *MultiSignature {
+
+	result := &MultiSignature{}
+	for i, signer := range signers {
+		s := &multiSigner{
+			signer:     signer,
+			includeKey: includeKeys,
+		}
+
+		if i < len(derivationHashes) {
+			s.derivationHash = derivationHashes[i]
+		}
+
+		result.signers = append(result.signers, s)
+	}
+
+	return result
+}
+
+func (*MultiSignature) IsSignatureType() {}
+
+func (*MultiSignature) ProtocolID() envelope.ProtocolID {
+	return ProtocolIDMultiSignedMessages
+}
+
+func (m *MultiSignature) Wrap(payload envelope.Data) (envelope.Data, error) {
+	for i, s := range m.signers {
+		if err := m.AddSignerSignature(payload, s.signer, s.derivationHash,
+			s.includeKey); err != nil {
+			return payload, errors.Wrapf(err, "sign %d", i)
+		}
+	}
+	m.signers = nil
+
+	return multiSignedCodec.Wrap(m, payload)
+}
+
+// AddSignature signs the payload with the key and adds the signature. Co-signers can each add a
+// signature of the same payload before it is wrapped.
+func (m *MultiSignature) AddSignature(payload envelope.Data, key bitcoin.Key,
+	derivationHash *bitcoin.Hash32, includeKey bool) error {
+
+	return m.AddSignerSignature(payload, NewKeySigner(key), derivationHash, includeKey)
+}
+
+// AddSignerSignature signs the payload with the signer and adds the signature.
+func (m *MultiSignature) AddSignerSignature(payload envelope.Data, signer Signer,
+	derivationHash *bitcoin.Hash32, includeKey bool) error {
+
+	hash, err := SignatureHash(payload)
+	if err != nil {
+		return errors.Wrap(err, "hash")
+	}
+
+	signature, publicKey, err := signer.Sign(*hash, derivationHash)
+	if err != nil {
+		return errors.Wrap(err, "sign")
+	}
+
+	result := &SignerSignature{
+		Signature:      signature,
+		DerivationHash: derivationHash,
+	}
+
+	if includeKey {
+		result.PublicKey = &publicKey
+	}
+
+	m.Signatures = append(m.Signatures, result)
+	m.hash = hash
+	return nil
+}
+
+// MultiSign signs the payload with each key and returns the multi-signature message.
+// derivationHashes, when not empty, must contain one entry for each key.
+func MultiSign(payload envelope.Data, keys []bitcoin.Key, derivationHashes []*bitcoin.Hash32,
+	includeKeys bool) (*MultiSignature, error) {
+
+	result := &MultiSignature{}
+	for i, key := range keys {
+		var derivationHash *bitcoin.Hash32
+		if i < len(derivationHashes) {
+			derivationHash = derivationHashes[i]
+		}
+
+		if err := result.AddSignature(payload, key, derivationHash, includeKeys); err != nil {
+			return nil, errors.Wrapf(err, "sign %d", i)
+		}
+	}
+
+	return result, nil
+}
+
+// WrapMultiSignature signs the payload with each key and wraps the payload with the signatures and
+// returns the new payload containing the signatures.
+func WrapMultiSignature(payload envelope.Data, keys []bitcoin.Key,
+	derivationHashes []*bitcoin.Hash32, includeKeys bool) (envelope.Data, error) {
+
+	multiSignature, err := MultiSign(payload, keys, derivationHashes, includeKeys)
+	if err != nil {
+		return payload, errors.Wrap(err, "sign")
+	}
+
+	return multiSignature.Wrap(payload)
+}
+
+// ParseMultiSigned parses the signatures and public keys (if provided).
+func ParseMultiSigned(payload envelope.Data) (*MultiSignature, envelope.Data, error) {
+	msg, payload, err := multiSignedCodec.Parse(payload)
+	if msg == nil || err != nil {
+		return nil, payload, err
+	}
+	result := msg.(*MultiSignature)
+
+	hash, err := SignatureHash(payload)
+	if err != nil {
+		return nil, payload, errors.Wrap(err, "hash")
+	}
+	result.hash = hash
+
+	return result, payload, nil
+}
+
+// SetPublicKeys sets the base public keys on the signatures. To be used when the public keys aren't
+// provided in the message but are known from context. The public keys must be in the same order as
+// the signatures. Nil entries are skipped.
+func (m *MultiSignature) SetPublicKeys(publicKeys []*bitcoin.PublicKey) {
+	for i, publicKey := range publicKeys {
+		if i >= len(m.Signatures) {
+			return
+		}
+
+		if publicKey != nil {
+			m.Signatures[i].PublicKey = publicKey
+		}
+	}
+}
+
+// GetPublicKey calculates the public key if there is a derivation hash or just returns the included
+// public key.
+func (s SignerSignature) GetPublicKey() (*bitcoin.PublicKey, error) {
+	if s.PublicKey == nil {
+		return nil, ErrPublicKeyMissing
+	}
+
+	if s.DerivationHash == nil {
+		return s.PublicKey, nil
+	}
+
+	publicKey, err := s.PublicKey.AddHash(*s.DerivationHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "derive key")
+	}
+
+	return &publicKey, nil
+}
+
+func (s SignerSignature) verify(hash bitcoin.Hash32) error {
+	publicKey, err := s.GetPublicKey()
+	if err != nil {
+		return err
+	}
+
+	if !s.Signature.Verify(hash, *publicKey) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// Verify checks each signature against the authorized base public keys and whether at least
+// threshold of the authorized keys made a valid signature. A signature only counts when it is by
+// an authorized key, with the derivation hash added, and each authorized key is only counted once
+// no matter how many signatures it made. When a signature doesn't include the public key then
+// each authorized key is tried. It returns ErrThresholdNotMet, along with the verification, when
+// there are not enough valid signatures.
+func (m MultiSignature) Verify(authorizedKeys []bitcoin.PublicKey,
+	threshold int) (*MultiSignatureVerification, error) {
+
+	if threshold <= 0 {
+		return nil, errors.Wrapf(ErrInvalidThreshold, "%d", threshold)
+	}
+
+	if m.hash == nil {
+		return nil, ErrHashMissing
+	}
+
+	result := &MultiSignatureVerification{
+		Errors: make([]error, len(m.Signatures)),
+	}
+
+	counted := make([]bool, len(authorizedKeys))
+	for i, signature := range m.Signatures {
+		index, err := signature.authorizedIndex(*m.hash, authorizedKeys)
+		if err != nil {
+			result.Errors[i] = err
+			continue
+		}
+
+		if !counted[index] {
+			counted[index] = true
+			result.ValidCount++
+		}
+	}
+
+	result.ThresholdMet = result.ValidCount >= threshold
+
+	if !result.ThresholdMet {
+		return result, errors.Wrapf(ErrThresholdNotMet, "%d of %d", result.ValidCount, threshold)
+	}
+
+	return result, nil
+}
+
+// authorizedIndex returns the index of the first authorized key that is equal to the key that made
+// the signature.
+func (s SignerSignature) authorizedIndex(hash bitcoin.Hash32,
+	authorizedKeys []bitcoin.PublicKey) (int, error) {
+
+	if s.PublicKey != nil {
+		for i, authorizedKey := range authorizedKeys {
+			if !authorizedKey.Equal(*s.PublicKey) {
+				continue
+			}
+
+			if err := s.verify(hash); err != nil {
+				return -1, err
+			}
+
+			return i, nil
+		}
+
+		return -1, ErrUnauthorizedPublicKey
+	}
+
+	if len(authorizedKeys) == 0 {
+		return -1, ErrPublicKeyMissing
+	}
+
+	for i := range authorizedKeys {
+		s.PublicKey = &authorizedKeys[i]
+		if err := s.verify(hash); err == nil {
+			return i, nil
+		}
+	}
+
+	return -1, ErrInvalidSignature
+}
+
+func MultiSignedResponseCodeToString(code uint32) string {
+	switch code {
+	case MultiSignedStatusSignaturesRequired:
+		return "signatures_required"
+	case MultiSignedStatusInvalidSignature:
+		return "invalid_signature"
+	case MultiSignedStatusWrongPublicKey:
+		return "wrong_public_key"
+	case MultiSignedStatusThresholdNotMet:
+		return "threshold_not_met"
+	default:
+		return "parse_error"
+	}
+}
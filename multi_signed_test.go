@@ -0,0 +1,226 @@
+package channels
+
+import (
+	"encoding/json"
+	"testing"
+
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+func Test_MultiSigned(t *testing.T) {
+	var keys []bitcoin.Key
+	var publicKeys []*bitcoin.PublicKey
+	var derivationHashes []*bitcoin.Hash32
+	for i := 0; i < 3; i++ {
+		key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+		keys = append(keys, key)
+		publicKey := key.PublicKey()
+		publicKeys = append(publicKeys, &publicKey)
+		derivationHashes = append(derivationHashes, RandomHashPtr())
+	}
+
+	id := UUID(uuid.New())
+	multiSignature := NewMultiSignature(keys[:2], derivationHashes[:2], false)
+
+	script, err := Wrap(&id, multiSignature)
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+	t.Logf("Script : %s", script)
+
+	protocols := NewProtocols(NewMultiSignedProtocol(), NewUUIDProtocol())
+	msg, wrappers, err := protocols.Parse(script)
+	if err != nil {
+		t.Fatalf("Failed to parse : %s", err)
+	}
+
+	if _, ok := msg.(*UUID); !ok {
+		t.Fatalf("Message should be a UUID : %T", msg)
+	}
+
+	if len(wrappers) != 1 {
+		t.Fatalf("Wrong wrapper count : got %d, want %d", len(wrappers), 1)
+	}
+
+	readMultiSignature, ok := wrappers[0].(*MultiSignature)
+	if !ok {
+		t.Fatalf("Wrapper should be a multi-signature : %T", wrappers[0])
+	}
+
+	js, _ := json.MarshalIndent(readMultiSignature, "", "  ")
+	t.Logf("Message : %s", js)
+
+	if len(readMultiSignature.Signatures) != 2 {
+		t.Fatalf("Wrong signature count : got %d, want %d", len(readMultiSignature.Signatures), 2)
+	}
+
+	verification, err := readMultiSignature.Verify(nil, 2)
+	if errors.Cause(err) != ErrThresholdNotMet {
+		t.Fatalf("Wrong verify error without keys : got %v, want %s", err, ErrThresholdNotMet)
+	}
+
+	for i, verifyErr := range verification.Errors {
+		if errors.Cause(verifyErr) != ErrPublicKeyMissing {
+			t.Errorf("Wrong verify error for signature %d : got %v, want %s", i, verifyErr,
+				ErrPublicKeyMissing)
+		}
+	}
+
+	// The third key didn't sign so only the first signature is by an authorized key.
+	authorizedKeys := []bitcoin.PublicKey{*publicKeys[0], *publicKeys[2]}
+	verification, err = readMultiSignature.Verify(authorizedKeys, 2)
+	if errors.Cause(err) != ErrThresholdNotMet {
+		t.Fatalf("Wrong verify error with wrong key : got %v, want %s", err, ErrThresholdNotMet)
+	}
+
+	if verification.ValidCount != 1 {
+		t.Errorf("Wrong valid count : got %d, want %d", verification.ValidCount, 1)
+	}
+
+	if verification.Errors[0] != nil {
+		t.Errorf("First signature should be valid : %s", verification.Errors[0])
+	}
+
+	if errors.Cause(verification.Errors[1]) != ErrInvalidSignature {
+		t.Errorf("Wrong verify error for second signature : got %v, want %s",
+			verification.Errors[1], ErrInvalidSignature)
+	}
+
+	if _, err := readMultiSignature.Verify(authorizedKeys, 1); err != nil {
+		t.Errorf("Threshold of 1 should be met : %s", err)
+	}
+
+	// Public keys set from context must be authorized.
+	readMultiSignature.SetPublicKeys([]*bitcoin.PublicKey{publicKeys[0], publicKeys[2]})
+
+	verification, err = readMultiSignature.Verify(authorizedKeys, 2)
+	if errors.Cause(err) != ErrThresholdNotMet {
+		t.Fatalf("Wrong verify error with set key : got %v, want %s", err, ErrThresholdNotMet)
+	}
+
+	if errors.Cause(verification.Errors[1]) != ErrInvalidSignature {
+		t.Errorf("Wrong verify error for second signature : got %v, want %s",
+			verification.Errors[1], ErrInvalidSignature)
+	}
+
+	readMultiSignature.SetPublicKeys(publicKeys[:2])
+
+	verification, err = readMultiSignature.Verify([]bitcoin.PublicKey{*publicKeys[0],
+		*publicKeys[1], *publicKeys[2]}, 2)
+	if err != nil {
+		t.Fatalf("Failed to verify : %s", err)
+	}
+
+	if !verification.ThresholdMet {
+		t.Errorf("Threshold should be met")
+	}
+
+	if verification.ValidCount != 2 {
+		t.Errorf("Wrong valid count : got %d, want %d", verification.ValidCount, 2)
+	}
+
+	_, err = readMultiSignature.Verify(authorizedKeys, 0)
+	if errors.Cause(err) != ErrInvalidThreshold {
+		t.Errorf("Wrong verify error for zero threshold : got %v, want %s", err,
+			ErrInvalidThreshold)
+	}
+}
+
+func Test_MultiSigned_Duplicate(t *testing.T) {
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	authorizedKeys := []bitcoin.PublicKey{key.PublicKey()}
+
+	id := UUID(uuid.New())
+	payload, err := id.Write()
+	if err != nil {
+		t.Fatalf("Failed to write message : %s", err)
+	}
+
+	// The same key signing twice, with or without different derivation hashes, counts once.
+	for _, derivationHashes := range [][]*bitcoin.Hash32{
+		nil,
+		{RandomHashPtr(), RandomHashPtr()},
+	} {
+		multiSignature, err := MultiSign(payload, []bitcoin.Key{key, key}, derivationHashes, true)
+		if err != nil {
+			t.Fatalf("Failed to sign : %s", err)
+		}
+
+		verification, err := multiSignature.Verify(authorizedKeys, 2)
+		if errors.Cause(err) != ErrThresholdNotMet {
+			t.Fatalf("Wrong verify error : got %v, want %s", err, ErrThresholdNotMet)
+		}
+
+		if verification.ValidCount != 1 {
+			t.Errorf("Wrong valid count : got %d, want %d", verification.ValidCount, 1)
+		}
+	}
+}
+
+func Test_MultiSigned_Unauthorized(t *testing.T) {
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	authorizedKeys := []bitcoin.PublicKey{key.PublicKey()}
+
+	id := UUID(uuid.New())
+	payload, err := id.Write()
+	if err != nil {
+		t.Fatalf("Failed to write message : %s", err)
+	}
+
+	// Anyone can include their own keys and valid signatures.
+	var otherKeys []bitcoin.Key
+	for i := 0; i < 2; i++ {
+		otherKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+		otherKeys = append(otherKeys, otherKey)
+	}
+
+	multiSignature, err := MultiSign(payload, otherKeys, nil, true)
+	if err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	verification, err := multiSignature.Verify(authorizedKeys, 1)
+	if errors.Cause(err) != ErrThresholdNotMet {
+		t.Fatalf("Wrong verify error : got %v, want %s", err, ErrThresholdNotMet)
+	}
+
+	for i, verifyErr := range verification.Errors {
+		if errors.Cause(verifyErr) != ErrUnauthorizedPublicKey {
+			t.Errorf("Wrong verify error for signature %d : got %v, want %s", i, verifyErr,
+				ErrUnauthorizedPublicKey)
+		}
+	}
+}
+
+func Test_MultiSigned_WireFormat(t *testing.T) {
+	signature, publicKey, hash, payload := testWireValues(t)
+
+	multiSignature := &MultiSignature{
+		Signatures: SignerSignatures{
+			{
+				Signature: signature,
+				PublicKey: &publicKey,
+			},
+			{
+				Signature:      signature,
+				DerivationHash: &hash,
+			},
+		},
+	}
+
+	wrapped, err := multiSignature.Wrap(payload)
+	if err != nil {
+		t.Fatalf("Failed to wrap multi-signature : %s", err)
+	}
+
+	testWireFormat(t, wrapped, "006a02bd0152024d53044e4f5445011100515152515251"+
+		"46"+testWireSignature+"5221"+testWirePublicKey+"515251"+"46"+testWireSignature+
+		"5320000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f00",
+		func(payload envelope.Data) (Wrapper, envelope.Data, error) {
+			return ParseMultiSigned(payload)
+		})
+}
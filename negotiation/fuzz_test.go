@@ -0,0 +1,54 @@
+package negotiation
+
+import (
+	"testing"
+
+	"github.com/tokenized/channels"
+	channelsExpandedTx "github.com/tokenized/channels/expanded_tx"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/expanded_tx"
+	"github.com/tokenized/pkg/fees"
+	"github.com/tokenized/pkg/wire"
+)
+
+func Fuzz_CompileTransaction(f *testing.F) {
+	threadID := "thread"
+	note := "note"
+	handle := "user@handle.com"
+	now := channels.Now()
+
+	for _, ntx := range []*Transaction{
+		{
+			ThreadID:  &threadID,
+			Fees:      fees.DefaultFeeRequirements,
+			ReplyTo:   &channels.ReplyTo{Handle: &handle},
+			Note:      &note,
+			Expiry:    &now,
+			Timestamp: &now,
+			Tx:        &expanded_tx.ExpandedTx{Tx: wire.NewMsgTx(1)},
+		},
+		{
+			ThreadID: &threadID,
+			Response: &channels.Response{Status: channels.StatusReject, Note: note},
+		},
+	} {
+		script, err := ntx.Wrap()
+		if err != nil {
+			f.Fatalf("Failed to wrap negotiation tx : %s", err)
+		}
+		f.Add([]byte(script))
+	}
+
+	protocols := channels.NewProtocols(channels.NewFeeRequirementsProtocol(),
+		channels.NewStringIDProtocol(), channels.NewNoteProtocol(), channels.NewReplyToProtocol(),
+		channels.NewResponseProtocol(), channels.NewExpiryProtocol(), channels.NewTimeProtocol(),
+		channelsExpandedTx.NewProtocol())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg, wrappers, err := protocols.Parse(bitcoin.Script(b))
+		if err != nil {
+			return
+		}
+
+		CompileTransaction(msg, wrappers)
+	})
+}
@@ -1,9 +1,6 @@
 package channels
 
 import (
-	"bytes"
-	"fmt"
-
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
 	"github.com/tokenized/pkg/bitcoin"
 
@@ -17,6 +14,8 @@ const (
 var (
 	ProtocolIDNote = envelope.ProtocolID("NOTE") // Protocol ID for notes
 
+	noteCodec = NewCodec(ProtocolIDNote, NoteVersion, "note", &Note{})
+
 	ErrInvalidNote = errors.New("Invalid Note")
 )
 
@@ -62,46 +61,29 @@ func WrapNote(payload envelope.Data, note string) (envelope.Data, error) {
 }
 
 func (m *Note) Wrap(payload envelope.Data) (envelope.Data, error) {
-	// Version
-	scriptItems := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(NoteVersion))}
-
-	// Message
-	scriptItems = append(scriptItems, bitcoin.NewPushDataScriptItem([]byte(m.Note)))
-
-	payload.ProtocolIDs = append(envelope.ProtocolIDs{ProtocolIDNote}, payload.ProtocolIDs...)
-	payload.Payload = append(scriptItems, payload.Payload...)
-
-	return payload, nil
+	return noteCodec.Wrap(m, payload)
 }
 
-func ParseNote(payload envelope.Data) (*Note, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 || !bytes.Equal(payload.ProtocolIDs[0], ProtocolIDNote) {
-		return nil, payload, nil
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
+func (m *Note) MarshalScriptItems() (bitcoin.ScriptItems, error) {
+	return bitcoin.ScriptItems{bitcoin.NewPushDataScriptItem([]byte(m.Note))}, nil
+}
 
-	if len(payload.Payload) < 3 {
-		return nil, payload, errors.Wrapf(ErrInvalidMessage, "not enough note push ops: %d",
-			len(payload.Payload))
-	}
+func (m *Note) UnmarshalScriptItems(scriptItems bitcoin.ScriptItems) (bitcoin.ScriptItems,
+	error) {
 
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(ErrUnsupportedVersion,
-			fmt.Sprintf("note: %d", version))
+	if len(scriptItems) == 0 || scriptItems[0].Type != bitcoin.ScriptItemTypePushData {
+		return nil, errors.New("Not Push Data")
 	}
+	m.Note = string(scriptItems[0].Data)
 
-	if payload.Payload[1].Type != bitcoin.ScriptItemTypePushData {
-		return nil, payload, errors.New("Not Push Data")
-	}
+	return scriptItems[1:], nil
+}
 
-	result := &Note{
-		Note: string(payload.Payload[1].Data),
+func ParseNote(payload envelope.Data) (*Note, envelope.Data, error) {
+	msg, payload, err := noteCodec.Parse(payload)
+	if msg == nil {
+		return nil, payload, err
 	}
 
-	payload.Payload = payload.Payload[2:]
-	return result, payload, nil
+	return msg.(*Note), payload, nil
 }
@@ -1,13 +1,11 @@
 package peer_channels
 
 import (
-	"bytes"
 	"fmt"
 
 	"github.com/tokenized/channels"
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
 	"github.com/tokenized/pkg/bitcoin"
-	"github.com/tokenized/pkg/bsor"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
@@ -28,6 +26,14 @@ var (
 
 	ErrUnsupportedVersion             = errors.New("Unsupported PeerChannels Version")
 	ErrUnsupportedPeerChannelsMessage = errors.New("Unsupported PeerChannels Message")
+
+	codec = channels.NewTypedCodec(ProtocolID, Version, "peer channels",
+		ErrUnsupportedPeerChannelsMessage, channels.CodecMessageTypes{
+			{Type: uint64(MessageTypeAccount), Name: "account", Message: &Account{}},
+			{Type: uint64(MessageTypeChannel), Name: "channel", Message: &Channel{}},
+			{Type: uint64(MessageTypeCreateChannel), Name: "create", Message: &CreateChannel{}},
+			{Type: uint64(MessageTypeDeleteChannel), Name: "delete", Message: &DeleteChannel{}},
+		}).SetErrUnsupportedVersion(ErrUnsupportedVersion).SetCantWrap()
 )
 
 type MessageType uint8
@@ -84,20 +90,7 @@ func (*Account) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *Account) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload, bitcoin.PushNumberScriptItem(int64(MessageTypeAccount)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 type Channel struct {
@@ -112,20 +105,7 @@ func (*Channel) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *Channel) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload, bitcoin.PushNumberScriptItem(int64(MessageTypeChannel)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 type CreateChannel struct {
@@ -137,21 +117,7 @@ func (*CreateChannel) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *CreateChannel) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload,
-		bitcoin.PushNumberScriptItem(int64(MessageTypeCreateChannel)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 type DeleteChannel struct {
@@ -163,99 +129,20 @@ func (*DeleteChannel) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *DeleteChannel) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload,
-		bitcoin.PushNumberScriptItem(int64(MessageTypeDeleteChannel)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(m)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
 }
 
 func Parse(payload envelope.Data) (channels.Message, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 {
-		return nil, payload, nil
-	}
-
-	if !bytes.Equal(payload.ProtocolIDs[0], ProtocolID) {
-		return nil, payload, nil
-	}
-
-	if len(payload.ProtocolIDs) != 1 {
-		return nil, payload, errors.Wrapf(channels.ErrInvalidMessage, "peer channels can't wrap")
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
-
-	if len(payload.Payload) == 0 {
-		return nil, payload, errors.Wrapf(channels.ErrInvalidMessage, "payload empty")
-	}
-
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(ErrUnsupportedVersion, fmt.Sprintf("%d", version))
-	}
-
-	messageType, err := bitcoin.ScriptNumberValue(payload.Payload[1])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "message type")
-	}
-
-	result := MessageForType(MessageType(messageType))
-	if result == nil {
-		return nil, payload, errors.Wrap(ErrUnsupportedPeerChannelsMessage,
-			fmt.Sprintf("%d", MessageType(messageType)))
-	}
-
-	payloads, err := bsor.Unmarshal(payload.Payload[2:], result)
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "unmarshal")
-	}
-	payload.Payload = payloads
-
-	return result, payload, nil
+	return codec.Parse(payload)
 }
 
 func MessageForType(messageType MessageType) channels.Message {
-	switch messageType {
-	case MessageTypeAccount:
-		return &Account{}
-	case MessageTypeChannel:
-		return &Channel{}
-	case MessageTypeCreateChannel:
-		return &CreateChannel{}
-	case MessageTypeDeleteChannel:
-		return &DeleteChannel{}
-	case MessageTypeInvalid:
-		return nil
-	default:
-		return nil
-	}
+	return codec.MessageForType(uint64(messageType))
 }
 
 func MessageTypeFor(message channels.Message) MessageType {
-	switch message.(type) {
-	case *Account:
-		return MessageTypeAccount
-	case *CreateChannel:
-		return MessageTypeCreateChannel
-	case *DeleteChannel:
-		return MessageTypeDeleteChannel
-	case *Channel:
-		return MessageTypeChannel
-	default:
-		return MessageTypeInvalid
-	}
+	messageType, _ := codec.MessageTypeFor(message)
+	return MessageType(messageType)
 }
 
 func (v *MessageType) UnmarshalJSON(data []byte) error {
@@ -289,36 +176,18 @@ func (v *MessageType) UnmarshalText(text []byte) error {
 }
 
 func (v *MessageType) SetString(s string) error {
-	switch s {
-	case "account":
-		*v = MessageTypeAccount
-	case "channel":
-		*v = MessageTypeChannel
-	case "create":
-		*v = MessageTypeCreateChannel
-	case "delete":
-		*v = MessageTypeDeleteChannel
-	default:
+	messageType, ok := codec.MessageTypeForName(s)
+	if !ok {
 		*v = MessageTypeInvalid
 		return fmt.Errorf("Unknown MessageType value \"%s\"", s)
 	}
 
+	*v = MessageType(messageType)
 	return nil
 }
 
 func (v MessageType) String() string {
-	switch v {
-	case MessageTypeAccount:
-		return "account"
-	case MessageTypeChannel:
-		return "channel"
-	case MessageTypeCreateChannel:
-		return "create"
-	case MessageTypeDeleteChannel:
-		return "delete"
-	default:
-		return ""
-	}
+	return codec.MessageTypeName(uint64(v))
 }
 
 func (v *ChannelType) UnmarshalJSON(data []byte) error {
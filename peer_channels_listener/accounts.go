@@ -0,0 +1,208 @@
+package peer_channels_listener
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tokenized/logger"
+	"github.com/tokenized/pkg/peer_channels"
+	"github.com/tokenized/threads"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultAccountID is the ID of the account for the read token specified in
+	// NewPeerChannelsListener.
+	DefaultAccountID = ""
+)
+
+var (
+	ErrAccountExists   = errors.New("Account Exists")
+	ErrAccountNotFound = errors.New("Account Not Found")
+)
+
+type accountIDContextKey struct{}
+
+// account is a peer channel account that the listener receives messages for. Each account has its
+// own listen thread and connection to the peer channel service.
+type account struct {
+	id           string
+	token        string
+	listChannels ListChannels
+
+	connectionState uint32
+
+	thread *threads.InterruptableThread
+	wait   sync.WaitGroup
+}
+
+// accountMessage is a message tagged with the account it was received for.
+type accountMessage struct {
+	peer_channels.Message
+	accountID string
+	token     string
+}
+
+// ContextWithAccountID returns a context that contains the ID of the account that a message was
+// received for.
+func ContextWithAccountID(ctx context.Context, accountID string) context.Context {
+	return context.WithValue(ctx, accountIDContextKey{}, accountID)
+}
+
+// AccountIDFromContext returns the ID of the account that the message being handled was received
+// for. It returns DefaultAccountID for messages received with the read token specified in
+// NewPeerChannelsListener.
+func AccountIDFromContext(ctx context.Context) string {
+	accountID, _ := ctx.Value(accountIDContextKey{}).(string)
+	return accountID
+}
+
+// AddAccount adds an account to receive messages for. Messages for all accounts are handled by the
+// same handler threads and the account ID is available from AccountIDFromContext. listChannels
+// specifies the channels to check for unread messages when connecting and can be nil. If the
+// listener is running then it starts listening for the account immediately. An account that gives
+// up reconnecting is removed, unless it is the last account, in which case Run returns the error.
+func (l *PeerChannelsListener) AddAccount(accountID, token string,
+	listChannels ListChannels) error {
+
+	l.accountsLock.Lock()
+	defer l.accountsLock.Unlock()
+
+	if _, exists := l.accounts[accountID]; exists {
+		return errors.Wrap(ErrAccountExists, accountID)
+	}
+
+	a := &account{
+		id:           CopyString(accountID),
+		token:        CopyString(token),
+		listChannels: listChannels,
+	}
+	l.accounts[accountID] = a
+
+	if l.runCtx != nil {
+		l.startAccount(a)
+	}
+
+	return nil
+}
+
+// RemoveAccount stops listening for an account and waits for its listen thread to stop. Messages
+// already received for the account are still handled.
+func (l *PeerChannelsListener) RemoveAccount(ctx context.Context, accountID string) error {
+	l.accountsLock.Lock()
+	a, exists := l.accounts[accountID]
+	if !exists {
+		l.accountsLock.Unlock()
+		return errors.Wrap(ErrAccountNotFound, accountID)
+	}
+
+	delete(l.accounts, accountID)
+	if a.thread != nil {
+		a.thread.Stop(ctx)
+	}
+	l.accountsLock.Unlock()
+
+	waitWarning := logger.NewWaitingWarning(ctx, time.Second*3, "Listen thread %s", accountID)
+	a.wait.Wait()
+	waitWarning.Cancel()
+
+	return nil
+}
+
+// AccountIDs returns the IDs of the accounts that the listener receives messages for.
+func (l *PeerChannelsListener) AccountIDs() []string {
+	l.accountsLock.Lock()
+	defer l.accountsLock.Unlock()
+
+	var result []string
+	for accountID := range l.accounts {
+		result = append(result, accountID)
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+// startAccount starts the listen thread for an account. It must be called while holding the
+// accounts lock and while the listener is running.
+func (l *PeerChannelsListener) startAccount(a *account) {
+	name := "Peer Channel Listen"
+	ctx := l.runCtx
+	if a.id != DefaultAccountID {
+		name = fmt.Sprintf("Peer Channel Listen %s", a.id)
+		ctx = logger.ContextWithLogFields(ctx, logger.String("account", a.id))
+	}
+
+	listenFailed := l.listenFailed
+	a.thread = threads.NewInterruptableThread(name,
+		func(ctx context.Context, interrupt <-chan interface{}) error {
+			err := l.listen(ctx, interrupt, a, l.channelTimeout.Load().(time.Duration))
+			if err != nil && !l.dropFailedAccount(ctx, a, err) {
+				select {
+				case listenFailed <- err:
+				default:
+				}
+			}
+			return err
+		})
+	a.thread.SetWait(&a.wait)
+	a.thread.Start(ctx)
+}
+
+// dropFailedAccount removes an account whose listen thread failed so the other accounts keep
+// listening. It returns false when the account is the last account so the listener stops.
+func (l *PeerChannelsListener) dropFailedAccount(ctx context.Context, a *account,
+	err error) bool {
+
+	l.accountsLock.Lock()
+	defer l.accountsLock.Unlock()
+
+	if current, exists := l.accounts[a.id]; !exists || current != a {
+		return true // already removed
+	}
+
+	if len(l.accounts) == 1 {
+		return false
+	}
+
+	delete(l.accounts, a.id)
+	logger.Error(ctx, "Removed peer channel account after listen failed : %s", err)
+	return true
+}
+
+// stopAccounts stops the listen threads of all accounts and waits for them to stop. It returns
+// the errors returned by the listen threads.
+func (l *PeerChannelsListener) stopAccounts(ctx context.Context) []error {
+	l.accountsLock.Lock()
+	l.runCtx = nil
+	var accounts []*account
+	for _, a := range l.accounts {
+		if a.thread != nil {
+			a.thread.Stop(ctx)
+			accounts = append(accounts, a)
+		}
+	}
+	l.accountsLock.Unlock()
+
+	waitWarning := logger.NewWaitingWarning(ctx, time.Second*3, "Listen threads")
+	for _, a := range accounts {
+		a.wait.Wait()
+	}
+	waitWarning.Cancel()
+
+	var errs []error
+	for _, a := range accounts {
+		if err := a.thread.Error(); err != nil {
+			if a.id != DefaultAccountID {
+				err = errors.Wrapf(err, "account %s", a.id)
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
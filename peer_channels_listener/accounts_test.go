@@ -0,0 +1,274 @@
+package peer_channels_listener
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/pkg/errors"
+)
+
+func Test_Accounts(t *testing.T) {
+	ctx := context.Background()
+	client := peer_channels.NewMockClient()
+
+	accountCount := 3
+	var accounts []*peer_channels.Account
+	var channels []*peer_channels.FullChannel
+	for i := 0; i < accountCount; i++ {
+		account, err := client.CreateAccount(ctx)
+		if err != nil {
+			t.Fatalf("Failed to create account : %s", err)
+		}
+		accounts = append(accounts, account)
+
+		accountClient := peer_channels.NewMockAccountClient(client, account.AccountID,
+			account.Token)
+		channel, err := accountClient.CreateChannel(ctx)
+		if err != nil {
+			t.Fatalf("Failed to create channel : %s", err)
+		}
+		channels = append(channels, channel)
+	}
+
+	var lock sync.Mutex
+	received := make(map[string][]string) // account id to channel ids
+	handled := make(chan interface{}, 100)
+	handleMessage := func(ctx context.Context, msg peer_channels.Message) error {
+		lock.Lock()
+		accountID := AccountIDFromContext(ctx)
+		received[accountID] = append(received[accountID], msg.ChannelID)
+		lock.Unlock()
+
+		handled <- nil
+		return nil
+	}
+
+	listener := NewPeerChannelsListener(client, "", 100, 2, time.Second, handleMessage, nil)
+	listener.SetConnectedDelay(10 * time.Millisecond)
+
+	// Added before running.
+	if err := listener.AddAccount(accounts[0].AccountID, accounts[0].Token, nil); err != nil {
+		t.Fatalf("Failed to add account : %s", err)
+	}
+
+	interrupt := make(chan interface{})
+	runComplete := make(chan error, 1)
+	go func() {
+		runComplete <- listener.Run(ctx, interrupt)
+	}()
+
+	// Added while running.
+	for _, account := range accounts[1:] {
+		if err := listener.AddAccount(account.AccountID, account.Token, nil); err != nil {
+			t.Fatalf("Failed to add account : %s", err)
+		}
+	}
+
+	if err := listener.AddAccount(accounts[0].AccountID, accounts[0].Token,
+		nil); errors.Cause(err) != ErrAccountExists {
+		t.Fatalf("Wrong add error : got %v, want %s", err, ErrAccountExists)
+	}
+
+	waitConnected := func() {
+		start := time.Now()
+		for _, account := range listener.AccountIDs() {
+			for listener.AccountConnectionState(account) != ConnectionStateConnected {
+				if time.Since(start) > 5*time.Second {
+					t.Fatalf("Timed out waiting to connect account %s", account)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	writeMessages := func() {
+		for _, channel := range channels {
+			if err := client.WriteMessage(ctx, channel.ID, channel.WriteToken,
+				peer_channels.ContentTypeBinary, bytes.NewReader([]byte{0x01})); err != nil {
+				t.Fatalf("Failed to write message : %s", err)
+			}
+		}
+	}
+
+	waitHandled := func(count int) {
+		for i := 0; i < count; i++ {
+			select {
+			case <-handled:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for messages : %d handled", i)
+			}
+		}
+	}
+
+	waitConnected()
+	writeMessages()
+	waitHandled(accountCount)
+
+	if err := listener.RemoveAccount(ctx, accounts[2].AccountID); err != nil {
+		t.Fatalf("Failed to remove account : %s", err)
+	}
+
+	if err := listener.RemoveAccount(ctx,
+		accounts[2].AccountID); errors.Cause(err) != ErrAccountNotFound {
+		t.Fatalf("Wrong remove error : got %v, want %s", err, ErrAccountNotFound)
+	}
+
+	writeMessages()
+	waitHandled(accountCount - 1)
+
+	select {
+	case <-handled:
+		t.Fatalf("Received message for removed account")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(interrupt)
+	select {
+	case err := <-runComplete:
+		if err != nil {
+			t.Fatalf("Failed to run listener : %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for listener to stop")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	for i, account := range accounts {
+		want := 2
+		if i == 2 {
+			want = 1
+		}
+
+		channelIDs := received[account.AccountID]
+		if len(channelIDs) != want {
+			t.Errorf("Wrong message count for account %d : got %d, want %d", i,
+				len(channelIDs), want)
+		}
+
+		for _, channelID := range channelIDs {
+			if channelID != channels[i].ID {
+				t.Errorf("Wrong channel for account %d : got %s, want %s", i, channelID,
+					channels[i].ID)
+			}
+		}
+	}
+}
+
+func Test_Accounts_GiveUp(t *testing.T) {
+	ctx := context.Background()
+	client := peer_channels.NewMockClient()
+
+	account, err := client.CreateAccount(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create account : %s", err)
+	}
+
+	accountClient := peer_channels.NewMockAccountClient(client, account.AccountID, account.Token)
+	channel, err := accountClient.CreateChannel(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create channel : %s", err)
+	}
+
+	handled := make(chan interface{}, 10)
+	handleMessage := func(ctx context.Context, msg peer_channels.Message) error {
+		handled <- nil
+		return nil
+	}
+
+	var lock sync.Mutex
+	gaveUp := make(map[string]bool)
+	handleConnectionState := func(ctx context.Context, event ConnectionStateEvent) {
+		if errors.Cause(event.Err) == ErrGaveUpReconnecting {
+			lock.Lock()
+			gaveUp[event.AccountID] = true
+			lock.Unlock()
+		}
+	}
+
+	listener := NewPeerChannelsListener(client, "", 100, 2, time.Second, handleMessage, nil)
+	listener.SetConnectedDelay(10 * time.Millisecond)
+	listener.SetReconnectPolicy(testReconnectPolicy(2))
+	listener.SetConnectionStateHandler(handleConnectionState)
+
+	if err := listener.AddAccount(account.AccountID, account.Token, nil); err != nil {
+		t.Fatalf("Failed to add account : %s", err)
+	}
+
+	// The token isn't known to the peer channel service so the account can't connect.
+	if err := listener.AddAccount("invalid", "invalid token", nil); err != nil {
+		t.Fatalf("Failed to add account : %s", err)
+	}
+
+	interrupt := make(chan interface{})
+	runComplete := make(chan error, 1)
+	go func() {
+		runComplete <- listener.Run(ctx, interrupt)
+	}()
+
+	// Only the failed account is removed.
+	start := time.Now()
+	for len(listener.AccountIDs()) != 1 {
+		select {
+		case err := <-runComplete:
+			t.Fatalf("Listener stopped when one account failed : %v", err)
+		default:
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Timed out waiting for account to be removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if accountIDs := listener.AccountIDs(); accountIDs[0] != account.AccountID {
+		t.Fatalf("Wrong remaining account : got %s, want %s", accountIDs[0], account.AccountID)
+	}
+
+	lock.Lock()
+	if !gaveUp["invalid"] {
+		t.Errorf("Failed account should be reported")
+	}
+	lock.Unlock()
+
+	for listener.AccountConnectionState(account.AccountID) != ConnectionStateConnected {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Timed out waiting to connect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := client.WriteMessage(ctx, channel.ID, channel.WriteToken,
+		peer_channels.ContentTypeBinary, bytes.NewReader([]byte{0x01})); err != nil {
+		t.Fatalf("Failed to write message : %s", err)
+	}
+
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+
+	// The listener stops when the last account fails.
+	if err := listener.RemoveAccount(ctx, account.AccountID); err != nil {
+		t.Fatalf("Failed to remove account : %s", err)
+	}
+
+	if err := listener.AddAccount("invalid", "invalid token", nil); err != nil {
+		t.Fatalf("Failed to add account : %s", err)
+	}
+
+	select {
+	case err := <-runComplete:
+		if errors.Cause(err) != ErrGaveUpReconnecting {
+			t.Fatalf("Wrong run error : got %v, want %s", err, ErrGaveUpReconnecting)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for listener to stop")
+	}
+}
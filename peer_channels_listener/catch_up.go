@@ -0,0 +1,197 @@
+package peer_channels_listener
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+
+	"github.com/tokenized/logger"
+	"github.com/tokenized/pkg/peer_channels"
+	"github.com/tokenized/threads"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultCatchUpMaxCount is the maximum number of unread messages fetched from each channel
+	// during a catch up.
+	DefaultCatchUpMaxCount = uint(1000)
+)
+
+// CatchUpChannel is a channel that is checked for unread messages when the listener connects.
+type CatchUpChannel struct {
+	ChannelID string
+	Token     string // read token for the channel
+}
+
+// ListChannels returns the channels that are checked for unread messages when the listener
+// connects.
+type ListChannels func(ctx context.Context) ([]*CatchUpChannel, error)
+
+// HandleSequenceGap is called when a message is received for a channel and the messages between
+// the last message received for the channel and it are missing. It is called from the listen
+// thread so it should not block.
+type HandleSequenceGap func(ctx context.Context, channelID string, expected, received uint64)
+
+// AccountChannels returns a ListChannels that checks every channel on a peer channel account.
+func AccountChannels(client peer_channels.AccountClient) ListChannels {
+	return func(ctx context.Context) ([]*CatchUpChannel, error) {
+		channels, err := client.ListChannels(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "list channels")
+		}
+
+		result := make([]*CatchUpChannel, len(channels))
+		for i, channel := range channels {
+			result[i] = &CatchUpChannel{
+				ChannelID: channel.ID,
+				Token:     channel.ReadToken,
+			}
+		}
+
+		return result, nil
+	}
+}
+
+// SetCatchUp enables fetching unread messages from the channels returned by listChannels before
+// and after each connection to the peer channel service, and when a gap in a channel's sequence
+// is detected, so messages posted while disconnected are not missed. It applies to the account
+// for the read token specified in NewPeerChannelsListener. Other accounts specify listChannels in
+// AddAccount. At most maxCount messages are fetched from each channel. It must be called before
+// Run.
+func (l *PeerChannelsListener) SetCatchUp(listChannels ListChannels, maxCount uint) {
+	l.accountsLock.Lock()
+	if a, exists := l.accounts[DefaultAccountID]; exists {
+		a.listChannels = listChannels
+	}
+	l.accountsLock.Unlock()
+
+	l.catchUpMaxCount = maxCount
+}
+
+// SetSequenceGapHandler sets a function that is called when messages are missing from a channel,
+// after catching up if it is enabled. It must be called before Run.
+func (l *PeerChannelsListener) SetSequenceGapHandler(handler HandleSequenceGap) {
+	l.handleSequenceGap = handler
+}
+
+// sequencer tracks the last sequence delivered for each channel so duplicate messages are dropped
+// and gaps are detected. It is only used by the listen thread.
+type sequencer struct {
+	last map[string]uint64
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{
+		last: make(map[string]uint64),
+	}
+}
+
+// isDuplicate returns true if the message, or a later message on the same channel, was already
+// delivered.
+func (s *sequencer) isDuplicate(msg peer_channels.Message) bool {
+	last, exists := s.last[msg.ChannelID]
+	return exists && msg.Sequence <= last
+}
+
+// gap returns the expected sequence and true if there are messages missing before the message.
+func (s *sequencer) gap(msg peer_channels.Message) (uint64, bool) {
+	last, exists := s.last[msg.ChannelID]
+	if !exists || msg.Sequence <= last+1 {
+		return 0, false
+	}
+
+	return last + 1, true
+}
+
+func (s *sequencer) record(msg peer_channels.Message) {
+	s.last[msg.ChannelID] = msg.Sequence
+}
+
+// catchUp fetches unread messages from each of the account's channels, if catch up is enabled,
+// and delivers them, with the extra messages, in sequence order.
+func (l *PeerChannelsListener) catchUp(ctx context.Context, interrupt <-chan interface{},
+	a *account, sequences *sequencer, extra ...peer_channels.Message) error {
+
+	messages := make([]peer_channels.Message, len(extra))
+	copy(messages, extra)
+
+	if a.listChannels != nil {
+		channels, err := a.listChannels(ctx)
+		if err != nil {
+			return errors.Wrap(err, "list channels")
+		}
+
+		for _, channel := range channels {
+			unread, err := l.peerChannelsClient.GetMessages(ctx, channel.ChannelID, channel.Token,
+				true, l.catchUpMaxCount)
+			if err != nil {
+				return errors.Wrapf(err, "get messages: %s", channel.ChannelID)
+			}
+
+			for _, msg := range unread {
+				messages = append(messages, *msg)
+			}
+		}
+
+		logger.InfoWithFields(ctx, []logger.Field{
+			logger.Int("channels", len(channels)),
+			logger.Int("messages", len(messages)-len(extra)),
+		}, "Caught up on unread peer channel messages")
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		if messages[i].ChannelID != messages[j].ChannelID {
+			return messages[i].ChannelID < messages[j].ChannelID
+		}
+		return messages[i].Sequence < messages[j].Sequence
+	})
+
+	for _, msg := range messages {
+		if err := l.deliver(ctx, interrupt, a, sequences, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deliver sends the message, tagged with the account, to be handled unless it was already
+// delivered. It returns threads.Interrupted if it is interrupted.
+func (l *PeerChannelsListener) deliver(ctx context.Context, interrupt <-chan interface{},
+	a *account, sequences *sequencer, msg peer_channels.Message) error {
+
+	if sequences.isDuplicate(msg) {
+		logger.VerboseWithFields(ctx, []logger.Field{
+			logger.String("channel", msg.ChannelID),
+			logger.Uint64("sequence", msg.Sequence),
+		}, "Dropping duplicate peer channel message")
+		l.metrics.AddCounter(MetricDuplicateMessages, nil, 1)
+		return nil
+	}
+
+	if expected, isGap := sequences.gap(msg); isGap {
+		logger.WarnWithFields(ctx, []logger.Field{
+			logger.String("channel", msg.ChannelID),
+			logger.Uint64("expected_sequence", expected),
+			logger.Uint64("sequence", msg.Sequence),
+		}, "Peer channel messages missing")
+		l.metrics.AddCounter(MetricSequenceGaps, nil, 1)
+
+		if l.handleSequenceGap != nil {
+			l.handleSequenceGap(ctx, msg.ChannelID, expected, msg.Sequence)
+		}
+	}
+
+	sequences.record(msg)
+
+	select {
+	case l.messagesChannel <- accountMessage{Message: msg, accountID: a.id, token: a.token}:
+		atomic.AddInt64(&l.pendingMessages, 1)
+		l.metrics.AddCounter(MetricMessagesReceived, nil, 1)
+		l.reportQueueDepths()
+		return nil
+	case <-interrupt:
+		return threads.Interrupted
+	}
+}
@@ -0,0 +1,181 @@
+package peer_channels_listener
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tokenized/channels/metrics"
+	"github.com/tokenized/pkg/peer_channels"
+)
+
+// noReplayClient doesn't send unread messages when listening so they are only received by
+// catching up.
+type noReplayClient struct {
+	*peer_channels.MockClient
+}
+
+func (c *noReplayClient) Listen(ctx context.Context, token string, sendUnread bool,
+	channelTimeout time.Duration, incoming chan<- peer_channels.Message,
+	interrupt <-chan interface{}) error {
+
+	return c.MockClient.Listen(ctx, token, false, channelTimeout, incoming, interrupt)
+}
+
+func Test_Deliver(t *testing.T) {
+	ctx := context.Background()
+	interrupt := make(chan interface{})
+
+	m := metrics.NewMemory()
+	listener := NewPeerChannelsListener(nil, "", 10, 1, time.Second, nil, nil)
+	listener.SetMetrics(m)
+	var gaps [][2]uint64
+	listener.SetSequenceGapHandler(func(ctx context.Context, channelID string,
+		expected, received uint64) {
+		gaps = append(gaps, [2]uint64{expected, received})
+	})
+
+	a := &account{id: "account"}
+	sequences := newSequencer()
+	for _, sequence := range []uint64{1, 2, 2, 1, 5, 6} {
+		msg := peer_channels.Message{
+			ChannelID: "channel",
+			Sequence:  sequence,
+		}
+		if err := listener.deliver(ctx, interrupt, a, sequences, msg); err != nil {
+			t.Fatalf("Failed to deliver message : %s", err)
+		}
+	}
+
+	if queued, _ := m.Gauge(MetricMessagesQueued, nil); queued != 4 {
+		t.Errorf("Wrong queued messages : got %f, want %f", queued, 4.0)
+	}
+	if count := m.Counter(MetricDuplicateMessages, nil); count != 2 {
+		t.Errorf("Wrong duplicate count : got %f, want %f", count, 2.0)
+	}
+	if count := m.Counter(MetricSequenceGaps, nil); count != 1 {
+		t.Errorf("Wrong sequence gap count : got %f, want %f", count, 1.0)
+	}
+
+	var delivered []uint64
+	for len(listener.messagesChannel) > 0 {
+		delivered = append(delivered, (<-listener.messagesChannel).Sequence)
+	}
+
+	want := []uint64{1, 2, 5, 6}
+	if len(delivered) != len(want) {
+		t.Fatalf("Wrong delivered messages : got %v, want %v", delivered, want)
+	}
+	for i := range want {
+		if delivered[i] != want[i] {
+			t.Errorf("Wrong delivered message %d : got %d, want %d", i, delivered[i], want[i])
+		}
+	}
+
+	if len(gaps) != 1 || gaps[0] != [2]uint64{3, 5} {
+		t.Errorf("Wrong gaps : got %v, want %v", gaps, [][2]uint64{{3, 5}})
+	}
+}
+
+func Test_CatchUp(t *testing.T) {
+	ctx := context.Background()
+	client := &noReplayClient{
+		MockClient: peer_channels.NewMockClient(),
+	}
+
+	account, err := client.CreateAccount(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create account : %s", err)
+	}
+
+	accountClient := peer_channels.NewMockAccountClient(client.MockClient, account.AccountID,
+		account.Token)
+
+	channel, err := accountClient.CreateChannel(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create channel : %s", err)
+	}
+
+	writeMessage := func(value uint64) {
+		payload := make([]byte, 8)
+		binary.LittleEndian.PutUint64(payload, value)
+		if err := client.WriteMessage(ctx, channel.ID, channel.WriteToken,
+			peer_channels.ContentTypeBinary, bytes.NewReader(payload)); err != nil {
+			t.Fatalf("Failed to write message : %s", err)
+		}
+	}
+
+	// Posted before the listener starts so they are only received by catching up.
+	messageCount := 10
+	for i := 0; i < messageCount/2; i++ {
+		writeMessage(uint64(i))
+	}
+
+	var lock sync.Mutex
+	var values []uint64
+	complete := make(chan interface{})
+	handleMessage := func(ctx context.Context, msg peer_channels.Message) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		values = append(values, binary.LittleEndian.Uint64(msg.Payload))
+		if len(values) == messageCount {
+			close(complete)
+		}
+		return nil
+	}
+
+	listener := NewPeerChannelsListener(client, account.Token, 100, 2, time.Second,
+		handleMessage, nil)
+	listener.SetCatchUp(AccountChannels(accountClient), DefaultCatchUpMaxCount)
+	listener.SetConnectedDelay(10 * time.Millisecond)
+
+	interrupt := make(chan interface{})
+	runComplete := make(chan error, 1)
+	go func() {
+		runComplete <- listener.Run(ctx, interrupt)
+	}()
+
+	start := time.Now()
+	for listener.ConnectionState() != ConnectionStateConnected {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Timed out waiting to connect : %s", listener.ConnectionState())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := messageCount / 2; i < messageCount; i++ {
+		writeMessage(uint64(i))
+	}
+
+	select {
+	case <-complete:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for messages : %v", values)
+	}
+
+	close(interrupt)
+	select {
+	case err := <-runComplete:
+		if err != nil {
+			t.Fatalf("Failed to run listener : %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for listener to stop")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if len(values) != messageCount {
+		t.Fatalf("Wrong message count : got %d, want %d", len(values), messageCount)
+	}
+	for i, value := range values {
+		if value != uint64(i) {
+			t.Errorf("Wrong message %d : got %d, want %d", i, value, i)
+		}
+	}
+}
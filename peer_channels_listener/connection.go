@@ -0,0 +1,132 @@
+package peer_channels_listener
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ConnectionStateDisconnected means the listener is not connected. It is the state before Run
+	// is called and while waiting to reconnect after the connection closed without an error.
+	ConnectionStateDisconnected = ConnectionState(0)
+
+	// ConnectionStateConnecting means the listener is connecting to the peer channel service.
+	ConnectionStateConnecting = ConnectionState(1)
+
+	// ConnectionStateConnected means the listener is connected and receiving messages.
+	ConnectionStateConnected = ConnectionState(2)
+
+	// ConnectionStateError means the connection failed. The event contains the error.
+	ConnectionStateError = ConnectionState(3)
+
+	// DefaultConnectedDelay is how long a connection must stay open, without receiving a message,
+	// before it is considered connected.
+	DefaultConnectedDelay = 2 * time.Second
+)
+
+var (
+	ErrGaveUpReconnecting = errors.New("Gave Up Reconnecting")
+)
+
+type ConnectionState uint8
+
+// ConnectionStateEvent is a change in the state of the connection to the peer channel service.
+type ConnectionStateEvent struct {
+	AccountID string
+	State     ConnectionState
+	Err       error // set when State is ConnectionStateError
+
+	// Attempt is the number of consecutive failed connection attempts.
+	Attempt int
+	Time    time.Time
+}
+
+// HandleConnectionState is called when the state of the connection changes. It is called from the
+// listen thread so it should not block.
+type HandleConnectionState func(ctx context.Context, event ConnectionStateEvent)
+
+func DefaultReconnectPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  0, // never give up
+		InitialDelay: time.Second,
+		MaxDelay:     time.Minute,
+		Multiplier:   2.0,
+		Jitter:       0.2,
+	}
+}
+
+// SetReconnectPolicy sets the backoff used when the connection to the peer channel service fails.
+// MaxAttempts is the number of consecutive failed connections before the listener gives up on an
+// account, or zero to never give up. An account that gives up is removed and the error is reported
+// to the connection state handler. When it is the last account Run returns ErrGaveUpReconnecting.
+// It must be called before Run.
+func (l *PeerChannelsListener) SetReconnectPolicy(policy RetryPolicy) {
+	l.reconnectPolicy = policy
+}
+
+// SetConnectionStateHandler sets a function that is called when the state of the connection
+// changes. It must be called before Run.
+func (l *PeerChannelsListener) SetConnectionStateHandler(handler HandleConnectionState) {
+	l.handleConnectionState = handler
+}
+
+// SetConnectedDelay sets how long a connection must stay open, without receiving a message,
+// before it is considered connected. It must be called before Run.
+func (l *PeerChannelsListener) SetConnectedDelay(delay time.Duration) {
+	l.connectedDelay = delay
+}
+
+// ConnectionState returns the current state of the connection to the peer channel service for the
+// account for the read token specified in NewPeerChannelsListener.
+func (l *PeerChannelsListener) ConnectionState() ConnectionState {
+	return l.AccountConnectionState(DefaultAccountID)
+}
+
+// AccountConnectionState returns the current state of the connection to the peer channel service
+// for an account. It returns ConnectionStateDisconnected if the account isn't found.
+func (l *PeerChannelsListener) AccountConnectionState(accountID string) ConnectionState {
+	l.accountsLock.Lock()
+	a, exists := l.accounts[accountID]
+	l.accountsLock.Unlock()
+
+	if !exists {
+		return ConnectionStateDisconnected
+	}
+
+	return ConnectionState(atomic.LoadUint32(&a.connectionState))
+}
+
+func (l *PeerChannelsListener) setConnectionState(ctx context.Context, a *account,
+	state ConnectionState, attempt int, err error) {
+
+	atomic.StoreUint32(&a.connectionState, uint32(state))
+
+	if l.handleConnectionState != nil {
+		l.handleConnectionState(ctx, ConnectionStateEvent{
+			AccountID: a.id,
+			State:     state,
+			Err:       err,
+			Attempt:   attempt,
+			Time:      time.Now(),
+		})
+	}
+}
+
+func (v ConnectionState) String() string {
+	switch v {
+	case ConnectionStateDisconnected:
+		return "disconnected"
+	case ConnectionStateConnecting:
+		return "connecting"
+	case ConnectionStateConnected:
+		return "connected"
+	case ConnectionStateError:
+		return "error"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(v))
+	}
+}
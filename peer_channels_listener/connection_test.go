@@ -0,0 +1,164 @@
+package peer_channels_listener
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tokenized/channels/metrics"
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/pkg/errors"
+)
+
+// failingClient fails to listen the first failCount times.
+type failingClient struct {
+	*peer_channels.MockClient
+	failCount int
+
+	listenCount int
+	lock        sync.Mutex
+}
+
+func (c *failingClient) Listen(ctx context.Context, token string, sendUnread bool,
+	channelTimeout time.Duration, incoming chan<- peer_channels.Message,
+	interrupt <-chan interface{}) error {
+
+	c.lock.Lock()
+	c.listenCount++
+	fail := c.failCount < 0 || c.listenCount <= c.failCount
+	c.lock.Unlock()
+
+	if fail {
+		return errors.New("Test Connection Failure")
+	}
+
+	return c.MockClient.Listen(ctx, token, sendUnread, channelTimeout, incoming, interrupt)
+}
+
+type testConnectionStates struct {
+	states []ConnectionState
+	lock   sync.Mutex
+}
+
+func (s *testConnectionStates) handle(ctx context.Context, event ConnectionStateEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.states = append(s.states, event.State)
+}
+
+func (s *testConnectionStates) count(state ConnectionState) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := 0
+	for _, st := range s.states {
+		if st == state {
+			result++
+		}
+	}
+	return result
+}
+
+func testReconnectPolicy(maxAttempts int) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  maxAttempts,
+		InitialDelay: time.Millisecond,
+		MaxDelay:     5 * time.Millisecond,
+		Multiplier:   2.0,
+		Jitter:       0.5,
+	}
+}
+
+func Test_Reconnect_GiveUp(t *testing.T) {
+	ctx := context.Background()
+	client := &failingClient{
+		MockClient: peer_channels.NewMockClient(),
+		failCount:  -1,
+	}
+
+	m := metrics.NewMemory()
+	listener := NewPeerChannelsListener(client, "token", 10, 1, time.Second, nil, nil)
+	listener.SetReconnectPolicy(testReconnectPolicy(3))
+	listener.SetMetrics(m)
+	states := &testConnectionStates{}
+	listener.SetConnectionStateHandler(states.handle)
+
+	err := listener.Run(ctx, make(chan interface{}))
+	if errors.Cause(err) != ErrGaveUpReconnecting {
+		t.Fatalf("Wrong run error : got %v, want %s", err, ErrGaveUpReconnecting)
+	}
+
+	if client.listenCount != 3 {
+		t.Errorf("Wrong listen count : got %d, want %d", client.listenCount, 3)
+	}
+
+	if count := states.count(ConnectionStateConnecting); count != 3 {
+		t.Errorf("Wrong connecting count : got %d, want %d", count, 3)
+	}
+
+	if count := states.count(ConnectionStateConnected); count != 0 {
+		t.Errorf("Wrong connected count : got %d, want %d", count, 0)
+	}
+
+	if state := listener.ConnectionState(); state != ConnectionStateError {
+		t.Errorf("Wrong final state : got %s, want %s", state, ConnectionStateError)
+	}
+
+	if count := m.Counter(MetricReconnects, nil); count != 2 {
+		t.Errorf("Wrong reconnect count : got %f, want %f", count, 2.0)
+	}
+}
+
+func Test_Reconnect(t *testing.T) {
+	ctx := context.Background()
+	client := &failingClient{
+		MockClient: peer_channels.NewMockClient(),
+		failCount:  2,
+	}
+
+	account, err := client.CreateAccount(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create account : %s", err)
+	}
+
+	listener := NewPeerChannelsListener(client, account.Token, 10, 1, time.Second, nil, nil)
+	listener.SetReconnectPolicy(testReconnectPolicy(5))
+	listener.SetConnectedDelay(10 * time.Millisecond)
+	states := &testConnectionStates{}
+	listener.SetConnectionStateHandler(states.handle)
+
+	interrupt := make(chan interface{})
+	runComplete := make(chan error, 1)
+	go func() {
+		runComplete <- listener.Run(ctx, interrupt)
+	}()
+
+	start := time.Now()
+	for listener.ConnectionState() != ConnectionStateConnected {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Timed out waiting to connect : %s", listener.ConnectionState())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(interrupt)
+	select {
+	case err := <-runComplete:
+		if err != nil {
+			t.Fatalf("Failed to run listener : %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for listener to stop")
+	}
+
+	if count := states.count(ConnectionStateError); count != 2 {
+		t.Errorf("Wrong error count : got %d, want %d", count, 2)
+	}
+
+	if state := listener.ConnectionState(); state != ConnectionStateDisconnected {
+		t.Errorf("Wrong final state : got %s, want %s", state, ConnectionStateDisconnected)
+	}
+}
@@ -0,0 +1,199 @@
+package peer_channels_listener
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/pkg/errors"
+)
+
+// DeadLetter is a message that failed to be handled after all retries.
+type DeadLetter struct {
+	Message   peer_channels.Message `json:"message"`
+	AccountID string                `json:"account_id,omitempty"`
+	Error     string                `json:"error"`
+	Attempts  int                   `json:"attempts"`
+	Time      time.Time             `json:"time"`
+}
+
+// DeadLetterSink stores messages that failed to be handled so they can be inspected or
+// reprocessed later.
+type DeadLetterSink interface {
+	AddDeadLetter(ctx context.Context, letter *DeadLetter) error
+}
+
+// RetryPolicy specifies how many times an operation, like handling a message or connecting, is
+// attempted before it is considered failed and how long to wait between attempts.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first attempt. Zero means there is no
+	// limit so the operation is attempted until it succeeds or is stopped.
+	MaxAttempts int
+
+	// InitialDelay is the delay before the first retry. The delay is multiplied by Multiplier
+	// after each retry up to MaxDelay.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+
+	// Jitter is the fraction of the delay that is randomized.
+	Jitter float64
+}
+
+// MarkPolicy specifies which messages are marked as read based on the outcome of handling them.
+// Messages that are left unread are delivered again the next time the listener is run.
+type MarkPolicy struct {
+	Handled     bool // handled without error
+	NotRelevant bool // the handler returned MessageNotRelevent
+	Failed      bool // sent to the dead letter sink
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: 500 * time.Millisecond,
+		MaxDelay:     10 * time.Second,
+		Multiplier:   2.0,
+		Jitter:       0.2,
+	}
+}
+
+func DefaultMarkPolicy() MarkPolicy {
+	return MarkPolicy{
+		Handled:     true,
+		NotRelevant: true,
+		Failed:      true,
+	}
+}
+
+// Exhausted returns true when no more attempts should be made after the specified number of
+// attempts.
+func (p RetryPolicy) Exhausted(attempts int) bool {
+	return p.MaxAttempts > 0 && attempts >= p.MaxAttempts
+}
+
+// Delay returns the delay before the retry after the specified attempt, starting at 1.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := float64(p.InitialDelay)
+	if attempt > 1 && p.Multiplier > 1.0 {
+		delay *= math.Pow(p.Multiplier, float64(attempt-1))
+	}
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	if p.Jitter > 0.0 {
+		delay += delay * p.Jitter * (rand.Float64()*2.0 - 1.0)
+	}
+
+	return time.Duration(delay)
+}
+
+// MemoryDeadLetterSink retains dead letters in memory.
+type MemoryDeadLetterSink struct {
+	letters []*DeadLetter
+
+	lock sync.Mutex
+}
+
+func NewMemoryDeadLetterSink() *MemoryDeadLetterSink {
+	return &MemoryDeadLetterSink{}
+}
+
+func (s *MemoryDeadLetterSink) AddDeadLetter(ctx context.Context, letter *DeadLetter) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+// DeadLetters returns the dead letters in the order they were added.
+func (s *MemoryDeadLetterSink) DeadLetters() []*DeadLetter {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make([]*DeadLetter, len(s.letters))
+	copy(result, s.letters)
+	return result
+}
+
+// FileDeadLetterSink appends dead letters to a file with one JSON object per line.
+type FileDeadLetterSink struct {
+	path string
+
+	lock sync.Mutex
+}
+
+func NewFileDeadLetterSink(path string) *FileDeadLetterSink {
+	return &FileDeadLetterSink{
+		path: path,
+	}
+}
+
+func (s *FileDeadLetterSink) AddDeadLetter(ctx context.Context, letter *DeadLetter) error {
+	js, err := json.Marshal(letter)
+	if err != nil {
+		return errors.Wrap(err, "json")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open")
+	}
+
+	if _, err := file.Write(append(js, '\n')); err != nil {
+		file.Close()
+		return errors.Wrap(err, "write")
+	}
+
+	if err := file.Close(); err != nil {
+		return errors.Wrap(err, "close")
+	}
+
+	return nil
+}
+
+// DeadLetters reads the dead letters from the file. It returns no dead letters if the file
+// doesn't exist.
+func (s *FileDeadLetterSink) DeadLetters() ([]*DeadLetter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "open")
+	}
+	defer file.Close()
+
+	var result []*DeadLetter
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		letter := &DeadLetter{}
+		if err := json.Unmarshal(scanner.Bytes(), letter); err != nil {
+			return nil, errors.Wrapf(err, "json %d", len(result))
+		}
+
+		result = append(result, letter)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read")
+	}
+
+	return result, nil
+}
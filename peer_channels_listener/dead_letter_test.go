@@ -0,0 +1,255 @@
+package peer_channels_listener
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tokenized/channels/metrics"
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/pkg/errors"
+)
+
+type failingDeadLetterSink struct{}
+
+func (s *failingDeadLetterSink) AddDeadLetter(ctx context.Context, letter *DeadLetter) error {
+	return errors.New("Test Failure")
+}
+
+func Test_HandleWithRetry(t *testing.T) {
+	ctx := context.Background()
+	interrupt := make(chan interface{})
+	msg := accountMessage{
+		Message: peer_channels.Message{
+			Sequence:  3,
+			ChannelID: "channel",
+			Payload:   []byte{0x01, 0x02},
+		},
+		accountID: "account",
+	}
+
+	sink := NewMemoryDeadLetterSink()
+	m := metrics.NewMemory()
+	listener := NewPeerChannelsListener(nil, "", 10, 1, time.Second, nil, nil)
+	listener.SetMetrics(m)
+	listener.SetRetryPolicy(RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: time.Millisecond,
+		MaxDelay:     5 * time.Millisecond,
+		Multiplier:   2.0,
+	})
+	listener.SetDeadLetterSink(sink)
+	listener.SetMarkPolicy(MarkPolicy{
+		Handled:     true,
+		NotRelevant: true,
+		Failed:      false,
+	})
+
+	calls := 0
+	failing := func(ctx context.Context, msg peer_channels.Message) error {
+		calls++
+		return errors.New("Test Failure")
+	}
+
+	mark, interrupted := listener.handleWithRetry(ctx, interrupt, failing, msg)
+	if interrupted {
+		t.Fatalf("Should not be interrupted")
+	}
+	if mark {
+		t.Errorf("Failed message should be left unread")
+	}
+	if calls != 3 {
+		t.Errorf("Wrong attempt count : got %d, want %d", calls, 3)
+	}
+
+	letters := sink.DeadLetters()
+	if len(letters) != 1 {
+		t.Fatalf("Wrong dead letter count : got %d, want %d", len(letters), 1)
+	}
+	if letters[0].Attempts != 3 || letters[0].Message.Sequence != msg.Sequence ||
+		letters[0].AccountID != msg.accountID {
+		t.Errorf("Wrong dead letter : %+v", letters[0])
+	}
+
+	if count := m.Counter(MetricRetries, nil); count != 2 {
+		t.Errorf("Wrong retry count : got %f, want %f", count, 2.0)
+	}
+	if count := m.Counter(MetricDeadLetters, nil); count != 1 {
+		t.Errorf("Wrong dead letter metric : got %f, want %f", count, 1.0)
+	}
+	if durations := m.Histogram(MetricHandleSeconds, errorLabels); len(durations) != 3 {
+		t.Errorf("Wrong handle duration count : got %d, want %d", len(durations), 3)
+	}
+
+	// Succeeds on retry.
+	calls = 0
+	flaky := func(ctx context.Context, msg peer_channels.Message) error {
+		calls++
+		if calls == 1 {
+			return errors.New("Test Failure")
+		}
+		return nil
+	}
+
+	mark, _ = listener.handleWithRetry(ctx, interrupt, flaky, msg)
+	if !mark {
+		t.Errorf("Handled message should be marked")
+	}
+	if calls != 2 {
+		t.Errorf("Wrong attempt count : got %d, want %d", calls, 2)
+	}
+	if len(sink.DeadLetters()) != 1 {
+		t.Errorf("Handled message should not be dead lettered")
+	}
+
+	// Not relevant isn't retried.
+	calls = 0
+	notRelevant := func(ctx context.Context, msg peer_channels.Message) error {
+		calls++
+		return errors.Wrap(MessageNotRelevent, "test")
+	}
+
+	mark, _ = listener.handleWithRetry(ctx, interrupt, notRelevant, msg)
+	if !mark {
+		t.Errorf("Not relevant message should be marked")
+	}
+	if calls != 1 {
+		t.Errorf("Wrong attempt count : got %d, want %d", calls, 1)
+	}
+
+	// Zero attempts has no limit.
+	listener.SetRetryPolicy(RetryPolicy{
+		InitialDelay: time.Millisecond,
+	})
+	calls = 0
+	eventually := func(ctx context.Context, msg peer_channels.Message) error {
+		calls++
+		if calls < 10 {
+			return errors.New("Test Failure")
+		}
+		return nil
+	}
+
+	if mark, _ := listener.handleWithRetry(ctx, interrupt, eventually, msg); !mark {
+		t.Errorf("Handled message should be marked")
+	}
+	if calls != 10 {
+		t.Errorf("Wrong attempt count : got %d, want %d", calls, 10)
+	}
+	if len(sink.DeadLetters()) != 1 {
+		t.Errorf("Handled message should not be dead lettered")
+	}
+
+	// A message that can't be dead lettered is still marked so it isn't delivered again.
+	listener.SetRetryPolicy(RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: time.Millisecond,
+	})
+	listener.SetDeadLetterSink(&failingDeadLetterSink{})
+	listener.SetMarkPolicy(DefaultMarkPolicy())
+	if mark, _ := listener.handleWithRetry(ctx, interrupt, failing, msg); !mark {
+		t.Errorf("Message that failed to be dead lettered should be marked")
+	}
+
+	// Interrupted while waiting to retry.
+	listener.SetRetryPolicy(RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: time.Hour,
+	})
+	close(interrupt)
+	if _, interrupted := listener.handleWithRetry(ctx, interrupt, failing, msg); !interrupted {
+		t.Errorf("Should be interrupted")
+	}
+}
+
+func Test_FileDeadLetterSink(t *testing.T) {
+	ctx := context.Background()
+	sink := NewFileDeadLetterSink(filepath.Join(t.TempDir(), "dead_letters.jsonl"))
+
+	letters, err := sink.DeadLetters()
+	if err != nil {
+		t.Fatalf("Failed to read empty dead letters : %s", err)
+	}
+	if len(letters) != 0 {
+		t.Fatalf("Wrong dead letter count : got %d, want %d", len(letters), 0)
+	}
+
+	for i := 0; i < 3; i++ {
+		letter := &DeadLetter{
+			Message: peer_channels.Message{
+				Sequence:  uint64(i),
+				ChannelID: "channel",
+				Payload:   []byte{byte(i)},
+			},
+			Error:    "failed",
+			Attempts: 2,
+			Time:     time.Now(),
+		}
+
+		if err := sink.AddDeadLetter(ctx, letter); err != nil {
+			t.Fatalf("Failed to add dead letter : %s", err)
+		}
+	}
+
+	letters, err = sink.DeadLetters()
+	if err != nil {
+		t.Fatalf("Failed to read dead letters : %s", err)
+	}
+
+	if len(letters) != 3 {
+		t.Fatalf("Wrong dead letter count : got %d, want %d", len(letters), 3)
+	}
+
+	for i, letter := range letters {
+		if letter.Message.Sequence != uint64(i) || letter.Message.Payload[0] != byte(i) {
+			t.Errorf("Wrong dead letter %d : %+v", i, letter.Message)
+		}
+	}
+}
+
+func Test_RetryPolicy_Delay(t *testing.T) {
+	policy := RetryPolicy{
+		InitialDelay: time.Second,
+		MaxDelay:     5 * time.Second,
+		Multiplier:   2.0,
+	}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if delay := policy.Delay(i + 1); delay != w {
+			t.Errorf("Wrong delay %d : got %s, want %s", i+1, delay, w)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := policy.Delay(1)
+		if delay < time.Second/2 || delay > 3*time.Second/2 {
+			t.Fatalf("Delay outside jitter : %s", delay)
+		}
+	}
+}
+
+func Test_RetryPolicy_Exhausted(t *testing.T) {
+	tests := []struct {
+		maxAttempts int
+		attempts    int
+		exhausted   bool
+	}{
+		{maxAttempts: 3, attempts: 1, exhausted: false},
+		{maxAttempts: 3, attempts: 3, exhausted: true},
+		{maxAttempts: 1, attempts: 1, exhausted: true},
+		{maxAttempts: 0, attempts: 1, exhausted: false},
+		{maxAttempts: 0, attempts: 1000, exhausted: false},
+	}
+
+	for _, tt := range tests {
+		policy := RetryPolicy{MaxAttempts: tt.maxAttempts}
+		if exhausted := policy.Exhausted(tt.attempts); exhausted != tt.exhausted {
+			t.Errorf("Wrong exhausted for %d of %d attempts : got %t, want %t", tt.attempts,
+				tt.maxAttempts, exhausted, tt.exhausted)
+		}
+	}
+}
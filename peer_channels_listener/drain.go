@@ -0,0 +1,73 @@
+package peer_channels_listener
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/tokenized/logger"
+	"github.com/tokenized/threads"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// drainPollFrequency is how often the buffered message and update counts are checked while
+	// draining.
+	drainPollFrequency = 10 * time.Millisecond
+)
+
+var (
+	ErrDrainTimeout = errors.New("Drain Timeout")
+)
+
+// SetDrainTimeout enables a graceful shutdown. When Run is interrupted it stops receiving new
+// messages and then waits up to the timeout for the messages and updates that are already
+// buffered to be handled, and marked, before stopping the handler threads. If the timeout passes
+// first then Run returns ErrDrainTimeout wrapped with the number of messages and updates that were
+// left unprocessed. Zero, the default, stops the handler threads immediately. It must be called
+// before Run.
+func (l *PeerChannelsListener) SetDrainTimeout(timeout time.Duration) {
+	l.drainTimeout = timeout
+}
+
+// drain waits until there are no buffered messages or updates, the drain timeout passes, or one of
+// the threads stops.
+func (l *PeerChannelsListener) drain(ctx context.Context, ts []*threads.InterruptableThread) {
+	messages, updates := l.unprocessed()
+	logger.InfoWithFields(ctx, []logger.Field{
+		logger.Int64("messages", messages),
+		logger.Int64("updates", updates),
+		logger.MillisecondsFromNano("timeout_ms", l.drainTimeout.Nanoseconds()),
+	}, "Draining peer channel listener")
+
+	deadline := time.NewTimer(l.drainTimeout)
+	defer deadline.Stop()
+
+	ticker := time.NewTicker(drainPollFrequency)
+	defer ticker.Stop()
+
+	for {
+		if messages, updates := l.unprocessed(); messages == 0 && updates == 0 {
+			return
+		}
+
+		for _, t := range ts {
+			if t.IsComplete() {
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return
+		}
+	}
+}
+
+// unprocessed returns the number of messages and updates that have been received or added but not
+// handled yet.
+func (l *PeerChannelsListener) unprocessed() (int64, int64) {
+	return atomic.LoadInt64(&l.pendingMessages), atomic.LoadInt64(&l.pendingUpdates)
+}
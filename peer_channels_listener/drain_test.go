@@ -0,0 +1,139 @@
+package peer_channels_listener
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/pkg/errors"
+)
+
+func Test_Drain(t *testing.T) {
+	tests := []struct {
+		name         string
+		drainTimeout time.Duration
+		releaseDelay time.Duration
+		wantErr      error
+	}{
+		{
+			name:         "complete",
+			drainTimeout: 5 * time.Second,
+		},
+		{
+			name:         "timeout",
+			drainTimeout: 20 * time.Millisecond,
+			releaseDelay: 100 * time.Millisecond,
+			wantErr:      ErrDrainTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := peer_channels.NewMockClient()
+
+			account, err := client.CreateAccount(ctx)
+			if err != nil {
+				t.Fatalf("Failed to create account : %s", err)
+			}
+
+			accountClient := peer_channels.NewMockAccountClient(client, account.AccountID,
+				account.Token)
+			channel, err := accountClient.CreateChannel(ctx)
+			if err != nil {
+				t.Fatalf("Failed to create channel : %s", err)
+			}
+
+			messageCount := 10
+			for i := 0; i < messageCount; i++ {
+				if err := client.WriteMessage(ctx, channel.ID, channel.WriteToken,
+					peer_channels.ContentTypeBinary, bytes.NewReader([]byte{byte(i)})); err != nil {
+					t.Fatalf("Failed to write message : %s", err)
+				}
+			}
+
+			var handled int64
+			started := make(chan interface{}, messageCount)
+			release := make(chan interface{})
+			handleMessage := func(ctx context.Context, msg peer_channels.Message) error {
+				started <- nil
+				<-release
+				atomic.AddInt64(&handled, 1)
+				return nil
+			}
+
+			listener := NewPeerChannelsListener(client, account.Token, 100, 1, time.Second,
+				handleMessage, nil)
+			listener.SetDrainTimeout(tt.drainTimeout)
+
+			interrupt := make(chan interface{})
+			runComplete := make(chan error, 1)
+			go func() {
+				runComplete <- listener.Run(ctx, interrupt)
+			}()
+
+			// Wait for all messages to be received and the first to be in the handler.
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for handler")
+			}
+
+			start := time.Now()
+			for {
+				if messages, _ := listener.unprocessed(); messages == int64(messageCount) {
+					break
+				}
+				if time.Since(start) > 5*time.Second {
+					t.Fatalf("Timed out waiting for messages to be received")
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			close(interrupt)
+			if tt.releaseDelay > 0 {
+				time.AfterFunc(tt.releaseDelay, func() { close(release) })
+			} else {
+				close(release)
+			}
+
+			var runErr error
+			select {
+			case runErr = <-runComplete:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for listener to stop")
+			}
+
+			if errors.Cause(runErr) != tt.wantErr {
+				t.Fatalf("Wrong run error : got %v, want %v", runErr, tt.wantErr)
+			}
+
+			unread, err := client.GetMessages(ctx, channel.ID, channel.ReadToken, true, 100)
+			if err != nil {
+				t.Fatalf("Failed to get messages : %s", err)
+			}
+
+			if tt.wantErr == nil {
+				if h := atomic.LoadInt64(&handled); h != int64(messageCount) {
+					t.Errorf("Wrong handled count : got %d, want %d", h, messageCount)
+				}
+				if len(unread) != 0 {
+					t.Errorf("Wrong unread count : got %d, want %d", len(unread), 0)
+				}
+				return
+			}
+
+			messages, _ := listener.unprocessed()
+			if messages == 0 {
+				t.Errorf("Messages should be left unprocessed")
+			}
+			if len(unread) != int(messages) {
+				t.Errorf("Wrong unread count : got %d, want %d", len(unread), messages)
+			}
+		})
+	}
+}
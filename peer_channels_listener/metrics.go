@@ -0,0 +1,61 @@
+package peer_channels_listener
+
+import (
+	"github.com/tokenized/channels/metrics"
+)
+
+const (
+	// MetricMessagesQueued is a gauge of the messages received and waiting for a handler thread.
+	MetricMessagesQueued = "peer_channels_listener_messages_queued"
+
+	// MetricUpdatesQueued is a gauge of the updates waiting for a handler thread.
+	MetricUpdatesQueued = "peer_channels_listener_updates_queued"
+
+	// MetricMessagesReceived counts messages received to be handled, not including duplicates.
+	MetricMessagesReceived = "peer_channels_listener_messages_received"
+
+	// MetricDuplicateMessages counts messages dropped because they were already received.
+	MetricDuplicateMessages = "peer_channels_listener_duplicate_messages"
+
+	// MetricSequenceGaps counts gaps detected in channel sequences.
+	MetricSequenceGaps = "peer_channels_listener_sequence_gaps"
+
+	// MetricHandleSeconds is a histogram of the time taken by each attempt to handle a message. It
+	// is labeled with the outcome, which is "handled", "not_relevant", or "error".
+	MetricHandleSeconds = "peer_channels_listener_handle_seconds"
+
+	// MetricRetries counts attempts to handle a message again after it failed.
+	MetricRetries = "peer_channels_listener_retries"
+
+	// MetricDeadLetters counts messages that failed to be handled after all attempts.
+	MetricDeadLetters = "peer_channels_listener_dead_letters"
+
+	// MetricReconnects counts attempts to reconnect to the peer channel service after the
+	// connection closed or failed.
+	MetricReconnects = "peer_channels_listener_reconnects"
+)
+
+var (
+	handledLabels     = metrics.Labels{"outcome": "handled"}
+	notRelevantLabels = metrics.Labels{"outcome": "not_relevant"}
+	errorLabels       = metrics.Labels{"outcome": "error"}
+)
+
+// SetMetrics sets where queue depths, handler latencies, and connection counts are reported. It
+// must be called before Run.
+func (l *PeerChannelsListener) SetMetrics(m metrics.Metrics) {
+	l.metrics = m
+}
+
+// reportQueueDepths reports the number of messages and updates waiting in the channels.
+func (l *PeerChannelsListener) reportQueueDepths() {
+	messages := len(l.messagesChannel)
+	updates := 0
+	for _, s := range l.shards {
+		messages += len(s.messagesChannel)
+		updates += len(s.updatesChannel)
+	}
+
+	l.metrics.SetGauge(MetricMessagesQueued, nil, float64(messages))
+	l.metrics.SetGauge(MetricUpdatesQueued, nil, float64(updates))
+}
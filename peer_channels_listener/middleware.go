@@ -0,0 +1,524 @@
+package peer_channels_listener
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/channels/authorize_script"
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	"github.com/tokenized/logger"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultMaxIDs is the default number of ids remembered by DeduplicateMiddleware.
+	DefaultMaxIDs = 10000
+)
+
+// Middleware wraps a handler to add processing before or after it. It can reject a message by not
+// calling next.
+type Middleware func(next HandleRoutedMessage) HandleRoutedMessage
+
+// Chain returns the handler wrapped in the middleware. The first middleware is the outermost so it
+// is called first.
+func Chain(handler HandleRoutedMessage, middlewares ...Middleware) HandleRoutedMessage {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// Reject sends the response to the sender of the message and returns MessageNotRelevent so the
+// message is not processed further. reply can be nil if no response should be sent. Messages that
+// contain a response are never responded to so two parties can't respond to each other's
+// responses indefinitely.
+func Reject(ctx context.Context, reply Reply, msg *RoutedMessage,
+	response *channels.Response) error {
+
+	if reply != nil && !ContainsResponse(msg) {
+		if err := reply(ctx, msg, response); err != nil {
+			return errors.Wrap(err, "reply")
+		}
+	}
+
+	return errors.Wrap(MessageNotRelevent, response.Error())
+}
+
+// ContainsResponse returns true if the message or any of its wrappers is a response. The protocol
+// IDs of the payload are checked when it wasn't parsed completely.
+func ContainsResponse(msg *RoutedMessage) bool {
+	if _, ok := msg.Message.(*channels.Response); ok {
+		return true
+	}
+
+	for _, wrapper := range msg.Wrappers {
+		if _, ok := wrapper.(*channels.Response); ok {
+			return true
+		}
+	}
+
+	payload, err := channels.ParseEnvelope(bitcoin.Script(msg.PeerChannelMessage.Payload))
+	if err != nil {
+		return false
+	}
+
+	for _, protocolID := range payload.ProtocolIDs {
+		if bytes.Equal(protocolID, channels.ProtocolIDResponse) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func reject(ctx context.Context, reply Reply, msg *RoutedMessage, status channels.Status,
+	protocolID envelope.ProtocolID, code uint32, note string) error {
+
+	return Reject(ctx, reply, msg, &channels.Response{
+		Status:         status,
+		CodeProtocolID: protocolID,
+		Code:           code,
+		Note:           note,
+	})
+}
+
+// PublicKeyLookup returns the public key that is expected to sign messages on the peer channel the
+// message was received on. It returns nil if no public key is expected to sign messages on the
+// peer channel.
+type PublicKeyLookup func(ctx context.Context, msg *RoutedMessage) (*bitcoin.PublicKey, error)
+
+// SignatureMiddleware verifies that the outermost signature of messages is signed by the public key
+// returned by lookup. Messages without a signature are rejected when required is true. Signed
+// messages are rejected when lookup doesn't return a public key since a public key included in the
+// message could be anyone's.
+func SignatureMiddleware(reply Reply, required bool, lookup PublicKeyLookup) Middleware {
+	return func(next HandleRoutedMessage) HandleRoutedMessage {
+		return func(ctx context.Context, msg *RoutedMessage) error {
+			var signature *channels.Signature
+			for _, wrapper := range msg.Wrappers {
+				if s, ok := wrapper.(*channels.Signature); ok {
+					signature = s
+					break
+				}
+			}
+
+			if signature == nil {
+				if required {
+					return reject(ctx, reply, msg, channels.StatusUnauthorized,
+						channels.ProtocolIDSignedMessages, channels.SignedStatusSignatureRequired,
+						"signature required")
+				}
+				return next(ctx, msg)
+			}
+
+			publicKey, err := lookup(ctx, msg)
+			if err != nil {
+				return errors.Wrap(err, "public key")
+			}
+
+			if publicKey == nil {
+				return reject(ctx, reply, msg, channels.StatusUnauthorized,
+					channels.ProtocolIDSignedMessages, channels.SignedStatusWrongPublicKey,
+					"unknown public key")
+			}
+
+			if signature.PublicKey != nil && !signature.PublicKey.Equal(*publicKey) {
+				return reject(ctx, reply, msg, channels.StatusUnauthorized,
+					channels.ProtocolIDSignedMessages, channels.SignedStatusWrongPublicKey,
+					"wrong public key")
+			}
+			signature.SetPublicKey(publicKey)
+
+			if err := signature.Verify(); err != nil {
+				return reject(ctx, reply, msg, channels.StatusUnauthorized,
+					channels.ProtocolIDSignedMessages, channels.SignedStatusInvalidSignature,
+					err.Error())
+			}
+
+			return next(ctx, msg)
+		}
+	}
+}
+
+// AuthorizedKeysLookup returns the base public keys that are authorized to sign messages on the
+// peer channel the message was received on.
+type AuthorizedKeysLookup func(ctx context.Context, msg *RoutedMessage) ([]bitcoin.PublicKey,
+	error)
+
+// MultiSignatureMiddleware verifies that the outermost multi-signature of messages has valid
+// signatures by at least threshold of the authorized keys returned by lookup. Messages without a
+// multi-signature are rejected when required is true.
+func MultiSignatureMiddleware(reply Reply, required bool, threshold int,
+	lookup AuthorizedKeysLookup) Middleware {
+
+	return func(next HandleRoutedMessage) HandleRoutedMessage {
+		return func(ctx context.Context, msg *RoutedMessage) error {
+			var multiSignature *channels.MultiSignature
+			for _, wrapper := range msg.Wrappers {
+				if s, ok := wrapper.(*channels.MultiSignature); ok {
+					multiSignature = s
+					break
+				}
+			}
+
+			if multiSignature == nil {
+				if required {
+					return reject(ctx, reply, msg, channels.StatusUnauthorized,
+						channels.ProtocolIDMultiSignedMessages,
+						channels.MultiSignedStatusSignaturesRequired, "signatures required")
+				}
+				return next(ctx, msg)
+			}
+
+			authorizedKeys, err := lookup(ctx, msg)
+			if err != nil {
+				return errors.Wrap(err, "authorized keys")
+			}
+
+			if _, err := multiSignature.Verify(authorizedKeys, threshold); err != nil {
+				code := channels.MultiSignedStatusInvalidSignature
+				switch errors.Cause(err) {
+				case channels.ErrThresholdNotMet:
+					code = channels.MultiSignedStatusThresholdNotMet
+				case channels.ErrInvalidThreshold, channels.ErrHashMissing:
+					return errors.Wrap(err, "verify")
+				}
+				return reject(ctx, reply, msg, channels.StatusUnauthorized,
+					channels.ProtocolIDMultiSignedMessages, code, err.Error())
+			}
+
+			return next(ctx, msg)
+		}
+	}
+}
+
+// AuthorizeMiddleware verifies that the authorize wrappers of messages unlock their locking
+// scripts. Messages without an authorize wrapper are rejected when required is true.
+func AuthorizeMiddleware(reply Reply, required bool) Middleware {
+	return func(next HandleRoutedMessage) HandleRoutedMessage {
+		return func(ctx context.Context, msg *RoutedMessage) error {
+			found := false
+			for _, wrapper := range msg.Wrappers {
+				authorize, ok := wrapper.(*authorize_script.Authorize)
+				if !ok {
+					continue
+				}
+				found = true
+
+				if err := authorize.Verify(); err != nil {
+					return reject(ctx, reply, msg, channels.StatusUnauthorized,
+						authorize_script.ProtocolID, authorize_script.AuthorizeStatusNotUnlocked,
+						err.Error())
+				}
+			}
+
+			if !found && required {
+				return reject(ctx, reply, msg, channels.StatusUnauthorized,
+					authorize_script.ProtocolID, authorize_script.AuthorizeStatusAuthorizeRequired,
+					"authorize required")
+			}
+
+			return next(ctx, msg)
+		}
+	}
+}
+
+// ReplayMiddleware verifies that messages are signed by the public key returned by lookup and
+// verifies their replay protection with the verifier. Messages are rejected when lookup doesn't
+// return a public key. The nonce is only remembered when the message is handled, or is not
+// relevant, so a message that fails is not rejected as a replay when it is retried.
+func ReplayMiddleware(reply Reply, verifier *channels.ReplayVerifier,
+	lookup PublicKeyLookup) Middleware {
+
+	return func(next HandleRoutedMessage) HandleRoutedMessage {
+		return func(ctx context.Context, msg *RoutedMessage) error {
+			publicKey, err := lookup(ctx, msg)
+			if err != nil {
+				return errors.Wrap(err, "public key")
+			}
+
+			if publicKey == nil {
+				return reject(ctx, reply, msg, channels.StatusUnauthorized,
+					channels.ProtocolIDSignedMessages, channels.SignedStatusWrongPublicKey,
+					"unknown public key")
+			}
+
+			done, err := verifier.Reserve(msg.PeerChannelMessage.ChannelID, *publicKey,
+				msg.Wrappers)
+			if err == nil {
+				err := next(ctx, msg)
+				done(err == nil || errors.Cause(err) == MessageNotRelevent)
+				return err
+			}
+
+			if response := channels.ReplayResponse(err); response != nil {
+				return Reject(ctx, reply, msg, response)
+			}
+
+			return reject(ctx, reply, msg, channels.StatusReject,
+				channels.ProtocolIDSignedMessages, channels.SignedStatusInvalidSignature,
+				err.Error())
+		}
+	}
+}
+
+// ExpiryMiddleware rejects messages with an expiry that has passed. Only the expiries inside the
+// outermost signature of signed messages are used since any other expiry could have been added or
+// changed by anyone that relayed the message.
+func ExpiryMiddleware(reply Reply) Middleware {
+	return func(next HandleRoutedMessage) HandleRoutedMessage {
+		return func(ctx context.Context, msg *RoutedMessage) error {
+			now := channels.Now()
+			for _, wrapper := range signedWrappers(msg.Wrappers) {
+				expiry, ok := wrapper.(*channels.ExpiryMessage)
+				if !ok {
+					continue
+				}
+
+				if expiry.GetExpiry() < now {
+					return reject(ctx, reply, msg, channels.StatusReject,
+						channels.ProtocolIDExpiry, channels.ExpiryStatusExpired,
+						fmt.Sprintf("expired %s", expiry.GetExpiry()))
+				}
+			}
+
+			return next(ctx, msg)
+		}
+	}
+}
+
+// DeduplicateMiddleware rejects messages with a message id or uuid that was already handled on the
+// same peer channel. The most recent maxIDs ids are remembered, or DefaultMaxIDs when maxIDs is
+// zero or less. An id is only remembered when the message is handled, or is not relevant, so a
+// message that fails is not rejected as a duplicate when it is retried. Only the ids inside the
+// outermost signature of signed messages are used since any other ids could have been added or
+// changed by anyone that relayed the message.
+func DeduplicateMiddleware(reply Reply, maxIDs int) Middleware {
+	if maxIDs <= 0 {
+		maxIDs = DefaultMaxIDs
+	}
+
+	dedup := &deduplicator{
+		maxIDs: maxIDs,
+		ids:    make(map[string]bool),
+	}
+
+	return func(next HandleRoutedMessage) HandleRoutedMessage {
+		return func(ctx context.Context, msg *RoutedMessage) error {
+			channelID := msg.PeerChannelMessage.ChannelID
+			var keys []string
+			var responses []*channels.Response
+			for _, wrapper := range signedWrappers(msg.Wrappers) {
+				switch w := wrapper.(type) {
+				case *channels.MessageID:
+					keys = append(keys, fmt.Sprintf("%s:id:%d", channelID, w.MessageID))
+					responses = append(responses, &channels.Response{
+						Status:         channels.StatusReject,
+						CodeProtocolID: channels.ProtocolIDMessageID,
+						Code:           channels.MessageIDStatusDuplicate,
+						Note:           fmt.Sprintf("duplicate message id %d", w.MessageID),
+					})
+
+				case *channels.UUID:
+					id := uuid.UUID(*w).String()
+					keys = append(keys, fmt.Sprintf("%s:uuid:%s", channelID, id))
+					responses = append(responses, &channels.Response{
+						Status:         channels.StatusReject,
+						CodeProtocolID: channels.ProtocolIDUUID,
+						Code:           channels.UUIDStatusDuplicate,
+						Note:           fmt.Sprintf("duplicate uuid %s", id),
+					})
+				}
+			}
+
+			if len(keys) == 0 {
+				return next(ctx, msg)
+			}
+
+			if duplicate := dedup.reserve(keys); duplicate != -1 {
+				return Reject(ctx, reply, msg, responses[duplicate])
+			}
+
+			err := next(ctx, msg)
+			dedup.done(keys, err == nil || errors.Cause(err) == MessageNotRelevent)
+			return err
+		}
+	}
+}
+
+// signedWrappers returns the wrappers inside the outermost signature, which is the one verified by
+// SignatureMiddleware and MultiSignatureMiddleware. All of the wrappers are returned when the
+// message isn't signed.
+func signedWrappers(wrappers []channels.Wrapper) []channels.Wrapper {
+	for _, wrapper := range wrappers {
+		if signature, ok := wrapper.(channels.SignatureWrapper); ok {
+			return channels.CalculateWrapperCoverage(wrappers).SignedBy(signature)
+		}
+	}
+
+	return wrappers
+}
+
+type deduplicator struct {
+	maxIDs int
+
+	ids     map[string]bool // false while the message is being handled
+	idOrder []string
+	lock    sync.Mutex
+}
+
+// reserve adds the ids until the message is done. It returns the index of the first id that was
+// already added, or -1 if none were.
+func (d *deduplicator) reserve(ids []string) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for i, id := range ids {
+		if _, exists := d.ids[id]; exists {
+			return i
+		}
+	}
+
+	for _, id := range ids {
+		d.ids[id] = false
+	}
+
+	return -1
+}
+
+// done remembers the reserved ids if the message was handled and otherwise removes them.
+func (d *deduplicator) done(ids []string, handled bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !handled {
+		for _, id := range ids {
+			delete(d.ids, id)
+		}
+		return
+	}
+
+	for _, id := range ids {
+		d.ids[id] = true
+		d.idOrder = append(d.idOrder, id)
+	}
+
+	for len(d.idOrder) > d.maxIDs {
+		delete(d.ids, d.idOrder[0])
+		d.idOrder = d.idOrder[1:]
+	}
+}
+
+// LoggingMiddleware logs each message along with how long it took to handle.
+func LoggingMiddleware() Middleware {
+	return func(next HandleRoutedMessage) HandleRoutedMessage {
+		return func(ctx context.Context, msg *RoutedMessage) error {
+			fields := []logger.Field{
+				logger.String("channel", msg.PeerChannelMessage.ChannelID),
+				logger.Uint64("sequence", msg.PeerChannelMessage.Sequence),
+				logger.String("protocol", msg.Message.ProtocolID().String()),
+				logger.String("message_type", fmt.Sprintf("%T", msg.Message)),
+			}
+
+			start := time.Now()
+			err := next(ctx, msg)
+			fields = append(fields, logger.MillisecondsFromNano("elapsed_ms",
+				time.Since(start).Nanoseconds()))
+
+			if err != nil {
+				logger.WarnWithFields(ctx, fields, "Failed to handle channels message : %s", err)
+			} else {
+				logger.InfoWithFields(ctx, fields, "Handled channels message")
+			}
+
+			return err
+		}
+	}
+}
+
+// RateLimitMiddleware rejects messages received on a peer channel faster than rate per second
+// after the first burst messages.
+func RateLimitMiddleware(reply Reply, rate float64, burst int) Middleware {
+	limiter := &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*rateBucket),
+	}
+
+	return func(next HandleRoutedMessage) HandleRoutedMessage {
+		return func(ctx context.Context, msg *RoutedMessage) error {
+			if !limiter.allow(msg.PeerChannelMessage.ChannelID, time.Now()) {
+				return reject(ctx, reply, msg, channels.StatusReject,
+					channels.ProtocolIDResponse, channels.ResponseStatusRateLimited,
+					"rate limited")
+			}
+
+			return next(ctx, msg)
+		}
+	}
+}
+
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	buckets   map[string]*rateBucket
+	lastEvict time.Time
+	lock      sync.Mutex
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.rate > 0 && now.Sub(l.lastEvict).Seconds() >= l.burst/l.rate {
+		l.evict(now)
+	}
+
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &rateBucket{
+			tokens: l.burst,
+			last:   now,
+		}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1.0 {
+		return false
+	}
+
+	bucket.tokens -= 1.0
+	return true
+}
+
+// evict removes the buckets that have been idle long enough to be full since they are the same as
+// new buckets. It is called at most once per the time it takes to fill a bucket.
+func (l *rateLimiter) evict(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.lastEvict = now
+}
@@ -0,0 +1,461 @@
+package peer_channels_listener
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/channels/relationships"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+func Test_Chain(t *testing.T) {
+	ctx := context.Background()
+
+	var order []int
+	middleware := func(index int) Middleware {
+		return func(next HandleRoutedMessage) HandleRoutedMessage {
+			return func(ctx context.Context, msg *RoutedMessage) error {
+				order = append(order, index)
+				return next(ctx, msg)
+			}
+		}
+	}
+
+	handler := Chain(func(ctx context.Context, msg *RoutedMessage) error {
+		order = append(order, 3)
+		return nil
+	}, middleware(1), middleware(2))
+
+	if err := handler(ctx, &RoutedMessage{}); err != nil {
+		t.Fatalf("Failed to handle : %s", err)
+	}
+
+	if len(order) != 3 || order[0] != 1 || order[1] != 2 || order[2] != 3 {
+		t.Fatalf("Wrong order : %v", order)
+	}
+}
+
+func Test_Middleware(t *testing.T) {
+	ctx := context.Background()
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	otherKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	publicKey := key.PublicKey()
+
+	var responses []*channels.Response
+	reply := func(ctx context.Context, msg *RoutedMessage, response *channels.Response) error {
+		responses = append(responses, response)
+		return nil
+	}
+
+	lookup := func(ctx context.Context, msg *RoutedMessage) (*bitcoin.PublicKey, error) {
+		return &publicKey, nil
+	}
+
+	unknownLookup := func(ctx context.Context, msg *RoutedMessage) (*bitcoin.PublicKey, error) {
+		return nil, nil
+	}
+
+	duplicateID := channels.UUID(uuid.New())
+
+	tests := []struct {
+		name       string
+		middleware Middleware
+		wrappers   []channels.Wrapper
+		handled    bool
+		protocolID []byte
+		code       uint32
+	}{
+		{
+			name:       "signature valid",
+			middleware: SignatureMiddleware(reply, true, lookup),
+			wrappers:   []channels.Wrapper{channels.NewSignature(key, nil, false)},
+			handled:    true,
+		},
+		{
+			name:       "signature required",
+			middleware: SignatureMiddleware(reply, true, lookup),
+			protocolID: channels.ProtocolIDSignedMessages,
+			code:       channels.SignedStatusSignatureRequired,
+		},
+		{
+			name:       "signature wrong key",
+			middleware: SignatureMiddleware(reply, true, lookup),
+			wrappers:   []channels.Wrapper{channels.NewSignature(otherKey, nil, true)},
+			protocolID: channels.ProtocolIDSignedMessages,
+			code:       channels.SignedStatusWrongPublicKey,
+		},
+		{
+			name:       "signature unknown key",
+			middleware: SignatureMiddleware(reply, true, unknownLookup),
+			wrappers:   []channels.Wrapper{channels.NewSignature(key, nil, true)},
+			protocolID: channels.ProtocolIDSignedMessages,
+			code:       channels.SignedStatusWrongPublicKey,
+		},
+		{
+			name:       "signature invalid",
+			middleware: SignatureMiddleware(reply, true, lookup),
+			wrappers:   []channels.Wrapper{channels.NewSignature(otherKey, nil, false)},
+			protocolID: channels.ProtocolIDSignedMessages,
+			code:       channels.SignedStatusInvalidSignature,
+		},
+		{
+			name:       "expiry valid",
+			middleware: ExpiryMiddleware(reply),
+			wrappers: []channels.Wrapper{
+				channels.NewExpiryMessage(channels.Now() + channels.Time(time.Hour)),
+			},
+			handled: true,
+		},
+		{
+			name:       "expired",
+			middleware: ExpiryMiddleware(reply),
+			wrappers: []channels.Wrapper{
+				channels.NewExpiryMessage(channels.Now() - channels.Time(time.Hour)),
+			},
+			protocolID: channels.ProtocolIDExpiry,
+			code:       channels.ExpiryStatusExpired,
+		},
+		{
+			name:       "expired signed",
+			middleware: ExpiryMiddleware(reply),
+			wrappers: []channels.Wrapper{
+				channels.NewExpiryMessage(channels.Now() - channels.Time(time.Hour)),
+				channels.NewSignature(key, nil, false),
+			},
+			protocolID: channels.ProtocolIDExpiry,
+			code:       channels.ExpiryStatusExpired,
+		},
+		{
+			name:       "expired outside signature",
+			middleware: ExpiryMiddleware(reply),
+			wrappers: []channels.Wrapper{
+				channels.NewSignature(key, nil, false),
+				channels.NewExpiryMessage(channels.Now() - channels.Time(time.Hour)),
+			},
+			handled: true,
+		},
+		{
+			name:       "duplicate uuid",
+			middleware: duplicateMiddleware(ctx, t, reply, &duplicateID),
+			wrappers:   []channels.Wrapper{&duplicateID},
+			protocolID: channels.ProtocolIDUUID,
+			code:       channels.UUIDStatusDuplicate,
+		},
+		{
+			name:       "duplicate message id",
+			middleware: duplicateMiddleware(ctx, t, reply, &channels.MessageID{MessageID: 5}),
+			wrappers:   []channels.Wrapper{&channels.MessageID{MessageID: 5}},
+			protocolID: channels.ProtocolIDMessageID,
+			code:       channels.MessageIDStatusDuplicate,
+		},
+		{
+			name:       "rate limited",
+			middleware: rateLimitedMiddleware(ctx, t, reply),
+			protocolID: channels.ProtocolIDResponse,
+			code:       channels.ResponseStatusRateLimited,
+		},
+	}
+
+	protocols := channels.NewProtocols(channels.NewSignedProtocol(), channels.NewExpiryProtocol(),
+		channels.NewUUIDProtocol(), channels.NewMessageIDProtocol(), relationships.NewProtocol())
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses = nil
+			router := NewRouter(protocols, reply)
+			router.Use(tt.middleware)
+
+			handled := false
+			router.Handle(&relationships.Initiation{}, func(ctx context.Context,
+				msg *RoutedMessage) error {
+
+				handled = true
+				return nil
+			})
+
+			err := router.HandleMessage(ctx, testPeerChannelMessage(t, tt.wrappers...))
+			if tt.handled {
+				if err != nil {
+					t.Fatalf("Failed to handle message : %s", err)
+				}
+				if !handled {
+					t.Fatalf("Message not handled")
+				}
+				return
+			}
+
+			if errors.Cause(err) != MessageNotRelevent {
+				t.Fatalf("Wrong error : got %v, want %s", err, MessageNotRelevent)
+			}
+
+			if handled {
+				t.Fatalf("Rejected message should not be handled")
+			}
+
+			if len(responses) != 1 {
+				t.Fatalf("Wrong response count : got %d, want %d", len(responses), 1)
+			}
+
+			t.Logf("Response : %s", responses[0].Error())
+			if !bytes.Equal(responses[0].CodeProtocolID, tt.protocolID) {
+				t.Errorf("Wrong response protocol : got %s, want %s", responses[0].CodeProtocolID,
+					tt.protocolID)
+			}
+
+			if responses[0].Code != tt.code {
+				t.Errorf("Wrong response code : got %d, want %d", responses[0].Code, tt.code)
+			}
+		})
+	}
+}
+
+func testPeerChannelMessage(t *testing.T, wrappers ...channels.Wrapper) peer_channels.Message {
+	script, err := channels.Wrap(&relationships.Initiation{}, wrappers...)
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+
+	return peer_channels.Message{
+		ChannelID: "channel",
+		Payload:   bitcoin.Hex(script),
+	}
+}
+
+// duplicateMiddleware returns a deduplicate middleware that has already seen the id.
+func duplicateMiddleware(ctx context.Context, t *testing.T, reply Reply,
+	id channels.Wrapper) Middleware {
+
+	middleware := DeduplicateMiddleware(reply, 10)
+	handler := middleware(func(ctx context.Context, msg *RoutedMessage) error {
+		return nil
+	})
+
+	msg := &RoutedMessage{
+		PeerChannelMessage: testPeerChannelMessage(t, id),
+		Message:            &relationships.Initiation{},
+		Wrappers:           []channels.Wrapper{id},
+	}
+	if err := handler(ctx, msg); err != nil {
+		t.Fatalf("Failed to handle first message : %s", err)
+	}
+
+	return middleware
+}
+
+// rateLimitedMiddleware returns a rate limit middleware that has already used its burst.
+func rateLimitedMiddleware(ctx context.Context, t *testing.T, reply Reply) Middleware {
+	middleware := RateLimitMiddleware(reply, 0.001, 2)
+	handler := middleware(func(ctx context.Context, msg *RoutedMessage) error {
+		return nil
+	})
+
+	msg := &RoutedMessage{
+		PeerChannelMessage: testPeerChannelMessage(t),
+		Message:            &relationships.Initiation{},
+	}
+	for i := 0; i < 2; i++ {
+		if err := handler(ctx, msg); err != nil {
+			t.Fatalf("Failed to handle message %d : %s", i, err)
+		}
+	}
+
+	return middleware
+}
+
+func Test_ReplayMiddleware_Retry(t *testing.T) {
+	ctx := context.Background()
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+
+	script, err := channels.Wrap(&relationships.Initiation{}, channels.NewTimeMessage(channels.Now()),
+		channels.NewReplayProtection("channel"), channels.NewSignature(key, nil, true))
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+
+	protocols := channels.NewProtocols(channels.NewSignedProtocol(),
+		channels.NewReplayProtectionProtocol(), channels.NewTimeProtocol(),
+		relationships.NewProtocol())
+	message, wrappers, err := protocols.Parse(script)
+	if err != nil {
+		t.Fatalf("Failed to parse : %s", err)
+	}
+
+	msg := &RoutedMessage{
+		PeerChannelMessage: peer_channels.Message{
+			ChannelID: "channel",
+			Payload:   bitcoin.Hex(script),
+		},
+		Message:  message,
+		Wrappers: wrappers,
+	}
+
+	var responses []*channels.Response
+	reply := func(ctx context.Context, msg *RoutedMessage, response *channels.Response) error {
+		responses = append(responses, response)
+		return nil
+	}
+
+	// The first attempt fails so the retry must not be rejected as a replay.
+	attempts := 0
+	publicKey := key.PublicKey()
+	lookup := func(ctx context.Context, msg *RoutedMessage) (*bitcoin.PublicKey, error) {
+		return &publicKey, nil
+	}
+	handler := ReplayMiddleware(reply, channels.NewReplayVerifier(10, time.Minute), lookup)(
+		func(ctx context.Context, msg *RoutedMessage) error {
+			attempts++
+			if attempts == 1 {
+				return errors.New("Temporary")
+			}
+			return nil
+		})
+
+	if err := handler(ctx, msg); err == nil {
+		t.Fatalf("First attempt should fail")
+	}
+
+	if err := handler(ctx, msg); err != nil {
+		t.Fatalf("Failed to handle retry : %s", err)
+	}
+
+	if err := handler(ctx, msg); errors.Cause(err) != MessageNotRelevent {
+		t.Fatalf("Wrong replay error : got %v, want %s", err, MessageNotRelevent)
+	}
+
+	if len(responses) != 1 || responses[0].Code != channels.SignedStatusNonceReused {
+		t.Fatalf("Wrong responses : %+v", responses)
+	}
+
+	// A message that isn't signed by the expected key is rejected.
+	otherKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	otherPublicKey := otherKey.PublicKey()
+	otherLookup := func(ctx context.Context, msg *RoutedMessage) (*bitcoin.PublicKey, error) {
+		return &otherPublicKey, nil
+	}
+	handler = ReplayMiddleware(reply, channels.NewReplayVerifier(10, time.Minute), otherLookup)(
+		func(ctx context.Context, msg *RoutedMessage) error {
+			return nil
+		})
+
+	if err := handler(ctx, msg); errors.Cause(err) != MessageNotRelevent {
+		t.Fatalf("Wrong wrong key error : got %v, want %s", err, MessageNotRelevent)
+	}
+
+	if len(responses) != 2 || responses[1].Code != channels.SignedStatusWrongPublicKey {
+		t.Fatalf("Wrong responses : %+v", responses)
+	}
+}
+
+func Test_DeduplicateMiddleware_Retry(t *testing.T) {
+	ctx := context.Background()
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+
+	id := channels.UUID(uuid.New())
+	script, err := channels.Wrap(&relationships.Initiation{}, &id,
+		channels.NewSignature(key, nil, true))
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+
+	protocols := channels.NewProtocols(channels.NewSignedProtocol(), channels.NewUUIDProtocol(),
+		relationships.NewProtocol())
+	message, wrappers, err := protocols.Parse(script)
+	if err != nil {
+		t.Fatalf("Failed to parse : %s", err)
+	}
+
+	msg := &RoutedMessage{
+		PeerChannelMessage: peer_channels.Message{
+			ChannelID: "channel",
+			Payload:   bitcoin.Hex(script),
+		},
+		Message:  message,
+		Wrappers: wrappers,
+	}
+
+	var responses []*channels.Response
+	reply := func(ctx context.Context, msg *RoutedMessage, response *channels.Response) error {
+		responses = append(responses, response)
+		return nil
+	}
+
+	// The first attempt fails so the retry must not be rejected as a duplicate.
+	attempts := 0
+	handler := DeduplicateMiddleware(reply, 0)(func(ctx context.Context,
+		msg *RoutedMessage) error {
+
+		attempts++
+		if attempts == 1 {
+			return errors.New("Temporary")
+		}
+		return nil
+	})
+
+	if err := handler(ctx, msg); err == nil {
+		t.Fatalf("First attempt should fail")
+	}
+
+	if err := handler(ctx, msg); err != nil {
+		t.Fatalf("Failed to handle retry : %s", err)
+	}
+
+	if err := handler(ctx, msg); errors.Cause(err) != MessageNotRelevent {
+		t.Fatalf("Wrong duplicate error : got %v, want %s", err, MessageNotRelevent)
+	}
+
+	if len(responses) != 1 || responses[0].Code != channels.UUIDStatusDuplicate {
+		t.Fatalf("Wrong responses : %+v", responses)
+	}
+
+	// An id outside of the signature is not used so it can't cause a signed message to be
+	// rejected.
+	injectedID := channels.UUID(uuid.New())
+	for i := 0; i < 2; i++ {
+		otherID := channels.UUID(uuid.New())
+		injected := &RoutedMessage{
+			PeerChannelMessage: msg.PeerChannelMessage,
+			Message:            message,
+			Wrappers:           []channels.Wrapper{&injectedID, wrappers[0], &otherID},
+		}
+
+		if err := handler(ctx, injected); err != nil {
+			t.Fatalf("Failed to handle injected message %d : %s", i, err)
+		}
+	}
+}
+
+func Test_RateLimiter_Evict(t *testing.T) {
+	limiter := &rateLimiter{
+		rate:    1.0,
+		burst:   2.0,
+		buckets: make(map[string]*rateBucket),
+	}
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		if !limiter.allow(fmt.Sprintf("channel %d", i), now) {
+			t.Fatalf("Channel %d should be allowed", i)
+		}
+	}
+
+	if len(limiter.buckets) != 10 {
+		t.Fatalf("Wrong bucket count : got %d, want %d", len(limiter.buckets), 10)
+	}
+
+	// Idle buckets are full again after two seconds so they are removed.
+	if !limiter.allow("active", now.Add(3*time.Second)) {
+		t.Fatalf("Active channel should be allowed")
+	}
+
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("Wrong bucket count : got %d, want %d", len(limiter.buckets), 1)
+	}
+}
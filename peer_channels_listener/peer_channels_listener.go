@@ -3,11 +3,13 @@ package peer_channels_listener
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
 	"reflect"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/tokenized/channels/metrics"
 	"github.com/tokenized/logger"
 	"github.com/tokenized/pkg/peer_channels"
 	"github.com/tokenized/threads"
@@ -20,77 +22,213 @@ var (
 )
 
 // HandleMessage handles a peer channel message. It returns MessageNotRelevent, which can be
-// wrapped, if it does not recognize the message. This will always be called in the same thread.
+// wrapped, if it does not recognize the message. Other errors are retried according to the retry
+// policy and then sent to the dead letter sink. Messages with the same shard key, the channel ID
+// by default, will always be handled in order in the same thread. The ID of the account the
+// message was received for is available from AccountIDFromContext.
 type HandleMessage func(ctx context.Context, msg peer_channels.Message) error
 
 // HandleUpdate handles a struct that updates the state of a message handler. It updates it in the
-// same thread that is handling messages so there is no multi-thread locking required.
+// same thread that is handling messages for the update's shard key so there is no multi-thread
+// locking required.
 type HandleUpdate func(ctx context.Context, update interface{}) error
 
+// ShardKey returns the key used to select the thread that handles a message. Messages with the
+// same key are handled in order in the same thread.
+type ShardKey func(msg peer_channels.Message) string
+
+// ShardedUpdate is implemented by updates that modify the state associated with a shard key so
+// they are handled in the same thread as the messages with that key. Updates that don't implement
+// it are handled in the first thread.
+type ShardedUpdate interface {
+	ShardKey() string
+}
+
+// BroadcastUpdate is implemented by updates that apply to the state of every shard, like removing
+// expired state, so they are handled once in every thread.
+type BroadcastUpdate interface {
+	Broadcast()
+}
+
+// ChannelIDShardKey returns the channel ID of the message so messages are handled in order per
+// channel.
+func ChannelIDShardKey(msg peer_channels.Message) string {
+	return msg.ChannelID
+}
+
 // AddUpdate adds an update struct to be handled in the same thread as the message handler. This
 // function interface can be used by the message handler so that there isn't a circular dependency
 // between the message handler and the listener.
 type AddUpdate func(update interface{}) error
 
 type PeerChannelsListener struct {
+	// Counts of messages and updates that are buffered or being handled. They are accessed
+	// atomically so they are first to be 64 bit aligned.
+	pendingMessages int64
+	pendingUpdates  int64
+
 	peerChannelsClient peer_channels.Client
-	readToken          string
 	handleMessage      HandleMessage
 	handleUpdate       HandleUpdate
-	messagesChannel    chan peer_channels.Message
-	updatesChannel     chan interface{}
-	handleThreadCount  int
+	messagesChannel    chan accountMessage
+	shards             []*shard
+	shardKey           ShardKey
 	channelTimeout     atomic.Value
+
+	retryPolicy    RetryPolicy
+	deadLetterSink DeadLetterSink
+	markPolicy     MarkPolicy
+
+	reconnectPolicy       RetryPolicy
+	connectedDelay        time.Duration
+	handleConnectionState HandleConnectionState
+	drainTimeout          time.Duration
+	metrics               metrics.Metrics
+
+	catchUpMaxCount   uint
+	handleSequenceGap HandleSequenceGap
+
+	accounts     map[string]*account
+	runCtx       context.Context // set while running
+	listenFailed chan error
+	accountsLock sync.Mutex
+}
+
+// shard contains the messages and updates for one handle thread.
+type shard struct {
+	messagesChannel chan accountMessage
+	updatesChannel  chan interface{}
 }
 
+// NewPeerChannelsListener creates a listener that receives messages for the account with the read
+// token. The read token can be empty and accounts added with AddAccount.
 func NewPeerChannelsListener(peerChannelsClient peer_channels.Client, readToken string,
 	channelSize, handleThreadCount int, channelTimeout time.Duration, handleMessage HandleMessage,
 	handleUpdate HandleUpdate) *PeerChannelsListener {
+
+	if handleThreadCount < 1 {
+		handleThreadCount = 1
+	}
+
 	result := &PeerChannelsListener{
 		peerChannelsClient: peerChannelsClient,
-		readToken:          readToken,
 		handleMessage:      handleMessage,
 		handleUpdate:       handleUpdate,
-		messagesChannel:    make(chan peer_channels.Message, channelSize),
-		updatesChannel:     make(chan interface{}, channelSize),
-		handleThreadCount:  handleThreadCount,
+		messagesChannel:    make(chan accountMessage, channelSize),
+		shards:             make([]*shard, handleThreadCount),
+		shardKey:           ChannelIDShardKey,
+		retryPolicy:        DefaultRetryPolicy(),
+		markPolicy:         DefaultMarkPolicy(),
+		reconnectPolicy:    DefaultReconnectPolicy(),
+		connectedDelay:     DefaultConnectedDelay,
+		catchUpMaxCount:    DefaultCatchUpMaxCount,
+		accounts:           make(map[string]*account),
+		metrics:            metrics.NoOp{},
+	}
+
+	if len(readToken) > 0 {
+		result.accounts[DefaultAccountID] = &account{
+			id:    DefaultAccountID,
+			token: readToken,
+		}
+	}
+
+	for i := range result.shards {
+		result.shards[i] = &shard{
+			messagesChannel: make(chan accountMessage, channelSize),
+			updatesChannel:  make(chan interface{}, channelSize),
+		}
 	}
 
 	result.channelTimeout.Store(channelTimeout)
 	return result
 }
 
+// SetShardKey sets the function used to select the thread that handles a message. It must be
+// called before Run.
+func (l *PeerChannelsListener) SetShardKey(shardKey ShardKey) {
+	l.shardKey = shardKey
+}
+
+// SetRetryPolicy sets how many times a message is handled before it is sent to the dead letter
+// sink. With a MaxAttempts of zero a failing message is retried until the listener is stopped,
+// which blocks the other messages of its thread. It must be called before Run.
+func (l *PeerChannelsListener) SetRetryPolicy(policy RetryPolicy) {
+	l.retryPolicy = policy
+}
+
+// SetDeadLetterSink sets where messages are sent when they fail to be handled after all retries.
+// If it isn't set then failed messages are only logged. It must be called before Run.
+func (l *PeerChannelsListener) SetDeadLetterSink(sink DeadLetterSink) {
+	l.deadLetterSink = sink
+}
+
+// SetMarkPolicy sets which messages are marked as read based on the outcome of handling them. It
+// must be called before Run.
+func (l *PeerChannelsListener) SetMarkPolicy(policy MarkPolicy) {
+	l.markPolicy = policy
+}
+
+// shardFor returns the shard that handles the key.
+func (l *PeerChannelsListener) shardFor(key string) *shard {
+	if len(l.shards) == 1 {
+		return l.shards[0]
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return l.shards[hash.Sum32()%uint32(len(l.shards))]
+}
+
+// AddUpdate adds an update to be handled in the thread for its shard key. Updates that implement
+// BroadcastUpdate are handled in every thread and updates that don't implement ShardedUpdate are
+// handled in the first thread.
 func (l *PeerChannelsListener) AddUpdate(update interface{}) error {
-	select {
-	case l.updatesChannel <- update:
-	case <-time.After(l.channelTimeout.Load().(time.Duration)):
-		return peer_channels.ErrChannelTimeout
+	shards := l.shards[:1]
+	if _, ok := update.(BroadcastUpdate); ok {
+		shards = l.shards
+	} else if sharded, ok := update.(ShardedUpdate); ok {
+		shards = []*shard{l.shardFor(sharded.ShardKey())}
+	}
+
+	timeout := time.After(l.channelTimeout.Load().(time.Duration))
+	for _, s := range shards {
+		select {
+		case s.updatesChannel <- update:
+			atomic.AddInt64(&l.pendingUpdates, 1)
+			l.reportQueueDepths()
+		case <-timeout:
+			return peer_channels.ErrChannelTimeout
+		}
 	}
 
 	return nil
 }
 
 func (l *PeerChannelsListener) Run(ctx context.Context, interrupt <-chan interface{}) error {
-	var listenWait, handleWait sync.WaitGroup
+	var dispatchWait, handleWait sync.WaitGroup
 	var selects []reflect.SelectCase
 
-	listenThread, listenComplete := threads.NewInterruptableThreadComplete("Peer Channel Listen",
-		func(ctx context.Context, interrupt <-chan interface{}) error {
-			return l.listen(ctx, interrupt, CopyString(l.readToken),
-				l.channelTimeout.Load().(time.Duration))
-		}, &listenWait)
+	listenFailed := make(chan error, 1)
+	selects = append(selects, reflect.SelectCase{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(listenFailed),
+	})
+
+	dispatchThread, dispatchComplete := threads.NewInterruptableThreadComplete(
+		"Peer Channel Dispatch", l.dispatch, &dispatchWait)
 	selects = append(selects, reflect.SelectCase{
 		Dir:  reflect.SelectRecv,
-		Chan: reflect.ValueOf(listenComplete),
+		Chan: reflect.ValueOf(dispatchComplete),
 	})
 
-	handleThreads := make([]*threads.InterruptableThread, l.handleThreadCount)
-	for i := 0; i < l.handleThreadCount; i++ {
-		index := i
-		handleThread, handleComplete := threads.NewInterruptableThreadComplete(fmt.Sprintf("Peer Channel Handle %d", index),
+	handleThreads := make([]*threads.InterruptableThread, len(l.shards))
+	for i, s := range l.shards {
+		shard := s
+		handleThread, handleComplete := threads.NewInterruptableThreadComplete(
+			fmt.Sprintf("Peer Channel Handle %d", i),
 			func(ctx context.Context, interrupt <-chan interface{}) error {
-				return l.handle(ctx, interrupt, l.handleMessage, l.handleUpdate,
-					CopyString(l.readToken))
+				return l.handle(ctx, interrupt, shard, l.handleMessage, l.handleUpdate)
 			}, &handleWait)
 		handleThreads[i] = handleThread
 
@@ -106,11 +244,19 @@ func (l *PeerChannelsListener) Run(ctx context.Context, interrupt <-chan interfa
 		Chan: reflect.ValueOf(interrupt),
 	})
 
-	listenThread.Start(ctx)
+	dispatchThread.Start(ctx)
 	for _, handleThread := range handleThreads {
 		handleThread.Start(ctx)
 	}
 
+	l.accountsLock.Lock()
+	l.runCtx = ctx
+	l.listenFailed = listenFailed
+	for _, a := range l.accounts {
+		l.startAccount(a)
+	}
+	l.accountsLock.Unlock()
+
 	selectIndex, selectValue, valueReceived := reflect.Select(selects)
 	var selectErr error
 	if valueReceived {
@@ -125,13 +271,22 @@ func (l *PeerChannelsListener) Run(ctx context.Context, interrupt <-chan interfa
 
 	if selectIndex == 0 {
 		logger.Error(ctx, "Peer Channel Listen thread completed : %s", selectErr)
+	} else if selectIndex == 1 {
+		logger.Error(ctx, "Peer Channel Dispatch thread completed : %s", selectErr)
 	} else if selectIndex < interruptIndex {
-		logger.Error(ctx, "Peer Channel Handle thread %d completed : %s", selectIndex-1, selectErr)
+		logger.Error(ctx, "Peer Channel Handle thread %d completed : %s", selectIndex-2, selectErr)
+	}
+
+	listenErrs := l.stopAccounts(ctx)
+
+	draining := selectIndex == interruptIndex && l.drainTimeout > 0
+	if draining {
+		l.drain(ctx, append([]*threads.InterruptableThread{dispatchThread}, handleThreads...))
 	}
 
-	listenThread.Stop(ctx)
-	waitWarning := logger.NewWaitingWarning(ctx, time.Second*3, "Listen thread")
-	listenWait.Wait()
+	dispatchThread.Stop(ctx)
+	waitWarning := logger.NewWaitingWarning(ctx, time.Second*3, "Dispatch thread")
+	dispatchWait.Wait()
 	waitWarning.Cancel()
 
 	for _, handleThread := range handleThreads {
@@ -141,8 +296,8 @@ func (l *PeerChannelsListener) Run(ctx context.Context, interrupt <-chan interfa
 	handleWait.Wait()
 	waitWarning.Cancel()
 
-	var errs []error
-	if err := listenThread.Error(); err != nil {
+	errs := listenErrs
+	if err := dispatchThread.Error(); err != nil {
 		errs = append(errs, err)
 	}
 	for _, handleThread := range handleThreads {
@@ -151,6 +306,18 @@ func (l *PeerChannelsListener) Run(ctx context.Context, interrupt <-chan interfa
 		}
 	}
 
+	if draining {
+		messages, updates := l.unprocessed()
+		if messages > 0 || updates > 0 {
+			logger.WarnWithFields(ctx, []logger.Field{
+				logger.Int64("messages", messages),
+				logger.Int64("updates", updates),
+			}, "Peer channel listener drain incomplete")
+			errs = append(errs, errors.Wrapf(ErrDrainTimeout, "%d messages, %d updates unprocessed",
+				messages, updates))
+		}
+	}
+
 	if len(errs) > 0 {
 		return threads.CombineErrors(errs...)
 	}
@@ -165,53 +332,201 @@ func CopyString(s string) string {
 }
 
 func (l *PeerChannelsListener) listen(ctx context.Context, interrupt <-chan interface{},
-	readToken string, channelTimeout time.Duration) error {
+	a *account, channelTimeout time.Duration) error {
 
+	sequences := newSequencer()
+	attempts := 0
 	for {
 		logger.Info(ctx, "Connecting to peer channel service to listen for messages")
+		l.setConnectionState(ctx, a, ConnectionStateConnecting, attempts, nil)
 
-		if err := l.peerChannelsClient.Listen(ctx, readToken, true, channelTimeout,
-			l.messagesChannel, interrupt); err != nil {
-			if errors.Cause(err) == threads.Interrupted {
-				return nil
-			}
+		connected, err := l.listenOnce(ctx, interrupt, a, sequences, channelTimeout, attempts)
+		if errors.Cause(err) == threads.Interrupted {
+			l.setConnectionState(ctx, a, ConnectionStateDisconnected, 0, nil)
+			return nil
+		}
+
+		if connected {
+			attempts = 0
+		}
+		attempts++
 
+		if err != nil {
 			logger.Warn(ctx, "Peer channel listening returned with error : %s", err)
+			l.setConnectionState(ctx, a, ConnectionStateError, attempts, err)
 		} else {
 			logger.Warn(ctx, "Peer channel listening returned")
+			l.setConnectionState(ctx, a, ConnectionStateDisconnected, attempts, nil)
+		}
+
+		if l.reconnectPolicy.Exhausted(attempts) {
+			err := errors.Wrapf(ErrGaveUpReconnecting, "%d attempts", attempts)
+			l.setConnectionState(ctx, a, ConnectionStateError, attempts, err)
+			return err
 		}
 
-		logger.Warn(ctx, "Waiting to reconnect to Peer channel")
+		l.metrics.AddCounter(MetricReconnects, nil, 1)
+		delay := l.reconnectPolicy.Delay(attempts)
+		logger.WarnWithFields(ctx, []logger.Field{
+			logger.Int("attempt", attempts),
+			logger.MillisecondsFromNano("delay_ms", delay.Nanoseconds()),
+		}, "Waiting to reconnect to Peer channel")
 		select {
-		case <-time.After(time.Second * 5):
+		case <-time.After(delay):
 		case <-interrupt:
+			l.setConnectionState(ctx, a, ConnectionStateDisconnected, 0, nil)
 			return nil
 		}
 	}
 }
 
-func (l *PeerChannelsListener) handle(ctx context.Context, interrupt <-chan interface{},
-	handleMessage HandleMessage, handleUpdate HandleUpdate, readToken string) error {
+// listenOnce listens to the peer channel service until the connection closes. It returns true if
+// the connection was established, which is when a message is received or the connection stays open
+// for the connected delay. When catch up is enabled unread messages are fetched before listening,
+// when the connection is established, and when messages are missing from a channel.
+func (l *PeerChannelsListener) listenOnce(ctx context.Context, interrupt <-chan interface{},
+	a *account, sequences *sequencer, channelTimeout time.Duration, attempts int) (bool, error) {
+
+	if a.listChannels != nil {
+		if err := l.catchUp(ctx, interrupt, a, sequences); err != nil {
+			return false, errors.Wrap(err, "catch up")
+		}
+	}
+
+	incoming := make(chan peer_channels.Message, cap(l.messagesChannel))
+	listenInterrupt := make(chan interface{})
+	listenComplete := make(chan error, 1)
+	go func() {
+		listenComplete <- l.peerChannelsClient.Listen(ctx, a.token, true, channelTimeout,
+			incoming, listenInterrupt)
+	}()
+
+	// stopListen stops the listen and waits for it to return. Messages it is still sending are
+	// dropped because they are unread and will be received again.
+	stopListen := func() {
+		close(listenInterrupt)
+		for {
+			select {
+			case <-incoming:
+			case <-listenComplete:
+				return
+			}
+		}
+	}
+
+	connected := false
+	connect := func(extra ...peer_channels.Message) error {
+		// Fetch messages posted before the connection was established.
+		if err := l.catchUp(ctx, interrupt, a, sequences, extra...); err != nil {
+			return err
+		}
+
+		connected = true
+		logger.Info(ctx, "Connected to peer channel service")
+		l.setConnectionState(ctx, a, ConnectionStateConnected, attempts, nil)
+		return nil
+	}
+
+	connectedTimer := time.NewTimer(l.connectedDelay)
+	defer connectedTimer.Stop()
+
+	for {
+		var err error
+		select {
+		case msg := <-incoming:
+			if !connected {
+				err = connect(msg)
+			} else if _, isGap := sequences.gap(msg); isGap && a.listChannels != nil {
+				err = l.catchUp(ctx, interrupt, a, sequences, msg)
+			} else {
+				err = l.deliver(ctx, interrupt, a, sequences, msg)
+			}
+
+		case <-connectedTimer.C:
+			if !connected {
+				err = connect()
+			}
+
+		case err := <-listenComplete:
+			// Forward any messages that were received before the connection closed.
+			for {
+				select {
+				case msg := <-incoming:
+					if err := l.deliver(ctx, interrupt, a, sequences, msg); err != nil {
+						return connected, err
+					}
+				default:
+					return connected, err
+				}
+			}
+
+		case <-interrupt:
+			err = threads.Interrupted
+		}
+
+		if err != nil {
+			stopListen()
+			if errors.Cause(err) == threads.Interrupted {
+				return connected, err
+			}
+			return connected, errors.Wrap(err, "catch up")
+		}
+	}
+}
+
+// dispatch sends each message to the shard for its shard key so messages with the same key are
+// handled in order.
+func (l *PeerChannelsListener) dispatch(ctx context.Context, interrupt <-chan interface{}) error {
 	for {
 		select {
 		case msg := <-l.messagesChannel:
-			if err := handleMessage(ctx, msg); err != nil &&
-				errors.Cause(err) != MessageNotRelevent {
-				return errors.Wrap(err, "handle message")
+			s := l.shardFor(l.shardKey(msg.Message))
+			select {
+			case s.messagesChannel <- msg:
+			case <-interrupt:
+				return nil
+			}
+
+		case <-interrupt:
+			return nil
+		}
+	}
+}
+
+func (l *PeerChannelsListener) handle(ctx context.Context, interrupt <-chan interface{},
+	s *shard, handleMessage HandleMessage, handleUpdate HandleUpdate) error {
+	for {
+		// Handle waiting updates first so state added before a message was received, like a
+		// registration for a response, is applied before the message is handled.
+		select {
+		case update := <-s.updatesChannel:
+			if err := l.applyUpdate(ctx, handleUpdate, update); err != nil {
+				return err
 			}
+			continue
+		default:
+		}
 
-			if err := l.peerChannelsClient.MarkMessages(ctx, msg.ChannelID, readToken,
-				msg.Sequence, true, true); err != nil {
-				return errors.Wrap(err, "mark message")
+		select {
+		case msg := <-s.messagesChannel:
+			l.reportQueueDepths()
+			mark, interrupted := l.handleWithRetry(ctx, interrupt, handleMessage, msg)
+			if interrupted {
+				return nil
 			}
 
-		case update := <-l.updatesChannel:
-			if handleUpdate == nil {
-				return errors.New("Received update with no handler specified")
+			if mark {
+				if err := l.peerChannelsClient.MarkMessages(ctx, msg.ChannelID, msg.token,
+					msg.Sequence, true, true); err != nil {
+					return errors.Wrap(err, "mark message")
+				}
 			}
 
-			if err := handleUpdate(ctx, update); err != nil {
-				return errors.Wrap(err, "handle update")
+			atomic.AddInt64(&l.pendingMessages, -1)
+
+		case update := <-s.updatesChannel:
+			if err := l.applyUpdate(ctx, handleUpdate, update); err != nil {
+				return err
 			}
 
 		case <-interrupt:
@@ -219,3 +534,91 @@ func (l *PeerChannelsListener) handle(ctx context.Context, interrupt <-chan inte
 		}
 	}
 }
+
+func (l *PeerChannelsListener) applyUpdate(ctx context.Context, handleUpdate HandleUpdate,
+	update interface{}) error {
+
+	l.reportQueueDepths()
+	if handleUpdate == nil {
+		return errors.New("Received update with no handler specified")
+	}
+
+	err := handleUpdate(ctx, update)
+	atomic.AddInt64(&l.pendingUpdates, -1)
+	if err != nil {
+		return errors.Wrap(err, "handle update")
+	}
+
+	return nil
+}
+
+// handleWithRetry handles the message, retrying according to the retry policy, and sends it to
+// the dead letter sink if it still fails. It returns true if the message should be marked as read
+// and whether the retries were interrupted.
+func (l *PeerChannelsListener) handleWithRetry(ctx context.Context, interrupt <-chan interface{},
+	handleMessage HandleMessage, msg accountMessage) (bool, bool) {
+
+	ctx = ContextWithAccountID(ctx, msg.accountID)
+	fields := []logger.Field{
+		logger.String("channel", msg.ChannelID),
+		logger.Uint64("sequence", msg.Sequence),
+	}
+	if msg.accountID != DefaultAccountID {
+		fields = append(fields, logger.String("account", msg.accountID))
+	}
+
+	attempts := 0
+	for {
+		attempts++
+		start := time.Now()
+		err := handleMessage(ctx, msg.Message)
+		seconds := time.Since(start).Seconds()
+		if err == nil {
+			l.metrics.ObserveHistogram(MetricHandleSeconds, handledLabels, seconds)
+			return l.markPolicy.Handled, false
+		}
+		if errors.Cause(err) == MessageNotRelevent {
+			l.metrics.ObserveHistogram(MetricHandleSeconds, notRelevantLabels, seconds)
+			return l.markPolicy.NotRelevant, false
+		}
+		l.metrics.ObserveHistogram(MetricHandleSeconds, errorLabels, seconds)
+
+		if !l.retryPolicy.Exhausted(attempts) {
+			l.metrics.AddCounter(MetricRetries, nil, 1)
+			delay := l.retryPolicy.Delay(attempts)
+			logger.WarnWithFields(ctx, append(fields, logger.Int("attempt", attempts),
+				logger.MillisecondsFromNano("retry_delay_ms", delay.Nanoseconds())),
+				"Failed to handle message : %s", err)
+
+			select {
+			case <-time.After(delay):
+				continue
+			case <-interrupt:
+				return false, true
+			}
+		}
+
+		logger.ErrorWithFields(ctx, append(fields, logger.Int("attempts", attempts)),
+			"Failed to handle message after all attempts : %s", err)
+		l.metrics.AddCounter(MetricDeadLetters, nil, 1)
+
+		if l.deadLetterSink != nil {
+			letter := &DeadLetter{
+				Message:   msg.Message,
+				AccountID: msg.accountID,
+				Error:     err.Error(),
+				Attempts:  attempts,
+				Time:      time.Now(),
+			}
+
+			if err := l.deadLetterSink.AddDeadLetter(ctx, letter); err != nil {
+				// The payload is logged so the message isn't lost. Leaving it unread would
+				// deliver it again every time the listener is run.
+				logger.ErrorWithFields(ctx, append(fields, logger.Hex("payload", msg.Payload)),
+					"Failed to add dead letter : %s", err)
+			}
+		}
+
+		return l.markPolicy.Failed, false
+	}
+}
@@ -0,0 +1,326 @@
+package peer_channels_listener
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tokenized/pkg/peer_channels"
+)
+
+type testUpdate struct {
+	channelID string
+}
+
+func (u *testUpdate) ShardKey() string {
+	return u.channelID
+}
+
+func Test_PeerChannelsListener_Ordered(t *testing.T) {
+	ctx := context.Background()
+	client := peer_channels.NewMockClient()
+
+	account, err := client.CreateAccount(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create account : %s", err)
+	}
+
+	accountClient := peer_channels.NewMockAccountClient(client, account.AccountID, account.Token)
+
+	channelCount := 3
+	messageCount := 20
+	var channelIDs []string
+	var writeTokens []string
+	for i := 0; i < channelCount; i++ {
+		channel, err := accountClient.CreateChannel(ctx)
+		if err != nil {
+			t.Fatalf("Failed to create channel : %s", err)
+		}
+
+		channelIDs = append(channelIDs, channel.ID)
+		writeTokens = append(writeTokens, channel.WriteToken)
+	}
+
+	var lock sync.Mutex
+	active := make(map[string]bool)
+	lastValues := make(map[string]uint64)
+	updates := make(map[string]int)
+	handled := 0
+	complete := make(chan interface{})
+
+	handleMessage := func(ctx context.Context, msg peer_channels.Message) error {
+		value := binary.LittleEndian.Uint64(msg.Payload)
+
+		lock.Lock()
+		if active[msg.ChannelID] {
+			t.Errorf("Concurrent messages on channel %s", msg.ChannelID)
+		}
+		active[msg.ChannelID] = true
+
+		if last, exists := lastValues[msg.ChannelID]; exists && value != last+1 {
+			t.Errorf("Out of order message on channel %s : got %d, want %d", msg.ChannelID,
+				value, last+1)
+		}
+		lastValues[msg.ChannelID] = value
+		lock.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		lock.Lock()
+		active[msg.ChannelID] = false
+		handled++
+		if handled == channelCount*messageCount {
+			close(complete)
+		}
+		lock.Unlock()
+
+		return nil
+	}
+
+	handleUpdate := func(ctx context.Context, update interface{}) error {
+		lock.Lock()
+		updates[update.(*testUpdate).channelID]++
+		lock.Unlock()
+		return nil
+	}
+
+	listener := NewPeerChannelsListener(client, account.Token, 100, 4, time.Second,
+		handleMessage, handleUpdate)
+
+	interrupt := make(chan interface{})
+	runComplete := make(chan error, 1)
+	go func() {
+		runComplete <- listener.Run(ctx, interrupt)
+	}()
+
+	time.Sleep(100 * time.Millisecond) // wait for listen to start
+
+	for i := 0; i < messageCount; i++ {
+		for c, channelID := range channelIDs {
+			payload := make([]byte, 8)
+			binary.LittleEndian.PutUint64(payload, uint64(i))
+			if err := client.WriteMessage(ctx, channelID, writeTokens[c],
+				peer_channels.ContentTypeBinary, bytes.NewReader(payload)); err != nil {
+				t.Fatalf("Failed to write message : %s", err)
+			}
+		}
+
+		if err := listener.AddUpdate(&testUpdate{channelID: channelIDs[i%channelCount]}); err != nil {
+			t.Fatalf("Failed to add update : %s", err)
+		}
+	}
+
+	select {
+	case <-complete:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for messages : %d handled", handled)
+	}
+
+	close(interrupt)
+	select {
+	case err := <-runComplete:
+		if err != nil {
+			t.Fatalf("Failed to run listener : %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for listener to stop")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	total := 0
+	for _, count := range updates {
+		total += count
+	}
+	if total != messageCount {
+		t.Errorf("Wrong update count : got %d, want %d", total, messageCount)
+	}
+}
+
+func Test_PeerChannelsListener_UpdatesBeforeMessages(t *testing.T) {
+	ctx := context.Background()
+	client := peer_channels.NewMockClient()
+
+	account, err := client.CreateAccount(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create account : %s", err)
+	}
+
+	accountClient := peer_channels.NewMockAccountClient(client, account.AccountID, account.Token)
+	channel, err := accountClient.CreateChannel(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create channel : %s", err)
+	}
+
+	// Each message blocks until it is released, so the next message and an update are both
+	// waiting when it returns. The update must be handled first.
+	var lock sync.Mutex
+	applied := uint64(0)
+	release := make(chan interface{})
+	handled := make(chan uint64, 1)
+
+	handleMessage := func(ctx context.Context, msg peer_channels.Message) error {
+		value := binary.LittleEndian.Uint64(msg.Payload)
+
+		lock.Lock()
+		if applied != value {
+			t.Errorf("Message handled before update : got %d updates, want %d", applied, value)
+		}
+		lock.Unlock()
+
+		handled <- value
+		<-release
+		return nil
+	}
+
+	handleUpdate := func(ctx context.Context, update interface{}) error {
+		lock.Lock()
+		applied++
+		lock.Unlock()
+		return nil
+	}
+
+	listener := NewPeerChannelsListener(client, account.Token, 100, 1, time.Second,
+		handleMessage, handleUpdate)
+
+	interrupt := make(chan interface{})
+	runComplete := make(chan error, 1)
+	go func() {
+		runComplete <- listener.Run(ctx, interrupt)
+	}()
+
+	time.Sleep(100 * time.Millisecond) // wait for listen to start
+
+	write := func(value uint64) {
+		payload := make([]byte, 8)
+		binary.LittleEndian.PutUint64(payload, value)
+		if err := client.WriteMessage(ctx, channel.ID, channel.WriteToken,
+			peer_channels.ContentTypeBinary, bytes.NewReader(payload)); err != nil {
+			t.Fatalf("Failed to write message : %s", err)
+		}
+	}
+
+	rounds := 20
+	write(0)
+	for i := 1; i <= rounds; i++ {
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for message %d", i-1)
+		}
+
+		if err := listener.AddUpdate(&testUpdate{channelID: channel.ID}); err != nil {
+			t.Fatalf("Failed to add update : %s", err)
+		}
+		write(uint64(i))
+
+		time.Sleep(10 * time.Millisecond) // wait for the message to reach the handle thread
+		release <- true
+	}
+
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for message %d", rounds)
+	}
+	close(release)
+
+	close(interrupt)
+	select {
+	case err := <-runComplete:
+		if err != nil {
+			t.Fatalf("Failed to run listener : %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for listener to stop")
+	}
+}
+
+type testBroadcastUpdate struct{}
+
+func (u *testBroadcastUpdate) Broadcast() {}
+
+func Test_PeerChannelsListener_BroadcastUpdate(t *testing.T) {
+	ctx := context.Background()
+	client := peer_channels.NewMockClient()
+
+	account, err := client.CreateAccount(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create account : %s", err)
+	}
+
+	threadCount := 4
+	var lock sync.Mutex
+	broadcasts := 0
+	sharded := 0
+	var handled sync.WaitGroup
+	handled.Add(threadCount + 1)
+
+	handleMessage := func(ctx context.Context, msg peer_channels.Message) error {
+		return nil
+	}
+
+	handleUpdate := func(ctx context.Context, update interface{}) error {
+		lock.Lock()
+		switch update.(type) {
+		case *testBroadcastUpdate:
+			broadcasts++
+		case *testUpdate:
+			sharded++
+		}
+		lock.Unlock()
+		handled.Done()
+		return nil
+	}
+
+	listener := NewPeerChannelsListener(client, account.Token, 100, threadCount, time.Second,
+		handleMessage, handleUpdate)
+
+	interrupt := make(chan interface{})
+	runComplete := make(chan error, 1)
+	go func() {
+		runComplete <- listener.Run(ctx, interrupt)
+	}()
+
+	if err := listener.AddUpdate(&testBroadcastUpdate{}); err != nil {
+		t.Fatalf("Failed to add update : %s", err)
+	}
+
+	if err := listener.AddUpdate(&testUpdate{channelID: "channel"}); err != nil {
+		t.Fatalf("Failed to add update : %s", err)
+	}
+
+	updatesHandled := make(chan interface{})
+	go func() {
+		handled.Wait()
+		close(updatesHandled)
+	}()
+
+	select {
+	case <-updatesHandled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for updates")
+	}
+
+	if broadcasts != threadCount {
+		t.Errorf("Wrong broadcast count : got %d, want %d", broadcasts, threadCount)
+	}
+
+	if sharded != 1 {
+		t.Errorf("Wrong sharded count : got %d, want %d", sharded, 1)
+	}
+
+	close(interrupt)
+	select {
+	case err := <-runComplete:
+		if err != nil {
+			t.Fatalf("Failed to run listener : %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for listener to stop")
+	}
+}
@@ -0,0 +1,165 @@
+package peer_channels_listener
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/tokenized/channels"
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	"github.com/tokenized/logger"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/pkg/errors"
+)
+
+// RoutedMessage is a channels message parsed from a peer channel message.
+type RoutedMessage struct {
+	PeerChannelMessage peer_channels.Message
+	Message            channels.Message
+	Wrappers           []channels.Wrapper
+}
+
+// HandleRoutedMessage handles a channels message. It is called in the same thread as
+// HandleMessage.
+type HandleRoutedMessage func(ctx context.Context, msg *RoutedMessage) error
+
+// Reply sends a response to the sender of a message. The implementation determines which peer
+// channel to send the response to, for example from a ReplyTo wrapper or the relationship that
+// the message was received on. msg.Message is nil when the message couldn't be parsed.
+type Reply func(ctx context.Context, msg *RoutedMessage, response *channels.Response) error
+
+// Router parses peer channel messages and dispatches them to the handler registered for the
+// protocol and message type. Its HandleMessage function can be used as the HandleMessage of a
+// PeerChannelsListener.
+type Router struct {
+	protocols *channels.Protocols
+	reply     Reply
+
+	handlers         map[routeKey]HandleRoutedMessage
+	protocolHandlers map[string]HandleRoutedMessage
+	middlewares      []Middleware
+
+	lock sync.RWMutex
+}
+
+type routeKey struct {
+	protocolID string
+	goType     reflect.Type
+}
+
+// NewRouter creates a router that parses messages with protocols. reply is used to respond when a
+// message can't be parsed or no handler matches it. It can be nil if no response should be sent.
+func NewRouter(protocols *channels.Protocols, reply Reply) *Router {
+	return &Router{
+		protocols:        protocols,
+		reply:            reply,
+		handlers:         make(map[routeKey]HandleRoutedMessage),
+		protocolHandlers: make(map[string]HandleRoutedMessage),
+	}
+}
+
+// Handle registers the handler for messages with the same protocol ID and Go type as message. For
+// example `router.Handle(&invoices.Invoice{}, handleInvoice)`.
+func (r *Router) Handle(message channels.Message, handler HandleRoutedMessage) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.handlers[newRouteKey(message)] = handler
+}
+
+// HandleProtocol registers the handler for messages of the protocol that don't have a handler
+// registered for their message type.
+func (r *Router) HandleProtocol(protocolID envelope.ProtocolID, handler HandleRoutedMessage) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.protocolHandlers[string(protocolID)] = handler
+}
+
+// Use adds middleware that is called before every handler. Middleware is called in the order it
+// is added.
+func (r *Router) Use(middlewares ...Middleware) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+func newRouteKey(message channels.Message) routeKey {
+	goType := reflect.TypeOf(message)
+	if goType.Kind() == reflect.Ptr {
+		goType = goType.Elem()
+	}
+
+	return routeKey{
+		protocolID: string(message.ProtocolID()),
+		goType:     goType,
+	}
+}
+
+// handler returns the handler for the message wrapped in the middleware.
+func (r *Router) handler(message channels.Message) HandleRoutedMessage {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	handler, exists := r.handlers[newRouteKey(message)]
+	if !exists {
+		handler, exists = r.protocolHandlers[string(message.ProtocolID())]
+		if !exists {
+			return nil
+		}
+	}
+
+	return Chain(handler, r.middlewares...)
+}
+
+// HandleMessage parses the peer channel message and calls the matching handler. When there is no
+// matching handler, or the message contains an unsupported protocol, it responds with
+// StatusUnsupportedProtocol and returns MessageNotRelevent. Messages with unsigned security
+// wrappers are responded to with StatusUnauthorized and messages that otherwise fail to parse,
+// including by exceeding the parse limits, with StatusInvalid. Messages that contain a response
+// are never responded to.
+func (r *Router) HandleMessage(ctx context.Context, msg peer_channels.Message) error {
+	routed := &RoutedMessage{
+		PeerChannelMessage: msg,
+	}
+
+	message, wrappers, err := r.protocols.Parse(bitcoin.Script(msg.Payload))
+	routed.Wrappers = wrappers
+	if err != nil {
+		if errors.Cause(err) == channels.ErrUnsupportedProtocol {
+			return r.replyUnsupported(ctx, routed, nil, err.Error())
+		}
+
+		if response := channels.LimitExceededResponse(err); response != nil {
+			return Reject(ctx, r.reply, routed, response)
+		}
+
+		if response := channels.UnsignedWrapperResponse(err); response != nil {
+			return Reject(ctx, r.reply, routed, response)
+		}
+
+		logger.WarnWithFields(ctx, []logger.Field{
+			logger.String("channel", msg.ChannelID),
+			logger.Uint64("sequence", msg.Sequence),
+		}, "Failed to parse channels message : %s", err)
+		return reject(ctx, r.reply, routed, channels.StatusInvalid, nil, 0, err.Error())
+	}
+	routed.Message = message
+
+	handler := r.handler(message)
+	if handler == nil {
+		return r.replyUnsupported(ctx, routed, message.ProtocolID(),
+			"no handler for message type")
+	}
+
+	return handler(ctx, routed)
+}
+
+func (r *Router) replyUnsupported(ctx context.Context, msg *RoutedMessage,
+	protocolID envelope.ProtocolID, note string) error {
+
+	return reject(ctx, r.reply, msg, channels.StatusUnsupportedProtocol, protocolID, 0, note)
+}
@@ -0,0 +1,253 @@
+package peer_channels_listener
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/channels/invoices"
+	"github.com/tokenized/channels/relationships"
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	envelopeV1 "github.com/tokenized/envelope/pkg/golang/envelope/v1"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+func Test_Router(t *testing.T) {
+	ctx := context.Background()
+
+	var responses []*channels.Response
+	reply := func(ctx context.Context, msg *RoutedMessage, response *channels.Response) error {
+		responses = append(responses, response)
+		return nil
+	}
+
+	protocols := channels.NewProtocols(channels.NewUUIDProtocol(), relationships.NewProtocol(),
+		invoices.NewProtocol())
+	router := NewRouter(protocols, reply)
+
+	var initiations, relationshipMessages int
+	router.Handle(&relationships.Initiation{}, func(ctx context.Context,
+		msg *RoutedMessage) error {
+
+		if _, ok := msg.Message.(*relationships.Initiation); !ok {
+			t.Errorf("Wrong message type : %T", msg.Message)
+		}
+
+		if len(msg.Wrappers) != 1 {
+			t.Errorf("Wrong wrapper count : got %d, want %d", len(msg.Wrappers), 1)
+		}
+
+		initiations++
+		return nil
+	})
+	router.HandleProtocol(relationships.ProtocolID, func(ctx context.Context,
+		msg *RoutedMessage) error {
+
+		relationshipMessages++
+		return nil
+	})
+
+	id := channels.UUID(uuid.New())
+	txid := channels.TxID(channels.RandomHash())
+	tests := []struct {
+		name                 string
+		msg                  channels.Writer
+		initiations          int
+		relationshipMessages int
+		responses            int
+		notRelevant          bool
+	}{
+		{
+			name:        "initiation",
+			msg:         &relationships.Initiation{},
+			initiations: 1,
+		},
+		{
+			name:                 "protocol",
+			msg:                  &relationships.Update{},
+			initiations:          1,
+			relationshipMessages: 1,
+		},
+		{
+			name:                 "no handler",
+			msg:                  &invoices.Invoice{},
+			initiations:          1,
+			relationshipMessages: 1,
+			responses:            1,
+			notRelevant:          true,
+		},
+		{
+			name:                 "unsupported protocol",
+			msg:                  &txid,
+			initiations:          1,
+			relationshipMessages: 1,
+			responses:            2,
+			notRelevant:          true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, err := channels.Wrap(tt.msg, &id)
+			if err != nil {
+				t.Fatalf("Failed to wrap message : %s", err)
+			}
+
+			err = router.HandleMessage(ctx, peer_channels.Message{
+				ChannelID: "channel",
+				Payload:   bitcoin.Hex(script),
+			})
+			if !tt.notRelevant {
+				if err != nil {
+					t.Fatalf("Failed to handle message : %s", err)
+				}
+			} else if errors.Cause(err) != MessageNotRelevent {
+				t.Fatalf("Wrong error : got %v, want %s", err, MessageNotRelevent)
+			}
+
+			if initiations != tt.initiations {
+				t.Errorf("Wrong initiations : got %d, want %d", initiations, tt.initiations)
+			}
+
+			if relationshipMessages != tt.relationshipMessages {
+				t.Errorf("Wrong relationship messages : got %d, want %d", relationshipMessages,
+					tt.relationshipMessages)
+			}
+
+			if len(responses) != tt.responses {
+				t.Fatalf("Wrong response count : got %d, want %d", len(responses), tt.responses)
+			}
+
+			if tt.responses > 0 {
+				response := responses[len(responses)-1]
+				t.Logf("Response : %s", response.Error())
+				if response.Status != channels.StatusUnsupportedProtocol {
+					t.Errorf("Wrong response status : got %s, want %s", response.Status,
+						channels.StatusUnsupportedProtocol)
+				}
+			}
+		})
+	}
+}
+
+func Test_Router_ParseErrors(t *testing.T) {
+	ctx := context.Background()
+
+	var responses []*channels.Response
+	reply := func(ctx context.Context, msg *RoutedMessage, response *channels.Response) error {
+		responses = append(responses, response)
+		return nil
+	}
+
+	protocols := channels.NewProtocols(channels.NewUUIDProtocol(), channels.NewReplyToProtocol())
+	protocols.SetUnsignedWrapperPolicy(channels.UnsignedWrappersRejected)
+	router := NewRouter(protocols, reply)
+	router.HandleProtocol(channels.ProtocolIDUUID, func(ctx context.Context,
+		msg *RoutedMessage) error {
+
+		t.Errorf("Handler should not be called")
+		return nil
+	})
+
+	id := channels.UUID(uuid.New())
+	handle := "test@test.com"
+	unsignedScript, err := channels.Wrap(&id, &channels.ReplyTo{Handle: &handle})
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+
+	limitsProtocols := channels.NewProtocols(channels.NewUUIDProtocol())
+	limits := channels.DefaultParseLimits()
+	limits.MaxScriptSize = 10
+	limitsProtocols.SetParseLimits(limits)
+	limitsRouter := NewRouter(limitsProtocols, reply)
+
+	idScript, err := channels.Wrap(&id)
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+
+	invalidScript, err := envelopeV1.Wrap(envelope.Data{
+		ProtocolIDs: envelope.ProtocolIDs{channels.ProtocolIDUUID},
+		Payload:     bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(0)},
+	}).Script()
+	if err != nil {
+		t.Fatalf("Failed to create script : %s", err)
+	}
+
+	// Responses are never responded to, even when they can't be parsed.
+	txid := channels.TxID(channels.RandomHash())
+	responseScript, err := channels.Wrap(&txid, &channels.Response{
+		Status: channels.StatusInvalid,
+	})
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+
+	tests := []struct {
+		name       string
+		router     *Router
+		script     bitcoin.Script
+		status     channels.Status
+		noResponse bool
+	}{
+		{
+			name:   "invalid",
+			router: router,
+			script: invalidScript,
+			status: channels.StatusInvalid,
+		},
+		{
+			name:       "response",
+			router:     router,
+			script:     responseScript,
+			noResponse: true,
+		},
+		{
+			name:   "unsigned wrapper",
+			router: router,
+			script: unsignedScript,
+			status: channels.StatusUnauthorized,
+		},
+		{
+			name:   "limit exceeded",
+			router: limitsRouter,
+			script: idScript,
+			status: channels.StatusInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses = nil
+			err := tt.router.HandleMessage(ctx, peer_channels.Message{
+				ChannelID: "channel",
+				Payload:   bitcoin.Hex(tt.script),
+			})
+			if errors.Cause(err) != MessageNotRelevent {
+				t.Fatalf("Wrong error : got %v, want %s", err, MessageNotRelevent)
+			}
+
+			if tt.noResponse {
+				if len(responses) != 0 {
+					t.Fatalf("Wrong response count : got %d, want %d", len(responses), 0)
+				}
+				return
+			}
+
+			if len(responses) != 1 {
+				t.Fatalf("Wrong response count : got %d, want %d", len(responses), 1)
+			}
+
+			t.Logf("Response : %s", responses[0].Error())
+			if responses[0].Status != tt.status {
+				t.Errorf("Wrong response status : got %s, want %s", responses[0].Status,
+					tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package peer_channels_service
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/tokenized/pkg/peer_channels"
+)
+
+// AccountClient implements peer_channels.AccountClient for an account of the in-memory service.
+type AccountClient struct {
+	service   *Service
+	accountID string
+	token     string
+}
+
+func (c *AccountClient) BaseURL() string {
+	return ServiceURL
+}
+
+func (c *AccountClient) AccountID() string {
+	return c.accountID
+}
+
+func (c *AccountClient) Token() string {
+	return c.token
+}
+
+func (c *AccountClient) CreatePublicChannel(ctx context.Context) (*peer_channels.FullChannel,
+	error) {
+	return c.service.createChannel(ctx, c.accountID, c.token, true)
+}
+
+func (c *AccountClient) CreateChannel(ctx context.Context) (*peer_channels.FullChannel, error) {
+	return c.service.createChannel(ctx, c.accountID, c.token, false)
+}
+
+func (c *AccountClient) GetChannel(ctx context.Context,
+	channelID string) (*peer_channels.FullChannel, error) {
+
+	c.service.lock.Lock()
+	defer c.service.lock.Unlock()
+
+	if _, err := c.service.authorizeAccount(c.accountID, c.token); err != nil {
+		return nil, err
+	}
+
+	ch, exists := c.service.channels[channelID]
+	if !exists || ch.accountID != c.accountID {
+		return nil, peer_channels.HTTPError{Status: http.StatusNotFound}
+	}
+
+	return ch.fullChannel(), nil
+}
+
+func (c *AccountClient) ListChannels(ctx context.Context) ([]*peer_channels.FullChannel, error) {
+	c.service.lock.Lock()
+	defer c.service.lock.Unlock()
+
+	if _, err := c.service.authorizeAccount(c.accountID, c.token); err != nil {
+		return nil, err
+	}
+
+	var result []*peer_channels.FullChannel
+	for _, ch := range c.service.accountChannels(c.accountID) {
+		result = append(result, ch.fullChannel())
+	}
+
+	return result, nil
+}
+
+func (c *AccountClient) MarkMessages(ctx context.Context, channelID string, sequence uint64,
+	read, older bool) error {
+	return c.service.MarkMessages(ctx, channelID, c.token, sequence, read, older)
+}
+
+func (c *AccountClient) DeleteMessage(ctx context.Context, channelID string, sequence uint64,
+	older bool) error {
+	return c.service.DeleteMessage(ctx, channelID, c.token, sequence, older)
+}
+
+func (c *AccountClient) Notify(ctx context.Context, sendUnread bool, channelTimeout time.Duration,
+	incoming chan<- peer_channels.MessageNotification, interrupt <-chan interface{}) error {
+	return c.service.Notify(ctx, c.token, sendUnread, channelTimeout, incoming, interrupt)
+}
+
+func (c *AccountClient) Listen(ctx context.Context, sendUnread bool, channelTimeout time.Duration,
+	incoming chan<- peer_channels.Message, interrupt <-chan interface{}) error {
+	return c.service.Listen(ctx, c.token, sendUnread, channelTimeout, incoming, interrupt)
+}
@@ -0,0 +1,238 @@
+package peer_channels_service
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/tokenized/logger"
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/pkg/errors"
+)
+
+func (s *Service) BaseURL() string {
+	return ServiceURL
+}
+
+func (s *Service) GetChannelMetaData(ctx context.Context,
+	channelID, token string) (*peer_channels.ChannelData, error) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, exists := s.channels[channelID]
+	if !exists {
+		return nil, peer_channels.HTTPError{Status: http.StatusNotFound}
+	}
+
+	if len(c.writeToken) > 0 && c.writeToken == token {
+		maxMessagePayloadSize := s.maxMessagePayloadSize
+		return &peer_channels.ChannelData{
+			MaxMessagePayloadSize: &maxMessagePayloadSize,
+		}, nil
+	}
+
+	if _, err := s.authorizeRead(channelID, token); err != nil {
+		return nil, err
+	}
+
+	autoDeleteReadMessages := false
+	return &peer_channels.ChannelData{
+		AutoDeleteReadMessages: &autoDeleteReadMessages,
+	}, nil
+}
+
+// WriteMessage posts a message to the channel. Public channels accept any token. The message is
+// sent to any active listeners for the channel before this function returns.
+func (s *Service) WriteMessage(ctx context.Context, channelID, token string, contentType string,
+	payload io.Reader) error {
+
+	b, err := ioutil.ReadAll(payload)
+	if err != nil {
+		return errors.Wrap(err, "read payload")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, exists := s.channels[channelID]
+	if !exists {
+		return peer_channels.HTTPError{Status: http.StatusNotFound}
+	}
+
+	if len(c.writeToken) > 0 && c.writeToken != token {
+		return peer_channels.HTTPError{Status: http.StatusUnauthorized}
+	}
+
+	if uint64(len(b)) > s.maxMessagePayloadSize {
+		return peer_channels.HTTPError{Status: http.StatusRequestEntityTooLarge}
+	}
+
+	c.lastSequence++
+	msg := peer_channels.Message{
+		Sequence:    c.lastSequence,
+		Received:    time.Now(),
+		ContentType: contentType,
+		ChannelID:   c.id,
+		Payload:     b,
+	}
+	c.messages = append(c.messages, &message{Message: msg})
+
+	logger.VerboseWithFields(ctx, []logger.Field{
+		logger.String("channel_id", c.id),
+		logger.Uint64("sequence", msg.Sequence),
+		logger.Int("bytes", len(b)),
+	}, "Wrote peer channel message")
+
+	for l := range s.listeners {
+		if l.matches(c) {
+			l.push(msg)
+		}
+	}
+
+	return nil
+}
+
+// GetMessages returns the messages in the channel in sequence order. When unread is true only
+// messages that haven't been marked read are returned. A maxCount of zero returns all of them.
+// Messages are not marked read by this function.
+func (s *Service) GetMessages(ctx context.Context, channelID, token string, unread bool,
+	maxCount uint) (peer_channels.Messages, error) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.authorizeRead(channelID, token)
+	if err != nil {
+		return nil, err
+	}
+
+	var result peer_channels.Messages
+	for _, msg := range c.messages {
+		if unread && msg.read {
+			continue
+		}
+
+		if maxCount != 0 && uint(len(result)) >= maxCount {
+			break
+		}
+
+		copied := msg.Message
+		result = append(result, &copied)
+	}
+
+	return result, nil
+}
+
+// GetMaxMessageSequence returns the sequence of the last message written to the channel, even if it
+// has since been deleted, or zero when no messages have been written.
+func (s *Service) GetMaxMessageSequence(ctx context.Context, channelID,
+	token string) (uint64, error) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.authorizeRead(channelID, token)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.lastSequence, nil
+}
+
+// MarkMessages sets whether the message with the sequence has been read. When older is true it
+// also sets all messages with lower sequences.
+func (s *Service) MarkMessages(ctx context.Context, channelID, token string, sequence uint64,
+	read, older bool) error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.authorizeRead(channelID, token)
+	if err != nil {
+		return err
+	}
+
+	if c.find(sequence) == -1 {
+		return peer_channels.HTTPError{Status: http.StatusNotFound}
+	}
+
+	for _, msg := range c.messages {
+		if msg.Sequence == sequence || (older && msg.Sequence < sequence) {
+			msg.read = read
+		}
+	}
+
+	return nil
+}
+
+// DeleteMessage removes the message with the sequence. When older is true it also removes all
+// messages with lower sequences.
+func (s *Service) DeleteMessage(ctx context.Context, channelID, token string, sequence uint64,
+	older bool) error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, err := s.authorizeRead(channelID, token)
+	if err != nil {
+		return err
+	}
+
+	if c.find(sequence) == -1 {
+		return peer_channels.HTTPError{Status: http.StatusNotFound}
+	}
+
+	var messages []*message
+	for _, msg := range c.messages {
+		if msg.Sequence == sequence || (older && msg.Sequence < sequence) {
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	c.messages = messages
+
+	return nil
+}
+
+func (s *Service) Notify(ctx context.Context, token string, sendUnread bool,
+	channelTimeout time.Duration, incoming chan<- peer_channels.MessageNotification,
+	interrupt <-chan interface{}) error {
+
+	return s.listen(ctx, token, sendUnread, interrupt, func(msg peer_channels.Message) error {
+		notification := peer_channels.MessageNotification{
+			Sequence:    msg.Sequence,
+			Received:    msg.Received,
+			ContentType: msg.ContentType,
+			ChannelID:   msg.ChannelID,
+		}
+
+		select {
+		case incoming <- notification:
+			return nil
+		case <-time.After(channelTimeout):
+			return peer_channels.ErrChannelTimeout
+		case <-interrupt:
+			return nil
+		}
+	})
+}
+
+func (s *Service) Listen(ctx context.Context, token string, sendUnread bool,
+	channelTimeout time.Duration, incoming chan<- peer_channels.Message,
+	interrupt <-chan interface{}) error {
+
+	return s.listen(ctx, token, sendUnread, interrupt, func(msg peer_channels.Message) error {
+		select {
+		case incoming <- msg:
+			return nil
+		case <-time.After(channelTimeout):
+			return peer_channels.ErrChannelTimeout
+		case <-interrupt:
+			return nil
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package peer_channels_service
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/tokenized/logger"
+	"github.com/tokenized/pkg/peer_channels"
+)
+
+// listener is an active call to Listen or Notify.
+type listener struct {
+	accountID string // all of the account's channels when listening with an account token
+	channelID string // only this channel when listening with a channel's read token
+
+	// queue contains messages that haven't been sent yet. It is protected by the service lock.
+	queue []peer_channels.Message
+
+	notify     chan struct{}
+	disconnect chan struct{}
+}
+
+// sendFunction sends a message to the caller of Listen or Notify. It returns nil if interrupted.
+type sendFunction func(msg peer_channels.Message) error
+
+// listen sends messages for the token to send until interrupted. The token can be an account token
+// or a channel read token.
+func (s *Service) listen(ctx context.Context, token string, sendUnread bool,
+	interrupt <-chan interface{}, send sendFunction) error {
+
+	l, err := s.addListener(token, sendUnread)
+	if err != nil {
+		return err
+	}
+	defer s.removeListener(l)
+
+	logger.VerboseWithFields(ctx, []logger.Field{
+		logger.String("account_id", l.accountID),
+		logger.String("channel_id", l.channelID),
+		logger.Bool("send_unread", sendUnread),
+	}, "Peer channel listener connected")
+
+	for {
+		for {
+			msg, ok := s.nextMessage(l)
+			if !ok {
+				break
+			}
+
+			if err := send(msg); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-l.notify:
+		case <-l.disconnect:
+			return ErrDisconnected
+		case <-interrupt:
+			return nil
+		}
+	}
+}
+
+func (s *Service) addListener(token string, sendUnread bool) (*listener, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	l := &listener{
+		notify:     make(chan struct{}, 1),
+		disconnect: make(chan struct{}),
+	}
+
+	var channels []*channel
+	for _, a := range s.accounts {
+		if a.token == token {
+			l.accountID = a.id
+			channels = s.accountChannels(a.id)
+			break
+		}
+	}
+
+	if len(l.accountID) == 0 {
+		for _, c := range s.channels {
+			if c.readToken == token {
+				l.channelID = c.id
+				channels = []*channel{c}
+				break
+			}
+		}
+	}
+
+	if len(l.accountID) == 0 && len(l.channelID) == 0 {
+		return nil, peer_channels.HTTPError{Status: http.StatusUnauthorized}
+	}
+
+	if sendUnread {
+		for _, c := range channels {
+			l.queue = append(l.queue, c.unread()...)
+		}
+	}
+
+	s.listeners[l] = true
+	return l, nil
+}
+
+func (s *Service) removeListener(l *listener) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.listeners, l)
+}
+
+func (s *Service) nextMessage(l *listener) (peer_channels.Message, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(l.queue) == 0 {
+		return peer_channels.Message{}, false
+	}
+
+	msg := l.queue[0]
+	l.queue = l.queue[1:]
+	return msg, true
+}
+
+func (l *listener) matches(c *channel) bool {
+	if len(l.channelID) > 0 {
+		return l.channelID == c.id
+	}
+
+	return l.accountID == c.accountID
+}
+
+// push adds a message to the queue and wakes the listener. The service lock must be held.
+func (l *listener) push(msg peer_channels.Message) {
+	l.queue = append(l.queue, msg)
+
+	select {
+	case l.notify <- struct{}{}:
+	default: // already notified
+	}
+}
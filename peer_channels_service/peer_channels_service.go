@@ -0,0 +1,251 @@
+package peer_channels_service
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/tokenized/logger"
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ServiceURL is the base URL of the in-memory service. It doesn't use the "mock://" prefix so
+	// peer_channels.Factory won't replace it with its own mock client.
+	ServiceURL = "memory://peer_channels"
+
+	// DefaultMaxMessagePayloadSize is the largest payload that can be written to a channel.
+	DefaultMaxMessagePayloadSize = uint64(1e6)
+)
+
+var (
+	ErrDisconnected   = errors.New("Disconnected")
+	ErrUnsupportedURL = errors.New("Unsupported URL")
+)
+
+// Service is an in-memory peer channel service. It implements peer_channels.Client and
+// peer_channels.AccountClientFactory so flows between several parties can be run in tests without
+// network access. Unlike the real service it keeps everything in memory and never deletes read
+// messages automatically.
+type Service struct {
+	accounts map[string]*account
+	channels map[string]*channel
+
+	listeners map[*listener]bool
+
+	maxMessagePayloadSize uint64
+
+	lock sync.Mutex
+}
+
+type account struct {
+	id         string
+	token      string
+	channelIDs []string
+}
+
+type channel struct {
+	id         string
+	accountID  string
+	readToken  string
+	writeToken string // empty for public channels which anyone can write to
+
+	lastSequence uint64
+	messages     []*message
+}
+
+type message struct {
+	peer_channels.Message
+	read bool
+}
+
+func NewService() *Service {
+	return &Service{
+		accounts:              make(map[string]*account),
+		channels:              make(map[string]*channel),
+		listeners:             make(map[*listener]bool),
+		maxMessagePayloadSize: DefaultMaxMessagePayloadSize,
+	}
+}
+
+// SetMaxMessagePayloadSize sets the largest payload that can be written to a channel.
+func (s *Service) SetMaxMessagePayloadSize(size uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.maxMessagePayloadSize = size
+}
+
+// CreateAccount creates a new account. The token in the result can be used to create channels with
+// an account client and to listen for messages on all of the account's channels.
+func (s *Service) CreateAccount(ctx context.Context) (*peer_channels.Account, error) {
+	a := &account{
+		id:    uuid.New().String(),
+		token: uuid.New().String(),
+	}
+
+	s.lock.Lock()
+	s.accounts[a.id] = a
+	s.lock.Unlock()
+
+	logger.VerboseWithFields(ctx, []logger.Field{
+		logger.String("account_id", a.id),
+	}, "Created peer channel account")
+
+	return &peer_channels.Account{
+		BaseURL:   ServiceURL,
+		AccountID: a.id,
+		Token:     a.token,
+	}, nil
+}
+
+// NewAccountClient returns a client for the account. The token is checked by each request, not
+// here, the same as with the real service.
+func (s *Service) NewAccountClient(accountID,
+	token string) (peer_channels.AccountClient, error) {
+
+	return &AccountClient{
+		service:   s,
+		accountID: accountID,
+		token:     token,
+	}, nil
+}
+
+// NewClient returns the service for its own base URL so it can be used where a factory of peer
+// channel clients is expected.
+func (s *Service) NewClient(baseURL string) (peer_channels.Client, error) {
+	if baseURL != ServiceURL {
+		return nil, errors.Wrap(ErrUnsupportedURL, baseURL)
+	}
+
+	return s, nil
+}
+
+// Disconnect stops all active calls to Listen and Notify with ErrDisconnected, the same as a lost
+// connection to the real service. It is used to test reconnecting.
+func (s *Service) Disconnect() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for l := range s.listeners {
+		delete(s.listeners, l)
+		close(l.disconnect)
+	}
+}
+
+func (s *Service) createChannel(ctx context.Context, accountID, token string,
+	public bool) (*peer_channels.FullChannel, error) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	a, err := s.authorizeAccount(accountID, token)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &channel{
+		id:        uuid.New().String(),
+		accountID: a.id,
+		readToken: uuid.New().String(),
+	}
+	if !public {
+		c.writeToken = uuid.New().String()
+	}
+
+	s.channels[c.id] = c
+	a.channelIDs = append(a.channelIDs, c.id)
+
+	logger.VerboseWithFields(ctx, []logger.Field{
+		logger.String("account_id", a.id),
+		logger.String("channel_id", c.id),
+		logger.Bool("public", public),
+	}, "Created peer channel")
+
+	return c.fullChannel(), nil
+}
+
+// authorizeAccount returns the account if the token is the account's token. The lock must be held.
+func (s *Service) authorizeAccount(accountID, token string) (*account, error) {
+	a, exists := s.accounts[accountID]
+	if !exists {
+		return nil, peer_channels.HTTPError{Status: http.StatusNotFound}
+	}
+
+	if a.token != token {
+		return nil, peer_channels.HTTPError{Status: http.StatusUnauthorized}
+	}
+
+	return a, nil
+}
+
+// authorizeRead returns the channel if the token is the channel's read token or the token of the
+// account that owns the channel. The lock must be held.
+func (s *Service) authorizeRead(channelID, token string) (*channel, error) {
+	c, exists := s.channels[channelID]
+	if !exists {
+		return nil, peer_channels.HTTPError{Status: http.StatusNotFound}
+	}
+
+	if c.readToken == token {
+		return c, nil
+	}
+
+	if a, exists := s.accounts[c.accountID]; exists && a.token == token {
+		return c, nil
+	}
+
+	return nil, peer_channels.HTTPError{Status: http.StatusUnauthorized}
+}
+
+// accountChannels returns the channels of the account with the lock held, in the order they were
+// created.
+func (s *Service) accountChannels(accountID string) []*channel {
+	a, exists := s.accounts[accountID]
+	if !exists {
+		return nil
+	}
+
+	var result []*channel
+	for _, channelID := range a.channelIDs {
+		if c, exists := s.channels[channelID]; exists {
+			result = append(result, c)
+		}
+	}
+
+	return result
+}
+
+func (c *channel) fullChannel() *peer_channels.FullChannel {
+	return &peer_channels.FullChannel{
+		ID:         c.id,
+		AccountID:  c.accountID,
+		ReadToken:  c.readToken,
+		WriteToken: c.writeToken,
+	}
+}
+
+// find returns the index of the message with the sequence or -1 if it doesn't exist.
+func (c *channel) find(sequence uint64) int {
+	for i, msg := range c.messages {
+		if msg.Sequence == sequence {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (c *channel) unread() []peer_channels.Message {
+	var result []peer_channels.Message
+	for _, msg := range c.messages {
+		if !msg.read {
+			result = append(result, msg.Message)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,303 @@
+package peer_channels_service
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tokenized/channels/peer_channels_listener"
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/pkg/errors"
+)
+
+func Test_Service(t *testing.T) {
+	ctx := context.Background()
+	service := NewService()
+
+	account, err := service.CreateAccount(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create account : %s", err)
+	}
+
+	accountClient, err := service.NewAccountClient(account.AccountID, account.Token)
+	if err != nil {
+		t.Fatalf("Failed to create account client : %s", err)
+	}
+
+	channel, err := accountClient.CreateChannel(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create channel : %s", err)
+	}
+
+	if err := service.WriteMessage(ctx, channel.ID, channel.ReadToken,
+		peer_channels.ContentTypeText, bytes.NewReader([]byte("wrong"))); !isStatus(err,
+		http.StatusUnauthorized) {
+		t.Errorf("Write with read token should be unauthorized : %v", err)
+	}
+
+	for _, text := range []string{"one", "two", "three", "four"} {
+		if err := service.WriteMessage(ctx, channel.ID, channel.WriteToken,
+			peer_channels.ContentTypeText, bytes.NewReader([]byte(text))); err != nil {
+			t.Fatalf("Failed to write message : %s", err)
+		}
+	}
+
+	if _, err := service.GetMessages(ctx, channel.ID, channel.WriteToken, true,
+		0); !isStatus(err, http.StatusUnauthorized) {
+		t.Errorf("Read with write token should be unauthorized : %v", err)
+	}
+
+	messages, err := service.GetMessages(ctx, channel.ID, channel.ReadToken, true, 3)
+	if err != nil {
+		t.Fatalf("Failed to get messages : %s", err)
+	}
+
+	if len(messages) != 3 {
+		t.Fatalf("Wrong message count : got %d, want %d", len(messages), 3)
+	}
+	for i, msg := range messages {
+		if msg.Sequence != uint64(i+1) {
+			t.Errorf("Wrong sequence : got %d, want %d", msg.Sequence, i+1)
+		}
+	}
+
+	// The account token can be used in place of the read token.
+	if err := service.MarkMessages(ctx, channel.ID, account.Token, 2, true, true); err != nil {
+		t.Fatalf("Failed to mark messages : %s", err)
+	}
+
+	if err := service.MarkMessages(ctx, channel.ID, account.Token, 10, true,
+		true); !isStatus(err, http.StatusNotFound) {
+		t.Errorf("Mark of missing message should be not found : %v", err)
+	}
+
+	messages, err = service.GetMessages(ctx, channel.ID, channel.ReadToken, true, 0)
+	if err != nil {
+		t.Fatalf("Failed to get messages : %s", err)
+	}
+
+	if len(messages) != 2 || messages[0].Sequence != 3 || messages[1].Sequence != 4 {
+		t.Fatalf("Wrong unread messages : got %d, want sequences 3 and 4", len(messages))
+	}
+
+	if err := service.DeleteMessage(ctx, channel.ID, channel.ReadToken, 3, true); err != nil {
+		t.Fatalf("Failed to delete messages : %s", err)
+	}
+
+	messages, err = service.GetMessages(ctx, channel.ID, channel.ReadToken, false, 0)
+	if err != nil {
+		t.Fatalf("Failed to get messages : %s", err)
+	}
+
+	if len(messages) != 1 || messages[0].Sequence != 4 {
+		t.Fatalf("Wrong messages : got %d, want sequence 4", len(messages))
+	}
+
+	sequence, err := service.GetMaxMessageSequence(ctx, channel.ID, channel.ReadToken)
+	if err != nil {
+		t.Fatalf("Failed to get max sequence : %s", err)
+	}
+
+	if sequence != 4 {
+		t.Errorf("Wrong max sequence : got %d, want %d", sequence, 4)
+	}
+
+	public, err := accountClient.CreatePublicChannel(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create public channel : %s", err)
+	}
+
+	if err := service.WriteMessage(ctx, public.ID, "", peer_channels.ContentTypeText,
+		bytes.NewReader([]byte("anyone"))); err != nil {
+		t.Fatalf("Failed to write to public channel : %s", err)
+	}
+
+	channels, err := accountClient.ListChannels(ctx)
+	if err != nil {
+		t.Fatalf("Failed to list channels : %s", err)
+	}
+
+	if len(channels) != 2 || channels[0].ID != channel.ID || channels[1].ID != public.ID {
+		t.Errorf("Wrong channels : got %d, want %d", len(channels), 2)
+	}
+
+	otherClient, _ := service.NewAccountClient(account.AccountID, "wrong")
+	if _, err := otherClient.ListChannels(ctx); !isStatus(err, http.StatusUnauthorized) {
+		t.Errorf("List with wrong token should be unauthorized : %v", err)
+	}
+}
+
+func Test_Listen(t *testing.T) {
+	ctx := context.Background()
+	service := NewService()
+
+	// Alice listens on her account while Bob writes to her channel.
+	alice, err := service.CreateAccount(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create account : %s", err)
+	}
+
+	aliceClient, _ := service.NewAccountClient(alice.AccountID, alice.Token)
+	channel, err := aliceClient.CreateChannel(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create channel : %s", err)
+	}
+
+	write := func(text string) {
+		if err := service.WriteMessage(ctx, channel.ID, channel.WriteToken,
+			peer_channels.ContentTypeText, bytes.NewReader([]byte(text))); err != nil {
+			t.Fatalf("Failed to write message : %s", err)
+		}
+	}
+
+	write("before")
+
+	incoming := make(chan peer_channels.Message, 10)
+	interrupt := make(chan interface{})
+	listenComplete := make(chan error, 1)
+	go func() {
+		listenComplete <- aliceClient.Listen(ctx, true, time.Second, incoming, interrupt)
+	}()
+
+	receive := func(want string) {
+		select {
+		case msg := <-incoming:
+			if string(msg.Payload) != want {
+				t.Errorf("Wrong message : got %s, want %s", msg.Payload, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s", want)
+		}
+	}
+
+	receive("before")
+	write("after")
+	receive("after")
+
+	service.Disconnect()
+	select {
+	case err := <-listenComplete:
+		if errors.Cause(err) != ErrDisconnected {
+			t.Errorf("Wrong listen error : got %v, want %s", err, ErrDisconnected)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for disconnect")
+	}
+
+	// Messages aren't marked read by listening so both are sent again.
+	go func() {
+		listenComplete <- service.Listen(ctx, channel.ReadToken, true, time.Second, incoming,
+			interrupt)
+	}()
+
+	receive("before")
+	receive("after")
+
+	close(interrupt)
+	select {
+	case err := <-listenComplete:
+		if err != nil {
+			t.Errorf("Failed to listen : %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for listen to stop")
+	}
+}
+
+func Test_PeerChannelsListener(t *testing.T) {
+	ctx := context.Background()
+	service := NewService()
+
+	account, err := service.CreateAccount(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create account : %s", err)
+	}
+
+	accountClient, _ := service.NewAccountClient(account.AccountID, account.Token)
+	channel, err := accountClient.CreateChannel(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create channel : %s", err)
+	}
+
+	var lock sync.Mutex
+	var received []string
+	handled := make(chan interface{}, 10)
+	handleMessage := func(ctx context.Context, msg peer_channels.Message) error {
+		lock.Lock()
+		received = append(received, string(msg.Payload))
+		lock.Unlock()
+
+		handled <- true
+		return nil
+	}
+
+	listener := peer_channels_listener.NewPeerChannelsListener(service, account.Token, 10, 1,
+		time.Second, handleMessage, nil)
+	listener.SetConnectedDelay(10 * time.Millisecond)
+	listener.SetReconnectPolicy(peer_channels_listener.RetryPolicy{
+		InitialDelay: 10 * time.Millisecond,
+		MaxDelay:     10 * time.Millisecond,
+		Multiplier:   1.0,
+	})
+
+	interrupt := make(chan interface{})
+	runComplete := make(chan error, 1)
+	go func() {
+		runComplete <- listener.Run(ctx, interrupt)
+	}()
+
+	write := func(text string) {
+		if err := service.WriteMessage(ctx, channel.ID, channel.WriteToken,
+			peer_channels.ContentTypeText, bytes.NewReader([]byte(text))); err != nil {
+			t.Fatalf("Failed to write message : %s", err)
+		}
+
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s", text)
+		}
+	}
+
+	write("first")
+
+	// The listener reconnects and receives messages written after the connection was lost.
+	service.Disconnect()
+	write("second")
+
+	close(interrupt)
+	select {
+	case err := <-runComplete:
+		if err != nil {
+			t.Fatalf("Failed to run listener : %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for listener to stop")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if len(received) != 2 || received[0] != "first" || received[1] != "second" {
+		t.Errorf("Wrong messages : got %v, want %v", received, []string{"first", "second"})
+	}
+
+	// Handled messages are marked read.
+	messages, err := service.GetMessages(ctx, channel.ID, channel.ReadToken, true, 0)
+	if err != nil {
+		t.Fatalf("Failed to get messages : %s", err)
+	}
+
+	if len(messages) != 0 {
+		t.Errorf("Wrong unread message count : got %d, want %d", len(messages), 0)
+	}
+}
+
+func isStatus(err error, status int) bool {
+	httpError, ok := errors.Cause(err).(peer_channels.HTTPError)
+	return ok && httpError.Status == status
+}
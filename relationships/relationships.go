@@ -1,13 +1,11 @@
 package relationships
 
 import (
-	"bytes"
 	"fmt"
 
 	"github.com/tokenized/channels"
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
 	"github.com/tokenized/pkg/bitcoin"
-	"github.com/tokenized/pkg/bsor"
 
 	"github.com/pkg/errors"
 )
@@ -56,6 +54,15 @@ var (
 	OptionSubChannels = bitcoin.Hex{0x01}
 
 	ErrUnsupportedRelationshipsMessage = errors.New("Unsupported Relationships Message")
+
+	codec = channels.NewTypedCodec(ProtocolID, Version, "relationships",
+		ErrUnsupportedRelationshipsMessage, channels.CodecMessageTypes{
+			{Type: uint64(MessageTypeInitiation), Name: "initiation", Message: &Initiation{}},
+			{Type: uint64(MessageTypeUpdate), Name: "update", Message: &Update{}},
+			{Type: uint64(MessageTypeSubInitiation), Name: "sub-initiation", Message: &SubInitiation{}},
+			{Type: uint64(MessageTypeSubUpdate), Name: "sub-update", Message: &SubUpdate{}},
+			{Type: uint64(MessageTypeSubTerminate), Name: "sub-remove", Message: &SubTerminate{}},
+		}).SetCantWrap()
 )
 
 type MessageType uint8
@@ -136,20 +143,7 @@ func (*Initiation) ProtocolID() envelope.ProtocolID {
 }
 
 func (r *Initiation) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload, bitcoin.PushNumberScriptItem(int64(MessageTypeInitiation)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(r)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(r)
 }
 
 type Update struct {
@@ -162,20 +156,7 @@ func (*Update) ProtocolID() envelope.ProtocolID {
 }
 
 func (r *Update) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload, bitcoin.PushNumberScriptItem(int64(MessageTypeUpdate)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(r)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(r)
 }
 
 type SubInitiation struct {
@@ -187,21 +168,7 @@ func (*SubInitiation) ProtocolID() envelope.ProtocolID {
 }
 
 func (r *SubInitiation) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload,
-		bitcoin.PushNumberScriptItem(int64(MessageTypeSubInitiation)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(r)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(r)
 }
 
 type SubUpdate struct {
@@ -213,21 +180,7 @@ func (*SubUpdate) ProtocolID() envelope.ProtocolID {
 }
 
 func (r *SubUpdate) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload,
-		bitcoin.PushNumberScriptItem(int64(MessageTypeSubUpdate)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(r)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(r)
 }
 
 type SubTerminate struct {
@@ -238,104 +191,20 @@ func (*SubTerminate) ProtocolID() envelope.ProtocolID {
 }
 
 func (r *SubTerminate) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// Message type
-	payload = append(payload,
-		bitcoin.PushNumberScriptItem(int64(MessageTypeSubTerminate)))
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(r)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(r)
 }
 
 func Parse(payload envelope.Data) (channels.Message, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 {
-		return nil, payload, nil
-	}
-
-	if !bytes.Equal(payload.ProtocolIDs[0], ProtocolID) {
-		return nil, payload, nil
-	}
-
-	if len(payload.ProtocolIDs) != 1 {
-		return nil, payload, errors.Wrapf(channels.ErrInvalidMessage, "relationship can't wrap")
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
-
-	if len(payload.Payload) == 0 {
-		return nil, payload, errors.Wrapf(channels.ErrInvalidMessage, "payload empty")
-	}
-
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(channels.ErrUnsupportedVersion,
-			fmt.Sprintf("relationships: %d", version))
-	}
-
-	messageType, err := bitcoin.ScriptNumberValue(payload.Payload[1])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "message type")
-	}
-
-	result := MessageForType(MessageType(messageType))
-	if result == nil {
-		return nil, payload, errors.Wrap(ErrUnsupportedRelationshipsMessage,
-			fmt.Sprintf("%d", MessageType(messageType)))
-	}
-
-	payloads, err := bsor.Unmarshal(payload.Payload[2:], result)
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "unmarshal")
-	}
-	payload.Payload = payloads
-
-	return result, payload, nil
+	return codec.Parse(payload)
 }
 
 func MessageForType(messageType MessageType) channels.Message {
-	switch messageType {
-	case MessageTypeInitiation:
-		return &Initiation{}
-	case MessageTypeUpdate:
-		return &Update{}
-	case MessageTypeSubInitiation:
-		return &SubInitiation{}
-	case MessageTypeSubUpdate:
-		return &SubUpdate{}
-	case MessageTypeSubTerminate:
-		return &SubTerminate{}
-	case MessageTypeInvalid:
-		return nil
-	default:
-		return nil
-	}
+	return codec.MessageForType(uint64(messageType))
 }
 
 func MessageTypeFor(message channels.Message) MessageType {
-	switch message.(type) {
-	case *Initiation:
-		return MessageTypeInitiation
-	case *Update:
-		return MessageTypeUpdate
-	case *SubInitiation:
-		return MessageTypeSubInitiation
-	case *SubUpdate:
-		return MessageTypeSubUpdate
-	case *SubTerminate:
-		return MessageTypeSubTerminate
-	default:
-		return MessageTypeInvalid
-	}
+	messageType, _ := codec.MessageTypeFor(message)
+	return MessageType(messageType)
 }
 
 func (v *MessageType) UnmarshalJSON(data []byte) error {
@@ -369,40 +238,18 @@ func (v *MessageType) UnmarshalText(text []byte) error {
 }
 
 func (v *MessageType) SetString(s string) error {
-	switch s {
-	case "initiation":
-		*v = MessageTypeInitiation
-	case "update":
-		*v = MessageTypeUpdate
-	case "sub-initiation":
-		*v = MessageTypeSubInitiation
-	case "sub-update":
-		*v = MessageTypeSubUpdate
-	case "sub-remove":
-		*v = MessageTypeSubTerminate
-	default:
+	messageType, ok := codec.MessageTypeForName(s)
+	if !ok {
 		*v = MessageTypeInvalid
 		return fmt.Errorf("Unknown MessageType value \"%s\"", s)
 	}
 
+	*v = MessageType(messageType)
 	return nil
 }
 
 func (v MessageType) String() string {
-	switch v {
-	case MessageTypeInitiation:
-		return "initiation"
-	case MessageTypeUpdate:
-		return "update"
-	case MessageTypeSubInitiation:
-		return "sub-initiation"
-	case MessageTypeSubUpdate:
-		return "sub-update"
-	case MessageTypeSubTerminate:
-		return "sub-remove"
-	default:
-		return ""
-	}
+	return codec.MessageTypeName(uint64(v))
 }
 
 func ResponseCodeToString(code uint32) string {
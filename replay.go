@@ -0,0 +1,288 @@
+package channels
+
+import (
+	"sync"
+	"time"
+
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ReplayProtectionVersion = uint8(0)
+
+	// DefaultMaxNonces is the default number of nonces remembered by a ReplayVerifier.
+	DefaultMaxNonces = 10000
+
+	// DefaultTimestampSkew is the default maximum difference between a message's timestamp and the
+	// local time.
+	DefaultTimestampSkew = 5 * time.Minute
+)
+
+var (
+	ProtocolIDReplayProtection = envelope.ProtocolID("RP") // Protocol ID for replay protection
+
+	replayProtectionCodec = NewCodec(ProtocolIDReplayProtection, ReplayProtectionVersion,
+		"replay protection", &ReplayProtection{})
+
+	ErrReplayProtectionMissing = errors.New("Replay Protection Missing")
+	ErrNonceReused             = errors.New("Nonce Reused")
+	ErrTimestampOutOfRange     = errors.New("Timestamp Out Of Range")
+	ErrWrongChannel            = errors.New("Wrong Channel")
+	ErrWrongPublicKey          = errors.New("Wrong Public Key")
+)
+
+type ReplayProtectionProtocol struct{}
+
+func NewReplayProtectionProtocol() *ReplayProtectionProtocol {
+	return &ReplayProtectionProtocol{}
+}
+
+func (*ReplayProtectionProtocol) ProtocolID() envelope.ProtocolID {
+	return ProtocolIDReplayProtection
+}
+
+func (*ReplayProtectionProtocol) Parse(payload envelope.Data) (Message, envelope.Data, error) {
+	return ParseReplayProtection(payload)
+}
+
+func (*ReplayProtectionProtocol) ResponseCodeToString(code uint32) string {
+	return ReplayProtectionResponseCodeToString(code)
+}
+
+// ReplayProtection binds a message to a single use on a specific channel. It must be wrapped
+// inside a signature, along with a TimeMessage, so that it can't be modified or removed.
+type ReplayProtection struct {
+	Nonce     bitcoin.Hash32 `bsor:"1" json:"nonce"`
+	ChannelID string         `bsor:"2" json:"channel_id"`
+}
+
+// NewReplayProtection creates replay protection for the channel with a random nonce.
+func NewReplayProtection(channelID string) *ReplayProtection {
+	return &ReplayProtection{
+		Nonce:     RandomHash(),
+		ChannelID: channelID,
+	}
+}
+
+func (*ReplayProtection) IsWrapperType() {}
+
+func (*ReplayProtection) ProtocolID() envelope.ProtocolID {
+	return ProtocolIDReplayProtection
+}
+
+func (m *ReplayProtection) Wrap(payload envelope.Data) (envelope.Data, error) {
+	return replayProtectionCodec.Wrap(m, payload)
+}
+
+func ParseReplayProtection(payload envelope.Data) (*ReplayProtection, envelope.Data, error) {
+	msg, payload, err := replayProtectionCodec.Parse(payload)
+	if msg == nil {
+		return nil, payload, err
+	}
+
+	return msg.(*ReplayProtection), payload, nil
+}
+
+// WrapReplayProtected wraps the payload with the current time and replay protection for the
+// channel and then signs it so they are covered by the signature.
+func WrapReplayProtected(payload envelope.Data, channelID string, signer Signer,
+	derivationHash *bitcoin.Hash32, includeKey bool) (envelope.Data, error) {
+
+	payload, err := NewTimeMessage(Now()).Wrap(payload)
+	if err != nil {
+		return payload, errors.Wrap(err, "time")
+	}
+
+	payload, err = NewReplayProtection(channelID).Wrap(payload)
+	if err != nil {
+		return payload, errors.Wrap(err, "replay protection")
+	}
+
+	payload, err = WrapSignatureWithSigner(payload, signer, derivationHash, includeKey)
+	if err != nil {
+		return payload, errors.Wrap(err, "signature")
+	}
+
+	return payload, nil
+}
+
+// ReplayVerifier rejects signed messages that have been seen before, are for a different channel,
+// or have a timestamp outside of the skew window. Nonces are remembered in a bounded cache so the
+// skew window should be short enough that old nonces are not evicted before their timestamps
+// expire.
+type ReplayVerifier struct {
+	maxNonces int
+	skew      time.Duration
+
+	nonces     map[bitcoin.Hash32]bool // false while reserved by a message being handled
+	nonceOrder []bitcoin.Hash32
+	lock       sync.Mutex
+}
+
+// NewReplayVerifier creates a verifier that remembers maxNonces nonces. DefaultMaxNonces is used
+// when maxNonces isn't positive.
+func NewReplayVerifier(maxNonces int, skew time.Duration) *ReplayVerifier {
+	if maxNonces <= 0 {
+		maxNonces = DefaultMaxNonces
+	}
+
+	return &ReplayVerifier{
+		maxNonces: maxNonces,
+		skew:      skew,
+		nonces:    make(map[bitcoin.Hash32]bool),
+	}
+}
+
+// Verify verifies that the wrappers returned from Protocols.Parse for a message received on the
+// channel are signed by the public key, which is the key expected to sign messages on the channel,
+// and contain replay protection and then remembers the nonce. The key included in the signature
+// isn't trusted since anyone could sign a captured message with a new key.
+func (v *ReplayVerifier) Verify(channelID string, publicKey bitcoin.PublicKey,
+	wrappers []Wrapper) error {
+
+	return v.verify(channelID, publicKey, wrappers, Now())
+}
+
+// Reserve verifies the same as Verify but only reserves the nonce so it is rejected for other
+// messages while this one is handled. The returned function must be called with whether the
+// message was handled. The nonce is only remembered when it was, so a message that failed can be
+// verified again when it is retried.
+func (v *ReplayVerifier) Reserve(channelID string, publicKey bitcoin.PublicKey,
+	wrappers []Wrapper) (func(handled bool), error) {
+
+	return v.reserve(channelID, publicKey, wrappers, Now())
+}
+
+func (v *ReplayVerifier) verify(channelID string, publicKey bitcoin.PublicKey, wrappers []Wrapper,
+	now Time) error {
+
+	done, err := v.reserve(channelID, publicKey, wrappers, now)
+	if err != nil {
+		return err
+	}
+
+	done(true)
+	return nil
+}
+
+func (v *ReplayVerifier) reserve(channelID string, publicKey bitcoin.PublicKey,
+	wrappers []Wrapper, now Time) (func(handled bool), error) {
+
+	var signature *Signature
+	var replayProtection *ReplayProtection
+	var timestamp *TimeMessage
+	for _, wrapper := range wrappers {
+		switch w := wrapper.(type) {
+		case *Signature:
+			if signature == nil {
+				signature = w
+			}
+		case *ReplayProtection:
+			// Only replay protection inside the signature counts.
+			if signature != nil && replayProtection == nil {
+				replayProtection = w
+			}
+		case *TimeMessage:
+			if signature != nil && timestamp == nil {
+				timestamp = w
+			}
+		}
+	}
+
+	if signature == nil {
+		return nil, errors.Wrap(ErrReplayProtectionMissing, "signature")
+	}
+	if replayProtection == nil {
+		return nil, errors.Wrap(ErrReplayProtectionMissing, "nonce")
+	}
+	if timestamp == nil {
+		return nil, errors.Wrap(ErrReplayProtectionMissing, "timestamp")
+	}
+
+	if signature.PublicKey != nil && !signature.PublicKey.Equal(publicKey) {
+		return nil, errors.Wrap(ErrWrongPublicKey, "signature")
+	}
+	signature.SetPublicKey(&publicKey)
+
+	if err := signature.Verify(); err != nil {
+		return nil, errors.Wrap(err, "signature")
+	}
+
+	if replayProtection.ChannelID != channelID {
+		return nil, errors.Wrapf(ErrWrongChannel, "got %s, want %s", replayProtection.ChannelID,
+			channelID)
+	}
+
+	skew := Time(v.skew.Nanoseconds())
+	t := timestamp.GetTime()
+	if t+skew < now || t > now+skew {
+		return nil, errors.Wrapf(ErrTimestampOutOfRange, "%s", t)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if _, exists := v.nonces[replayProtection.Nonce]; exists {
+		return nil, errors.Wrapf(ErrNonceReused, "%s", replayProtection.Nonce)
+	}
+
+	nonce := replayProtection.Nonce
+	v.nonces[nonce] = false
+
+	return func(handled bool) {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		if !handled {
+			delete(v.nonces, nonce)
+			return
+		}
+
+		v.nonces[nonce] = true
+		v.nonceOrder = append(v.nonceOrder, nonce)
+		for len(v.nonceOrder) > v.maxNonces {
+			delete(v.nonces, v.nonceOrder[0])
+			v.nonceOrder = v.nonceOrder[1:]
+		}
+	}, nil
+}
+
+// ReplayResponse returns a response that explains why the message was rejected for an error
+// returned from ReplayVerifier.Verify. It returns nil if the error is not related to signatures
+// or replay protection.
+func ReplayResponse(err error) *Response {
+	var code uint32
+	switch errors.Cause(err) {
+	case ErrReplayProtectionMissing:
+		code = SignedStatusReplayProtectionRequired
+	case ErrNonceReused:
+		code = SignedStatusNonceReused
+	case ErrTimestampOutOfRange:
+		code = SignedStatusTimestampOutOfRange
+	case ErrWrongChannel:
+		code = SignedStatusWrongChannel
+	case ErrInvalidSignature:
+		code = SignedStatusInvalidSignature
+	case ErrPublicKeyMissing, ErrWrongPublicKey:
+		code = SignedStatusWrongPublicKey
+	default:
+		return nil
+	}
+
+	return &Response{
+		Status:         StatusReject,
+		CodeProtocolID: ProtocolIDSignedMessages,
+		Code:           code,
+		Note:           err.Error(),
+	}
+}
+
+func ReplayProtectionResponseCodeToString(code uint32) string {
+	switch code {
+	default:
+		return "parse_error"
+	}
+}
@@ -0,0 +1,171 @@
+package channels
+
+import (
+	"testing"
+	"time"
+
+	envelopeV1 "github.com/tokenized/envelope/pkg/golang/envelope/v1"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+func Test_ReplayProtection(t *testing.T) {
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	channelID := uuid.New().String()
+
+	id := UUID(uuid.New())
+	payload, err := id.Write()
+	if err != nil {
+		t.Fatalf("Failed to write message : %s", err)
+	}
+
+	signedPayload, err := WrapReplayProtected(payload, channelID, NewKeySigner(key), nil, true)
+	if err != nil {
+		t.Fatalf("Failed to wrap replay protection : %s", err)
+	}
+
+	script, err := envelopeV1.Wrap(signedPayload).Script()
+	if err != nil {
+		t.Fatalf("Failed to create script : %s", err)
+	}
+	t.Logf("Script : %s", script)
+
+	protocols := NewProtocols(NewSignedProtocol(), NewReplayProtectionProtocol(),
+		NewTimeProtocol(), NewUUIDProtocol())
+	msg, wrappers, err := protocols.Parse(script)
+	if err != nil {
+		t.Fatalf("Failed to parse : %s", err)
+	}
+
+	if _, ok := msg.(*UUID); !ok {
+		t.Fatalf("Message should be a UUID : %T", msg)
+	}
+
+	if len(wrappers) != 3 {
+		t.Fatalf("Wrong wrapper count : got %d, want %d", len(wrappers), 3)
+	}
+
+	verifier := NewReplayVerifier(2, time.Minute)
+
+	if err := verifier.Verify(uuid.New().String(), key.PublicKey(),
+		wrappers); errors.Cause(err) != ErrWrongChannel {
+		t.Fatalf("Wrong verify error for other channel : got %v, want %s", err, ErrWrongChannel)
+	}
+
+	if err := verifier.verify(channelID, key.PublicKey(), wrappers,
+		Now()+Time(2*time.Minute)); errors.Cause(err) != ErrTimestampOutOfRange {
+		t.Fatalf("Wrong verify error for late message : got %v, want %s", err,
+			ErrTimestampOutOfRange)
+	}
+
+	// The captured payload signed again by a different key is rejected and doesn't use the nonce.
+	otherKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	for _, includeKey := range []bool{true, false} {
+		resigned, err := Wrap(msg.(*UUID), wrappers[2], wrappers[1],
+			NewSignature(otherKey, nil, includeKey))
+		if err != nil {
+			t.Fatalf("Failed to wrap re-signed message : %s", err)
+		}
+
+		_, resignedWrappers, err := protocols.Parse(resigned)
+		if err != nil {
+			t.Fatalf("Failed to parse re-signed message : %s", err)
+		}
+
+		want := ErrWrongPublicKey
+		if !includeKey {
+			want = ErrInvalidSignature
+		}
+		if err := verifier.Verify(channelID, key.PublicKey(),
+			resignedWrappers); errors.Cause(err) != want {
+			t.Fatalf("Wrong verify error for re-signed : got %v, want %s", err, want)
+		}
+	}
+
+	if err := verifier.Verify(channelID, key.PublicKey(), wrappers); err != nil {
+		t.Fatalf("Failed to verify : %s", err)
+	}
+
+	err = verifier.Verify(channelID, key.PublicKey(), wrappers)
+	if errors.Cause(err) != ErrNonceReused {
+		t.Fatalf("Wrong verify error for replay : got %v, want %s", err, ErrNonceReused)
+	}
+
+	response := ReplayResponse(err)
+	if response == nil {
+		t.Fatalf("Missing response")
+	}
+
+	if response.Code != SignedStatusNonceReused {
+		t.Errorf("Wrong response code : got %d, want %d", response.Code, SignedStatusNonceReused)
+	}
+
+	// Unsigned replay protection doesn't count.
+	unsignedWrappers := []Wrapper{NewReplayProtection(channelID), NewTimeMessage(Now())}
+	if err := verifier.Verify(channelID, key.PublicKey(),
+		unsignedWrappers); errors.Cause(err) != ErrReplayProtectionMissing {
+		t.Fatalf("Wrong verify error for unsigned : got %v, want %s", err,
+			ErrReplayProtectionMissing)
+	}
+}
+
+func Test_ReplayVerifier_Reserve(t *testing.T) {
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	channelID := uuid.New().String()
+
+	id := UUID(uuid.New())
+	payload, err := id.Write()
+	if err != nil {
+		t.Fatalf("Failed to write message : %s", err)
+	}
+
+	signedPayload, err := WrapReplayProtected(payload, channelID, NewKeySigner(key), nil, true)
+	if err != nil {
+		t.Fatalf("Failed to wrap replay protection : %s", err)
+	}
+
+	script, err := envelopeV1.Wrap(signedPayload).Script()
+	if err != nil {
+		t.Fatalf("Failed to create script : %s", err)
+	}
+
+	protocols := NewProtocols(NewSignedProtocol(), NewReplayProtectionProtocol(),
+		NewTimeProtocol(), NewUUIDProtocol())
+	_, wrappers, err := protocols.Parse(script)
+	if err != nil {
+		t.Fatalf("Failed to parse : %s", err)
+	}
+
+	// A max nonces that isn't positive would remember nothing.
+	verifier := NewReplayVerifier(0, time.Minute)
+	if verifier.maxNonces != DefaultMaxNonces {
+		t.Errorf("Wrong max nonces : got %d, want %d", verifier.maxNonces, DefaultMaxNonces)
+	}
+
+	done, err := verifier.Reserve(channelID, key.PublicKey(), wrappers)
+	if err != nil {
+		t.Fatalf("Failed to reserve : %s", err)
+	}
+
+	// The nonce is rejected while the message is being handled.
+	if _, err := verifier.Reserve(channelID, key.PublicKey(),
+		wrappers); errors.Cause(err) != ErrNonceReused {
+		t.Fatalf("Wrong reserve error while reserved : got %v, want %s", err, ErrNonceReused)
+	}
+
+	// A message that failed can be verified again when it is retried.
+	done(false)
+
+	done, err = verifier.Reserve(channelID, key.PublicKey(), wrappers)
+	if err != nil {
+		t.Fatalf("Failed to reserve retry : %s", err)
+	}
+	done(true)
+
+	if err := verifier.Verify(channelID, key.PublicKey(),
+		wrappers); errors.Cause(err) != ErrNonceReused {
+		t.Fatalf("Wrong verify error for replay : got %v, want %s", err, ErrNonceReused)
+	}
+}
@@ -1,15 +1,10 @@
 package channels
 
 import (
-	"bytes"
 	"fmt"
 
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
-	"github.com/tokenized/pkg/bitcoin"
-	"github.com/tokenized/pkg/bsor"
 	"github.com/tokenized/pkg/peer_channels"
-
-	"github.com/pkg/errors"
 )
 
 const (
@@ -18,6 +13,8 @@ const (
 
 var (
 	ProtocolIDReplyTo = envelope.ProtocolID("RT") // Protocol ID for channel reply messages
+
+	replyToCodec = NewCodec(ProtocolIDReplyTo, ReplyToVersion, "reply", &ReplyTo{})
 )
 
 type ReplyToProtocol struct{}
@@ -63,34 +60,11 @@ func (*ReplyTo) ProtocolID() envelope.ProtocolID {
 }
 
 func (r *ReplyTo) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(ReplyToVersion))}
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(r)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolIDReplyTo}, payload}, nil
+	return replyToCodec.Write(r)
 }
 
 func (r *ReplyTo) Wrap(payload envelope.Data) (envelope.Data, error) {
-	// Version
-	scriptItems := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(ReplyToVersion))}
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(r)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	scriptItems = append(scriptItems, msgScriptItems...)
-
-	payload.ProtocolIDs = append(envelope.ProtocolIDs{ProtocolIDReplyTo}, payload.ProtocolIDs...)
-	payload.Payload = append(scriptItems, payload.Payload...)
-
-	return payload, nil
+	return replyToCodec.Wrap(r, payload)
 }
 
 func (r ReplyTo) Copy() ReplyTo {
@@ -116,33 +90,12 @@ func CopyString(s string) string {
 }
 
 func ParseReplyTo(payload envelope.Data) (*ReplyTo, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 || !bytes.Equal(payload.ProtocolIDs[0], ProtocolIDReplyTo) {
-		return nil, payload, nil
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
-
-	if len(payload.Payload) < 2 {
-		return nil, payload, errors.Wrapf(ErrInvalidMessage, "not enough reply push ops: %d",
-			len(payload.Payload))
-	}
-
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(ErrUnsupportedVersion,
-			fmt.Sprintf("reply: %d", version))
-	}
-
-	result := &ReplyTo{}
-	payloads, err := bsor.Unmarshal(payload.Payload[1:], result)
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "unmarshal")
+	msg, payload, err := replyToCodec.Parse(payload)
+	if msg == nil {
+		return nil, payload, err
 	}
-	payload.Payload = payloads
 
-	return result, payload, nil
+	return msg.(*ReplyTo), payload, nil
 }
 
 func ReplyToResponseCodeToString(code uint32) string {
@@ -1,14 +1,9 @@
 package channels
 
 import (
-	"bytes"
 	"fmt"
 
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
-	"github.com/tokenized/pkg/bitcoin"
-	"github.com/tokenized/pkg/bsor"
-
-	"github.com/pkg/errors"
 )
 
 const (
@@ -50,10 +45,16 @@ const (
 
 	ResponseStatusMessageNotFound = uint32(1)
 	ResponseStatusWrongMessage    = uint32(2)
+
+	// ResponseStatusRateLimited is placed in a Reject message to signify that too many messages
+	// were received on the channel and the message was not processed.
+	ResponseStatusRateLimited = uint32(3)
 )
 
 var (
 	ProtocolIDResponse = envelope.ProtocolID("RE") // Protocol ID for channel response messages
+
+	responseCodec = NewCodec(ProtocolIDResponse, ResponseVersion, "response", &Response{})
 )
 
 type Status uint32
@@ -113,64 +114,20 @@ func (r Response) Copy() Response {
 }
 
 func (r *Response) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(ResponseVersion))}
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(r)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	payload = append(payload, msgScriptItems...)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolIDResponse}, payload}, nil
+	return responseCodec.Write(r)
 }
 
 func (r *Response) Wrap(payload envelope.Data) (envelope.Data, error) {
-	// Version
-	scriptItems := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(ResponseVersion))}
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(r)
-	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
-	}
-	scriptItems = append(scriptItems, msgScriptItems...)
-
-	payload.ProtocolIDs = append(envelope.ProtocolIDs{ProtocolIDResponse}, payload.ProtocolIDs...)
-	payload.Payload = append(scriptItems, payload.Payload...)
-
-	return payload, nil
+	return responseCodec.Wrap(r, payload)
 }
 
 func ParseResponse(payload envelope.Data) (*Response, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 || !bytes.Equal(payload.ProtocolIDs[0], ProtocolIDResponse) {
-		return nil, payload, nil
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
-
-	if len(payload.Payload) < 2 {
-		return nil, payload, errors.Wrapf(ErrInvalidMessage, "not enough response push ops: %d",
-			len(payload.Payload))
-	}
-
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(ErrUnsupportedVersion,
-			fmt.Sprintf("response: %d", version))
-	}
-
-	result := &Response{}
-	remainingPayload, err := bsor.Unmarshal(payload.Payload[1:], result)
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "unmarshal")
+	msg, payload, err := responseCodec.Parse(payload)
+	if msg == nil {
+		return nil, payload, err
 	}
-	payload.Payload = remainingPayload
 
-	return result, payload, nil
+	return msg.(*Response), payload, nil
 }
 
 func ResponseStatusToString(code uint32) string {
@@ -179,6 +136,8 @@ func ResponseStatusToString(code uint32) string {
 		return "message_not_found"
 	case ResponseStatusWrongMessage:
 		return "wrong_message"
+	case ResponseStatusRateLimited:
+		return "rate_limited"
 	default:
 		return "parse_error"
 	}
@@ -0,0 +1,148 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/channels/peer_channels_listener"
+	"github.com/tokenized/channels/uuid_response_handler"
+	"github.com/tokenized/logger"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultTimeout is how long Call waits for a response.
+	DefaultTimeout = 30 * time.Second
+)
+
+// Client sends requests to the other party of a relationship and waits for their responses.
+type Client struct {
+	clients     ClientFactory
+	handler     *uuid_response_handler.Handler
+	protocols   *channels.Protocols
+	retryPolicy peer_channels_listener.RetryPolicy
+	timeout     time.Duration
+}
+
+// NewClient returns a client that posts requests with peer channel clients from the factory and
+// receives responses through the handler, which must be handling the messages of the listener
+// for the relationships' reply to channels with the default UUID key extractor. The protocols are
+// used to parse responses and must include the signed, UUID, and response protocols.
+func NewClient(clients ClientFactory, handler *uuid_response_handler.Handler,
+	protocols *channels.Protocols) *Client {
+
+	return &Client{
+		clients:     clients,
+		handler:     handler,
+		protocols:   protocols,
+		retryPolicy: peer_channels_listener.DefaultRetryPolicy(),
+		timeout:     DefaultTimeout,
+	}
+}
+
+// SetRetryPolicy sets how many times a request is posted when posting fails with a transient error.
+func (c *Client) SetRetryPolicy(policy peer_channels_listener.RetryPolicy) {
+	c.retryPolicy = policy
+}
+
+// SetTimeout sets how long Call waits for a response. Zero means it only waits until the context
+// is done.
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// Call wraps the request with a UUID, a reply to containing the relationship's reply to channel,
+// and a signature, posts it to the relationship's peer channel, and waits for the response with
+// the same UUID. The response must be signed by the relationship's public key. Messages with the
+// same UUID that can't be parsed or aren't signed by that key are ignored and Call keeps waiting.
+// If the response contains a channels.Response with a status other than OK then a ResponseError
+// is returned. Transient failures posting the request are retried.
+func (c *Client) Call(ctx context.Context, relationship *Relationship,
+	request channels.Writer) (channels.Message, []channels.Wrapper, error) {
+
+	id := uuid.New()
+	ctx = logger.ContextWithLogFields(ctx, logger.Stringer("request_id", id))
+
+	uuidWrapper := channels.UUID(id)
+	replyTo := &channels.ReplyTo{
+		PeerChannel: &relationship.ReplyTo,
+	}
+	signature := channels.NewSignatureWithSigner(relationship.Signer, channels.RandomHashPtr(),
+		true)
+
+	script, err := channels.Wrap(request, &uuidWrapper, replyTo, signature)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "wrap")
+	}
+
+	// Subscribe before posting so a fast response isn't missed. A subscription is used instead of
+	// a single response so a message that isn't from the other party can't take its place.
+	responses, cancel, err := c.handler.Subscribe(ctx, relationship.ReplyTo.ChannelID,
+		uuid_response_handler.UUIDKey(id), c.timeout, nil)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "subscribe")
+	}
+	defer cancel()
+
+	if err := post(ctx, c.clients, relationship.PeerChannel, script,
+		c.retryPolicy); err != nil {
+		return nil, nil, errors.Wrap(err, "post")
+	}
+
+	waitCtx := ctx
+	if c.timeout != 0 {
+		var waitCancel context.CancelFunc
+		waitCtx, waitCancel = context.WithTimeout(ctx, c.timeout)
+		defer waitCancel()
+	}
+
+	for {
+		response, err := uuid_response_handler.WaitWithContext(waitCtx, responses)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "response")
+		}
+
+		msg, wrappers, err := c.parseResponse(response, relationship.PublicKey)
+		if err != nil {
+			logger.WarnWithFields(ctx, []logger.Field{
+				logger.String("channel_id", response.ChannelID),
+				logger.Uint64("sequence", response.Sequence),
+			}, "Ignoring invalid response : %s", err)
+			continue
+		}
+
+		if r := findResponse(msg, wrappers); r != nil && r.Status != channels.StatusOK {
+			responseErr := ResponseError{
+				Response: *r,
+			}
+			if len(r.CodeProtocolID) > 0 {
+				responseErr.CodeString = c.protocols.ResponseCodeToString(r.CodeProtocolID,
+					r.Code)
+			}
+			return nil, nil, responseErr
+		}
+
+		return msg, wrappers, nil
+	}
+}
+
+// parseResponse parses the response and verifies that it is signed by the public key.
+func (c *Client) parseResponse(response *peer_channels.Message,
+	publicKey bitcoin.PublicKey) (channels.Message, []channels.Wrapper, error) {
+
+	msg, wrappers, err := c.protocols.Parse(bitcoin.Script(response.Payload))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parse")
+	}
+
+	if err := verifySignature(wrappers, publicKey); err != nil {
+		return nil, nil, errors.Wrap(err, "signature")
+	}
+
+	return msg, wrappers, nil
+}
@@ -0,0 +1,375 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/channels/invoices"
+	"github.com/tokenized/channels/peer_channels_listener"
+	"github.com/tokenized/channels/peer_channels_service"
+	"github.com/tokenized/channels/uuid_response_handler"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/pkg/errors"
+)
+
+// testParty is one side of a relationship. It has an account on the service and a channel that
+// the other party writes to.
+type testParty struct {
+	key     bitcoin.Key
+	account *peer_channels.Account
+	channel *peer_channels.FullChannel
+}
+
+func newTestParty(t *testing.T, ctx context.Context,
+	service *peer_channels_service.Service) *testParty {
+
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+
+	account, err := service.CreateAccount(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create account : %s", err)
+	}
+
+	accountClient, _ := service.NewAccountClient(account.AccountID, account.Token)
+	channel, err := accountClient.CreateChannel(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create channel : %s", err)
+	}
+
+	return &testParty{
+		key:     key,
+		account: account,
+		channel: channel,
+	}
+}
+
+// relationship returns the relationship with the other party from this party's view.
+func (p *testParty) relationship(other *testParty) *Relationship {
+	return &Relationship{
+		Signer:    channels.NewKeySigner(p.key),
+		PublicKey: other.key.PublicKey(),
+		PeerChannel: peer_channels.Channel{
+			BaseURL:   peer_channels_service.ServiceURL,
+			ChannelID: other.channel.ID,
+			Token:     other.channel.WriteToken,
+		},
+		ReplyTo: peer_channels.Channel{
+			BaseURL:   peer_channels_service.ServiceURL,
+			ChannelID: p.channel.ID,
+			Token:     p.channel.WriteToken,
+		},
+	}
+}
+
+func testProtocols() *channels.Protocols {
+	return channels.NewProtocols(channels.NewSignedProtocol(), channels.NewUUIDProtocol(),
+		channels.NewReplyToProtocol(), channels.NewResponseProtocol(), invoices.NewProtocol())
+}
+
+// startClient runs a listener for the party's account and returns a client that receives
+// responses through it.
+func startClient(t *testing.T, ctx context.Context, service *peer_channels_service.Service,
+	party *testParty) (*Client, func()) {
+
+	handler := uuid_response_handler.NewHandler()
+	listener := peer_channels_listener.NewPeerChannelsListener(service, party.account.Token, 100,
+		1, time.Second, handler.HandleMessage, handler.HandleUpdate)
+	handler.SetAddUpdate(listener.AddUpdate)
+
+	interrupt := make(chan interface{})
+	var wait sync.WaitGroup
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		if err := listener.Run(ctx, interrupt); err != nil {
+			t.Errorf("Failed to run listener : %s", err)
+		}
+	}()
+
+	client := NewClient(service, handler, testProtocols())
+	client.SetTimeout(5 * time.Second)
+
+	return client, func() {
+		close(interrupt)
+		wait.Wait()
+	}
+}
+
+// respondFunction returns the response message and wrappers for a request.
+type respondFunction func(request channels.Message) (channels.Writer, []channels.Wrapper)
+
+// startTestServer responds to each request posted to the party's channel once for each key, in
+// order, with a response signed by that key.
+func startTestServer(t *testing.T, ctx context.Context, service *peer_channels_service.Service,
+	party *testParty, keys []bitcoin.Key, respond respondFunction) func() {
+
+	incoming := make(chan peer_channels.Message, 10)
+	interrupt := make(chan interface{})
+	var wait sync.WaitGroup
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		service.Listen(ctx, party.channel.ReadToken, true, time.Second, incoming, interrupt)
+	}()
+
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for {
+			select {
+			case msg := <-incoming:
+				request, wrappers, err := testProtocols().Parse(bitcoin.Script(msg.Payload))
+				if err != nil {
+					t.Errorf("Failed to parse request : %s", err)
+					continue
+				}
+
+				var id *channels.UUID
+				var replyTo *channels.ReplyTo
+				for _, wrapper := range wrappers {
+					switch w := wrapper.(type) {
+					case *channels.UUID:
+						id = w
+					case *channels.ReplyTo:
+						replyTo = w
+					}
+				}
+
+				for _, key := range keys {
+					response, responseWrappers := respond(request)
+					responseWrappers = append(responseWrappers, id,
+						channels.NewSignature(key, channels.RandomHashPtr(), false))
+					script, err := channels.Wrap(response, responseWrappers...)
+					if err != nil {
+						t.Errorf("Failed to wrap response : %s", err)
+						continue
+					}
+
+					if err := post(ctx, service, *replyTo.PeerChannel, script,
+						peer_channels_listener.DefaultRetryPolicy()); err != nil {
+						t.Errorf("Failed to post response : %s", err)
+					}
+				}
+
+			case <-interrupt:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(interrupt)
+		wait.Wait()
+	}
+}
+
+func Test_Call(t *testing.T) {
+	ctx := context.Background()
+	service := peer_channels_service.NewService()
+
+	alice := newTestParty(t, ctx, service)
+	bob := newTestParty(t, ctx, service)
+
+	client, stopClient := startClient(t, ctx, service, alice)
+	defer stopClient()
+
+	stopServer := startTestServer(t, ctx, service, bob, []bitcoin.Key{bob.key},
+		func(request channels.Message) (channels.Writer, []channels.Wrapper) {
+			if _, ok := request.(*invoices.RequestMenu); ok {
+				return &invoices.Menu{}, nil
+			}
+
+			return nil, []channels.Wrapper{&channels.Response{
+				Status:         channels.StatusReject,
+				CodeProtocolID: invoices.ProtocolID,
+				Code:           invoices.StatusUnknownItem,
+			}}
+		})
+	defer stopServer()
+
+	relationship := alice.relationship(bob)
+
+	msg, _, err := client.Call(ctx, relationship, &invoices.RequestMenu{})
+	if err != nil {
+		t.Fatalf("Failed to call : %s", err)
+	}
+
+	if _, ok := msg.(*invoices.Menu); !ok {
+		t.Errorf("Wrong response message type : got %T, want %T", msg, &invoices.Menu{})
+	}
+
+	_, _, err = client.Call(ctx, relationship, &invoices.PurchaseOrder{})
+	responseErr, ok := errors.Cause(err).(ResponseError)
+	if !ok {
+		t.Fatalf("Wrong error : got %v, want %T", err, ResponseError{})
+	}
+
+	if responseErr.Status() != channels.StatusReject {
+		t.Errorf("Wrong status : got %s, want %s", responseErr.Status(), channels.StatusReject)
+	}
+
+	if responseErr.Response.Code != invoices.StatusUnknownItem {
+		t.Errorf("Wrong code : got %d, want %d", responseErr.Response.Code,
+			invoices.StatusUnknownItem)
+	}
+}
+
+func Test_Call_WrongKey(t *testing.T) {
+	ctx := context.Background()
+	service := peer_channels_service.NewService()
+
+	alice := newTestParty(t, ctx, service)
+	bob := newTestParty(t, ctx, service)
+
+	client, stopClient := startClient(t, ctx, service, alice)
+	defer stopClient()
+
+	// A response signed with a key that isn't in the relationship is posted before Bob's
+	// response and is ignored.
+	otherKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	stopServer := startTestServer(t, ctx, service, bob, []bitcoin.Key{otherKey, bob.key},
+		func(request channels.Message) (channels.Writer, []channels.Wrapper) {
+			return &invoices.Menu{}, nil
+		})
+
+	if _, _, err := client.Call(ctx, alice.relationship(bob), &invoices.RequestMenu{}); err != nil {
+		t.Fatalf("Failed to call : %s", err)
+	}
+	stopServer()
+
+	// Only responses signed with the wrong key are posted so the call times out.
+	stopServer = startTestServer(t, ctx, service, bob, []bitcoin.Key{otherKey},
+		func(request channels.Message) (channels.Writer, []channels.Wrapper) {
+			return &invoices.Menu{}, nil
+		})
+	defer stopServer()
+
+	client.SetTimeout(200 * time.Millisecond)
+	_, _, err := client.Call(ctx, alice.relationship(bob), &invoices.RequestMenu{})
+	if errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("Wrong error : got %v, want %s", err, context.DeadlineExceeded)
+	}
+}
+
+// flakyClients fails the first writes with a service unavailable status.
+type flakyClients struct {
+	*peer_channels_service.Service
+	failures int
+	lock     sync.Mutex
+}
+
+func (c *flakyClients) NewClient(baseURL string) (peer_channels.Client, error) {
+	return c, nil
+}
+
+func (c *flakyClients) WriteMessage(ctx context.Context, channelID, token string,
+	contentType string, payload io.Reader) error {
+
+	c.lock.Lock()
+	if c.failures > 0 {
+		c.failures--
+		c.lock.Unlock()
+		return peer_channels.HTTPError{Status: http.StatusServiceUnavailable}
+	}
+	c.lock.Unlock()
+
+	return c.Service.WriteMessage(ctx, channelID, token, contentType, payload)
+}
+
+func Test_Call_Retry(t *testing.T) {
+	ctx := context.Background()
+	service := peer_channels_service.NewService()
+
+	alice := newTestParty(t, ctx, service)
+	bob := newTestParty(t, ctx, service)
+
+	client, stopClient := startClient(t, ctx, service, alice)
+	defer stopClient()
+
+	client.clients = &flakyClients{Service: service, failures: 2}
+	client.SetRetryPolicy(peer_channels_listener.RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: time.Millisecond,
+	})
+
+	stopServer := startTestServer(t, ctx, service, bob, []bitcoin.Key{bob.key},
+		func(request channels.Message) (channels.Writer, []channels.Wrapper) {
+			return &invoices.Menu{}, nil
+		})
+	defer stopServer()
+
+	if _, _, err := client.Call(ctx, alice.relationship(bob), &invoices.RequestMenu{}); err != nil {
+		t.Fatalf("Failed to call : %s", err)
+	}
+}
+
+func Test_IsTransient(t *testing.T) {
+	networkErr := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{
+			name:      "service unavailable",
+			err:       peer_channels.HTTPError{Status: http.StatusServiceUnavailable},
+			transient: true,
+		},
+		{
+			name: "wrapped internal server error",
+			err: errors.Wrap(peer_channels.HTTPError{Status: http.StatusInternalServerError},
+				"write"),
+			transient: true,
+		},
+		{
+			name:      "too many requests",
+			err:       peer_channels.HTTPError{Status: http.StatusTooManyRequests},
+			transient: true,
+		},
+		{
+			name:      "unauthorized",
+			err:       peer_channels.HTTPError{Status: http.StatusUnauthorized},
+			transient: false,
+		},
+		{
+			name:      "network",
+			err:       errors.Wrap(&url.Error{Op: "Post", URL: "url", Err: networkErr}, "http post"),
+			transient: true,
+		},
+		{
+			name:      "canceled",
+			err:       errors.Wrap(context.Canceled, "write"),
+			transient: false,
+		},
+		{
+			name: "deadline exceeded",
+			err: errors.Wrap(&url.Error{Op: "Post", URL: "url", Err: context.DeadlineExceeded},
+				"http post"),
+			transient: false,
+		},
+		{
+			name:      "local",
+			err:       errors.Wrap(errors.New("Test Failure"), "marshal"),
+			transient: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if transient := IsTransient(tt.err); transient != tt.transient {
+				t.Errorf("Wrong transient : got %t, want %t", transient, tt.transient)
+			}
+		})
+	}
+}
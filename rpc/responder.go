@@ -0,0 +1,216 @@
+package rpc
+
+import (
+	"context"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/channels/peer_channels_listener"
+	"github.com/tokenized/logger"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/pkg/errors"
+)
+
+// HandleRequest handles a request and returns the reply message, along with any wrappers to add
+// to it, or an error. A nil reply is acknowledged with a response with an OK status.
+type HandleRequest func(ctx context.Context,
+	request *peer_channels_listener.RoutedMessage) (channels.Writer, []channels.Wrapper, error)
+
+// RelationshipLookup returns the relationship with the party that sent a message, usually based
+// on the peer channel it was received on. It returns nil if there is no relationship.
+type RelationshipLookup func(ctx context.Context,
+	msg *peer_channels_listener.RoutedMessage) (*Relationship, error)
+
+// MapError returns the response to send for an error returned by a request handler. It returns
+// nil if no response should be sent and the error should be returned to the listener so the
+// request is retried.
+type MapError func(err error) *channels.Response
+
+// Responder sends the replies of request handlers to the parties that sent the requests. Replies
+// contain the correlation IDs of the request, are signed with the relationship's signer, and are
+// posted to the peer channel in the request's reply to, or to the relationship's peer channel if
+// the request doesn't have one signed by the relationship's public key.
+type Responder struct {
+	clients     ClientFactory
+	lookup      RelationshipLookup
+	mapError    MapError
+	retryPolicy peer_channels_listener.RetryPolicy
+}
+
+// NewResponder returns a responder that posts replies with peer channel clients from the factory
+// and finds the relationship of each request with lookup.
+func NewResponder(clients ClientFactory, lookup RelationshipLookup) *Responder {
+	return &Responder{
+		clients:     clients,
+		lookup:      lookup,
+		mapError:    DefaultMapError,
+		retryPolicy: peer_channels_listener.DefaultRetryPolicy(),
+	}
+}
+
+// SetMapError sets how errors returned by request handlers are converted to responses.
+func (r *Responder) SetMapError(mapError MapError) {
+	r.mapError = mapError
+}
+
+// SetRetryPolicy sets how many times a reply is posted when posting fails with a transient error.
+func (r *Responder) SetRetryPolicy(policy peer_channels_listener.RetryPolicy) {
+	r.retryPolicy = policy
+}
+
+// DefaultMapError responds with the channels.Response, or the response of the ResponseError, that
+// is the cause of the error. Other errors are not responded to.
+func DefaultMapError(err error) *channels.Response {
+	switch cause := errors.Cause(err).(type) {
+	case *channels.Response:
+		response := cause.Copy()
+		return &response
+	case channels.Response:
+		response := cause.Copy()
+		return &response
+	case ResponseError:
+		response := cause.Response.Copy()
+		return &response
+	}
+
+	return nil
+}
+
+// Handler returns a function that can be registered with a peer_channels_listener.Router. It
+// calls handle and sends the reply. When handle returns an error that maps to a response, the
+// response is sent and the request is not relevant, like a rejection by middleware.
+func (r *Responder) Handler(handle HandleRequest) peer_channels_listener.HandleRoutedMessage {
+	return func(ctx context.Context, msg *peer_channels_listener.RoutedMessage) error {
+		reply, wrappers, err := handle(ctx, msg)
+		if err != nil {
+			response := r.mapError(err)
+			if response == nil {
+				return errors.Wrap(err, "handle request")
+			}
+
+			return peer_channels_listener.Reject(ctx, r.Reply, msg, response)
+		}
+
+		if reply == nil {
+			reply = &channels.Response{
+				Status: channels.StatusOK,
+			}
+		}
+
+		if err := r.Respond(ctx, msg, reply, wrappers...); err != nil {
+			return errors.Wrap(err, "respond")
+		}
+
+		return nil
+	}
+}
+
+// Reply sends the response to the sender of the message. It implements
+// peer_channels_listener.Reply so it can be used by the router and middleware.
+func (r *Responder) Reply(ctx context.Context, msg *peer_channels_listener.RoutedMessage,
+	response *channels.Response) error {
+
+	return r.Respond(ctx, msg, response)
+}
+
+// Respond wraps the reply with the wrappers, the correlation IDs of the request, and a signature,
+// and posts it to the sender of the request. It returns MessageNotRelevent, wrapped, if there is
+// no relationship with the sender.
+func (r *Responder) Respond(ctx context.Context, msg *peer_channels_listener.RoutedMessage,
+	reply channels.Writer, wrappers ...channels.Wrapper) error {
+
+	relationship, err := r.lookup(ctx, msg)
+	if err != nil {
+		return errors.Wrap(err, "relationship")
+	}
+
+	if relationship == nil {
+		return errors.Wrap(peer_channels_listener.MessageNotRelevent, "unknown relationship")
+	}
+
+	wrappers = append(wrappers, correlationIDs(msg.Wrappers)...)
+	wrappers = append(wrappers, channels.NewSignatureWithSigner(relationship.Signer,
+		channels.RandomHashPtr(), true))
+
+	script, err := channels.Wrap(reply, wrappers...)
+	if err != nil {
+		return errors.Wrap(err, "wrap")
+	}
+
+	channel := replyChannel(msg.Wrappers, relationship)
+	if err := post(ctx, r.clients, channel, script, r.retryPolicy); err != nil {
+		return errors.Wrap(err, "post")
+	}
+
+	logger.VerboseWithFields(ctx, []logger.Field{
+		logger.String("channel_id", msg.PeerChannelMessage.ChannelID),
+		logger.Uint64("sequence", msg.PeerChannelMessage.Sequence),
+		logger.String("reply_channel_id", channel.ChannelID),
+	}, "Sent reply")
+
+	return nil
+}
+
+// PublicKeyLookup returns a lookup for SignatureMiddleware that requires requests to be signed by
+// the public key of the sender's relationship.
+func (r *Responder) PublicKeyLookup() peer_channels_listener.PublicKeyLookup {
+	return func(ctx context.Context,
+		msg *peer_channels_listener.RoutedMessage) (*bitcoin.PublicKey, error) {
+
+		relationship, err := r.lookup(ctx, msg)
+		if err != nil {
+			return nil, errors.Wrap(err, "relationship")
+		}
+
+		if relationship == nil {
+			return nil, nil
+		}
+
+		publicKey := relationship.PublicKey
+		return &publicKey, nil
+	}
+}
+
+// correlationIDs returns copies of the wrappers of the request that identify it so they can be
+// included in the reply. They are the wrappers that the uuid_response_handler key extractors use.
+func correlationIDs(wrappers []channels.Wrapper) []channels.Wrapper {
+	var result []channels.Wrapper
+	for _, wrapper := range wrappers {
+		switch w := wrapper.(type) {
+		case *channels.UUID:
+			id := *w
+			result = append(result, &id)
+		case *channels.StringID:
+			result = append(result, channels.NewStringID(w.StringID))
+		case *channels.MessageID:
+			result = append(result, &channels.MessageID{MessageID: w.MessageID})
+		case *channels.TxID:
+			txid := *w
+			result = append(result, &txid)
+		}
+	}
+
+	return result
+}
+
+// replyChannel returns the peer channel in the request's reply to, or the relationship's peer
+// channel if the request doesn't specify one. The reply to is only used when it is inside a
+// signature by the relationship's public key so a reply can't be redirected by a wrapper added by
+// someone else.
+func replyChannel(wrappers []channels.Wrapper,
+	relationship *Relationship) peer_channels.Channel {
+
+	if err := verifySignature(wrappers, relationship.PublicKey); err != nil {
+		return relationship.PeerChannel
+	}
+
+	signature := wrappers[0].(channels.SignatureWrapper)
+	for _, wrapper := range channels.CalculateWrapperCoverage(wrappers).SignedBy(signature) {
+		if replyTo, ok := wrapper.(*channels.ReplyTo); ok && replyTo.PeerChannel != nil {
+			return *replyTo.PeerChannel
+		}
+	}
+
+	return relationship.PeerChannel
+}
@@ -0,0 +1,314 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/channels/invoices"
+	"github.com/tokenized/channels/peer_channels_listener"
+	"github.com/tokenized/channels/peer_channels_service"
+	"github.com/tokenized/channels/uuid_response_handler"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// startResponder runs a listener for the party's account that routes requests from the other
+// party to the handlers through a responder.
+func startResponder(t *testing.T, ctx context.Context, service *peer_channels_service.Service,
+	party, other *testParty,
+	handlers map[channels.Message]HandleRequest) func() {
+
+	relationship := party.relationship(other)
+	responder := NewResponder(service, func(ctx context.Context,
+		msg *peer_channels_listener.RoutedMessage) (*Relationship, error) {
+
+		if msg.PeerChannelMessage.ChannelID != party.channel.ID {
+			return nil, nil
+		}
+		return relationship, nil
+	})
+
+	router := peer_channels_listener.NewRouter(testProtocols(), responder.Reply)
+	router.Use(peer_channels_listener.SignatureMiddleware(responder.Reply, true,
+		responder.PublicKeyLookup()))
+	for message, handle := range handlers {
+		router.Handle(message, responder.Handler(handle))
+	}
+
+	listener := peer_channels_listener.NewPeerChannelsListener(service, party.account.Token, 100,
+		1, time.Second, router.HandleMessage, nil)
+
+	interrupt := make(chan interface{})
+	var wait sync.WaitGroup
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		if err := listener.Run(ctx, interrupt); err != nil {
+			t.Errorf("Failed to run listener : %s", err)
+		}
+	}()
+
+	return func() {
+		close(interrupt)
+		wait.Wait()
+	}
+}
+
+func Test_Responder(t *testing.T) {
+	ctx := context.Background()
+	service := peer_channels_service.NewService()
+
+	alice := newTestParty(t, ctx, service)
+	bob := newTestParty(t, ctx, service)
+
+	client, stopClient := startClient(t, ctx, service, alice)
+	defer stopClient()
+
+	stopResponder := startResponder(t, ctx, service, bob, alice,
+		map[channels.Message]HandleRequest{
+			&invoices.RequestMenu{}: func(ctx context.Context,
+				request *peer_channels_listener.RoutedMessage) (channels.Writer,
+				[]channels.Wrapper, error) {
+
+				return &invoices.Menu{}, nil, nil
+			},
+			&invoices.PurchaseOrder{}: func(ctx context.Context,
+				request *peer_channels_listener.RoutedMessage) (channels.Writer,
+				[]channels.Wrapper, error) {
+
+				return nil, nil, errors.Wrap(&channels.Response{
+					Status:         channels.StatusReject,
+					CodeProtocolID: invoices.ProtocolID,
+					Code:           invoices.StatusUnknownItem,
+				}, "item")
+			},
+			&invoices.TransferAccept{}: func(ctx context.Context,
+				request *peer_channels_listener.RoutedMessage) (channels.Writer,
+				[]channels.Wrapper, error) {
+
+				return nil, nil, nil
+			},
+		})
+	defer stopResponder()
+
+	relationship := alice.relationship(bob)
+
+	msg, _, err := client.Call(ctx, relationship, &invoices.RequestMenu{})
+	if err != nil {
+		t.Fatalf("Failed to call : %s", err)
+	}
+
+	if _, ok := msg.(*invoices.Menu); !ok {
+		t.Errorf("Wrong response message type : got %T, want %T", msg, &invoices.Menu{})
+	}
+
+	// A nil reply is acknowledged.
+	msg, _, err = client.Call(ctx, relationship, &invoices.TransferAccept{})
+	if err != nil {
+		t.Fatalf("Failed to call : %s", err)
+	}
+
+	if response, ok := msg.(*channels.Response); !ok || response.Status != channels.StatusOK {
+		t.Errorf("Wrong acknowledgement : got %+v, want OK response", msg)
+	}
+
+	// An error from the handler is mapped to the response.
+	_, _, err = client.Call(ctx, relationship, &invoices.PurchaseOrder{})
+	responseErr, ok := errors.Cause(err).(ResponseError)
+	if !ok {
+		t.Fatalf("Wrong error : got %v, want %T", err, ResponseError{})
+	}
+
+	if responseErr.Status() != channels.StatusReject {
+		t.Errorf("Wrong status : got %s, want %s", responseErr.Status(), channels.StatusReject)
+	}
+
+	if responseErr.Response.Code != invoices.StatusUnknownItem {
+		t.Errorf("Wrong code : got %d, want %d", responseErr.Response.Code,
+			invoices.StatusUnknownItem)
+	}
+
+	// Requests without a handler are rejected by the router through the responder.
+	_, _, err = client.Call(ctx, relationship, &invoices.Invoice{})
+	responseErr, ok = errors.Cause(err).(ResponseError)
+	if !ok {
+		t.Fatalf("Wrong error : got %v, want %T", err, ResponseError{})
+	}
+
+	if responseErr.Status() != channels.StatusUnsupportedProtocol {
+		t.Errorf("Wrong status : got %s, want %s", responseErr.Status(),
+			channels.StatusUnsupportedProtocol)
+	}
+}
+
+func Test_Responder_WrongSigner(t *testing.T) {
+	ctx := context.Background()
+	service := peer_channels_service.NewService()
+
+	alice := newTestParty(t, ctx, service)
+	bob := newTestParty(t, ctx, service)
+	mallory := newTestParty(t, ctx, service)
+
+	client, stopClient := startClient(t, ctx, service, alice)
+	defer stopClient()
+
+	stopResponder := startResponder(t, ctx, service, bob, alice,
+		map[channels.Message]HandleRequest{
+			&invoices.RequestMenu{}: func(ctx context.Context,
+				request *peer_channels_listener.RoutedMessage) (channels.Writer,
+				[]channels.Wrapper, error) {
+
+				return &invoices.Menu{}, nil, nil
+			},
+		})
+	defer stopResponder()
+
+	// The request is signed by a key that isn't in Bob's relationship with Alice.
+	relationship := alice.relationship(bob)
+	relationship.Signer = channels.NewKeySigner(mallory.key)
+
+	_, _, err := client.Call(ctx, relationship, &invoices.RequestMenu{})
+	responseErr, ok := errors.Cause(err).(ResponseError)
+	if !ok {
+		t.Fatalf("Wrong error : got %v, want %T", err, ResponseError{})
+	}
+
+	if responseErr.Status() != channels.StatusUnauthorized {
+		t.Errorf("Wrong status : got %s, want %s", responseErr.Status(),
+			channels.StatusUnauthorized)
+	}
+}
+
+func Test_DefaultMapError(t *testing.T) {
+	if response := DefaultMapError(errors.New("database")); response != nil {
+		t.Errorf("Wrong response : got %+v, want nil", response)
+	}
+
+	response := DefaultMapError(errors.Wrap(channels.Response{
+		Status: channels.StatusInvalid,
+	}, "invalid"))
+	if response == nil || response.Status != channels.StatusInvalid {
+		t.Errorf("Wrong response : got %+v, want invalid status", response)
+	}
+}
+
+func Test_ReplyChannel(t *testing.T) {
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	otherKey, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+
+	relationship := &Relationship{
+		PublicKey: key.PublicKey(),
+		PeerChannel: peer_channels.Channel{
+			BaseURL:   peer_channels_service.ServiceURL,
+			ChannelID: "relationship",
+		},
+	}
+
+	replyTo := &channels.ReplyTo{
+		PeerChannel: &peer_channels.Channel{
+			BaseURL:   peer_channels_service.ServiceURL,
+			ChannelID: "reply_to",
+		},
+	}
+
+	tests := []struct {
+		name     string
+		wrappers []channels.Wrapper
+		want     string
+	}{
+		{
+			name: "signed",
+			wrappers: []channels.Wrapper{replyTo,
+				channels.NewSignature(key, channels.RandomHashPtr(), true)},
+			want: "reply_to",
+		},
+		{
+			name: "wrong key",
+			wrappers: []channels.Wrapper{replyTo,
+				channels.NewSignature(otherKey, channels.RandomHashPtr(), true)},
+			want: "relationship",
+		},
+		{
+			name: "outside signature",
+			wrappers: []channels.Wrapper{
+				channels.NewSignature(key, channels.RandomHashPtr(), true), replyTo},
+			want: "relationship",
+		},
+		{
+			name:     "unsigned",
+			wrappers: []channels.Wrapper{replyTo},
+			want:     "relationship",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, err := channels.Wrap(&invoices.RequestMenu{}, tt.wrappers...)
+			if err != nil {
+				t.Fatalf("Failed to wrap message : %s", err)
+			}
+
+			_, wrappers, err := testProtocols().Parse(script)
+			if err != nil {
+				t.Fatalf("Failed to parse message : %s", err)
+			}
+
+			channel := replyChannel(wrappers, relationship)
+			if channel.ChannelID != tt.want {
+				t.Errorf("Wrong reply channel : got %s, want %s", channel.ChannelID, tt.want)
+			}
+		})
+	}
+}
+
+func Test_CorrelationIDs(t *testing.T) {
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	id := channels.UUID(uuid.New())
+	txid := channels.TxID(channels.RandomHash())
+	wrappers := []channels.Wrapper{
+		channels.NewSignature(key, nil, true),
+		&channels.ReplyTo{},
+		&id,
+		channels.NewStringID("thread"),
+		&channels.MessageID{MessageID: 12},
+		&txid,
+	}
+
+	copies := correlationIDs(wrappers)
+	if len(copies) != 4 {
+		t.Fatalf("Wrong correlation id count : got %d, want %d", len(copies), 4)
+	}
+
+	extractors := []uuid_response_handler.ExtractKey{
+		uuid_response_handler.ExtractUUID,
+		uuid_response_handler.ExtractStringID,
+		uuid_response_handler.ExtractMessageID,
+		uuid_response_handler.ExtractTxID,
+	}
+
+	for i, extract := range extractors {
+		want, ok := extract(nil, wrappers)
+		if !ok {
+			t.Fatalf("Failed to extract key %d from request", i)
+		}
+
+		got, ok := extract(nil, copies)
+		if !ok {
+			t.Fatalf("Failed to extract key %d from reply", i)
+		}
+
+		if got != want {
+			t.Errorf("Wrong key %d : got %s, want %s", i, got, want)
+		}
+
+		if copies[i] == wrappers[i+2] {
+			t.Errorf("Correlation id %d should be a copy", i)
+		}
+	}
+}
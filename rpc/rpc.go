@@ -0,0 +1,169 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/channels/peer_channels_listener"
+	"github.com/tokenized/logger"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrMissingSignature = errors.New("Missing Signature")
+	ErrWrongPublicKey   = errors.New("Wrong Public Key")
+)
+
+// Relationship is one party's view of a relationship with another party. It contains what is
+// needed to sign the messages sent to the other party, to verify the messages received from them,
+// and to exchange messages over peer channels.
+type Relationship struct {
+	// Signer signs the messages sent to the other party.
+	Signer channels.Signer
+
+	// PublicKey is the other party's base public key. Messages received from them must be signed
+	// by it, with a derivation hash added.
+	PublicKey bitcoin.PublicKey
+
+	// PeerChannel is the other party's peer channel, with a write token, that requests are posted
+	// to.
+	PeerChannel peer_channels.Channel
+
+	// ReplyTo is our peer channel, with a write token for the other party, that responses are
+	// posted to.
+	ReplyTo peer_channels.Channel
+}
+
+// ClientFactory returns a peer channel client for a base URL. peer_channels.Factory implements it.
+type ClientFactory interface {
+	NewClient(baseURL string) (peer_channels.Client, error)
+}
+
+// ResponseError is returned when a response has a status other than OK.
+type ResponseError struct {
+	Response channels.Response
+
+	// CodeString is the protocol specific code of the response converted to text.
+	CodeString string
+}
+
+func (err ResponseError) Error() string {
+	result := fmt.Sprintf("Response %s", err.Response.Status)
+	if len(err.CodeString) > 0 {
+		result += " : " + err.CodeString
+	}
+	if len(err.Response.Note) > 0 {
+		result += " : " + err.Response.Note
+	}
+
+	return result
+}
+
+// Status returns the status of the response.
+func (err ResponseError) Status() channels.Status {
+	return err.Response.Status
+}
+
+// IsTransient returns true if an error posting a message might not happen again so the post
+// should be retried. Network errors, including timeouts, and HTTP statuses that indicate the
+// service is failing or rate limiting are transient. Canceled or expired contexts, other HTTP
+// statuses, and local errors are not.
+func IsTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var httpError peer_channels.HTTPError
+	if errors.As(err, &httpError) {
+		return httpError.Status >= http.StatusInternalServerError ||
+			httpError.Status == http.StatusTooManyRequests
+	}
+
+	var netError net.Error
+	return errors.As(err, &netError)
+}
+
+// post writes the script to the peer channel, retrying transient failures according to the retry
+// policy.
+func post(ctx context.Context, clients ClientFactory, channel peer_channels.Channel,
+	script bitcoin.Script, policy peer_channels_listener.RetryPolicy) error {
+
+	client, err := clients.NewClient(channel.BaseURL)
+	if err != nil {
+		return errors.Wrap(err, "peer channels client")
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := client.WriteMessage(ctx, channel.ChannelID, channel.Token,
+			peer_channels.ContentTypeBinary, bytes.NewReader(script))
+		if err == nil {
+			return nil
+		}
+
+		if !IsTransient(err) || policy.Exhausted(attempt) {
+			return errors.Wrapf(err, "attempt %d", attempt)
+		}
+
+		delay := policy.Delay(attempt)
+		logger.WarnWithFields(ctx, []logger.Field{
+			logger.String("channel_id", channel.ChannelID),
+			logger.Int("attempt", attempt),
+			logger.MillisecondsFromNano("delay_ms", delay.Nanoseconds()),
+		}, "Failed to post peer channel message : %s", err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "attempt %d", attempt)
+		}
+	}
+}
+
+// verifySignature verifies that the outermost wrapper is a signature by the public key, so all
+// of the other wrappers and the message are covered by it.
+func verifySignature(wrappers []channels.Wrapper, publicKey bitcoin.PublicKey) error {
+	if len(wrappers) == 0 {
+		return ErrMissingSignature
+	}
+
+	signature, ok := wrappers[0].(*channels.Signature)
+	if !ok {
+		return ErrMissingSignature
+	}
+
+	if signature.PublicKey == nil {
+		signature.SetPublicKey(&publicKey)
+	} else if !signature.PublicKey.Equal(publicKey) {
+		return ErrWrongPublicKey
+	}
+
+	if err := signature.Verify(); err != nil {
+		return errors.Wrap(err, "verify")
+	}
+
+	return nil
+}
+
+// findResponse returns the response wrapper, or the message when a response isn't wrapping
+// anything.
+func findResponse(msg channels.Message, wrappers []channels.Wrapper) *channels.Response {
+	if response, ok := msg.(*channels.Response); ok {
+		return response
+	}
+
+	for _, wrapper := range wrappers {
+		if response, ok := wrapper.(*channels.Response); ok {
+			return response
+		}
+	}
+
+	return nil
+}
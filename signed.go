@@ -1,15 +1,12 @@
 package channels
 
 import (
-	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
-	"fmt"
 	"time"
 
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
 	"github.com/tokenized/pkg/bitcoin"
-	"github.com/tokenized/pkg/bsor"
 
 	"github.com/pkg/errors"
 )
@@ -29,11 +26,37 @@ const (
 	// SignedStatusWrongPublicKey is a code specific to the signature protocol that is placed
 	// in a Reject message to signify that a message includes the wrong public key for context.
 	SignedStatusWrongPublicKey = uint32(3)
+
+	// SignedStatusReplayProtectionRequired is a code specific to the signature protocol that is
+	// placed in a Reject message to signify that a message is considered invalid if it doesn't
+	// have a nonce and timestamp covered by the signature.
+	SignedStatusReplayProtectionRequired = uint32(4)
+
+	// SignedStatusNonceReused is a code specific to the signature protocol that is placed in a
+	// Reject message to signify that a message with the same nonce was already received.
+	SignedStatusNonceReused = uint32(5)
+
+	// SignedStatusTimestampOutOfRange is a code specific to the signature protocol that is placed
+	// in a Reject message to signify that a message's signed timestamp is too old or too far in
+	// the future.
+	SignedStatusTimestampOutOfRange = uint32(6)
+
+	// SignedStatusWrongChannel is a code specific to the signature protocol that is placed in a
+	// Reject message to signify that a message was signed for a different channel.
+	SignedStatusWrongChannel = uint32(7)
+
+	// SignedStatusUnsignedWrapper is a code specific to the signature protocol that is placed in a
+	// Unauthorized message to signify that a security relevant wrapper, like a reply to, was
+	// outside of the signature.
+	SignedStatusUnsignedWrapper = uint32(8)
 )
 
 var (
 	ProtocolIDSignedMessages = envelope.ProtocolID("S") // Protocol ID for signed messages
 
+	signedCodec = NewCodec(ProtocolIDSignedMessages, SignedMessagesVersion, "signed",
+		&Signature{})
+
 	ErrPublicKeyMissing = errors.New("Public Key Missing")
 	ErrHashMissing      = errors.New("Hash Missing")
 	ErrInvalidSignature = errors.New("Invalid Signature")
@@ -65,87 +88,60 @@ type Signature struct {
 	PublicKey      *bitcoin.PublicKey `bsor:"2" json:"public_key"`
 	DerivationHash *bitcoin.Hash32    `bsor:"3" json:"derivation_hash"`
 
-	key  *bitcoin.Key
-	hash *bitcoin.Hash32
+	signer     Signer
+	includeKey bool
+	hash       *bitcoin.Hash32
 }
 
 func NewSignature(key bitcoin.Key, derivationHash *bitcoin.Hash32, includeKey bool) *Signature {
-	result := &Signature{
-		DerivationHash: derivationHash,
-		key:            &key,
-		hash:           derivationHash,
-	}
+	return NewSignatureWithSigner(NewKeySigner(key), derivationHash, includeKey)
+}
 
-	if includeKey {
-		pk := key.PublicKey()
-		result.PublicKey = &pk
-	}
+// NewSignatureWithSigner creates a signature that will be signed by the signer when it is wrapped
+// around a payload.
+func NewSignatureWithSigner(signer Signer, derivationHash *bitcoin.Hash32,
+	includeKey bool) *Signature {
 
-	return result
+	return &Signature{
+		DerivationHash: derivationHash,
+		signer:         signer,
+		includeKey:     includeKey,
+	}
 }
 
+func (*Signature) IsSignatureType() {}
+
 func (*Signature) ProtocolID() envelope.ProtocolID {
 	return ProtocolIDSignedMessages
 }
 
 func (s *Signature) Wrap(payload envelope.Data) (envelope.Data, error) {
-	if s.key != nil {
+	if s.signer != nil {
 		if err := s.sign(payload); err != nil {
 			return payload, errors.Wrap(err, "sign")
 		}
 	}
 
-	// Version
-	scriptItems := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(SignedMessagesVersion))}
-
-	// Message
-	msgScriptItems, err := bsor.Marshal(s)
-	if err != nil {
-		return payload, errors.Wrap(err, "marshal")
-	}
-	scriptItems = append(scriptItems, msgScriptItems...)
-
-	payload.ProtocolIDs = append(envelope.ProtocolIDs{ProtocolIDSignedMessages},
-		payload.ProtocolIDs...)
-	payload.Payload = append(scriptItems, payload.Payload...)
-
-	return payload, nil
+	return signedCodec.Wrap(s, payload)
 }
 
 func (s *Signature) sign(payload envelope.Data) error {
-	hasher := sha256.New()
-	for _, protocolID := range payload.ProtocolIDs {
-		hasher.Write(protocolID)
-	}
-
-	if err := payload.Payload.Write(hasher); err != nil {
-		return errors.Wrap(err, "script")
+	sigHash, err := SignatureHash(payload)
+	if err != nil {
+		return errors.Wrap(err, "hash")
 	}
 
-	sigHash, err := bitcoin.NewHash32(hasher.Sum(nil))
+	signature, publicKey, err := s.signer.Sign(*sigHash, s.DerivationHash)
 	if err != nil {
-		return errors.Wrap(err, "new hash")
+		return errors.Wrap(err, "sign")
 	}
 
-	var signature bitcoin.Signature
-	if s.DerivationHash != nil {
-		derivedKey, err := s.key.AddHash(*s.DerivationHash)
-		if err != nil {
-			return errors.Wrap(err, "derive key")
-		}
-
-		signature, err = derivedKey.Sign(*sigHash)
-		if err != nil {
-			return errors.Wrap(err, "sign")
-		}
-	} else {
-		signature, err = s.key.Sign(*sigHash)
-		if err != nil {
-			return errors.Wrap(err, "sign")
-		}
+	s.Signature = signature
+	s.hash = sigHash
+	if s.includeKey {
+		s.PublicKey = &publicKey
 	}
 
-	s.Signature = signature
 	return nil
 }
 
@@ -154,15 +150,25 @@ func (s *Signature) sign(payload envelope.Data) error {
 func Sign(payload envelope.Data, key bitcoin.Key, derivationHash *bitcoin.Hash32,
 	includeKey bool) (*Signature, error) {
 
-	result := &Signature{
-		DerivationHash: derivationHash,
-	}
+	return SignWithSigner(payload, NewKeySigner(key), derivationHash, includeKey)
+}
 
-	if includeKey {
-		publicKey := key.PublicKey()
-		result.PublicKey = &publicKey
+// SignWithSigner returns the signature of the payload created by the signer.
+func SignWithSigner(payload envelope.Data, signer Signer, derivationHash *bitcoin.Hash32,
+	includeKey bool) (*Signature, error) {
+
+	result := NewSignatureWithSigner(signer, derivationHash, includeKey)
+	if err := result.sign(payload); err != nil {
+		return nil, err
 	}
 
+	result.signer = nil
+	return result, nil
+}
+
+// SignatureHash returns the hash that is signed for the payload. It covers the protocol IDs and
+// push ops of the payload.
+func SignatureHash(payload envelope.Data) (*bitcoin.Hash32, error) {
 	hasher := sha256.New()
 	for _, protocolID := range payload.ProtocolIDs {
 		hasher.Write(protocolID)
@@ -177,26 +183,7 @@ func Sign(payload envelope.Data, key bitcoin.Key, derivationHash *bitcoin.Hash32
 		return nil, errors.Wrap(err, "new hash")
 	}
 
-	var signature bitcoin.Signature
-	if derivationHash != nil {
-		derivedKey, err := key.AddHash(*derivationHash)
-		if err != nil {
-			return nil, errors.Wrap(err, "derive key")
-		}
-
-		signature, err = derivedKey.Sign(*hash)
-		if err != nil {
-			return nil, errors.Wrap(err, "sign")
-		}
-	} else {
-		signature, err = key.Sign(*hash)
-		if err != nil {
-			return nil, errors.Wrap(err, "sign")
-		}
-	}
-
-	result.Signature = signature
-	return result, nil
+	return hash, nil
 }
 
 func RandomHash() bitcoin.Hash32 {
@@ -242,45 +229,30 @@ func WrapSignature(payload envelope.Data, key bitcoin.Key, derivationHash *bitco
 	return signature.Wrap(payload)
 }
 
-// ParseSigned parses the signature and public key (if provided).
-func ParseSigned(payload envelope.Data) (*Signature, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 ||
-		!bytes.Equal(payload.ProtocolIDs[0], ProtocolIDSignedMessages) {
-		return nil, payload, nil
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
-
-	if len(payload.Payload) < 2 {
-		return nil, payload, errors.Wrapf(ErrInvalidMessage, "not enough signature push ops: %d",
-			len(payload.Payload))
-	}
+// WrapSignatureWithSigner signs the payload with the signer and wraps the payload with the
+// signature and returns the new payload containing the signature.
+func WrapSignatureWithSigner(payload envelope.Data, signer Signer, derivationHash *bitcoin.Hash32,
+	includeKey bool) (envelope.Data, error) {
 
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
+	signature, err := SignWithSigner(payload, signer, derivationHash, includeKey)
 	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(ErrUnsupportedVersion, fmt.Sprintf("signed: %d", version))
+		return payload, errors.Wrap(err, "sign")
 	}
-	payload.Payload = payload.Payload[1:]
 
-	signature := &Signature{}
-	payload.Payload, err = bsor.Unmarshal(payload.Payload, signature)
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "unmarshal")
-	}
+	return signature.Wrap(payload)
+}
 
-	hasher := sha256.New()
-	for _, protocolID := range payload.ProtocolIDs {
-		hasher.Write(protocolID)
-	}
-	if err := payload.Payload.Write(hasher); err != nil {
-		return nil, payload, errors.Wrap(err, "hash")
+// ParseSigned parses the signature and public key (if provided).
+func ParseSigned(payload envelope.Data) (*Signature, envelope.Data, error) {
+	msg, payload, err := signedCodec.Parse(payload)
+	if msg == nil || err != nil {
+		return nil, payload, err
 	}
+	signature := msg.(*Signature)
 
-	hash, err := bitcoin.NewHash32(hasher.Sum(nil))
+	hash, err := SignatureHash(payload)
 	if err != nil {
-		return nil, payload, errors.Wrap(err, "new hash")
+		return nil, payload, errors.Wrap(err, "hash")
 	}
 	signature.hash = hash
 
@@ -348,6 +320,16 @@ func SignedResponseCodeToString(code uint32) string {
 		return "invalid_signature"
 	case SignedStatusWrongPublicKey:
 		return "wrong_public_key"
+	case SignedStatusReplayProtectionRequired:
+		return "replay_protection_required"
+	case SignedStatusNonceReused:
+		return "nonce_reused"
+	case SignedStatusTimestampOutOfRange:
+		return "timestamp_out_of_range"
+	case SignedStatusWrongChannel:
+		return "wrong_channel"
+	case SignedStatusUnsignedWrapper:
+		return "unsigned_wrapper"
 	default:
 		return "parse_error"
 	}
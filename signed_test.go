@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/json"
+	"fmt"
 	"testing"
 
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
@@ -305,3 +306,97 @@ func Test_SignedMessage_WithHash(t *testing.T) {
 		t.Errorf("Wrong protocol id : got 0x%x, want 0x%x", signedPayload.Payload[0].Data, testData)
 	}
 }
+
+const (
+	testWirePublicKey = "0263ebe72a1f4c41514a8da5a232ccef8c629a18333c4005702471396c8a9f6157"
+	testWireSignature = "304402202690bfc4b9bf5b308a1f3184660c255a3da43b8003612bb15e79f4334ae32fc302" +
+		"2018de6c5d0da32b594c2f7234d859952f193fc1c73dda331a2a314ad4a543f52c"
+)
+
+// testWireValues returns fixed values so the wire format of messages containing keys and
+// signatures can be compared to known bytes.
+func testWireValues(t *testing.T) (bitcoin.Signature, bitcoin.PublicKey, bitcoin.Hash32,
+	envelope.Data) {
+
+	signature, err := bitcoin.SignatureFromStr(testWireSignature)
+	if err != nil {
+		t.Fatalf("Failed to parse signature : %s", err)
+	}
+
+	publicKey, err := bitcoin.PublicKeyFromStr(testWirePublicKey)
+	if err != nil {
+		t.Fatalf("Failed to parse public key : %s", err)
+	}
+
+	var hash bitcoin.Hash32
+	for i := range hash {
+		hash[i] = byte(i)
+	}
+
+	payload := envelope.Data{
+		ProtocolIDs: envelope.ProtocolIDs{ProtocolIDNote},
+		Payload:     bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(0)},
+	}
+
+	return signature, publicKey, hash, payload
+}
+
+// testWireFormat verifies the payload is written as the known bytes and that the parsed wrapper
+// writes the same bytes again.
+func testWireFormat(t *testing.T, payload envelope.Data, want string,
+	parse func(payload envelope.Data) (Wrapper, envelope.Data, error)) {
+
+	script, err := envelopeV1.Wrap(payload).Script()
+	if err != nil {
+		t.Fatalf("Failed to create script : %s", err)
+	}
+
+	if got := fmt.Sprintf("%x", []byte(script)); got != want {
+		t.Fatalf("Wrong script : \ngot  %s\nwant %s", got, want)
+	}
+
+	parsedPayload, err := ParseEnvelope(script)
+	if err != nil {
+		t.Fatalf("Failed to parse envelope : %s", err)
+	}
+
+	wrapper, remaining, err := parse(parsedPayload)
+	if err != nil {
+		t.Fatalf("Failed to parse wrapper : %s", err)
+	}
+
+	rewrapped, err := wrapper.Wrap(remaining)
+	if err != nil {
+		t.Fatalf("Failed to wrap parsed wrapper : %s", err)
+	}
+
+	reScript, err := envelopeV1.Wrap(rewrapped).Script()
+	if err != nil {
+		t.Fatalf("Failed to create script : %s", err)
+	}
+
+	if !bytes.Equal(reScript, script) {
+		t.Fatalf("Wrong wrapped script : \ngot  %x\nwant %x", []byte(reScript), []byte(script))
+	}
+}
+
+func Test_Signed_WireFormat(t *testing.T) {
+	signatureValue, publicKey, hash, payload := testWireValues(t)
+
+	signature := &Signature{
+		Signature:      signatureValue,
+		PublicKey:      &publicKey,
+		DerivationHash: &hash,
+	}
+
+	wrapped, err := signature.Wrap(payload)
+	if err != nil {
+		t.Fatalf("Failed to wrap signature : %s", err)
+	}
+
+	testWireFormat(t, wrapped, "006a02bd01520153044e4f54455900535146"+testWireSignature+"5221"+
+		testWirePublicKey+"5320000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f00",
+		func(payload envelope.Data) (Wrapper, envelope.Data, error) {
+			return ParseSigned(payload)
+		})
+}
@@ -0,0 +1,47 @@
+package channels
+
+import (
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+// Signer signs hashes for channels messages so that keys don't have to be held in process memory.
+// When a derivation hash is provided the signature must be made by the base key with the
+// derivation hash added. The base public key, without the derivation hash added, is returned with
+// the signature.
+type Signer interface {
+	Sign(hash bitcoin.Hash32, derivationHash *bitcoin.Hash32) (bitcoin.Signature, bitcoin.PublicKey,
+		error)
+}
+
+// KeySigner is a Signer that holds the key in memory.
+type KeySigner struct {
+	key bitcoin.Key
+}
+
+func NewKeySigner(key bitcoin.Key) *KeySigner {
+	return &KeySigner{
+		key: key,
+	}
+}
+
+func (s *KeySigner) Sign(hash bitcoin.Hash32,
+	derivationHash *bitcoin.Hash32) (bitcoin.Signature, bitcoin.PublicKey, error) {
+
+	key := s.key
+	if derivationHash != nil {
+		derivedKey, err := key.AddHash(*derivationHash)
+		if err != nil {
+			return bitcoin.Signature{}, bitcoin.PublicKey{}, errors.Wrap(err, "derive key")
+		}
+		key = derivedKey
+	}
+
+	signature, err := key.Sign(hash)
+	if err != nil {
+		return bitcoin.Signature{}, bitcoin.PublicKey{}, errors.Wrap(err, "sign")
+	}
+
+	return signature, s.key.PublicKey(), nil
+}
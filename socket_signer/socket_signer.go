@@ -0,0 +1,231 @@
+package socket_signer
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/logger"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/bsor"
+
+	"github.com/pkg/errors"
+)
+
+// socket_signer is a reference implementation of an external channels.Signer. The Server holds the
+// signer, usually containing the keys, and serves signature requests over a local socket so that
+// the process using the Client never has access to the keys.
+
+const (
+	// maxMessageSize is the largest request or response accepted. Messages only contain a few
+	// hashes, keys, and signatures.
+	maxMessageSize = 1024
+)
+
+var (
+	ErrMessageTooLarge = errors.New("Message Too Large")
+	ErrSignerFailed    = errors.New("Signer Failed")
+)
+
+type SignRequest struct {
+	Hash           bitcoin.Hash32  `bsor:"1" json:"hash"`
+	DerivationHash *bitcoin.Hash32 `bsor:"2" json:"derivation_hash,omitempty"`
+}
+
+type SignResponse struct {
+	Signature *bitcoin.Signature `bsor:"1" json:"signature,omitempty"`
+	PublicKey *bitcoin.PublicKey `bsor:"2" json:"public_key,omitempty"`
+	Error     string             `bsor:"3" json:"error,omitempty"`
+}
+
+// Server serves signature requests from a channels.Signer to clients connected to the listener.
+type Server struct {
+	listener net.Listener
+	signer   channels.Signer
+
+	connections     map[net.Conn]bool
+	connectionsLock sync.Mutex
+}
+
+// Client is a channels.Signer that requests signatures from a Server.
+type Client struct {
+	network string
+	address string
+}
+
+func NewServer(listener net.Listener, signer channels.Signer) *Server {
+	return &Server{
+		listener:    listener,
+		signer:      signer,
+		connections: make(map[net.Conn]bool),
+	}
+}
+
+// Run accepts connections until interrupted. The listener is closed when it returns.
+func (s *Server) Run(ctx context.Context, interrupt <-chan interface{}) error {
+	var wait sync.WaitGroup
+	acceptComplete := make(chan error, 1)
+
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				acceptComplete <- err
+				return
+			}
+
+			s.connectionsLock.Lock()
+			s.connections[conn] = true
+			s.connectionsLock.Unlock()
+
+			wait.Add(1)
+			go func() {
+				s.handleConnection(ctx, conn)
+
+				s.connectionsLock.Lock()
+				delete(s.connections, conn)
+				s.connectionsLock.Unlock()
+
+				wait.Done()
+			}()
+		}
+	}()
+
+	var result error
+	select {
+	case <-interrupt:
+		s.listener.Close()
+		<-acceptComplete
+	case err := <-acceptComplete:
+		result = errors.Wrap(err, "accept")
+	}
+
+	s.connectionsLock.Lock()
+	for conn := range s.connections {
+		conn.Close()
+	}
+	s.connectionsLock.Unlock()
+
+	wait.Wait()
+	return result
+}
+
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		request := &SignRequest{}
+		if err := readMessage(conn, request); err != nil {
+			if errors.Cause(err) != io.EOF {
+				logger.Warn(ctx, "Failed to read sign request : %s", err)
+			}
+			return
+		}
+
+		response := &SignResponse{}
+		signature, publicKey, err := s.signer.Sign(request.Hash, request.DerivationHash)
+		if err != nil {
+			logger.Warn(ctx, "Failed to sign : %s", err)
+			response.Error = err.Error()
+		} else {
+			response.Signature = &signature
+			response.PublicKey = &publicKey
+		}
+
+		if err := writeMessage(conn, response); err != nil {
+			logger.Warn(ctx, "Failed to write sign response : %s", err)
+			return
+		}
+	}
+}
+
+// NewClient creates a signer that connects to a server at the address. For example "unix" and
+// "/path/to/signer.sock".
+func NewClient(network, address string) *Client {
+	return &Client{
+		network: network,
+		address: address,
+	}
+}
+
+func (c *Client) Sign(hash bitcoin.Hash32,
+	derivationHash *bitcoin.Hash32) (bitcoin.Signature, bitcoin.PublicKey, error) {
+
+	conn, err := net.Dial(c.network, c.address)
+	if err != nil {
+		return bitcoin.Signature{}, bitcoin.PublicKey{}, errors.Wrap(err, "dial")
+	}
+	defer conn.Close()
+
+	request := &SignRequest{
+		Hash:           hash,
+		DerivationHash: derivationHash,
+	}
+	if err := writeMessage(conn, request); err != nil {
+		return bitcoin.Signature{}, bitcoin.PublicKey{}, errors.Wrap(err, "write request")
+	}
+
+	response := &SignResponse{}
+	if err := readMessage(conn, response); err != nil {
+		return bitcoin.Signature{}, bitcoin.PublicKey{}, errors.Wrap(err, "read response")
+	}
+
+	if len(response.Error) > 0 {
+		return bitcoin.Signature{}, bitcoin.PublicKey{}, errors.Wrap(ErrSignerFailed,
+			response.Error)
+	}
+
+	if response.Signature == nil || response.PublicKey == nil {
+		return bitcoin.Signature{}, bitcoin.PublicKey{}, errors.Wrap(ErrSignerFailed,
+			"missing signature")
+	}
+
+	return *response.Signature, *response.PublicKey, nil
+}
+
+// writeMessage writes the message as a 4 byte length followed by the bsor encoded message.
+func writeMessage(w io.Writer, message interface{}) error {
+	b, err := bsor.MarshalBinary(message)
+	if err != nil {
+		return errors.Wrap(err, "marshal")
+	}
+
+	if len(b) > maxMessageSize {
+		return errors.Wrapf(ErrMessageTooLarge, "%d", len(b))
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(b))); err != nil {
+		return errors.Wrap(err, "size")
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return errors.Wrap(err, "message")
+	}
+
+	return nil
+}
+
+func readMessage(r io.Reader, message interface{}) error {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return errors.Wrap(err, "size")
+	}
+
+	if size > maxMessageSize {
+		return errors.Wrapf(ErrMessageTooLarge, "%d", size)
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return errors.Wrap(err, "message")
+	}
+
+	if _, err := bsor.UnmarshalBinary(b, message); err != nil {
+		return errors.Wrap(err, "unmarshal")
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package socket_signer
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/google/uuid"
+)
+
+func Test_Sign(t *testing.T) {
+	ctx := context.Background()
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+	publicKey := key.PublicKey()
+
+	address := filepath.Join(t.TempDir(), "signer.sock")
+	listener, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatalf("Failed to listen : %s", err)
+	}
+
+	server := NewServer(listener, channels.NewKeySigner(key))
+	interrupt := make(chan interface{})
+	serverComplete := make(chan error, 1)
+	go func() {
+		serverComplete <- server.Run(ctx, interrupt)
+	}()
+
+	client := NewClient("unix", address)
+
+	id := channels.UUID(uuid.New())
+	payload, err := id.Write()
+	if err != nil {
+		t.Fatalf("Failed to write message : %s", err)
+	}
+
+	derivationHash := channels.RandomHashPtr()
+	signature, err := channels.SignWithSigner(payload, client, derivationHash, false)
+	if err != nil {
+		t.Fatalf("Failed to sign : %s", err)
+	}
+
+	signature.SetPublicKey(&publicKey)
+	if err := signature.Verify(); err != nil {
+		t.Fatalf("Failed to verify : %s", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := channels.SignWithSigner(payload, client, derivationHash, false); err != nil {
+			t.Fatalf("Failed to sign : %s", err)
+		}
+	}
+
+	// Connections are removed when the client closes them.
+	for i := 0; ; i++ {
+		server.connectionsLock.Lock()
+		count := len(server.connections)
+		server.connectionsLock.Unlock()
+
+		if count == 0 {
+			break
+		}
+
+		if i == 100 {
+			t.Fatalf("Wrong connection count : got %d, want %d", count, 0)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(interrupt)
+	if err := <-serverComplete; err != nil {
+		t.Fatalf("Server failed : %s", err)
+	}
+}
@@ -1,9 +1,6 @@
 package channels
 
 import (
-	"bytes"
-	"fmt"
-
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
 	"github.com/tokenized/pkg/bitcoin"
 
@@ -17,6 +14,8 @@ const (
 var (
 	ProtocolIDStringID = envelope.ProtocolID("SID") // Protocol ID for string id
 
+	stringIDCodec = NewCodec(ProtocolIDStringID, StringIDVersion, "string id", &StringID{})
+
 	ErrInvalidStringID = errors.New("Invalid StringID")
 )
 
@@ -63,46 +62,29 @@ func WrapStringID(payload envelope.Data, threadID string) (envelope.Data, error)
 }
 
 func (m *StringID) Wrap(payload envelope.Data) (envelope.Data, error) {
-	// Version
-	scriptItems := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(StringIDVersion))}
-
-	// Message
-	scriptItems = append(scriptItems, bitcoin.NewPushDataScriptItem([]byte(m.StringID)))
-
-	payload.ProtocolIDs = append(envelope.ProtocolIDs{ProtocolIDStringID}, payload.ProtocolIDs...)
-	payload.Payload = append(scriptItems, payload.Payload...)
-
-	return payload, nil
+	return stringIDCodec.Wrap(m, payload)
 }
 
-func ParseStringID(payload envelope.Data) (*StringID, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 || !bytes.Equal(payload.ProtocolIDs[0], ProtocolIDStringID) {
-		return nil, payload, nil
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
+func (m *StringID) MarshalScriptItems() (bitcoin.ScriptItems, error) {
+	return bitcoin.ScriptItems{bitcoin.NewPushDataScriptItem([]byte(m.StringID))}, nil
+}
 
-	if len(payload.Payload) < 3 {
-		return nil, payload, errors.Wrapf(ErrInvalidMessage, "not enough thread id push ops: %d",
-			len(payload.Payload))
-	}
+func (m *StringID) UnmarshalScriptItems(scriptItems bitcoin.ScriptItems) (bitcoin.ScriptItems,
+	error) {
 
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(ErrUnsupportedVersion,
-			fmt.Sprintf("thread id: %d", version))
+	if len(scriptItems) == 0 || scriptItems[0].Type != bitcoin.ScriptItemTypePushData {
+		return nil, errors.New("Not Push Data")
 	}
+	m.StringID = string(scriptItems[0].Data)
 
-	if payload.Payload[1].Type != bitcoin.ScriptItemTypePushData {
-		return nil, payload, errors.New("Not Push Data")
-	}
+	return scriptItems[1:], nil
+}
 
-	result := &StringID{
-		StringID: string(payload.Payload[1].Data),
+func ParseStringID(payload envelope.Data) (*StringID, envelope.Data, error) {
+	msg, payload, err := stringIDCodec.Parse(payload)
+	if msg == nil {
+		return nil, payload, err
 	}
 
-	payload.Payload = payload.Payload[2:]
-	return result, payload, nil
+	return msg.(*StringID), payload, nil
 }
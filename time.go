@@ -31,6 +31,8 @@ const (
 
 var (
 	ProtocolIDTime = envelope.ProtocolID("T") // Protocol ID for channel times
+
+	timeCodec = NewCodec(ProtocolIDTime, TimeVersion, "time", new(TimeMessage))
 )
 
 type PeriodType uint8
@@ -330,60 +332,40 @@ func (*TimeMessage) ProtocolID() envelope.ProtocolID {
 }
 
 func (r *TimeMessage) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(TimeVersion))}
-
-	// Message
-	item := bitcoin.PushNumberScriptItemUnsigned(uint64(*r))
-	payload = append(payload, item)
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolIDTime}, payload}, nil
+	return timeCodec.Write(r)
 }
 
 func (r *TimeMessage) Wrap(payload envelope.Data) (envelope.Data, error) {
-	// Version
-	scriptItems := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(TimeVersion))}
-
-	// Message
-	item := bitcoin.PushNumberScriptItemUnsigned(uint64(*r))
-	scriptItems = append(scriptItems, item)
-
-	payload.ProtocolIDs = append(envelope.ProtocolIDs{ProtocolIDTime}, payload.ProtocolIDs...)
-	payload.Payload = append(scriptItems, payload.Payload...)
+	return timeCodec.Wrap(r, payload)
+}
 
-	return payload, nil
+func (r *TimeMessage) MarshalScriptItems() (bitcoin.ScriptItems, error) {
+	return bitcoin.ScriptItems{bitcoin.PushNumberScriptItemUnsigned(uint64(*r))}, nil
 }
 
-func ParseTime(payload envelope.Data) (*TimeMessage, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 ||
-		!bytes.Equal(payload.ProtocolIDs[0], ProtocolIDTime) {
-		return nil, payload, nil
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
+func (r *TimeMessage) UnmarshalScriptItems(scriptItems bitcoin.ScriptItems) (bitcoin.ScriptItems,
+	error) {
 
-	if len(payload.Payload) < 2 {
-		return nil, payload, errors.Wrapf(ErrInvalidMessage,
-			"not enough fee requirements push ops: %d", len(payload.Payload))
+	if len(scriptItems) == 0 {
+		return nil, errors.Wrap(ErrInvalidMessage, "missing time")
 	}
 
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
+	value, err := ScriptNumberValueUnsigned(scriptItems[0])
 	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(ErrUnsupportedVersion,
-			fmt.Sprintf("fee requirements: %d", version))
+		return nil, errors.Wrap(err, "value")
 	}
+	*r = TimeMessage(value)
 
-	value, err := bitcoin.ScriptNumberValueUnsigned(payload.Payload[1])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "value")
-	}
-	result := TimeMessage(value)
+	return scriptItems[1:], nil
+}
 
-	payload.Payload = payload.Payload[2:]
+func ParseTime(payload envelope.Data) (*TimeMessage, envelope.Data, error) {
+	msg, payload, err := timeCodec.Parse(payload)
+	if msg == nil {
+		return nil, payload, err
+	}
 
-	return &result, payload, nil
+	return msg.(*TimeMessage), payload, nil
 }
 
 func TimeResponseCodeToString(code uint32) string {
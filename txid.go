@@ -1,9 +1,6 @@
 package channels
 
 import (
-	"bytes"
-	"fmt"
-
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
 	"github.com/tokenized/pkg/bitcoin"
 
@@ -17,6 +14,8 @@ const (
 var (
 	ProtocolIDTxID = envelope.ProtocolID("TxID") // Protocol ID for txid
 
+	txidCodec = NewCodec(ProtocolIDTxID, TxIDVersion, "txid", &TxID{})
+
 	ErrInvalidTxID = errors.New("Invalid TxID")
 )
 
@@ -47,13 +46,7 @@ func (*TxID) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *TxID) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(TxIDVersion))}
-
-	// Message
-	payload = append(payload, bitcoin.NewPushDataScriptItem(m[:]))
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolIDTxID}, payload}, nil
+	return txidCodec.Write(m)
 }
 
 // WrapTxID wraps the payload with the txid and returns the new payload containing the txid.
@@ -63,48 +56,33 @@ func WrapTxID(payload envelope.Data, id bitcoin.Hash32) (envelope.Data, error) {
 }
 
 func (m *TxID) Wrap(payload envelope.Data) (envelope.Data, error) {
-	// Version
-	scriptItems := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(TxIDVersion))}
-
-	// Message
-	scriptItems = append(scriptItems, bitcoin.NewPushDataScriptItem(m[:]))
-
-	payload.ProtocolIDs = append(envelope.ProtocolIDs{ProtocolIDTxID}, payload.ProtocolIDs...)
-	payload.Payload = append(scriptItems, payload.Payload...)
+	return txidCodec.Wrap(m, payload)
+}
 
-	return payload, nil
+func (m *TxID) MarshalScriptItems() (bitcoin.ScriptItems, error) {
+	return bitcoin.ScriptItems{bitcoin.NewPushDataScriptItem(m[:])}, nil
 }
 
-func ParseTxID(payload envelope.Data) (*TxID, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 || !bytes.Equal(payload.ProtocolIDs[0], ProtocolIDTxID) {
-		return nil, payload, nil
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
+func (m *TxID) UnmarshalScriptItems(scriptItems bitcoin.ScriptItems) (bitcoin.ScriptItems,
+	error) {
 
-	if len(payload.Payload) < 2 {
-		return nil, payload, errors.Wrapf(ErrInvalidMessage, "not enough txid push ops: %d",
-			len(payload.Payload))
+	if len(scriptItems) == 0 || scriptItems[0].Type != bitcoin.ScriptItemTypePushData {
+		return nil, errors.Wrap(ErrInvalidTxID, "not push data")
 	}
 
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(ErrUnsupportedVersion, fmt.Sprintf("txid: %d", version))
+	if len(scriptItems[0].Data) != len(m[:]) {
+		return nil, errors.Wrapf(ErrInvalidTxID, "wrong size: %d", len(scriptItems[0].Data))
 	}
+	copy(m[:], scriptItems[0].Data)
 
-	if payload.Payload[1].Type != bitcoin.ScriptItemTypePushData {
-		return nil, payload, errors.Wrap(ErrInvalidTxID, "not push data")
-	}
+	return scriptItems[1:], nil
+}
 
-	var result TxID
-	if len(payload.Payload[1].Data) != len(result[:]) {
-		return nil, payload, errors.Wrapf(ErrInvalidTxID, "wrong size: %d",
-			len(payload.Payload[1].Data))
+func ParseTxID(payload envelope.Data) (*TxID, envelope.Data, error) {
+	msg, payload, err := txidCodec.Parse(payload)
+	if msg == nil {
+		return nil, payload, err
 	}
-	copy(result[:], payload.Payload[1].Data)
 
-	payload.Payload = payload.Payload[2:]
-	return &result, payload, nil
+	return msg.(*TxID), payload, nil
 }
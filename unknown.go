@@ -0,0 +1,144 @@
+package channels
+
+import (
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+// UnknownWrapper is a wrapper for a protocol that isn't supported. It retains the protocol ID and
+// push ops so the message can be forwarded unchanged.
+type UnknownWrapper struct {
+	Protocol envelope.ProtocolID `json:"protocol_id"`
+	Payload  bitcoin.ScriptItems `json:"payload"`
+}
+
+func NewUnknownWrapper(protocolID envelope.ProtocolID,
+	payload bitcoin.ScriptItems) *UnknownWrapper {
+
+	return &UnknownWrapper{
+		Protocol: protocolID,
+		Payload:  payload,
+	}
+}
+
+func (*UnknownWrapper) IsWrapperType() {}
+
+func (w *UnknownWrapper) ProtocolID() envelope.ProtocolID {
+	return w.Protocol
+}
+
+func (w *UnknownWrapper) Wrap(payload envelope.Data) (envelope.Data, error) {
+	payload.ProtocolIDs = append(envelope.ProtocolIDs{w.Protocol}, payload.ProtocolIDs...)
+	scriptItems := make(bitcoin.ScriptItems, len(w.Payload))
+	copy(scriptItems, w.Payload)
+	payload.Payload = append(scriptItems, payload.Payload...)
+
+	return payload, nil
+}
+
+// SetLenient sets whether wrappers with unsupported protocols are returned as UnknownWrappers
+// instead of failing the parse. The message itself must still be a supported protocol.
+func (ps *Protocols) SetLenient(lenient bool) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.lenient = lenient
+}
+
+func (ps *Protocols) isLenient() bool {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return ps.lenient
+}
+
+// parseUnknownWrapper separates the push ops of an unsupported wrapper from the push ops of the
+// protocols it contains and returns the result with the unknown wrapper's layer and the contained
+// layers appended. Envelope doesn't specify how many push ops belong to each protocol so each
+// split is tried by parsing the contained protocols, which are listed after the unknown protocol
+// ID, from the push ops after it. A split is only valid when the contained protocols parse
+// completely and consume all of the push ops. More than one valid split is ambiguous and is
+// rejected instead of guessing. The parse of the valid split is kept so the contained protocols
+// are only parsed once for each split. The search is limited so the contained protocols can't
+// have more than MaxUnknownWrapperSearch push ops and no more than MaxUnknownWrapperSearch splits
+// are tried for the whole message. When unknown protocols are adjacent the push ops can't be
+// separated between them so they all belong to the innermost of them.
+func (ps *Protocols) parseUnknownWrapper(result *ParsedMessage, payload envelope.Data,
+	source bitcoin.Script, offsets []int, signed bool, limits ParseLimits,
+	searches *int) (*ParsedMessage, error) {
+
+	if ps.GetProtocol(payload.ProtocolIDs[1]) == nil {
+		layer := newLayer(payload.ProtocolIDs[0], NewUnknownWrapper(payload.ProtocolIDs[0], nil),
+			signed, payload, source, offsets)
+		layer.Bytes = source[offsets[0]:offsets[0]:offsets[0]]
+		result.Layers = append(result.Layers, layer)
+
+		inner := envelope.Data{
+			ProtocolIDs: payload.ProtocolIDs[1:],
+			Payload:     payload.Payload,
+		}
+		return ps.parsePayload(result, inner, source, offsets, signed, limits, searches, nil)
+	}
+
+	minCount := 0
+	if limits.MaxUnknownWrapperSearch > 0 && len(payload.Payload) > limits.MaxUnknownWrapperSearch {
+		minCount = len(payload.Payload) - limits.MaxUnknownWrapperSearch
+	}
+
+	var found *ParsedMessage
+	for count := len(payload.Payload); count >= minCount; count-- {
+		if limits.MaxUnknownWrapperSearch > 0 {
+			if *searches <= 0 {
+				return nil, errors.Wrapf(ErrLimitExceeded, "unknown wrapper search over %d",
+					limits.MaxUnknownWrapperSearch)
+			}
+			*searches--
+		}
+
+		layer := newLayer(payload.ProtocolIDs[0],
+			NewUnknownWrapper(payload.ProtocolIDs[0], payload.Payload[:count]), signed, payload,
+			source, offsets)
+		layer.Bytes = source[offsets[0]:offsets[count]:offsets[count]]
+
+		trial := &ParsedMessage{
+			header: result.header,
+			Layers: append(append([]*Layer{}, result.Layers...), layer),
+		}
+
+		inner := envelope.Data{
+			ProtocolIDs: payload.ProtocolIDs[1:],
+			Payload:     payload.Payload[count:],
+		}
+
+		parsed, err := ps.parsePayload(trial, inner, source, offsets[count:], signed, limits,
+			searches, nil)
+		if err != nil {
+			if errors.Cause(err) == ErrLimitExceeded {
+				return nil, err
+			}
+			continue
+		}
+		if !parsed.complete || !consumedAll(parsed) {
+			continue
+		}
+
+		if found != nil {
+			return nil, errors.Wrap(ErrUnsupportedProtocol, "ambiguous contained protocols")
+		}
+		found = parsed
+	}
+
+	if found == nil {
+		return nil, errors.Wrap(ErrUnsupportedProtocol, "contained protocols not parsable")
+	}
+
+	return found, nil
+}
+
+// consumedAll returns true if the innermost layer consumed all of the push ops it covers.
+func consumedAll(parsed *ParsedMessage) bool {
+	last := parsed.Layers[len(parsed.Layers)-1]
+	return len(last.Bytes) == len(last.CoveredBytes)
+}
@@ -0,0 +1,186 @@
+package channels
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	envelopeV1 "github.com/tokenized/envelope/pkg/golang/envelope/v1"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+func Test_UnknownWrapper(t *testing.T) {
+	key, _ := bitcoin.GenerateKey(bitcoin.MainNet)
+
+	id := UUID(uuid.New())
+	replyTo := &ReplyTo{Handle: stringPtr("test@test.com")}
+
+	script, err := Wrap(&id, NewTimeMessage(Now()), replyTo, NewSignature(key, nil, true))
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+	t.Logf("Script : %s", script)
+
+	// Reply to and signatures are not supported.
+	protocols := NewProtocols(NewTimeProtocol(), NewUUIDProtocol())
+	if _, _, err := protocols.Parse(script); errors.Cause(err) != ErrUnsupportedProtocol {
+		t.Fatalf("Wrong strict parse error : got %v, want %s", err, ErrUnsupportedProtocol)
+	}
+
+	protocols.SetLenient(true)
+	msg, wrappers, err := protocols.Parse(script)
+	if err != nil {
+		t.Fatalf("Failed to parse : %s", err)
+	}
+
+	readID, ok := msg.(*UUID)
+	if !ok {
+		t.Fatalf("Message should be a UUID : %T", msg)
+	}
+
+	if !bytes.Equal(readID[:], id[:]) {
+		t.Errorf("Wrong UUID : got %s, want %s", readID, id)
+	}
+
+	if len(wrappers) != 3 {
+		t.Fatalf("Wrong wrapper count : got %d, want %d", len(wrappers), 3)
+	}
+
+	for i, wantProtocolID := range [][]byte{ProtocolIDSignedMessages, ProtocolIDReplyTo} {
+		unknown, ok := wrappers[i].(*UnknownWrapper)
+		if !ok {
+			t.Fatalf("Wrapper %d should be unknown : %T", i, wrappers[i])
+		}
+
+		if !bytes.Equal(unknown.ProtocolID(), wantProtocolID) {
+			t.Errorf("Wrong wrapper %d protocol id : got %s, want %s", i, unknown.ProtocolID(),
+				wantProtocolID)
+		}
+
+		js, err := json.Marshal(unknown)
+		if err != nil {
+			t.Fatalf("Failed to marshal json : %s", err)
+		}
+		t.Logf("JSON : %s", js)
+
+		readUnknown := &UnknownWrapper{}
+		if err := json.Unmarshal(js, readUnknown); err != nil {
+			t.Fatalf("Failed to unmarshal json : %s", err)
+		}
+
+		if !bytes.Equal(readUnknown.ProtocolID(), wantProtocolID) {
+			t.Errorf("Wrong json wrapper %d protocol id : got %s, want %s", i,
+				readUnknown.ProtocolID(), wantProtocolID)
+		}
+	}
+
+	if _, ok := wrappers[2].(*TimeMessage); !ok {
+		t.Fatalf("Inner wrapper should be a time : %T", wrappers[2])
+	}
+
+	// Wrappers are applied innermost first.
+	var reversed []Wrapper
+	for i := len(wrappers) - 1; i >= 0; i-- {
+		reversed = append(reversed, wrappers[i])
+	}
+
+	rewrapped, err := Wrap(readID, reversed...)
+	if err != nil {
+		t.Fatalf("Failed to wrap again : %s", err)
+	}
+
+	if !bytes.Equal(rewrapped, script) {
+		t.Fatalf("Wrong rewrapped script : \n  got  %s\n  want %s", rewrapped, script)
+	}
+
+	// The signature still verifies when parsed by a full implementation.
+	fullProtocols := NewProtocols(NewSignedProtocol(), NewReplyToProtocol(), NewTimeProtocol(),
+		NewUUIDProtocol())
+	_, fullWrappers, err := fullProtocols.Parse(rewrapped)
+	if err != nil {
+		t.Fatalf("Failed to parse rewrapped : %s", err)
+	}
+
+	if err := fullWrappers[0].(*Signature).Verify(); err != nil {
+		t.Fatalf("Failed to verify rewrapped signature : %s", err)
+	}
+}
+
+// testGreedy is a protocol whose messages consume all of the push ops of the payload so any split
+// of an unknown wrapper around it parses.
+type testGreedy struct{}
+
+func (*testGreedy) ProtocolID() envelope.ProtocolID {
+	return envelope.ProtocolID("GR")
+}
+
+func (g *testGreedy) Parse(payload envelope.Data) (Message, envelope.Data, error) {
+	return g, envelope.Data{}, nil
+}
+
+func (*testGreedy) ResponseCodeToString(code uint32) string {
+	return "parse_error"
+}
+
+func Test_UnknownWrapper_Split(t *testing.T) {
+	items := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(1),
+		bitcoin.PushNumberScriptItem(2)}
+
+	// More than one split parses completely so the split is ambiguous.
+	script, err := envelopeV1.Wrap(envelope.Data{
+		ProtocolIDs: envelope.ProtocolIDs{envelope.ProtocolID("zz"), envelope.ProtocolID("GR")},
+		Payload:     items,
+	}).Script()
+	if err != nil {
+		t.Fatalf("Failed to create script : %s", err)
+	}
+
+	protocols := NewProtocols(&testGreedy{})
+	protocols.SetLenient(true)
+	if _, _, err := protocols.Parse(script); errors.Cause(err) != ErrUnsupportedProtocol {
+		t.Fatalf("Wrong ambiguous error : got %v, want %s", err, ErrUnsupportedProtocol)
+	}
+
+	// Adjacent unknown wrappers can't be separated so the innermost has all of the push ops.
+	id := UUID(uuid.New())
+	uuidPayload, err := id.Write()
+	if err != nil {
+		t.Fatalf("Failed to write uuid : %s", err)
+	}
+
+	script, err = envelopeV1.Wrap(envelope.Data{
+		ProtocolIDs: append(envelope.ProtocolIDs{envelope.ProtocolID("yy"),
+			envelope.ProtocolID("zz")}, uuidPayload.ProtocolIDs...),
+		Payload: append(items, uuidPayload.Payload...),
+	}).Script()
+	if err != nil {
+		t.Fatalf("Failed to create script : %s", err)
+	}
+
+	protocols = NewProtocols(NewUUIDProtocol())
+	protocols.SetLenient(true)
+	_, wrappers, err := protocols.Parse(script)
+	if err != nil {
+		t.Fatalf("Failed to parse : %s", err)
+	}
+
+	if len(wrappers) != 2 {
+		t.Fatalf("Wrong wrapper count : got %d, want %d", len(wrappers), 2)
+	}
+
+	for i, wantCount := range []int{0, len(items)} {
+		unknown, ok := wrappers[i].(*UnknownWrapper)
+		if !ok {
+			t.Fatalf("Wrapper %d should be unknown : %T", i, wrappers[i])
+		}
+
+		if len(unknown.Payload) != wantCount {
+			t.Errorf("Wrong wrapper %d push op count : got %d, want %d", i,
+				len(unknown.Payload), wantCount)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package unlocking_data
+
+import (
+	"testing"
+
+	"github.com/tokenized/channels"
+	envelopeV1 "github.com/tokenized/envelope/pkg/golang/envelope/v1"
+	"github.com/tokenized/pkg/bitcoin"
+)
+
+func Fuzz_Parse(f *testing.F) {
+	for _, msg := range []channels.Writer{
+		&UnlockingData{},
+	} {
+		script, err := channels.Wrap(msg)
+		if err != nil {
+			f.Fatalf("Failed to wrap %T : %s", msg, err)
+		}
+		f.Add([]byte(script))
+	}
+
+	version0, err := (&UnlockingData{Size: 100, Value: 1000,
+		Party: PartyCounterParty}).WriteVersion(0)
+	if err != nil {
+		f.Fatalf("Failed to write version 0 : %s", err)
+	}
+	script, err := envelopeV1.Wrap(version0).Script()
+	if err != nil {
+		f.Fatalf("Failed to create version 0 script : %s", err)
+	}
+	f.Add([]byte(script))
+
+	// Version 0 with an empty push data (OP_PUSHDATA1 0) for the size.
+	f.Add([]byte{0x00, 0x6a, 0x02, 0xbd, 0x01, 0x51, 0x02, 0x55, 0x4c, 0x53, 0x00, 0x4c, 0x00,
+		0x51})
+
+	protocols := channels.NewProtocols(NewProtocol())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		script := bitcoin.Script(b)
+		if payload, err := channels.ParseEnvelope(script); err == nil {
+			Parse(payload)
+		}
+
+		protocols.Parse(script)
+	})
+}
@@ -1,13 +1,9 @@
 package unlocking_data
 
 import (
-	"bytes"
-	"fmt"
-
 	"github.com/tokenized/channels"
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
 	"github.com/tokenized/pkg/bitcoin"
-	"github.com/tokenized/pkg/bsor"
 
 	"github.com/pkg/errors"
 )
@@ -17,6 +13,14 @@ var (
 	Version    = uint8(1)
 
 	ErrUnsupportedVersion = errors.New("Unsupported Operator Version")
+
+	codec = channels.NewCodec(ProtocolID, Version, "unlocking data", &UnlockingData{}).
+		SetErrUnsupportedVersion(ErrUnsupportedVersion).
+		AddVersion(&channels.CodecVersion{
+			Version:   0,
+			Unmarshal: unmarshalVersion0,
+			Marshal:   marshalVersion0,
+		})
 )
 
 type Protocol struct{}
@@ -33,6 +37,12 @@ func (*Protocol) Parse(payload envelope.Data) (channels.Message, envelope.Data,
 	return Parse(payload)
 }
 
+// SupportedProtocols returns the protocol IDs that advertise the versions of unlocking data that
+// are supported. They are included in the supported protocols of a channel configuration.
+func SupportedProtocols() envelope.ProtocolIDs {
+	return codec.SupportedProtocols()
+}
+
 func (*Protocol) ResponseCodeToString(code uint32) string {
 	return "parse_error"
 }
@@ -53,76 +63,64 @@ func (*UnlockingData) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *UnlockingData) Write() (envelope.Data, error) {
-	// // Version 0
-	// payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
-
-	// // Message
-	// payload = append(payload, bitcoin.PushNumberScriptItemUnsigned(m.Size))
-	// payload = append(payload, bitcoin.PushNumberScriptItemUnsigned(m.Value))
-
-	// return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.Write(m)
+}
 
-	// Version 1
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(Version))}
+// WriteVersion writes the message in the specified version.
+func (m *UnlockingData) WriteVersion(version uint8) (envelope.Data, error) {
+	return codec.WriteVersion(m, version)
+}
 
-	data, err := bsor.Marshal(m)
+// WriteFor writes the message in the highest version that the counterparty advertised in its
+// supported protocols, or the current version when it doesn't advertise any versions.
+func (m *UnlockingData) WriteFor(supportedProtocols envelope.ProtocolIDs) (envelope.Data, error) {
+	version, err := codec.SelectVersion(supportedProtocols)
 	if err != nil {
-		return envelope.Data{}, errors.Wrap(err, "marshal")
+		return envelope.Data{}, errors.Wrap(err, "version")
 	}
-	payload = append(payload, data...)
 
-	return envelope.Data{envelope.ProtocolIDs{ProtocolID}, payload}, nil
+	return codec.WriteVersion(m, version)
 }
 
-func Parse(payload envelope.Data) (channels.Message, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 {
-		return nil, payload, nil
-	}
+// unmarshalVersion0 decodes version 0 which only contains the size and value.
+func unmarshalVersion0(message channels.Message,
+	scriptItems bitcoin.ScriptItems) (bitcoin.ScriptItems, error) {
 
-	if !bytes.Equal(payload.ProtocolIDs[0], ProtocolID) {
-		return nil, payload, nil
+	if len(scriptItems) < 2 {
+		return nil, errors.Wrapf(channels.ErrInvalidMessage, "3 push datas needed")
 	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
 
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
+	size, err := channels.ScriptNumberValueUnsigned(scriptItems[0])
 	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
+		return nil, errors.Wrap(err, "size script number")
 	}
-	if version == 0 {
-		if len(payload.Payload) < 3 {
-			return nil, payload, errors.Wrapf(channels.ErrInvalidMessage, "3 push datas needed")
-		}
-
-		size, err := bitcoin.ScriptNumberValueUnsigned(payload.Payload[1])
-		if err != nil {
-			return nil, payload, errors.Wrap(err, "size script number")
-		}
-
-		value, err := bitcoin.ScriptNumberValueUnsigned(payload.Payload[2])
-		if err != nil {
-			return nil, payload, errors.Wrap(err, "value script number")
-		}
-
-		payload.Payload = payload.Payload[3:]
-
-		result := &UnlockingData{
-			Size:  size,
-			Value: value,
-			Party: 1, // default to first counterparty for version 0
-		}
-
-		return result, payload, nil
-	} else if version != 1 {
-		return nil, payload, errors.Wrap(ErrUnsupportedVersion, fmt.Sprintf("%d", version))
+
+	value, err := channels.ScriptNumberValueUnsigned(scriptItems[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "value script number")
 	}
 
-	result := &UnlockingData{}
+	m := message.(*UnlockingData)
+	m.Size = size
+	m.Value = value
+	m.Party = PartyCounterParty // default to first counterparty for version 0
 
-	remaining, err := bsor.Unmarshal(payload.Payload[1:], result)
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "unmarshal")
+	return scriptItems[2:], nil
+}
+
+// marshalVersion0 encodes version 0 which can't specify the party.
+func marshalVersion0(message channels.Message) (bitcoin.ScriptItems, error) {
+	m := message.(*UnlockingData)
+	if m.Party != PartyCounterParty {
+		return nil, errors.Wrapf(ErrUnsupportedVersion, "party %d in version 0", m.Party)
 	}
 
-	payload.Payload = remaining
-	return result, payload, nil
+	return bitcoin.ScriptItems{
+		bitcoin.PushNumberScriptItemUnsigned(m.Size),
+		bitcoin.PushNumberScriptItemUnsigned(m.Value),
+	}, nil
+}
+
+func Parse(payload envelope.Data) (channels.Message, envelope.Data, error) {
+	return codec.Parse(payload)
 }
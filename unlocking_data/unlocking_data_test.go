@@ -0,0 +1,172 @@
+package unlocking_data
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tokenized/channels"
+	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/pkg/errors"
+)
+
+func Test_Version0(t *testing.T) {
+	// Version 0 as it was written before version 1 existed.
+	payload := envelope.Data{
+		ProtocolIDs: envelope.ProtocolIDs{ProtocolID},
+		Payload: bitcoin.ScriptItems{
+			bitcoin.PushNumberScriptItem(0),
+			bitcoin.PushNumberScriptItemUnsigned(107),
+			bitcoin.PushNumberScriptItemUnsigned(1000),
+		},
+	}
+
+	msg, _, err := Parse(payload)
+	if err != nil {
+		t.Fatalf("Failed to parse version 0 : %s", err)
+	}
+
+	unlockingData, ok := msg.(*UnlockingData)
+	if !ok {
+		t.Fatalf("Wrong message type : %T", msg)
+	}
+
+	if unlockingData.Size != 107 || unlockingData.Value != 1000 {
+		t.Errorf("Wrong size and value : got %d %d, want %d %d", unlockingData.Size,
+			unlockingData.Value, 107, 1000)
+	}
+
+	if unlockingData.Party != PartyCounterParty {
+		t.Errorf("Wrong party : got %d, want %d", unlockingData.Party, PartyCounterParty)
+	}
+
+	written, err := unlockingData.WriteVersion(0)
+	if err != nil {
+		t.Fatalf("Failed to write version 0 : %s", err)
+	}
+
+	writtenScript, _ := written.Payload.Script()
+	payloadScript, _ := payload.Payload.Script()
+	if !writtenScript.Equal(payloadScript) {
+		t.Errorf("Wrong version 0 payload : \ngot  %s\nwant %s", writtenScript, payloadScript)
+	}
+
+	// Version 0 can't contain the party.
+	unlockingData.Party = PartyInitiator
+	if _, err := unlockingData.WriteVersion(0); errors.Cause(err) != ErrUnsupportedVersion {
+		t.Errorf("Wrong party error : got %v, want %s", err, ErrUnsupportedVersion)
+	}
+
+	payload.Payload[0] = bitcoin.PushNumberScriptItem(2)
+	if _, _, err := Parse(payload); errors.Cause(err) != ErrUnsupportedVersion {
+		t.Errorf("Wrong version error : got %v, want %s", err, ErrUnsupportedVersion)
+	}
+}
+
+func Test_WriteFor(t *testing.T) {
+	tests := []struct {
+		name               string
+		party              Party
+		supportedProtocols envelope.ProtocolIDs
+		version            int64
+		err                error
+	}{
+		{
+			name:    "not specified",
+			party:   PartyCounterParty,
+			version: 1,
+		},
+		{
+			name:    "not specified other party",
+			party:   Party(2),
+			version: 1,
+		},
+		{
+			name:               "unversioned",
+			party:              PartyCounterParty,
+			supportedProtocols: envelope.ProtocolIDs{ProtocolID},
+			version:            1,
+		},
+		{
+			name:  "version 0",
+			party: PartyCounterParty,
+			supportedProtocols: envelope.ProtocolIDs{ProtocolID,
+				channels.VersionedProtocolID(ProtocolID, 0)},
+			version: 0,
+		},
+		{
+			name:  "version 0 other party",
+			party: Party(2),
+			supportedProtocols: envelope.ProtocolIDs{ProtocolID,
+				channels.VersionedProtocolID(ProtocolID, 0)},
+			err: ErrUnsupportedVersion,
+		},
+		{
+			name:               "all",
+			party:              PartyCounterParty,
+			supportedProtocols: SupportedProtocols(),
+			version:            1,
+		},
+		{
+			name:  "newer",
+			party: PartyCounterParty,
+			supportedProtocols: envelope.ProtocolIDs{ProtocolID,
+				channels.VersionedProtocolID(ProtocolID, 2)},
+			err: ErrUnsupportedVersion,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unlockingData := &UnlockingData{
+				Size:  107,
+				Value: 1000,
+				Party: tt.party,
+			}
+
+			payload, err := unlockingData.WriteFor(tt.supportedProtocols)
+			if tt.err != nil {
+				if errors.Cause(err) != tt.err {
+					t.Fatalf("Wrong error : got %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to write : %s", err)
+			}
+
+			version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
+			if err != nil {
+				t.Fatalf("Failed to read version : %s", err)
+			}
+
+			if version != tt.version {
+				t.Errorf("Wrong version : got %d, want %d", version, tt.version)
+			}
+
+			msg, _, err := Parse(payload)
+			if err != nil {
+				t.Fatalf("Failed to parse : %s", err)
+			}
+
+			if *msg.(*UnlockingData) != *unlockingData {
+				t.Errorf("Wrong message : got %+v, want %+v", msg, unlockingData)
+			}
+		})
+	}
+
+	supportedProtocols := SupportedProtocols()
+	want := envelope.ProtocolIDs{ProtocolID, channels.VersionedProtocolID(ProtocolID, 1),
+		channels.VersionedProtocolID(ProtocolID, 0)}
+	if len(supportedProtocols) != len(want) {
+		t.Fatalf("Wrong supported protocols : got %v, want %v", supportedProtocols, want)
+	}
+
+	for i := range want {
+		if !bytes.Equal(supportedProtocols[i], want[i]) {
+			t.Errorf("Wrong supported protocol %d : got %s, want %s", i, supportedProtocols[i],
+				want[i])
+		}
+	}
+}
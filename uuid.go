@@ -1,9 +1,6 @@
 package channels
 
 import (
-	"bytes"
-	"fmt"
-
 	envelope "github.com/tokenized/envelope/pkg/golang/envelope/base"
 	"github.com/tokenized/pkg/bitcoin"
 
@@ -13,11 +10,17 @@ import (
 
 const (
 	UUIDVersion = uint8(0)
+
+	// UUIDStatusDuplicate is a code specific to the uuid protocol that is placed in a Reject
+	// message to signify that a message with the same uuid was already received.
+	UUIDStatusDuplicate = uint32(1)
 )
 
 var (
 	ProtocolIDUUID = envelope.ProtocolID("UUID") // Protocol ID for uuid
 
+	uuidCodec = NewCodec(ProtocolIDUUID, UUIDVersion, "uuid", &UUID{})
+
 	ErrInvalidUUID = errors.New("Invalid UUID")
 )
 
@@ -38,7 +41,7 @@ func (*UUIDProtocol) Parse(payload envelope.Data) (Message, envelope.Data, error
 }
 
 func (*UUIDProtocol) ResponseCodeToString(code uint32) string {
-	return SignedResponseCodeToString(code)
+	return UUIDResponseCodeToString(code)
 }
 
 func (*UUID) IsWrapperType() {}
@@ -48,13 +51,7 @@ func (*UUID) ProtocolID() envelope.ProtocolID {
 }
 
 func (m *UUID) Write() (envelope.Data, error) {
-	// Version
-	payload := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(UUIDVersion))}
-
-	// Message
-	payload = append(payload, bitcoin.NewPushDataScriptItem(m[:]))
-
-	return envelope.Data{envelope.ProtocolIDs{ProtocolIDUUID}, payload}, nil
+	return uuidCodec.Write(m)
 }
 
 // WrapUUID wraps the payload with the uuid and returns the new payload containing the uuid.
@@ -64,48 +61,42 @@ func WrapUUID(payload envelope.Data, id uuid.UUID) (envelope.Data, error) {
 }
 
 func (m *UUID) Wrap(payload envelope.Data) (envelope.Data, error) {
-	// Version
-	scriptItems := bitcoin.ScriptItems{bitcoin.PushNumberScriptItem(int64(UUIDVersion))}
-
-	// Message
-	scriptItems = append(scriptItems, bitcoin.NewPushDataScriptItem(m[:]))
-
-	payload.ProtocolIDs = append(envelope.ProtocolIDs{ProtocolIDUUID}, payload.ProtocolIDs...)
-	payload.Payload = append(scriptItems, payload.Payload...)
+	return uuidCodec.Wrap(m, payload)
+}
 
-	return payload, nil
+func (m *UUID) MarshalScriptItems() (bitcoin.ScriptItems, error) {
+	return bitcoin.ScriptItems{bitcoin.NewPushDataScriptItem(m[:])}, nil
 }
 
-func ParseUUID(payload envelope.Data) (*UUID, envelope.Data, error) {
-	if len(payload.ProtocolIDs) == 0 || !bytes.Equal(payload.ProtocolIDs[0], ProtocolIDUUID) {
-		return nil, payload, nil
-	}
-	payload.ProtocolIDs = payload.ProtocolIDs[1:]
+func (m *UUID) UnmarshalScriptItems(scriptItems bitcoin.ScriptItems) (bitcoin.ScriptItems,
+	error) {
 
-	if len(payload.Payload) < 2 {
-		return nil, payload, errors.Wrapf(ErrInvalidMessage, "not enough uuid push ops: %d",
-			len(payload.Payload))
+	if len(scriptItems) == 0 || scriptItems[0].Type != bitcoin.ScriptItemTypePushData {
+		return nil, errors.Wrap(ErrInvalidUUID, "not push data")
 	}
 
-	version, err := bitcoin.ScriptNumberValue(payload.Payload[0])
-	if err != nil {
-		return nil, payload, errors.Wrap(err, "version")
-	}
-	if version != 0 {
-		return nil, payload, errors.Wrap(ErrUnsupportedVersion, fmt.Sprintf("uuid: %d", version))
+	if len(scriptItems[0].Data) != len(m[:]) {
+		return nil, errors.Wrapf(ErrInvalidUUID, "wrong size: %d", len(scriptItems[0].Data))
 	}
+	copy(m[:], scriptItems[0].Data)
 
-	if payload.Payload[1].Type != bitcoin.ScriptItemTypePushData {
-		return nil, payload, errors.Wrap(ErrInvalidUUID, "not push data")
-	}
+	return scriptItems[1:], nil
+}
 
-	var result UUID
-	if len(payload.Payload[1].Data) != len(result[:]) {
-		return nil, payload, errors.Wrapf(ErrInvalidUUID, "wrong size: %d",
-			len(payload.Payload[1].Data))
+func ParseUUID(payload envelope.Data) (*UUID, envelope.Data, error) {
+	msg, payload, err := uuidCodec.Parse(payload)
+	if msg == nil {
+		return nil, payload, err
 	}
-	copy(result[:], payload.Payload[1].Data)
 
-	payload.Payload = payload.Payload[2:]
-	return &result, payload, nil
+	return msg.(*UUID), payload, nil
+}
+
+func UUIDResponseCodeToString(code uint32) string {
+	switch code {
+	case UUIDStatusDuplicate:
+		return "duplicate"
+	default:
+		return "parse_error"
+	}
 }
@@ -0,0 +1,79 @@
+package uuid_response_handler
+
+import (
+	"strconv"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/pkg/bitcoin"
+
+	"github.com/google/uuid"
+)
+
+// ExtractKey returns the key that correlates a response with a registration. It is called with
+// the message and wrappers parsed from each received message, or only the wrappers outside of an
+// unsupported protocol, and returns false if they don't contain a key.
+type ExtractKey func(msg channels.Message, wrappers []channels.Wrapper) (string, bool)
+
+// ExtractUUID returns the key from the UUID wrapper. It is the default.
+func ExtractUUID(msg channels.Message, wrappers []channels.Wrapper) (string, bool) {
+	for _, wrapper := range wrappers {
+		if id, ok := wrapper.(*channels.UUID); ok {
+			return UUIDKey(uuid.UUID(*id)), true
+		}
+	}
+
+	return "", false
+}
+
+// ExtractStringID returns the key from the StringID wrapper, like a negotiation thread ID.
+func ExtractStringID(msg channels.Message, wrappers []channels.Wrapper) (string, bool) {
+	for _, wrapper := range wrappers {
+		if id, ok := wrapper.(*channels.StringID); ok {
+			return StringIDKey(id.StringID), true
+		}
+	}
+
+	return "", false
+}
+
+// ExtractMessageID returns the key from the MessageID wrapper.
+func ExtractMessageID(msg channels.Message, wrappers []channels.Wrapper) (string, bool) {
+	for _, wrapper := range wrappers {
+		if id, ok := wrapper.(*channels.MessageID); ok {
+			return MessageIDKey(id.MessageID), true
+		}
+	}
+
+	return "", false
+}
+
+// ExtractTxID returns the key from the TxID wrapper.
+func ExtractTxID(msg channels.Message, wrappers []channels.Wrapper) (string, bool) {
+	for _, wrapper := range wrappers {
+		if txid, ok := wrapper.(*channels.TxID); ok {
+			return TxIDKey(bitcoin.Hash32(*txid)), true
+		}
+	}
+
+	return "", false
+}
+
+// UUIDKey returns the key to register for a response extracted by ExtractUUID.
+func UUIDKey(id uuid.UUID) string {
+	return id.String()
+}
+
+// StringIDKey returns the key to register for a response extracted by ExtractStringID.
+func StringIDKey(id string) string {
+	return id
+}
+
+// MessageIDKey returns the key to register for a response extracted by ExtractMessageID.
+func MessageIDKey(id uint64) string {
+	return strconv.FormatUint(id, 10)
+}
+
+// TxIDKey returns the key to register for a response extracted by ExtractTxID.
+func TxIDKey(txid bitcoin.Hash32) string {
+	return txid.String()
+}
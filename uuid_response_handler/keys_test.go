@@ -0,0 +1,110 @@
+package uuid_response_handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/pkg/bitcoin"
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/google/uuid"
+)
+
+func Test_ExtractKey(t *testing.T) {
+	id := uuid.New()
+	uuidWrapper := channels.UUID(id)
+	txid := channels.TxID(*channels.RandomHashPtr())
+
+	wrappers := []channels.Wrapper{
+		&uuidWrapper,
+		channels.NewStringID("thread"),
+		&channels.MessageID{MessageID: 12},
+		&txid,
+	}
+
+	tests := []struct {
+		name       string
+		extractKey ExtractKey
+		want       string
+	}{
+		{
+			name:       "uuid",
+			extractKey: ExtractUUID,
+			want:       UUIDKey(id),
+		},
+		{
+			name:       "string id",
+			extractKey: ExtractStringID,
+			want:       StringIDKey("thread"),
+		},
+		{
+			name:       "message id",
+			extractKey: ExtractMessageID,
+			want:       MessageIDKey(12),
+		},
+		{
+			name:       "txid",
+			extractKey: ExtractTxID,
+			want:       TxIDKey(bitcoin.Hash32(txid)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, found := tt.extractKey(nil, wrappers)
+			if !found {
+				t.Fatalf("Key not found")
+			}
+
+			if key != tt.want {
+				t.Errorf("Wrong key : got %s, want %s", key, tt.want)
+			}
+
+			if _, found := tt.extractKey(nil, nil); found {
+				t.Errorf("Key should not be found without wrappers")
+			}
+		})
+	}
+}
+
+func Test_StringIDResponse(t *testing.T) {
+	ctx := context.Background()
+
+	handler := NewHandler()
+	handler.SetExtractKey(ExtractStringID)
+	handler.SetProtocols(channels.NewProtocols(channels.NewStringIDProtocol()))
+	handler.SetAddUpdate(func(update interface{}) error {
+		return handler.HandleUpdate(ctx, update)
+	})
+
+	channelID := uuid.New().String()
+	responseChannel := handler.RegisterForKey(channelID, StringIDKey("thread"))
+
+	// The response protocol isn't in the set so only the string id wrapper is parsed.
+	response := &channels.Response{
+		Status: channels.StatusOK,
+	}
+	payload, err := channels.Wrap(response, channels.NewStringID("thread"))
+	if err != nil {
+		t.Fatalf("Failed to wrap message : %s", err)
+	}
+
+	msg := peer_channels.Message{
+		ChannelID: channelID,
+		Payload:   bitcoin.Hex(payload),
+	}
+	if err := handler.HandleMessage(ctx, msg); err != nil {
+		t.Fatalf("Failed to handle message : %s", err)
+	}
+
+	received, err := WaitWithTimeout(responseChannel, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to wait for response : %s", err)
+	}
+
+	if received.ChannelID != channelID {
+		t.Errorf("Wrong channel : got %s, want %s", received.ChannelID, channelID)
+	}
+}
@@ -0,0 +1,137 @@
+package uuid_response_handler
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/channels/metrics"
+	"github.com/tokenized/logger"
+	"github.com/tokenized/pkg/peer_channels"
+)
+
+const (
+	// DefaultSubscriptionSize is the number of messages a subscription buffers before it is closed
+	// because they aren't being received.
+	DefaultSubscriptionSize = 100
+)
+
+// IsTerminal returns true if the message is the last one that should be delivered to a
+// subscription.
+type IsTerminal func(msg channels.Message, wrappers []channels.Wrapper) bool
+
+// Subscribe registers for every message on the specified channel for which the key extractor
+// returns the specified key. Messages are written to the returned channel until the cancel
+// function is called, the context is done, the ttl passes without a message, or isTerminal
+// returns true, in which case that message is the last one written. A ttl of zero uses the default
+// TTL and a nil isTerminal never ends the subscription. The channel is closed when the subscription
+// is removed. If the buffer of the channel is full when a message is received then the
+// subscription is removed and the message is dropped.
+func (h *Handler) Subscribe(ctx context.Context, channelID, key string, ttl time.Duration,
+	isTerminal IsTerminal) (<-chan peer_channels.Message, func(), error) {
+
+	if ttl == 0 {
+		ttl = h.defaultTTL
+	}
+
+	handler := newMessageHandler(channelID, key, ttl)
+	handler.response = make(chan peer_channels.Message, h.subscriptionSize)
+	handler.subscription = true
+	handler.isTerminal = isTerminal
+	handler.ttl = ttl
+
+	cancel, err := h.add(ctx, handler)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return handler.response, cancel, nil
+}
+
+// SetSubscriptionSize sets the number of messages each subscription buffers. It must be called
+// before subscribing.
+func (h *Handler) SetSubscriptionSize(size int) {
+	h.subscriptionSize = size
+}
+
+// deliver writes a message to a subscription and removes the subscription if the message is
+// terminal.
+func (h *Handler) deliver(ctx context.Context, handler *messageHandler,
+	msg peer_channels.Message, message channels.Message, wrappers []channels.Wrapper) {
+
+	select {
+	case handler.response <- msg:
+	default:
+		logger.WarnWithFields(ctx, []logger.Field{
+			logger.String("key", handler.key),
+			logger.String("channel_id", msg.ChannelID),
+			logger.Uint64("sequence", msg.Sequence),
+		}, "Subscription buffer full")
+		h.remove(handler)
+		h.metrics.AddCounter(MetricRemoved, metrics.Labels{"reason": "overflow"}, 1)
+		handler.close()
+		return
+	}
+
+	h.reportResponse("matched")
+
+	if handler.isTerminal != nil && handler.isTerminal(message, wrappers) {
+		h.remove(handler)
+		handler.close()
+		return
+	}
+
+	if handler.ttl != 0 {
+		handler.expires = time.Now().Add(handler.ttl)
+	}
+}
+
+// TerminalResponse ends a subscription with a message that is, or is wrapped in, a response.
+func TerminalResponse(msg channels.Message, wrappers []channels.Wrapper) bool {
+	return findResponse(msg, wrappers) != nil
+}
+
+// TerminalRejection ends a subscription with a response that doesn't have an OK status. Messages
+// wrapped in a response with an OK status, like an acceptance, don't end the subscription.
+func TerminalRejection(msg channels.Message, wrappers []channels.Wrapper) bool {
+	response := findResponse(msg, wrappers)
+	return response != nil && response.Status != channels.StatusOK
+}
+
+// TerminalMessageType returns a condition that ends a subscription with a message of the same
+// type as the example, for example &invoices.TransferAccept{}. The message's protocol must be in
+// the handler's protocols to be parsed.
+func TerminalMessageType(example channels.Message) IsTerminal {
+	typ := reflect.TypeOf(example)
+	return func(msg channels.Message, wrappers []channels.Wrapper) bool {
+		return msg != nil && reflect.TypeOf(msg) == typ
+	}
+}
+
+// AnyTerminal returns a condition that ends a subscription when any of the conditions do.
+func AnyTerminal(conditions ...IsTerminal) IsTerminal {
+	return func(msg channels.Message, wrappers []channels.Wrapper) bool {
+		for _, condition := range conditions {
+			if condition(msg, wrappers) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+func findResponse(msg channels.Message, wrappers []channels.Wrapper) *channels.Response {
+	if response, ok := msg.(*channels.Response); ok {
+		return response
+	}
+
+	for _, wrapper := range wrappers {
+		if response, ok := wrapper.(*channels.Response); ok {
+			return response
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package uuid_response_handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tokenized/channels"
+	"github.com/tokenized/channels/invoices"
+	"github.com/tokenized/channels/metrics"
+	"github.com/tokenized/channels/peer_channels_listener"
+	"github.com/tokenized/pkg/peer_channels"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+func Test_Subscribe(t *testing.T) {
+	ctx := context.Background()
+
+	m := metrics.NewMemory()
+	handler := NewHandler()
+	handler.SetExtractKey(ExtractStringID)
+	protocols := DefaultProtocols()
+	protocols.AddProtocols(invoices.NewProtocol())
+	handler.SetProtocols(protocols)
+	handler.SetMetrics(m)
+	handler.SetAddUpdate(func(update interface{}) error {
+		return handler.HandleUpdate(ctx, update)
+	})
+
+	channelID := uuid.New().String()
+	handle := func(msg channels.Writer, wrappers ...channels.Wrapper) error {
+		payload, err := channels.Wrap(msg, wrappers...)
+		if err != nil {
+			t.Fatalf("Failed to wrap message : %s", err)
+		}
+
+		return handler.HandleMessage(ctx, peer_channels.Message{
+			ChannelID: channelID,
+			Payload:   []byte(payload),
+		})
+	}
+
+	receive := func(messages <-chan peer_channels.Message) bool {
+		select {
+		case _, ok := <-messages:
+			return ok
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for message")
+		}
+		return false
+	}
+
+	// The subscription continues after an OK response and ends with the transfer accept.
+	isTerminal := AnyTerminal(TerminalRejection,
+		TerminalMessageType(&invoices.TransferAccept{}))
+	messages, cancel, err := handler.Subscribe(ctx, channelID, StringIDKey("accept"), 0,
+		isTerminal)
+	if err != nil {
+		t.Fatalf("Failed to subscribe : %s", err)
+	}
+	defer cancel()
+
+	ok := &channels.Response{Status: channels.StatusOK}
+	if err := handle(nil, ok, channels.NewStringID("accept")); err != nil {
+		t.Fatalf("Failed to handle response : %s", err)
+	}
+	if err := handle(&invoices.TransferAccept{}, ok, channels.NewStringID("accept")); err != nil {
+		t.Fatalf("Failed to handle accept : %s", err)
+	}
+	if err := handle(nil, ok, channels.NewStringID("accept")); errors.Cause(err) !=
+		peer_channels_listener.MessageNotRelevent {
+		t.Errorf("Message after terminal should not be relevant : %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if !receive(messages) {
+			t.Fatalf("Subscription closed before message %d", i)
+		}
+	}
+	if receive(messages) {
+		t.Fatalf("Subscription should be closed")
+	}
+
+	// A rejection ends the subscription.
+	messages, cancel, err = handler.Subscribe(ctx, channelID, StringIDKey("reject"), 0,
+		isTerminal)
+	if err != nil {
+		t.Fatalf("Failed to subscribe : %s", err)
+	}
+	defer cancel()
+
+	reject := &channels.Response{Status: channels.StatusReject}
+	if err := handle(nil, reject, channels.NewStringID("reject")); err != nil {
+		t.Fatalf("Failed to handle rejection : %s", err)
+	}
+
+	if !receive(messages) {
+		t.Fatalf("Subscription closed before rejection")
+	}
+	if receive(messages) {
+		t.Fatalf("Subscription should be closed")
+	}
+
+	// A subscription that isn't received from is removed when its buffer is full.
+	handler.SetSubscriptionSize(1)
+	messages, cancel, err = handler.Subscribe(ctx, channelID, StringIDKey("slow"), 0, nil)
+	if err != nil {
+		t.Fatalf("Failed to subscribe : %s", err)
+	}
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		if err := handle(nil, ok, channels.NewStringID("slow")); err != nil {
+			t.Fatalf("Failed to handle message : %s", err)
+		}
+	}
+
+	if !receive(messages) {
+		t.Fatalf("Subscription closed before first message")
+	}
+	if receive(messages) {
+		t.Fatalf("Subscription should be closed")
+	}
+
+	if count := m.Counter(MetricRemoved, metrics.Labels{"reason": "overflow"}); count != 1 {
+		t.Errorf("Wrong overflow count : got %f, want %f", count, 1.0)
+	}
+
+	if registrations, _ := m.Gauge(MetricRegistrations, nil); registrations != 0 {
+		t.Errorf("Wrong registrations : got %f, want %f", registrations, 0.0)
+	}
+}
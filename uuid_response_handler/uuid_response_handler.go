@@ -2,9 +2,11 @@ package uuid_response_handler
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/tokenized/channels"
+	"github.com/tokenized/channels/metrics"
 	"github.com/tokenized/channels/peer_channels_listener"
 	"github.com/tokenized/logger"
 	"github.com/tokenized/pkg/bitcoin"
@@ -14,66 +16,302 @@ import (
 	"github.com/pkg/errors"
 )
 
+const (
+	// MetricResponses counts messages handled. It is labeled with the result, which is "matched",
+	// "missing_id", "no_channel", or "no_id".
+	MetricResponses = "uuid_response_handler_responses"
+
+	// MetricRegistrations is a gauge of the registrations waiting for a response.
+	MetricRegistrations = "uuid_response_handler_registrations"
+
+	// MetricRemoved counts registrations removed before a response was received, or before the
+	// terminal message of a subscription. It is labeled with the reason, which is "cancelled",
+	// "expired", or "overflow".
+	MetricRemoved = "uuid_response_handler_removed"
+
+	// DefaultExpireFrequency is how often Run removes expired registrations.
+	DefaultExpireFrequency = 10 * time.Second
+)
+
 var (
 	ErrTimeout = errors.New("Timeout")
+
+	// ErrRegistrationClosed is returned when waiting for a response to a registration that was
+	// cancelled, expired, or replaced by a registration for the same channel and key.
+	ErrRegistrationClosed = errors.New("Registration Closed")
+
+	ErrUnsupportedUpdate = errors.New("Unsupported Update")
 )
 
 // type AddUpdate func(update *messageHandler)
 
-// Handler handles responses with UUIDs from peer channels. It expects only one response for each
-// UUID and will ignore any further responses.
+// Handler handles responses from peer channels that are correlated by a key, a UUID by default.
+// It expects only one response for each registered key and will ignore any further responses.
+// Subscriptions receive every message with their key until they end. Registrations are sharded by
+// channel ID so they are ordered with the messages on their channel when the listener has more
+// than one handle thread.
 type Handler struct {
-	handlers  map[string]map[uuid.UUID]*messageHandler
-	addUpdate peer_channels_listener.AddUpdate
+	handlers      map[string]map[string]*messageHandler
+	registrations int
+	lock          sync.Mutex
+
+	addUpdate        peer_channels_listener.AddUpdate
+	protocols        *channels.Protocols
+	extractKey       ExtractKey
+	metrics          metrics.Metrics
+	defaultTTL       time.Duration
+	expireFrequency  time.Duration
+	subscriptionSize int
 }
 
 type messageHandler struct {
 	channelID string
-	id        uuid.UUID
+	key       string
+	expires   time.Time // zero when the registration doesn't expire
 	response  chan peer_channels.Message
+
+	// subscription is true when every matching message is delivered instead of only the first.
+	subscription bool
+	isTerminal   IsTerminal
+	ttl          time.Duration // subscriptions expire after the ttl passes without a message
+
+	// done is closed when the registration is removed.
+	done chan struct{}
+}
+
+// cancelRegistration is an update that removes a registration.
+type cancelRegistration struct {
+	handler *messageHandler
+}
+
+// expireRegistrations is an update that removes registrations that expired before now. It is
+// broadcast to every handle thread so it is ordered with the messages on every channel.
+type expireRegistrations struct {
+	now time.Time
 }
 
+func (mh *messageHandler) ShardKey() string {
+	return mh.channelID
+}
+
+func (u *cancelRegistration) ShardKey() string {
+	return u.handler.channelID
+}
+
+func (u *expireRegistrations) Broadcast() {}
+
 func NewHandler() *Handler {
 	return &Handler{
-		handlers: make(map[string]map[uuid.UUID]*messageHandler),
+		handlers:         make(map[string]map[string]*messageHandler),
+		protocols:        DefaultProtocols(),
+		extractKey:       ExtractUUID,
+		metrics:          metrics.NoOp{},
+		expireFrequency:  DefaultExpireFrequency,
+		subscriptionSize: DefaultSubscriptionSize,
 	}
 }
 
+// DefaultProtocols returns the protocols used to parse responses unless others are set. They
+// include the wrappers used by the built-in key extractors.
+func DefaultProtocols() *channels.Protocols {
+	return channels.NewProtocols(channels.NewSignedProtocol(), channels.NewUUIDProtocol(),
+		channels.NewStringIDProtocol(), channels.NewMessageIDProtocol(),
+		channels.NewTxIDProtocol(), channels.NewReplyToProtocol(), channels.NewResponseProtocol())
+}
+
+// SetProtocols sets the protocols used to parse responses. Wrappers outside of a protocol that
+// isn't in the set are still passed to the key extractor. SetMetrics sets the metrics of the
+// protocols so it should be called after this. It must be called before messages are handled.
+func (h *Handler) SetProtocols(protocols *channels.Protocols) {
+	h.protocols = protocols
+}
+
+// SetExtractKey sets the function that returns the key used to match responses with
+// registrations. Registrations must use keys in the same format, like those returned by UUIDKey
+// for ExtractUUID. It must be called before messages are handled.
+func (h *Handler) SetExtractKey(extractKey ExtractKey) {
+	h.extractKey = extractKey
+}
+
 func (h *Handler) SetAddUpdate(addUpdate peer_channels_listener.AddUpdate) {
 	h.addUpdate = addUpdate
 }
 
+// SetMetrics sets where response counts and parse counts are reported. It must be called before
+// messages are handled.
+func (h *Handler) SetMetrics(m metrics.Metrics) {
+	h.metrics = m
+	h.protocols.SetMetrics(m)
+}
+
+// SetDefaultTTL sets how long registrations wait for a response, when a TTL isn't specified,
+// before Run removes them. Zero, the default, means they are only removed by a response or by
+// cancelling them. It must be called before registering.
+func (h *Handler) SetDefaultTTL(ttl time.Duration) {
+	h.defaultTTL = ttl
+}
+
+// SetExpireFrequency sets how often Run removes expired registrations. It must be called before
+// Run.
+func (h *Handler) SetExpireFrequency(frequency time.Duration) {
+	h.expireFrequency = frequency
+}
+
+func (h *Handler) reportResponse(result string) {
+	h.metrics.AddCounter(MetricResponses, metrics.Labels{"result": result}, 1)
+}
+
 // RegisterForResponse registers for a response on the specified channel containing the specified
 // UUID and returns a channel the will have the first message that matches that criteria written to
-// it.
+// it. The registration expires after the default TTL. It requires the ExtractUUID key extractor.
 func (h *Handler) RegisterForResponse(channelID string, id uuid.UUID) <-chan peer_channels.Message {
-	handler := newMessageHandler(channelID, id)
+	return h.RegisterForKey(channelID, UUIDKey(id))
+}
+
+// RegisterForResponseWithContext registers for a response containing the UUID like
+// RegisterForKeyWithContext.
+func (h *Handler) RegisterForResponseWithContext(ctx context.Context, channelID string,
+	id uuid.UUID, ttl time.Duration) (<-chan peer_channels.Message, func(), error) {
+	return h.RegisterForKeyWithContext(ctx, channelID, UUIDKey(id), ttl)
+}
+
+// RegisterForKey registers for a response on the specified channel for which the key extractor
+// returns the specified key and returns a channel the will have the first matching message
+// written to it. The registration expires after the default TTL.
+func (h *Handler) RegisterForKey(channelID, key string) <-chan peer_channels.Message {
+	handler := newMessageHandler(channelID, key, h.defaultTTL)
 	h.addUpdate(handler)
 	return handler.response
 }
 
-func newMessageHandler(channelID string, id uuid.UUID) *messageHandler {
-	return &messageHandler{
+// RegisterForKeyWithContext registers for a response like RegisterForKey. The registration is
+// removed when the returned cancel function is called, when the context is done, or when the ttl
+// passes without a response. A ttl of zero uses the default TTL. The response channel is closed
+// if the registration is removed without a response. The cancel function should be called when
+// the response is no longer needed.
+func (h *Handler) RegisterForKeyWithContext(ctx context.Context, channelID, key string,
+	ttl time.Duration) (<-chan peer_channels.Message, func(), error) {
+
+	if ttl == 0 {
+		ttl = h.defaultTTL
+	}
+
+	handler := newMessageHandler(channelID, key, ttl)
+	cancel, err := h.add(ctx, handler)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return handler.response, cancel, nil
+}
+
+// add adds the registration and returns a function that cancels it. The registration is also
+// cancelled when the context is done.
+func (h *Handler) add(ctx context.Context, handler *messageHandler) (func(), error) {
+	if err := h.addUpdate(handler); err != nil {
+		return nil, errors.Wrap(err, "add update")
+	}
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			if err := h.addUpdate(&cancelRegistration{handler: handler}); err != nil {
+				logger.WarnWithFields(ctx, []logger.Field{
+					logger.String("key", handler.key),
+					logger.String("channel_id", handler.channelID),
+				}, "Failed to cancel response registration : %s", err)
+			}
+		})
+	}
+
+	if done := ctx.Done(); done != nil {
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-handler.done:
+			}
+		}()
+	}
+
+	return cancel, nil
+}
+
+func newMessageHandler(channelID, key string, ttl time.Duration) *messageHandler {
+	result := &messageHandler{
 		channelID: channelID,
-		id:        id,
+		key:       key,
 		response:  make(chan peer_channels.Message, 1), // buffered to prevent locking
+		done:      make(chan struct{}),
 	}
+
+	if ttl != 0 {
+		result.expires = time.Now().Add(ttl)
+	}
+
+	return result
+}
+
+// close is called when the handler is removed. A response written before closing is still
+// received.
+func (mh *messageHandler) close() {
+	close(mh.response)
+	close(mh.done)
 }
 
 func WaitWithTimeout(responseChannel <-chan peer_channels.Message,
 	timeout time.Duration) (*peer_channels.Message, error) {
 
 	select {
-	case response := <-responseChannel:
+	case response, ok := <-responseChannel:
+		if !ok {
+			return nil, ErrRegistrationClosed
+		}
 		return &response, nil
 	case <-time.After(timeout):
 		return nil, errors.Wrap(ErrTimeout, timeout.String())
 	}
 }
 
+// WaitWithContext waits for a response until the context is done, in which case it returns the
+// context's error.
+func WaitWithContext(ctx context.Context,
+	responseChannel <-chan peer_channels.Message) (*peer_channels.Message, error) {
+
+	select {
+	case response, ok := <-responseChannel:
+		if !ok {
+			return nil, ErrRegistrationClosed
+		}
+		return &response, nil
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "wait")
+	}
+}
+
+// Run adds an update to remove expired registrations at the expire frequency until it is
+// interrupted. The update is applied in the thread that handles messages, like registrations.
+func (h *Handler) Run(ctx context.Context, interrupt <-chan interface{}) error {
+	ticker := time.NewTicker(h.expireFrequency)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := h.addUpdate(&expireRegistrations{now: now}); err != nil {
+				logger.Warn(ctx, "Failed to add expire registrations update : %s", err)
+			}
+
+		case <-interrupt:
+			return nil
+		}
+	}
+}
+
 func (h *Handler) HandleMessage(ctx context.Context, msg peer_channels.Message) error {
-	id := parseUUID(bitcoin.Script(msg.Payload))
-	if id == nil {
+	message, wrappers, key, found := h.parseKey(bitcoin.Script(msg.Payload))
+	if !found {
+		h.reportResponse("missing_id")
 		logger.InfoWithFields(ctx, []logger.Field{
 			logger.String("channel_id", msg.ChannelID),
 			logger.Uint64("sequence", msg.Sequence),
@@ -81,8 +319,12 @@ func (h *Handler) HandleMessage(ctx context.Context, msg peer_channels.Message)
 		return errors.Wrap(peer_channels_listener.MessageNotRelevent, "missing id")
 	}
 
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
 	channelHandlers, channelExists := h.handlers[msg.ChannelID]
 	if !channelExists {
+		h.reportResponse("no_channel")
 		logger.InfoWithFields(ctx, []logger.Field{
 			logger.String("channel_id", msg.ChannelID),
 			logger.Uint64("sequence", msg.Sequence),
@@ -90,59 +332,133 @@ func (h *Handler) HandleMessage(ctx context.Context, msg peer_channels.Message)
 		return errors.Wrap(peer_channels_listener.MessageNotRelevent, "channel")
 	}
 
-	handler, idExists := channelHandlers[*id]
-	if !idExists {
+	handler, keyExists := channelHandlers[key]
+	if !keyExists {
+		h.reportResponse("no_id")
 		logger.InfoWithFields(ctx, []logger.Field{
-			logger.Stringer("id", *id),
+			logger.String("key", key),
 			logger.String("channel_id", msg.ChannelID),
 			logger.Uint64("sequence", msg.Sequence),
 		}, "No handler found for ID")
-		return errors.Wrapf(peer_channels_listener.MessageNotRelevent, "id: %s", *id)
+		return errors.Wrapf(peer_channels_listener.MessageNotRelevent, "id: %s", key)
 	}
 
 	logger.InfoWithFields(ctx, []logger.Field{
-		logger.Stringer("id", *id),
+		logger.String("key", key),
 		logger.String("channel_id", msg.ChannelID),
 		logger.Uint64("sequence", msg.Sequence),
-	}, "Received UUID message")
-	delete(channelHandlers, *id)
-	if len(channelHandlers) == 0 {
-		delete(h.handlers, msg.ChannelID)
+	}, "Received response message")
+
+	if handler.subscription {
+		h.deliver(ctx, handler, msg, message, wrappers)
+		return nil
 	}
-	response := handler.response
 
-	response <- msg
+	h.remove(handler)
+	h.reportResponse("matched")
+
+	handler.response <- msg
+	handler.close()
 	return nil
 }
 
 func (h *Handler) HandleUpdate(ctx context.Context, update interface{}) error {
-	handler := update.(*messageHandler)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	switch u := update.(type) {
+	case *messageHandler:
+		h.register(u)
+
+	case *cancelRegistration:
+		if h.remove(u.handler) {
+			h.metrics.AddCounter(MetricRemoved, metrics.Labels{"reason": "cancelled"}, 1)
+			u.handler.close()
+		}
+
+	case *expireRegistrations:
+		h.expire(ctx, u.now)
+
+	default:
+		return errors.Wrapf(ErrUnsupportedUpdate, "%T", update)
+	}
 
+	return nil
+}
+
+func (h *Handler) register(handler *messageHandler) {
 	channelHandlers, exists := h.handlers[handler.channelID]
 	if !exists {
-		channelHandlers = make(map[uuid.UUID]*messageHandler)
+		channelHandlers = make(map[string]*messageHandler)
 		h.handlers[handler.channelID] = channelHandlers
 	}
 
-	channelHandlers[handler.id] = handler
-	return nil
+	if previous, exists := channelHandlers[handler.key]; exists {
+		previous.close()
+	} else {
+		h.registrations++
+		h.metrics.SetGauge(MetricRegistrations, nil, float64(h.registrations))
+	}
+	channelHandlers[handler.key] = handler
 }
 
-func parseUUID(script bitcoin.Script) *uuid.UUID {
-	protocols := channels.NewProtocols(channels.NewSignedProtocol(), channels.NewUUIDProtocol(),
-		channels.NewReplyToProtocol(), channels.NewResponseProtocol())
+// remove removes the handler if it is still registered and returns true if it was.
+func (h *Handler) remove(handler *messageHandler) bool {
+	channelHandlers, exists := h.handlers[handler.channelID]
+	if !exists {
+		return false
+	}
+
+	if current, exists := channelHandlers[handler.key]; !exists || current != handler {
+		return false
+	}
 
-	_, wrappers, err := protocols.Parse(script)
-	if err != nil && errors.Cause(err) != channels.ErrUnsupportedProtocol {
-		return nil
+	delete(channelHandlers, handler.key)
+	if len(channelHandlers) == 0 {
+		delete(h.handlers, handler.channelID)
 	}
 
-	for _, wrapper := range wrappers {
-		if id, ok := wrapper.(*channels.UUID); ok {
-			uuid := uuid.UUID(*id)
-			return &uuid
+	h.registrations--
+	h.metrics.SetGauge(MetricRegistrations, nil, float64(h.registrations))
+	return true
+}
+
+func (h *Handler) expire(ctx context.Context, now time.Time) {
+	var expired []*messageHandler
+	for _, channelHandlers := range h.handlers {
+		for _, handler := range channelHandlers {
+			if !handler.expires.IsZero() && now.After(handler.expires) {
+				expired = append(expired, handler)
+			}
 		}
 	}
 
-	return nil
+	for _, handler := range expired {
+		logger.InfoWithFields(ctx, []logger.Field{
+			logger.String("key", handler.key),
+			logger.String("channel_id", handler.channelID),
+		}, "Response registration expired")
+
+		h.remove(handler)
+		handler.close()
+	}
+
+	if len(expired) > 0 {
+		h.metrics.AddCounter(MetricRemoved, metrics.Labels{"reason": "expired"},
+			float64(len(expired)))
+	}
+}
+
+// parseKey returns the key extracted from the message. Wrappers outside of an unsupported
+// protocol are still used.
+func (h *Handler) parseKey(script bitcoin.Script) (channels.Message, []channels.Wrapper, string,
+	bool) {
+
+	msg, wrappers, err := h.protocols.Parse(script)
+	if err != nil && errors.Cause(err) != channels.ErrUnsupportedProtocol {
+		return nil, nil, "", false
+	}
+
+	key, found := h.extractKey(msg, wrappers)
+	return msg, wrappers, key, found
 }
@@ -3,16 +3,19 @@ package uuid_response_handler
 import (
 	"bytes"
 	"context"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/tokenized/channels"
+	"github.com/tokenized/channels/metrics"
 	"github.com/tokenized/channels/peer_channels_listener"
 	"github.com/tokenized/logger"
 	"github.com/tokenized/pkg/bitcoin"
 	"github.com/tokenized/pkg/peer_channels"
 
 	"github.com/google/uuid"
+	"github.com/pkg/errors"
 )
 
 func Test_MessageHandling(t *testing.T) {
@@ -24,7 +27,9 @@ func Test_MessageHandling(t *testing.T) {
 		peerChannelsAccount.AccountID, peerChannelsAccount.Token)
 	peerChannel, _ := peerChannelsAccountClient.CreatePublicChannel(ctx)
 
+	m := metrics.NewMemory()
 	handler := NewHandler()
+	handler.SetMetrics(m)
 	listener := peer_channels_listener.NewPeerChannelsListener(peerChannelsClient,
 		peerChannelsAccount.Token, 100, 1, time.Second, handler.HandleMessage, handler.HandleUpdate)
 	handler.SetAddUpdate(listener.AddUpdate)
@@ -101,4 +106,237 @@ func Test_MessageHandling(t *testing.T) {
 	if listenerError != nil {
 		t.Fatalf("Listener completed with error : %s", listenerError)
 	}
+
+	if count := m.Counter(MetricResponses, metrics.Labels{"result": "matched"}); count != 1 {
+		t.Errorf("Wrong matched count : got %f, want %f", count, 1.0)
+	}
+
+	if registrations, _ := m.Gauge(MetricRegistrations, nil); registrations != 0 {
+		t.Errorf("Wrong registrations : got %f, want %f", registrations, 0.0)
+	}
+
+	labels := metrics.Labels{"protocol": channels.ProtocolIDResponse.String()}
+	if count := m.Counter(channels.MetricParsed, labels); count != 1 {
+		t.Errorf("Wrong parsed count : got %f, want %f", count, 1.0)
+	}
+}
+
+func Test_RegistrationRemoval(t *testing.T) {
+	ctx := context.Background()
+
+	m := metrics.NewMemory()
+	handler := NewHandler()
+	handler.SetMetrics(m)
+	handler.SetAddUpdate(func(update interface{}) error {
+		return handler.HandleUpdate(ctx, update)
+	})
+
+	channelID := uuid.New().String()
+	expiredChannel, _, err := handler.RegisterForResponseWithContext(ctx, channelID, uuid.New(),
+		time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to register : %s", err)
+	}
+
+	cancelledChannel, cancel, err := handler.RegisterForResponseWithContext(ctx, channelID,
+		uuid.New(), 0)
+	if err != nil {
+		t.Fatalf("Failed to register : %s", err)
+	}
+
+	registerCtx, registerCancel := context.WithCancel(ctx)
+	contextChannel, _, err := handler.RegisterForResponseWithContext(registerCtx, channelID,
+		uuid.New(), 0)
+	if err != nil {
+		t.Fatalf("Failed to register : %s", err)
+	}
+
+	if registrations, _ := m.Gauge(MetricRegistrations, nil); registrations != 3 {
+		t.Fatalf("Wrong registrations : got %f, want %f", registrations, 3.0)
+	}
+
+	if err := handler.HandleUpdate(ctx,
+		&expireRegistrations{now: time.Now().Add(time.Second)}); err != nil {
+		t.Fatalf("Failed to expire registrations : %s", err)
+	}
+
+	if _, err := WaitWithTimeout(expiredChannel, time.Second); err != ErrRegistrationClosed {
+		t.Errorf("Wrong expired wait error : got %v, want %s", err, ErrRegistrationClosed)
+	}
+
+	cancel()
+	cancel() // calling cancel again does nothing
+	if _, err := WaitWithTimeout(cancelledChannel, time.Second); err != ErrRegistrationClosed {
+		t.Errorf("Wrong cancelled wait error : got %v, want %s", err, ErrRegistrationClosed)
+	}
+
+	registerCancel()
+	waitCtx, waitCancel := context.WithTimeout(ctx, time.Second)
+	defer waitCancel()
+	if _, err := WaitWithContext(waitCtx, contextChannel); err != ErrRegistrationClosed {
+		t.Errorf("Wrong context wait error : got %v, want %s", err, ErrRegistrationClosed)
+	}
+
+	if registrations, _ := m.Gauge(MetricRegistrations, nil); registrations != 0 {
+		t.Errorf("Wrong registrations : got %f, want %f", registrations, 0.0)
+	}
+
+	if count := m.Counter(MetricRemoved, metrics.Labels{"reason": "expired"}); count != 1 {
+		t.Errorf("Wrong expired count : got %f, want %f", count, 1.0)
+	}
+
+	if count := m.Counter(MetricRemoved, metrics.Labels{"reason": "cancelled"}); count != 2 {
+		t.Errorf("Wrong cancelled count : got %f, want %f", count, 2.0)
+	}
+
+	// The context ends before a response is received.
+	responseChannel, cancel, err := handler.RegisterForResponseWithContext(ctx, channelID,
+		uuid.New(), 0)
+	if err != nil {
+		t.Fatalf("Failed to register : %s", err)
+	}
+	defer cancel()
+
+	shortCtx, shortCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer shortCancel()
+	if _, err := WaitWithContext(shortCtx, responseChannel); errors.Cause(err) !=
+		context.DeadlineExceeded {
+		t.Errorf("Wrong wait error : got %v, want %s", err, context.DeadlineExceeded)
+	}
+}
+
+func Test_Run(t *testing.T) {
+	ctx := context.Background()
+
+	handler := NewHandler()
+	handler.SetDefaultTTL(time.Millisecond)
+	handler.SetExpireFrequency(5 * time.Millisecond)
+	handler.SetAddUpdate(func(update interface{}) error {
+		return handler.HandleUpdate(ctx, update)
+	})
+
+	responseChannel := handler.RegisterForResponse(uuid.New().String(), uuid.New())
+
+	interrupt := make(chan interface{})
+	runComplete := make(chan error, 1)
+	go func() {
+		runComplete <- handler.Run(ctx, interrupt)
+	}()
+
+	if _, err := WaitWithTimeout(responseChannel, time.Second); err != ErrRegistrationClosed {
+		t.Errorf("Wrong wait error : got %v, want %s", err, ErrRegistrationClosed)
+	}
+
+	close(interrupt)
+	if err := <-runComplete; err != nil {
+		t.Fatalf("Failed to run : %s", err)
+	}
+}
+
+func Test_MessageHandling_Sharded(t *testing.T) {
+	ctx := context.Background()
+
+	peerChannelsClient := peer_channels.NewMockClient()
+	peerChannelsAccount, _ := peerChannelsClient.CreateAccount(ctx)
+	peerChannelsAccountClient := peer_channels.NewMockAccountClient(peerChannelsClient,
+		peerChannelsAccount.AccountID, peerChannelsAccount.Token)
+
+	handler := NewHandler()
+	handler.SetExpireFrequency(time.Millisecond)
+	listener := peer_channels_listener.NewPeerChannelsListener(peerChannelsClient,
+		peerChannelsAccount.Token, 100, 4, time.Second, handler.HandleMessage,
+		handler.HandleUpdate)
+	handler.SetAddUpdate(listener.AddUpdate)
+
+	listenerInterrupt := make(chan interface{})
+	listenerComplete := make(chan error, 1)
+	go func() {
+		listenerComplete <- listener.Run(ctx, listenerInterrupt)
+	}()
+
+	runInterrupt := make(chan interface{})
+	runComplete := make(chan error, 1)
+	go func() {
+		runComplete <- handler.Run(ctx, runInterrupt)
+	}()
+
+	time.Sleep(100 * time.Millisecond) // wait for listen to start
+
+	channelCount := 8
+	responseCount := 10
+	var wait sync.WaitGroup
+	for i := 0; i < channelCount; i++ {
+		peerChannel, err := peerChannelsAccountClient.CreatePublicChannel(ctx)
+		if err != nil {
+			t.Fatalf("Failed to create channel : %s", err)
+		}
+
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+
+			for j := 0; j < responseCount; j++ {
+				id := uuid.New()
+
+				// Registrations that expire are removed by updates in every thread.
+				_, expireCancel, err := handler.RegisterForResponseWithContext(ctx,
+					peerChannel.ID, uuid.New(), time.Millisecond)
+				if err != nil {
+					t.Errorf("Failed to register : %s", err)
+					return
+				}
+				defer expireCancel()
+
+				responseChannel, cancel, err := handler.RegisterForResponseWithContext(ctx,
+					peerChannel.ID, id, 0)
+				if err != nil {
+					t.Errorf("Failed to register : %s", err)
+					return
+				}
+				defer cancel()
+
+				uuid := channels.UUID(id)
+				payload, err := channels.Wrap(&channels.Response{Status: channels.StatusOK},
+					&uuid)
+				if err != nil {
+					t.Errorf("Failed to wrap message : %s", err)
+					return
+				}
+
+				if err := peerChannelsClient.WriteMessage(ctx, peerChannel.ID,
+					peerChannel.WriteToken, peer_channels.ContentTypeBinary,
+					bytes.NewReader(payload)); err != nil {
+					t.Errorf("Failed to write peer channel message : %s", err)
+					return
+				}
+
+				message, err := WaitWithTimeout(responseChannel, 5*time.Second)
+				if err != nil {
+					t.Errorf("Failed to wait for response : %s", err)
+					return
+				}
+
+				if !bytes.Equal(message.Payload, payload) {
+					t.Errorf("Payload doesn't match")
+				}
+			}
+		}()
+	}
+
+	wait.Wait()
+
+	close(runInterrupt)
+	if err := <-runComplete; err != nil {
+		t.Fatalf("Failed to run : %s", err)
+	}
+
+	close(listenerInterrupt)
+	select {
+	case err := <-listenerComplete:
+		if err != nil {
+			t.Fatalf("Listener completed with error : %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Listener shutdown timed out")
+	}
 }